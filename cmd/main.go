@@ -13,9 +13,10 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer db.Close()
 
-	// Créer une collection
-	users, err := db.CreateCollection("users")
+	// Créer une collection (ou la rouvrir si elle est déjà au catalogue)
+	users, err := db.GetOrCreateCollection("users", database.CollectionOptions{})
 	if err != nil {
 		log.Fatal(err)
 	}
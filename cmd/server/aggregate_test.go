@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"nosql-db/internal/database"
+)
+
+// TestAggregateEndpoint vérifie la réponse de POST
+// /api/{collection}/aggregate, vide ou non, et le statut d'un pipeline
+// invalide
+func TestAggregateEndpoint(t *testing.T) {
+	openTestDatabase(t, "orders")
+	mustInsert(t, "orders", database.Document{"city": "Lyon", "amount": 10})
+	mustInsert(t, "orders", database.Document{"city": "Lyon", "amount": 5})
+	mustInsert(t, "orders", database.Document{"city": "Nice", "amount": 7})
+
+	w := serve(handleCollectionAggregate, "orders", http.MethodPost, "/api/orders/aggregate",
+		`{"pipeline": [{"$group": {"_id": "$city", "total": {"$sum": "$amount"}}}, {"$sort": {"total": -1}}]}`)
+	checkStatus(t, w, http.StatusOK)
+	var documents []database.Document
+	if err := json.Unmarshal(w.Body.Bytes(), &documents); err != nil {
+		t.Fatalf("réponse illisible: %v (%s)", err, w.Body.String())
+	}
+	if len(documents) != 2 || documents[0]["_id"] != "Lyon" || documents[0]["total"] != float64(15) {
+		t.Fatalf("documents = %v, attendu Lyon (15) puis Nice", documents)
+	}
+
+	w = serve(handleCollectionAggregate, "orders", http.MethodPost, "/api/orders/aggregate", `{"pipeline": [{"$match": {"city": "Paris"}}]}`)
+	checkStatus(t, w, http.StatusOK)
+	if body := w.Body.String(); body != "[]\n" {
+		t.Fatalf("réponse = %q, attendu un tableau vide", body)
+	}
+
+	checkStatus(t, serve(handleCollectionAggregate, "orders", http.MethodPost, "/api/orders/aggregate", `{"pipeline": [{"$explode": {}}]}`), http.StatusBadRequest)
+	checkStatus(t, serve(handleCollectionAggregate, "orders", http.MethodGet, "/api/orders/aggregate", ""), http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// bulkLines envoie body à POST target et retourne les lignes NDJSON de la
+// réponse
+func bulkLines(t *testing.T, target, body string) []BulkLineResult {
+	t.Helper()
+	w := serve(handleCollectionBulk, "books", http.MethodPost, target, body)
+	checkStatus(t, w, http.StatusOK)
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/x-ndjson" {
+		t.Fatalf("Content-Type = %q, attendu application/x-ndjson", contentType)
+	}
+
+	var lines []BulkLineResult
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var line BulkLineResult
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("ligne illisible %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// checkBulkLines vérifie le numéro de ligne et le statut de chaque résultat
+func checkBulkLines(t *testing.T, lines []BulkLineResult, want ...[2]int) {
+	t.Helper()
+	if len(lines) != len(want) {
+		t.Fatalf("%d lignes de résultat %+v, attendu %d", len(lines), lines, len(want))
+	}
+	for i, line := range lines {
+		if line.Line != want[i][0] || line.Status != want[i][1] {
+			t.Fatalf("résultat %d = %+v, attendu ligne %d et statut %d", i, line, want[i][0], want[i][1])
+		}
+	}
+}
+
+const bulkBody = `{"op": "insert", "document": {"_id": "a", "n": 1}}
+
+{"op": "insert", "document": {"_id": "a", "n": 2}}
+{"op": "update",
+{"op": "delete", "id": "missing"}
+{"op": "update", "id": "a", "update": {"$inc": {"n": 10}}}
+`
+
+// TestBulkEndpointOrdered vérifie qu'un lot ordonné répond ligne par
+// ligne, dans l'ordre, et s'arrête à la première opération en échec
+func TestBulkEndpointOrdered(t *testing.T) {
+	openTestDatabase(t, "books")
+
+	lines := bulkLines(t, "/api/books/_bulk", bulkBody)
+	checkBulkLines(t, lines, [2]int{1, http.StatusCreated}, [2]int{3, http.StatusConflict})
+	if lines[0].ID != "a" || lines[1].Error == "" {
+		t.Fatalf("résultats = %+v, attendu l'ID inséré puis l'erreur", lines)
+	}
+	if doc, err := testCollection(t, "books").FindByID("a"); err != nil || doc["n"] != float64(1) {
+		t.Fatalf("a = %v (%v), attendu les opérations suivantes non exécutées", doc, err)
+	}
+}
+
+// TestBulkEndpointUnordered vérifie qu'un lot non ordonné exécute toutes
+// les opérations, y compris celles qui suivent une ligne invalide
+func TestBulkEndpointUnordered(t *testing.T) {
+	openTestDatabase(t, "books")
+
+	lines := bulkLines(t, "/api/books/_bulk?ordered=false", bulkBody)
+	// La ligne invalide est signalée après l'écriture des opérations qui
+	// la précèdent
+	checkBulkLines(t, lines,
+		[2]int{1, http.StatusCreated}, [2]int{3, http.StatusConflict}, [2]int{4, http.StatusBadRequest},
+		[2]int{5, http.StatusNotFound}, [2]int{6, http.StatusOK})
+	if doc, err := testCollection(t, "books").FindByID("a"); err != nil || doc["n"] != float64(11) {
+		t.Fatalf("a = %v (%v), attendu la mise à jour de la dernière ligne", doc, err)
+	}
+}
+
+// TestBulkEndpointInvalidLine vérifie qu'un lot ordonné dont une
+// ligne est invalide s'arrête après avoir écrit les précédentes
+func TestBulkEndpointInvalidLine(t *testing.T) {
+	openTestDatabase(t, "books")
+
+	body := strings.Join([]string{`{"op": "insert", "document": {"_id": "a"}}`, `not json`, `{"op": "insert", "document": {"_id": "b"}}`}, "\n")
+	checkBulkLines(t, bulkLines(t, "/api/books/_bulk", body), [2]int{1, http.StatusCreated}, [2]int{2, http.StatusBadRequest})
+	if _, err := testCollection(t, "books").FindByID("b"); err == nil {
+		t.Fatal("b inséré après la ligne invalide")
+	}
+	checkStatus(t, serve(handleCollectionBulk, "books", http.MethodGet, "/api/books/_bulk", ""), http.StatusMethodNotAllowed)
+}
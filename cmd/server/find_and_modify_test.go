@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"nosql-db/internal/database"
+)
+
+// TestUpsertEndpoint vérifie le 201 d'un upsert qui insère et le 200
+// d'un upsert qui remplace
+func TestUpsertEndpoint(t *testing.T) {
+	openTestDatabase(t, "settings")
+
+	w := serve(handleCollectionUpsert, "settings", http.MethodPost, "/api/settings/upsert", `{"filter": {"_id": "theme"}, "document": {"value": "dark"}}`)
+	checkStatus(t, w, http.StatusCreated)
+	var result database.UpdateResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || result.UpsertedID != "theme" {
+		t.Fatalf("résultat = %s (%v), attendu upserted_id theme", w.Body.String(), err)
+	}
+
+	w = serve(handleCollectionUpsert, "settings", http.MethodPost, "/api/settings/upsert", `{"filter": {"_id": "theme"}, "document": {"value": "light"}}`)
+	checkStatus(t, w, http.StatusOK)
+	result = database.UpdateResult{}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || result.Modified != 1 || result.UpsertedID != "" {
+		t.Fatalf("résultat = %s (%v), attendu un document remplacé", w.Body.String(), err)
+	}
+
+	checkStatus(t, serve(handleCollectionUpsert, "settings", http.MethodPost, "/api/settings/upsert", `{"filter": {}}`), http.StatusBadRequest)
+	checkStatus(t, serve(handleCollectionUpsert, "settings", http.MethodPost, "/api/settings/upsert", `{"filter": {"n": {"$near": 1}}, "document": {}}`), http.StatusBadRequest)
+}
+
+// TestFindAndModifyEndpoints vérifie les documents retournés par
+// find-and-update et find-and-delete, le 404 sans document et le 204 d'un
+// upsert
+func TestFindAndModifyEndpoints(t *testing.T) {
+	openTestDatabase(t, "jobs")
+	mustInsert(t, "jobs", database.Document{"state": "queued", "n": 1})
+	findAndUpdate := func(w http.ResponseWriter, r *http.Request, collectionName string) {
+		handleCollectionFindAndModify(w, r, collectionName, false)
+	}
+	findAndDelete := func(w http.ResponseWriter, r *http.Request, collectionName string) {
+		handleCollectionFindAndModify(w, r, collectionName, true)
+	}
+
+	w := serve(findAndUpdate, "jobs", http.MethodPost, "/api/jobs/find-and-update",
+		`{"filter": {"state": "queued"}, "update": {"$set": {"state": "running"}}, "return_after": true}`)
+	checkStatus(t, w, http.StatusOK)
+	var doc database.Document
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil || doc["state"] != "running" {
+		t.Fatalf("document = %s (%v), attendu l'état après mise à jour", w.Body.String(), err)
+	}
+
+	checkStatus(t, serve(findAndUpdate, "jobs", http.MethodPost, "/api/jobs/find-and-update",
+		`{"filter": {"state": "queued"}, "update": {"$set": {"state": "running"}}}`), http.StatusNotFound)
+	checkStatus(t, serve(findAndUpdate, "jobs", http.MethodPost, "/api/jobs/find-and-update",
+		`{"filter": {"state": "queued"}, "update": {"$set": {"state": "running"}}, "upsert": true}`), http.StatusNoContent)
+	checkStatus(t, serve(findAndUpdate, "jobs", http.MethodPost, "/api/jobs/find-and-update",
+		`{"filter": {"state": "running"}, "update": {"$explode": {"n": 1}}}`), http.StatusBadRequest)
+
+	w = serve(findAndDelete, "jobs", http.MethodPost, "/api/jobs/find-and-delete", `{"filter": {"n": 1}}`)
+	checkStatus(t, w, http.StatusOK)
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil || doc["n"] != float64(1) {
+		t.Fatalf("document = %s (%v), attendu le document supprimé", w.Body.String(), err)
+	}
+	checkStatus(t, serve(findAndDelete, "jobs", http.MethodPost, "/api/jobs/find-and-delete", `{"filter": {"n": 1}}`), http.StatusNotFound)
+}
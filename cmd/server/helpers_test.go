@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"nosql-db/internal/database"
+)
+
+// openTestDatabase remplace la base du serveur par une base temporaire
+// contenant les collections names, fermée à la fin du test
+func openTestDatabase(t *testing.T, names ...string) {
+	t.Helper()
+	testDB, err := database.NewDatabase(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewDatabase: %v", err)
+	}
+	for _, name := range names {
+		if _, err := testDB.CreateCollection(name); err != nil {
+			t.Fatalf("CreateCollection(%s): %v", name, err)
+		}
+	}
+	db = testDB
+	t.Cleanup(func() {
+		testDB.Close()
+		db = nil
+	})
+}
+
+// testCollection retourne la collection name de la base du serveur
+func testCollection(t *testing.T, name string) *database.Collection {
+	t.Helper()
+	collection, err := db.GetCollection(name)
+	if err != nil {
+		t.Fatalf("GetCollection(%s): %v", name, err)
+	}
+	return collection
+}
+
+// mustInsert insère doc dans la collection name et retourne son ID
+func mustInsert(t *testing.T, name string, doc database.Document) string {
+	t.Helper()
+	docID, err := testCollection(t, name).Insert(doc)
+	if err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	return docID
+}
+
+// serve envoie à handler, pour la collection collectionName, une requête
+// method sur target avec body et les en-têtes header (nom, valeur...)
+func serve(handler func(http.ResponseWriter, *http.Request, string), collectionName, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	handler(w, r, collectionName)
+	return w
+}
+
+// checkStatus vérifie le statut d'une réponse
+func checkStatus(t *testing.T, w *httptest.ResponseRecorder, want int) {
+	t.Helper()
+	if w.Code != want {
+		t.Fatalf("statut %d, attendu %d: %s", w.Code, want, strings.TrimSpace(w.Body.String()))
+	}
+}
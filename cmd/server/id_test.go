@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// TestClientSuppliedIDEndpoint vérifie qu'un _id fourni à POST est gardé
+// et retourné, et les statuts d'un _id en double, invalide ou réservé
+func TestClientSuppliedIDEndpoint(t *testing.T) {
+	openTestDatabase(t, "books")
+
+	w := serve(handleCollection, "books", http.MethodPost, "/api/books", `{"_id": "sku-1", "title": "A"}`)
+	checkStatus(t, w, http.StatusCreated)
+	var response struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || response.ID != "sku-1" {
+		t.Fatalf("réponse = %s (%v), attendu l'ID sku-1", w.Body.String(), err)
+	}
+	w = serve(handleCollection, "books", http.MethodGet, "/api/books/sku-1", "")
+	checkStatus(t, w, http.StatusOK)
+	var doc map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil || doc["_id"] != "sku-1" {
+		t.Fatalf("document = %s (%v), attendu son _id", w.Body.String(), err)
+	}
+
+	checkStatus(t, serve(handleCollection, "books", http.MethodPost, "/api/books", `{"_id": "sku-1"}`), http.StatusConflict)
+	checkStatus(t, serve(handleCollection, "books", http.MethodPost, "/api/books", `{"_id": "../x"}`), http.StatusBadRequest)
+	checkStatus(t, serve(handleCollection, "books", http.MethodPost, "/api/books", `{"_id": "query"}`), http.StatusBadRequest)
+	checkStatus(t, serve(handleCollection, "books", http.MethodPut, "/api/books/sku-1", `{"_id": "sku-2"}`), http.StatusBadRequest)
+}
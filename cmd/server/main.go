@@ -1,14 +1,26 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"nosql-db/internal/database"
 )
@@ -16,13 +28,19 @@ import (
 var (
 	db         *database.Database
 	configPath string
+	durability string
 )
 
 type CollectionConfig struct {
-	Name    string `json:"name"`
-	Indexes []struct {
-		Field  string `json:"field"`
-		Unique bool   `json:"unique"`
+	Name        string               `json:"name"`
+	Storage     database.StorageKind `json:"storage,omitempty"`
+	IDGenerator database.IDGenerator `json:"id_generator,omitempty"`
+	Indexes     []struct {
+		Name   string                `json:"name,omitempty"`
+		Field  string                `json:"field,omitempty"`
+		Fields []database.IndexField `json:"fields,omitempty"`
+		Unique bool                  `json:"unique"`
+		Type   database.IndexType    `json:"type,omitempty"`
 	} `json:"indexes"`
 }
 
@@ -42,14 +60,20 @@ type PageData struct {
 func main() {
 	// Définir le flag pour le chemin du fichier de configuration
 	flag.StringVar(&configPath, "config", "config/collections.json", "Chemin vers le fichier de configuration des collections")
+	flag.StringVar(&durability, "durability", "write", "Niveau de durabilité des écritures (none, write, commit)")
 	flag.Parse()
 
+	durabilityLevel, err := database.ParseDurability(durability)
+	if err != nil {
+		log.Fatalf("Erreur de configuration: %v", err)
+	}
+
 	// Créer une nouvelle instance de la base de données
-	var err error
 	db, err = database.NewDatabase("data")
 	if err != nil {
 		log.Fatalf("Erreur lors de la création de la base de données: %v", err)
 	}
+	db.SetDurability(durabilityLevel)
 
 	// Charger la configuration
 	config, err := loadConfig(configPath)
@@ -57,18 +81,26 @@ func main() {
 		log.Fatalf("Erreur lors du chargement de la configuration: %v", err)
 	}
 
-	// Créer les collections et leurs index
+	// Créer les collections et leurs index (celles du catalogue sont déjà ouvertes)
 	for _, collectionConfig := range config.Collections {
-		collection, err := db.CreateCollection(collectionConfig.Name)
+		collection, err := db.GetOrCreateCollection(collectionConfig.Name, database.CollectionOptions{
+			Storage:     collectionConfig.Storage,
+			IDGenerator: collectionConfig.IDGenerator,
+		})
 		if err != nil {
 			log.Printf("Erreur lors de la création de la collection %s: %v", collectionConfig.Name, err)
 			continue
 		}
 
 		for _, indexConfig := range collectionConfig.Indexes {
-			if err := collection.CreateIndex(indexConfig.Field, indexConfig.Unique); err != nil {
-				log.Printf("Erreur lors de la création de l'index %s pour la collection %s: %v",
-					indexConfig.Field, collectionConfig.Name, err)
+			options := database.IndexOptions{Name: indexConfig.Name, Unique: indexConfig.Unique, Type: indexConfig.Type}
+			fields := indexConfig.Fields
+			if len(fields) == 0 {
+				fields = []database.IndexField{{Path: indexConfig.Field}}
+			}
+			if err := collection.CreateCompoundIndex(fields, options); err != nil {
+				log.Printf("Erreur lors de la création de l'index %v pour la collection %s: %v",
+					fields, collectionConfig.Name, err)
 			}
 		}
 	}
@@ -76,9 +108,9 @@ func main() {
 	// Créer un nouveau routeur
 	mux := http.NewServeMux()
 
-	// Configurer les routes API en premier
-	for _, collectionConfig := range config.Collections {
-		collectionName := collectionConfig.Name
+	// Configurer les routes API en premier, pour toutes les collections du catalogue
+	for _, info := range db.ListCollections() {
+		collectionName := info.Name
 		// Handler pour toutes les opérations CRUD sur la collection
 		mux.HandleFunc(fmt.Sprintf("/api/%s", collectionName),
 			func(w http.ResponseWriter, r *http.Request) {
@@ -94,6 +126,39 @@ func main() {
 			func(w http.ResponseWriter, r *http.Request) {
 				handleCollectionSearch(w, r, collectionName)
 			})
+		// Handler pour les requêtes par filtre
+		mux.HandleFunc(fmt.Sprintf("/api/%s/query", collectionName),
+			func(w http.ResponseWriter, r *http.Request) {
+				handleCollectionQuery(w, r, collectionName)
+			})
+		// Handler pour les agrégations
+		mux.HandleFunc(fmt.Sprintf("/api/%s/aggregate", collectionName),
+			func(w http.ResponseWriter, r *http.Request) {
+				handleCollectionAggregate(w, r, collectionName)
+			})
+		// Handler pour les mises à jour par opérateurs
+		mux.HandleFunc(fmt.Sprintf("/api/%s/update", collectionName),
+			func(w http.ResponseWriter, r *http.Request) {
+				handleCollectionUpdate(w, r, collectionName)
+			})
+		// Handlers pour l'upsert et les find-and-modify
+		mux.HandleFunc(fmt.Sprintf("/api/%s/upsert", collectionName),
+			func(w http.ResponseWriter, r *http.Request) {
+				handleCollectionUpsert(w, r, collectionName)
+			})
+		mux.HandleFunc(fmt.Sprintf("/api/%s/find-and-update", collectionName),
+			func(w http.ResponseWriter, r *http.Request) {
+				handleCollectionFindAndModify(w, r, collectionName, false)
+			})
+		mux.HandleFunc(fmt.Sprintf("/api/%s/find-and-delete", collectionName),
+			func(w http.ResponseWriter, r *http.Request) {
+				handleCollectionFindAndModify(w, r, collectionName, true)
+			})
+		// Handler pour les écritures en lot (NDJSON)
+		mux.HandleFunc(fmt.Sprintf("/api/%s/_bulk", collectionName),
+			func(w http.ResponseWriter, r *http.Request) {
+				handleCollectionBulk(w, r, collectionName)
+			})
 	}
 
 	// Routes pour les transactions
@@ -108,8 +173,28 @@ func main() {
 	mux.HandleFunc("/api/collections", handleCollectionsAPI) // API pour Vue.js
 
 	// Démarrer le serveur avec le routeur personnalisé
-	log.Println("Serveur démarré sur http://localhost:8081")
-	log.Fatal(http.ListenAndServe(":8081", mux))
+	server := &http.Server{Addr: ":8081", Handler: mux}
+	go func() {
+		log.Println("Serveur démarré sur http://localhost:8081")
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Arrêt propre : les index sont persistés pour un redémarrage rapide
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	log.Println("Arrêt du serveur...")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Erreur lors de l'arrêt du serveur: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		log.Printf("Erreur lors de la fermeture de la base de données: %v", err)
+	}
 }
 
 func loadConfig(path string) (*Config, error) {
@@ -222,15 +307,22 @@ func handleCollection(w http.ResponseWriter, r *http.Request, collectionName str
 				http.Error(w, err.Error(), http.StatusNotFound)
 				return
 			}
+			// La révision sert d'ETag : le client la renvoie dans If-Match
+			revision := database.Revision(doc)
+			setETag(w, revision)
+			if containsETag(parseETags(r.Header.Get("If-None-Match")), revision) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
 			json.NewEncoder(w).Encode(doc)
 		} else {
-			// Lister tous les documents
-			documents, err := collection.GetAllDocuments()
+			// Lister les documents (sort, skip, limit, fields, cursor)
+			options, err := parseFindOptions(r.URL.Query())
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
-			json.NewEncoder(w).Encode(documents)
+			writeDocuments(w, r, collection, database.Filter{}, options)
 		}
 
 	case http.MethodPost:
@@ -241,11 +333,13 @@ func handleCollection(w http.ResponseWriter, r *http.Request, collectionName str
 			return
 		}
 
+		// Le document peut fournir son _id, sinon il est généré
 		id, err := collection.Insert(doc)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), writeErrorStatus(err))
 			return
 		}
+		doc[database.IDField] = id
 
 		response := map[string]interface{}{
 			"id":       id,
@@ -253,6 +347,7 @@ func handleCollection(w http.ResponseWriter, r *http.Request, collectionName str
 		}
 
 		w.Header().Set("Content-Type", "application/json")
+		setETag(w, database.Revision(doc))
 		w.WriteHeader(http.StatusCreated)
 		json.NewEncoder(w).Encode(response)
 
@@ -269,19 +364,35 @@ func handleCollection(w http.ResponseWriter, r *http.Request, collectionName str
 			return
 		}
 
-		if err := collection.Update(documentID, doc); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		// Retourner le document écrit, et non une relecture qu'une écriture
+		// concurrente aurait pu modifier
+		precondition := parsePrecondition(r)
+		var updatedDoc database.Document
+		var err error
+		if isUpdateDocument(doc) {
+			// Mise à jour partielle ({"$set": ..., "$inc": ...})
+			updatedDoc, err = collection.ModifyWithPrecondition(documentID, database.Update(doc), precondition)
+			if err == nil && updatedDoc == nil {
+				http.Error(w, fmt.Sprintf("document %s introuvable", documentID), http.StatusNotFound)
+				return
+			}
+		} else {
+			updatedDoc, err = collection.ReplaceWithPrecondition(documentID, doc, precondition)
 		}
-
-		// Retourner le document mis à jour
-		updatedDoc, err := collection.FindByID(documentID)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), writeErrorStatus(err))
 			return
 		}
+		setETag(w, database.Revision(updatedDoc))
 		json.NewEncoder(w).Encode(updatedDoc)
 
+	case http.MethodPatch:
+		if documentID == "" {
+			http.Error(w, "Document ID is required for patch", http.StatusBadRequest)
+			return
+		}
+		handleDocumentPatch(w, r, collection, documentID)
+
 	case http.MethodDelete:
 		if documentID == "" {
 			http.Error(w, "Document ID is required for deletion", http.StatusBadRequest)
@@ -289,8 +400,8 @@ func handleCollection(w http.ResponseWriter, r *http.Request, collectionName str
 		}
 
 		// Supprimer un document
-		if err := collection.Delete(documentID); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err := collection.DeleteWithPrecondition(documentID, parsePrecondition(r)); err != nil {
+			http.Error(w, err.Error(), writeErrorStatus(err))
 			return
 		}
 		w.WriteHeader(http.StatusNoContent)
@@ -300,6 +411,99 @@ func handleCollection(w http.ResponseWriter, r *http.Request, collectionName str
 	}
 }
 
+// handleDocumentPatch applique un JSON Merge Patch (RFC 7396) ou un JSON
+// Patch (RFC 6902) à un document, selon le Content-Type de la requête
+func handleDocumentPatch(w http.ResponseWriter, r *http.Request, collection *database.Collection, documentID string) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	precondition := parsePrecondition(r)
+
+	var doc database.Document
+	var err error
+	switch mediaType {
+	case "application/merge-patch+json":
+		var patch map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		doc, err = collection.MergePatchWithPrecondition(documentID, patch, precondition)
+	case "application/json-patch+json":
+		var operations []database.PatchOperation
+		if err := json.NewDecoder(r.Body).Decode(&operations); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		doc, err = collection.JSONPatchWithPrecondition(documentID, operations, precondition)
+	default:
+		w.Header().Set("Accept-Patch", "application/merge-patch+json, application/json-patch+json")
+		http.Error(w, fmt.Sprintf("Content-Type %q non supporté pour PATCH", mediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), writeErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	setETag(w, database.Revision(doc))
+	json.NewEncoder(w).Encode(doc)
+}
+
+// writeErrorStatus retourne le statut HTTP d'une erreur d'écriture d'un document
+func writeErrorStatus(err error) int {
+	switch {
+	case os.IsNotExist(err):
+		return http.StatusNotFound
+	case errors.Is(err, database.ErrRevisionMismatch):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, database.ErrDuplicateID):
+		return http.StatusConflict
+	case errors.Is(err, database.ErrInvalidUpdate), errors.Is(err, database.ErrInvalidID),
+		errors.Is(err, database.ErrInvalidWriteOp):
+		return http.StatusBadRequest
+	case errors.Is(err, database.ErrPatchTestFailed), errors.Is(err, database.ErrWriteConflict),
+		errors.Is(err, database.ErrSerializationFailure), errors.Is(err, database.ErrDeadlock),
+		errors.Is(err, database.ErrLockTimeout):
+		return http.StatusConflict
+	case errors.Is(err, database.ErrInvalidPatch):
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
+// parsePrecondition lit les en-têtes If-Match et If-None-Match d'une écriture
+func parsePrecondition(r *http.Request) database.Precondition {
+	return database.Precondition{
+		IfMatch:     parseETags(r.Header.Get("If-Match")),
+		IfNoneMatch: parseETags(r.Header.Get("If-None-Match")),
+	}
+}
+
+// parseETags lit une liste d'ETags ("a", W/"b" ou *) et retourne les
+// révisions correspondantes ; les ETags faibles sont comparés comme forts
+func parseETags(header string) []string {
+	var revisions []string
+	for _, tag := range splitList(header) {
+		revisions = append(revisions, strings.Trim(strings.TrimPrefix(tag, "W/"), `"`))
+	}
+	return revisions
+}
+
+// containsETag indique si revision figure parmi revisions ou si "*" y figure
+func containsETag(revisions []string, revision string) bool {
+	for _, candidate := range revisions {
+		if candidate == "*" || candidate == revision {
+			return true
+		}
+	}
+	return false
+}
+
+// setETag envoie la révision d'un document dans l'en-tête ETag
+func setETag(w http.ResponseWriter, revision string) {
+	w.Header().Set("ETag", `"`+revision+`"`)
+}
+
 // handleCollectionSearch gère les requêtes de recherche
 func handleCollectionSearch(w http.ResponseWriter, r *http.Request, collectionName string) {
 	if r.Method != http.MethodGet {
@@ -314,44 +518,535 @@ func handleCollectionSearch(w http.ResponseWriter, r *http.Request, collectionNa
 	}
 
 	// Récupérer les paramètres de recherche
-	field := r.URL.Query().Get("field")
-	value := r.URL.Query().Get("value")
+	query := r.URL.Query()
+	field := query.Get("field")
+	value := query.Get("value")
 
-	if field == "" || value == "" {
-		http.Error(w, "Field and value parameters are required", http.StatusBadRequest)
+	if field == "" {
+		http.Error(w, "Field parameter is required", http.StatusBadRequest)
 		return
 	}
 
-	// Convertir la valeur en interface{} pour la recherche
-	var searchValue interface{}
-	if err := json.Unmarshal([]byte(value), &searchValue); err != nil {
-		// Si la conversion JSON échoue, utiliser la valeur comme string
-		searchValue = value
+	options, err := parseFindOptions(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	// Rechercher les documents
-	documents, err := collection.FindByField(field, searchValue)
+	filter := database.Filter{}
+	fields, values := query["field"], query["value"]
+	if len(fields) > 1 {
+		// Plusieurs couples field/value : égalité sur chacun des champs
+		if len(fields) != len(values) {
+			http.Error(w, "Each field parameter needs a value parameter", http.StatusBadRequest)
+			return
+		}
+		for i, name := range fields {
+			filter[name] = parseSearchValue(values[i])
+		}
+	} else {
+		// Égalité, préfixe ou intervalle (gt, gte, lt, lte)
+		operators := map[string]interface{}{}
+		for _, param := range []string{"gt", "gte", "lt", "lte"} {
+			if query.Has(param) {
+				operators["$"+param] = parseSearchValue(query.Get(param))
+			}
+		}
+		switch {
+		case value != "":
+			filter[field] = parseSearchValue(value)
+		case query.Has("prefix"):
+			filter[field] = map[string]interface{}{"$regex": "^" + regexp.QuoteMeta(query.Get("prefix"))}
+		case len(operators) > 0:
+			filter[field] = operators
+		default:
+			http.Error(w, "A value, prefix or range (gt, gte, lt, lte) parameter is required", http.StatusBadRequest)
+			return
+		}
+	}
+
+	writeDocuments(w, r, collection, filter, options)
+}
+
+// defaultPageSize est la taille d'une page lue par curseur sans limit
+const defaultPageSize = 100
+
+// PageResponse est la réponse d'une liste paginée par curseur
+type PageResponse struct {
+	Documents  []database.Document `json:"documents"`
+	NextCursor string              `json:"next_cursor,omitempty"`
+}
+
+// writeDocuments écrit les documents d'une recherche. Avec le paramètre
+// cursor (vide pour la première page), la réponse est une page suivie du
+// curseur de la page suivante, absent après la dernière page.
+func writeDocuments(w http.ResponseWriter, r *http.Request, collection *database.Collection, filter database.Filter, options database.FindOptions) {
+	query := r.URL.Query()
+	if !query.Has("cursor") {
+		documents, err := collection.Find(filter, options)
+		if err != nil {
+			http.Error(w, err.Error(), queryErrorStatus(err))
+			return
+		}
+		json.NewEncoder(w).Encode(documents)
+		return
+	}
+
+	options.After = query.Get("cursor")
+	if options.Limit == 0 {
+		options.Limit = defaultPageSize
+	}
+	iterator, err := collection.Iterate(filter, options)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), queryErrorStatus(err))
+		return
+	}
+	documents, err := iterator.Next()
+	if err != nil {
+		http.Error(w, err.Error(), queryErrorStatus(err))
 		return
 	}
+	if documents == nil {
+		documents = []database.Document{}
+	}
 
-	json.NewEncoder(w).Encode(documents)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PageResponse{Documents: documents, NextCursor: iterator.Token()})
+}
+
+// QueryRequest est le corps d'une requête POST /api/{collection}/query
+type QueryRequest struct {
+	Filter database.Filter `json:"filter"`
+	database.FindOptions
+}
+
+// handleCollectionQuery gère les requêtes par filtre
+func handleCollectionQuery(w http.ResponseWriter, r *http.Request, collectionName string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	collection, err := db.GetCollection(collectionName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Collection %s does not exist", collectionName), http.StatusNotFound)
+		return
+	}
+
+	var request QueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var result interface{}
+	if r.URL.Query().Get("explain") == "true" {
+		// Plan choisi, documents examinés et durée, sans les documents
+		result, err = collection.Explain(request.Filter, request.FindOptions)
+	} else {
+		result, err = collection.Find(request.Filter, request.FindOptions)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), queryErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// AggregateRequest est le corps d'une requête POST /api/{collection}/aggregate
+type AggregateRequest struct {
+	Pipeline database.Pipeline `json:"pipeline"`
+}
+
+// handleCollectionAggregate exécute un pipeline d'agrégation ; les
+// documents sont écrits au fil de leur production
+func handleCollectionAggregate(w http.ResponseWriter, r *http.Request, collectionName string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	collection, err := db.GetCollection(collectionName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Collection %s does not exist", collectionName), http.StatusNotFound)
+		return
+	}
+
+	var request AggregateRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Le pipeline est validé avant le premier document : une erreur
+	// produite ensuite ne peut plus changer le statut de la réponse
+	started := false
+	encoder := json.NewEncoder(w)
+	err = collection.AggregateFunc(request.Pipeline, func(doc database.Document) error {
+		separator := ","
+		if !started {
+			w.Header().Set("Content-Type", "application/json")
+			separator, started = "[", true
+		}
+		if _, err := io.WriteString(w, separator); err != nil {
+			return err
+		}
+		return encoder.Encode(doc)
+	})
+	if err != nil {
+		if !started {
+			http.Error(w, err.Error(), queryErrorStatus(err))
+			return
+		}
+		log.Printf("Erreur pendant l'agrégation de la collection %s: %v", collectionName, err)
+		return
+	}
+
+	if !started {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, "[")
+	}
+	io.WriteString(w, "]\n")
+}
+
+// UpdateRequest est le corps d'une requête POST /api/{collection}/update
+type UpdateRequest struct {
+	Filter database.Filter `json:"filter"`
+	Update database.Update `json:"update"`
+	// Multi modifie tous les documents vérifiant le filtre, sinon le premier
+	Multi bool `json:"multi,omitempty"`
+}
+
+// handleCollectionUpdate applique des opérateurs de mise à jour aux
+// documents vérifiant un filtre
+func handleCollectionUpdate(w http.ResponseWriter, r *http.Request, collectionName string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	collection, err := db.GetCollection(collectionName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Collection %s does not exist", collectionName), http.StatusNotFound)
+		return
+	}
+
+	var request UpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var result database.UpdateResult
+	if request.Multi {
+		result, err = collection.UpdateMany(request.Filter, request.Update)
+	} else {
+		result, err = collection.UpdateOne(request.Filter, request.Update)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), queryErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// UpsertRequest est le corps d'une requête POST /api/{collection}/upsert
+type UpsertRequest struct {
+	Filter   database.Filter   `json:"filter"`
+	Document database.Document `json:"document"`
+}
+
+// handleCollectionUpsert remplace le premier document vérifiant un filtre,
+// ou insère le document s'il n'y en a pas
+func handleCollectionUpsert(w http.ResponseWriter, r *http.Request, collectionName string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	collection, err := db.GetCollection(collectionName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Collection %s does not exist", collectionName), http.StatusNotFound)
+		return
+	}
+
+	var request UpsertRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Document == nil {
+		http.Error(w, "Missing document", http.StatusBadRequest)
+		return
+	}
+
+	result, err := collection.Upsert(request.Filter, request.Document)
+	if err != nil {
+		http.Error(w, err.Error(), modifyErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if result.UpsertedID != "" {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// FindAndModifyRequest est le corps d'une requête POST
+// /api/{collection}/find-and-update ou /api/{collection}/find-and-delete
+type FindAndModifyRequest struct {
+	Filter database.Filter `json:"filter"`
+	Update database.Update `json:"update,omitempty"`
+	database.FindAndModifyOptions
+}
+
+// handleCollectionFindAndModify modifie ou supprime le premier document
+// vérifiant un filtre et le retourne ; 404 si aucun document ne le vérifie
+func handleCollectionFindAndModify(w http.ResponseWriter, r *http.Request, collectionName string, remove bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	collection, err := db.GetCollection(collectionName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Collection %s does not exist", collectionName), http.StatusNotFound)
+		return
+	}
+
+	var request FindAndModifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var doc database.Document
+	if remove {
+		doc, err = collection.FindOneAndDelete(request.Filter, request.FindAndModifyOptions)
+	} else {
+		doc, err = collection.FindOneAndUpdate(request.Filter, request.Update, request.FindAndModifyOptions)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), modifyErrorStatus(err))
+		return
+	}
+	if doc == nil {
+		if request.Upsert && !remove {
+			// Document inséré, sans version antérieure à retourner
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.Error(w, "No matching document", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(doc)
+}
+
+// modifyErrorStatus retourne le statut HTTP d'une erreur d'écriture
+// par filtre : erreur de recherche ou d'écriture d'un document
+func modifyErrorStatus(err error) int {
+	if status := queryErrorStatus(err); status != http.StatusInternalServerError {
+		return status
+	}
+	return writeErrorStatus(err)
+}
+
+// bulkChunkSize est le nombre d'opérations d'un corps NDJSON écrites sous
+// un même verrou de la collection et synchronisées ensemble
+const bulkChunkSize = 1000
+
+// BulkLineResult est le résultat d'une ligne d'un corps NDJSON
+type BulkLineResult struct {
+	Line   int    `json:"line"`
+	ID     string `json:"id,omitempty"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// handleCollectionBulk exécute les opérations d'un corps NDJSON, une
+// opération database.WriteOp par ligne, par lots de bulkChunkSize. La
+// réponse est en NDJSON, une ligne de résultat par opération et dans le
+// même ordre, écrite au fil des lots. Avec ordered=false, les opérations
+// qui suivent une opération en échec sont exécutées.
+func handleCollectionBulk(w http.ResponseWriter, r *http.Request, collectionName string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	collection, err := db.GetCollection(collectionName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Collection %s does not exist", collectionName), http.StatusNotFound)
+		return
+	}
+	ordered := r.URL.Query().Get("ordered") != "false"
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+
+	var ops []database.WriteOp
+	var lines []int
+	// flush écrit le lot en attente et indique si la lecture doit continuer
+	flush := func() bool {
+		if len(ops) == 0 {
+			return true
+		}
+		result, err := collection.BulkWrite(ops, ordered)
+		for i, op := range result.Results {
+			line := BulkLineResult{Line: lines[i], ID: op.ID, Status: http.StatusOK}
+			if ops[i].Op == "insert" {
+				line.Status = http.StatusCreated
+			}
+			if op.Err() != nil {
+				line.Status, line.Error = writeErrorStatus(op.Err()), op.Error
+			}
+			encoder.Encode(line)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		stopped := ordered && result.Failed > 0
+		ops, lines = ops[:0], lines[:0]
+		if err != nil {
+			log.Printf("Erreur pendant l'écriture en lot de la collection %s: %v", collectionName, err)
+			encoder.Encode(BulkLineResult{Status: writeErrorStatus(err), Error: err.Error()})
+			return false
+		}
+		return !stopped
+	}
+
+	reader := bufio.NewReader(r.Body)
+	for number := 1; ; number++ {
+		data, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			if flush() {
+				encoder.Encode(BulkLineResult{Line: number, Status: http.StatusBadRequest, Error: readErr.Error()})
+			}
+			return
+		}
+		if data = bytes.TrimSpace(data); len(data) > 0 {
+			var op database.WriteOp
+			if err := json.Unmarshal(data, &op); err != nil {
+				// Les opérations qui précèdent la ligne invalide sont écrites d'abord
+				if !flush() {
+					return
+				}
+				encoder.Encode(BulkLineResult{Line: number, Status: http.StatusBadRequest, Error: err.Error()})
+				if ordered {
+					return
+				}
+			} else {
+				ops, lines = append(ops, op), append(lines, number)
+			}
+		}
+		if readErr == io.EOF || (len(ops) == bulkChunkSize && !flush()) {
+			break
+		}
+	}
+	flush()
+}
+
+// isUpdateDocument indique si un corps de requête est une liste
+// d'opérateurs de mise à jour plutôt qu'un document de remplacement
+func isUpdateDocument(doc database.Document) bool {
+	for key := range doc {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return len(doc) > 0
+}
+
+// queryErrorStatus retourne le statut HTTP d'une erreur de recherche
+func queryErrorStatus(err error) int {
+	if errors.Is(err, database.ErrInvalidFilter) || errors.Is(err, database.ErrInvalidPipeline) ||
+		errors.Is(err, database.ErrInvalidUpdate) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// parseFindOptions lit les options de recherche d'une URL :
+// sort=age,-name (- pour un tri décroissant), skip, limit et
+// fields=name,email (inclusion) ou fields=-password (exclusion)
+func parseFindOptions(query url.Values) (database.FindOptions, error) {
+	var options database.FindOptions
+	for _, path := range splitList(query.Get("sort")) {
+		field := database.SortField{Path: strings.TrimPrefix(path, "-"), Desc: strings.HasPrefix(path, "-")}
+		options.Sort = append(options.Sort, field)
+	}
+	for param, target := range map[string]*int{"skip": &options.Skip, "limit": &options.Limit} {
+		if !query.Has(param) {
+			continue
+		}
+		n, err := strconv.Atoi(query.Get(param))
+		if err != nil || n < 0 {
+			return options, fmt.Errorf("Invalid %s parameter: %q", param, query.Get(param))
+		}
+		*target = n
+	}
+	for _, path := range splitList(query.Get("fields")) {
+		if options.Projection == nil {
+			options.Projection = database.Projection{}
+		}
+		options.Projection[strings.TrimPrefix(path, "-")] = !strings.HasPrefix(path, "-")
+	}
+	return options, nil
+}
+
+// splitList découpe une liste séparée par des virgules, sans éléments vides
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseSearchValue convertit un paramètre de recherche en valeur JSON,
+// ou le garde comme chaîne si ce n'est pas du JSON valide
+func parseSearchValue(value string) interface{} {
+	var searchValue interface{}
+	if err := json.Unmarshal([]byte(value), &searchValue); err != nil {
+		return value
+	}
+	return searchValue
 }
 
 // Handlers pour les transactions
 
-// handleTransactionBegin commence une nouvelle transaction
+// handleTransactionBegin commence une nouvelle transaction ; le corps,
+// facultatif, choisit son isolation ({"isolation": "serializable"})
 func handleTransactionBegin(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	tx := db.BeginTransaction()
+	var opts database.TransactionOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tx, err := db.BeginTransactionWithOptions(opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	response := map[string]interface{}{
 		"transaction_id": tx.ID,
 		"status":         "active",
+		"isolation":      tx.Isolation,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -381,8 +1076,9 @@ func handleTransactionCommit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := db.Commit(tx); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	err := db.Commit(tx)
+	if err != nil && !errors.Is(err, database.ErrNotDurable) {
+		http.Error(w, err.Error(), writeErrorStatus(err))
 		return
 	}
 
@@ -390,6 +1086,11 @@ func handleTransactionCommit(w http.ResponseWriter, r *http.Request) {
 		"transaction_id": request.TransactionID,
 		"status":         "committed",
 	}
+	// La transaction est validée même si ses documents n'ont pu être
+	// forcés sur disque
+	if err != nil {
+		response["warning"] = err.Error()
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
@@ -455,6 +1156,12 @@ func handleTransactionOperation(w http.ResponseWriter, r *http.Request) {
 		handleTransactionUpdate(w, r, tx)
 	case "delete":
 		handleTransactionDelete(w, r, tx)
+	case "document":
+		handleTransactionDocument(w, r, tx)
+	case "find":
+		handleTransactionFind(w, r, tx)
+	case "lock":
+		handleTransactionLock(w, r, tx)
 	default:
 		http.Error(w, "Unknown transaction operation", http.StatusBadRequest)
 	}
@@ -479,9 +1186,10 @@ func handleTransactionInsert(w http.ResponseWriter, r *http.Request, tx *databas
 
 	id, err := db.InsertWithTransaction(tx, request.Collection, request.Document)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), writeErrorStatus(err))
 		return
 	}
+	request.Document[database.IDField] = id
 
 	response := map[string]interface{}{
 		"id":       id,
@@ -504,6 +1212,9 @@ func handleTransactionUpdate(w http.ResponseWriter, r *http.Request, tx *databas
 		Collection string            `json:"collection"`
 		DocumentID string            `json:"document_id"`
 		Updates    database.Document `json:"updates"`
+		// Update, à la place de Updates, applique des opérateurs au
+		// document tel qu'il sera à la validation
+		Update database.Update `json:"update,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
@@ -511,19 +1222,24 @@ func handleTransactionUpdate(w http.ResponseWriter, r *http.Request, tx *databas
 		return
 	}
 
-	collection, err := db.GetCollection(request.Collection)
-	if err != nil {
+	if _, err := db.GetCollection(request.Collection); err != nil {
 		http.Error(w, fmt.Sprintf("Collection %s does not exist", request.Collection), http.StatusNotFound)
 		return
 	}
 
-	if err := db.UpdateWithTransaction(tx, request.Collection, request.DocumentID, request.Updates); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	var err error
+	if len(request.Update) > 0 {
+		err = db.ModifyWithTransaction(tx, request.Collection, request.DocumentID, request.Update)
+	} else {
+		err = db.UpdateWithTransaction(tx, request.Collection, request.DocumentID, request.Updates)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), modifyErrorStatus(err))
 		return
 	}
 
-	// Retourner le document mis à jour
-	updatedDoc, err := collection.FindByID(request.DocumentID)
+	// Retourner le document tel que la transaction le voit
+	updatedDoc, err := db.GetDocumentWithTransaction(tx, request.Collection, request.DocumentID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -551,9 +1267,119 @@ func handleTransactionDelete(w http.ResponseWriter, r *http.Request, tx *databas
 	}
 
 	if err := db.DeleteWithTransaction(tx, request.Collection, request.DocumentID); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), writeErrorStatus(err))
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// handleTransactionLock verrouille pour la transaction un document ou, sans
+// document_id, toute la collection, jusqu'à sa fin
+func handleTransactionLock(w http.ResponseWriter, r *http.Request, tx *database.Transaction) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Collection string            `json:"collection"`
+		DocumentID string            `json:"document_id,omitempty"`
+		Mode       database.LockMode `json:"mode"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if request.Mode != database.LockShared && request.Mode != database.LockExclusive {
+		http.Error(w, fmt.Sprintf("Invalid lock mode %q (shared or exclusive)", request.Mode), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := db.GetCollection(request.Collection); err != nil {
+		http.Error(w, fmt.Sprintf("Collection %s does not exist", request.Collection), http.StatusNotFound)
+		return
+	}
+
+	var err error
+	if request.DocumentID != "" {
+		err = db.LockDocument(tx, request.Collection, request.DocumentID, request.Mode)
+	} else {
+		err = db.LockCollection(tx, request.Collection, request.Mode)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), writeErrorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleTransactionDocument lit un document tel que la transaction le voit,
+// ses écritures non validées comprises : ?collection=users&id=...
+func handleTransactionDocument(w http.ResponseWriter, r *http.Request, tx *database.Transaction) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	if _, err := db.GetCollection(query.Get("collection")); err != nil {
+		http.Error(w, fmt.Sprintf("Collection %s does not exist", query.Get("collection")), http.StatusNotFound)
+		return
+	}
+	doc, err := db.GetDocumentWithTransaction(tx, query.Get("collection"), query.Get("id"))
+	if err != nil {
+		http.Error(w, err.Error(), writeErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	setETag(w, database.Revision(doc))
+	json.NewEncoder(w).Encode(doc)
+}
+
+// handleTransactionFind recherche des documents tels que la transaction les
+// voit : ?collection=users, avec un filtre JSON (filter=...) ou une égalité
+// (field=...&value=...), et les options sort, skip, limit et fields
+func handleTransactionFind(w http.ResponseWriter, r *http.Request, tx *database.Transaction) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	if _, err := db.GetCollection(query.Get("collection")); err != nil {
+		http.Error(w, fmt.Sprintf("Collection %s does not exist", query.Get("collection")), http.StatusNotFound)
+		return
+	}
+	options, err := parseFindOptions(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter := database.Filter{}
+	if raw := query.Get("filter"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &filter); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid filter parameter: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if field := query.Get("field"); field != "" {
+		filter[field] = parseSearchValue(query.Get("value"))
+	}
+
+	documents, err := db.FindWithTransaction(tx, query.Get("collection"), filter, options)
+	if err != nil {
+		http.Error(w, err.Error(), queryErrorStatus(err))
+		return
+	}
+	if documents == nil {
+		documents = []database.Document{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(documents)
+}
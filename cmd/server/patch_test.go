@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"nosql-db/internal/database"
+)
+
+// TestPatchEndpoint vérifie PATCH avec JSON Merge Patch et JSON Patch, et
+// le statut de chaque erreur
+func TestPatchEndpoint(t *testing.T) {
+	openTestDatabase(t, "books")
+	docID := mustInsert(t, "books", database.Document{"title": "A", "tags": []interface{}{"sf"}, "draft": true})
+	patch := func(contentType, body string) *httptest.ResponseRecorder {
+		return serve(handleCollection, "books", http.MethodPatch, "/api/books/"+docID, body, "Content-Type", contentType)
+	}
+
+	w := patch("application/merge-patch+json", `{"title": "B", "draft": null}`)
+	checkStatus(t, w, http.StatusOK)
+	var doc database.Document
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("réponse illisible: %v", err)
+	}
+	if _, exists := doc["draft"]; doc["title"] != "B" || exists {
+		t.Fatalf("document = %v, attendu le titre changé et draft retiré", doc)
+	}
+
+	w = patch("application/json-patch+json", `[{"op": "add", "path": "/tags/-", "value": "classique"}]`)
+	checkStatus(t, w, http.StatusOK)
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil || len(doc["tags"].([]interface{})) != 2 {
+		t.Fatalf("document = %v (%v), attendu deux tags", doc, err)
+	}
+
+	checkStatus(t, patch("application/json-patch+json", `[{"op": "test", "path": "/title", "value": "A"}]`), http.StatusConflict)
+	checkStatus(t, patch("application/json-patch+json", `[{"op": "explode", "path": "/title"}]`), http.StatusUnprocessableEntity)
+	checkStatus(t, patch("application/json-patch+json", `[`), http.StatusBadRequest)
+	w = patch("application/json", `{"title": "C"}`)
+	checkStatus(t, w, http.StatusUnsupportedMediaType)
+	if w.Header().Get("Accept-Patch") == "" {
+		t.Fatal("en-tête Accept-Patch absent")
+	}
+	checkStatus(t, serve(handleCollection, "books", http.MethodPatch, "/api/books/missing", `{"title": "C"}`, "Content-Type", "application/merge-patch+json"), http.StatusNotFound)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"nosql-db/internal/database"
+)
+
+// TestQueryEndpoint vérifie les documents retournés par POST
+// /api/{collection}/query et les statuts de ses erreurs
+func TestQueryEndpoint(t *testing.T) {
+	openTestDatabase(t, "books")
+	mustInsert(t, "books", database.Document{"title": "A", "year": 1950})
+	mustInsert(t, "books", database.Document{"title": "B", "year": 2001})
+
+	w := serve(handleCollectionQuery, "books", http.MethodPost, "/api/books/query", `{"filter": {"year": {"$gt": 1990}}}`)
+	checkStatus(t, w, http.StatusOK)
+	var documents []database.Document
+	if err := json.Unmarshal(w.Body.Bytes(), &documents); err != nil {
+		t.Fatalf("réponse illisible: %v", err)
+	}
+	if len(documents) != 1 || documents[0]["title"] != "B" {
+		t.Fatalf("documents = %v, attendu le livre B", documents)
+	}
+
+	checkStatus(t, serve(handleCollectionQuery, "books", http.MethodPost, "/api/books/query", `{"filter": {"year": {"$near": 1}}}`), http.StatusBadRequest)
+	checkStatus(t, serve(handleCollectionQuery, "books", http.MethodPost, "/api/books/query", `{"filter":`), http.StatusBadRequest)
+	checkStatus(t, serve(handleCollectionQuery, "books", http.MethodGet, "/api/books/query", ""), http.StatusMethodNotAllowed)
+	checkStatus(t, serve(handleCollectionQuery, "films", http.MethodPost, "/api/films/query", `{}`), http.StatusNotFound)
+}
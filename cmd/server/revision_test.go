@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"nosql-db/internal/database"
+)
+
+// TestETagPreconditions vérifie l'ETag des lectures et des écritures, le
+// 304 de If-None-Match et le 412 d'un If-Match périmé
+func TestETagPreconditions(t *testing.T) {
+	openTestDatabase(t, "books")
+	docID := mustInsert(t, "books", database.Document{"title": "A"})
+	target := "/api/books/" + docID
+
+	w := serve(handleCollection, "books", http.MethodGet, target, "")
+	checkStatus(t, w, http.StatusOK)
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("GET sans ETag")
+	}
+	checkStatus(t, serve(handleCollection, "books", http.MethodGet, target, "", "If-None-Match", etag), http.StatusNotModified)
+
+	w = serve(handleCollection, "books", http.MethodPut, target, `{"title": "B"}`, "If-Match", etag)
+	checkStatus(t, w, http.StatusOK)
+	updated := w.Header().Get("ETag")
+	if updated == "" || updated == etag {
+		t.Fatalf("ETag après PUT = %q, attendu une nouvelle révision", updated)
+	}
+
+	// L'ancienne révision ne permet plus d'écrire
+	checkStatus(t, serve(handleCollection, "books", http.MethodPut, target, `{"title": "C"}`, "If-Match", etag), http.StatusPreconditionFailed)
+	checkStatus(t, serve(handleCollection, "books", http.MethodPatch, target, `{"title": "C"}`, "Content-Type", "application/merge-patch+json", "If-Match", etag), http.StatusPreconditionFailed)
+	checkStatus(t, serve(handleCollection, "books", http.MethodDelete, target, "", "If-Match", etag), http.StatusPreconditionFailed)
+
+	// If-None-Match: * n'écrit que si le document n'existe pas
+	checkStatus(t, serve(handleCollection, "books", http.MethodPut, target, `{"title": "C"}`, "If-None-Match", "*"), http.StatusPreconditionFailed)
+	checkStatus(t, serve(handleCollection, "books", http.MethodGet, target, "", "If-None-Match", etag), http.StatusOK)
+
+	checkStatus(t, serve(handleCollection, "books", http.MethodDelete, target, "", "If-Match", updated), http.StatusNoContent)
+	checkStatus(t, serve(handleCollection, "books", http.MethodGet, target, ""), http.StatusNotFound)
+}
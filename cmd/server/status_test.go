@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+
+	"nosql-db/internal/database"
+)
+
+// TestErrorStatus vérifie le statut HTTP associé à chaque erreur
+// d'écriture, directe ou enveloppée, et à chaque erreur de recherche
+func TestErrorStatus(t *testing.T) {
+	cases := []struct {
+		err    error
+		write  int
+		modify int
+	}{
+		{&os.PathError{Op: "get", Path: "a", Err: os.ErrNotExist}, http.StatusNotFound, http.StatusNotFound},
+		{database.ErrRevisionMismatch, http.StatusPreconditionFailed, http.StatusPreconditionFailed},
+		{database.ErrDuplicateID, http.StatusConflict, http.StatusConflict},
+		{database.ErrInvalidID, http.StatusBadRequest, http.StatusBadRequest},
+		{database.ErrInvalidUpdate, http.StatusBadRequest, http.StatusBadRequest},
+		{database.ErrInvalidWriteOp, http.StatusBadRequest, http.StatusBadRequest},
+		{database.ErrPatchTestFailed, http.StatusConflict, http.StatusConflict},
+		{database.ErrInvalidPatch, http.StatusUnprocessableEntity, http.StatusUnprocessableEntity},
+		{database.ErrSerializationFailure, http.StatusConflict, http.StatusConflict},
+		{database.ErrWriteConflict, http.StatusConflict, http.StatusConflict},
+		{database.ErrDeadlock, http.StatusConflict, http.StatusConflict},
+		{database.ErrLockTimeout, http.StatusConflict, http.StatusConflict},
+		{database.ErrInvalidFilter, http.StatusInternalServerError, http.StatusBadRequest},
+		{fmt.Errorf("disque plein"), http.StatusInternalServerError, http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		// os.IsNotExist ne déroule pas les erreurs enveloppées : le
+		// stockage retourne un *os.PathError tel quel
+		wrapped := c.err
+		if _, ok := c.err.(*os.PathError); !ok {
+			wrapped = fmt.Errorf("écriture: %w", c.err)
+		}
+		if status := writeErrorStatus(wrapped); status != c.write {
+			t.Errorf("writeErrorStatus(%v) = %d, attendu %d", c.err, status, c.write)
+		}
+		if status := modifyErrorStatus(wrapped); status != c.modify {
+			t.Errorf("modifyErrorStatus(%v) = %d, attendu %d", c.err, status, c.modify)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"nosql-db/internal/database"
+)
+
+// TestUpdateEndpoint vérifie POST /api/{collection}/update, sur un ou
+// tous les documents, et le statut d'opérateurs invalides
+func TestUpdateEndpoint(t *testing.T) {
+	openTestDatabase(t, "books")
+	mustInsert(t, "books", database.Document{"genre": "sf", "stock": 1})
+	mustInsert(t, "books", database.Document{"genre": "sf", "stock": 2})
+
+	w := serve(handleCollectionUpdate, "books", http.MethodPost, "/api/books/update",
+		`{"filter": {"genre": "sf"}, "update": {"$inc": {"stock": 10}}, "multi": true}`)
+	checkStatus(t, w, http.StatusOK)
+	var result database.UpdateResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("réponse illisible: %v", err)
+	}
+	if result.Matched != 2 || result.Modified != 2 {
+		t.Fatalf("résultat = %+v, attendu 2 documents modifiés", result)
+	}
+
+	w = serve(handleCollectionUpdate, "books", http.MethodPost, "/api/books/update",
+		`{"filter": {"genre": "sf"}, "update": {"$set": {"genre": "polar"}}}`)
+	checkStatus(t, w, http.StatusOK)
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || result.Modified != 1 {
+		t.Fatalf("résultat = %+v (%v), attendu un seul document modifié", result, err)
+	}
+
+	checkStatus(t, serve(handleCollectionUpdate, "books", http.MethodPost, "/api/books/update", `{"filter": {}, "update": {"$explode": {"stock": 1}}}`), http.StatusBadRequest)
+	checkStatus(t, serve(handleCollectionUpdate, "books", http.MethodGet, "/api/books/update", ""), http.StatusMethodNotAllowed)
+}
+
+// TestPutWithOperators vérifie qu'un PUT composé d'opérateurs modifie le
+// document au lieu de le remplacer
+func TestPutWithOperators(t *testing.T) {
+	openTestDatabase(t, "books")
+	docID := mustInsert(t, "books", database.Document{"title": "A", "stock": 1})
+
+	w := serve(handleCollection, "books", http.MethodPut, "/api/books/"+docID, `{"$inc": {"stock": 2}}`)
+	checkStatus(t, w, http.StatusOK)
+	var doc database.Document
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("réponse illisible: %v", err)
+	}
+	if doc["title"] != "A" || doc["stock"] != float64(3) {
+		t.Fatalf("document = %v, attendu le titre gardé et le stock à 3", doc)
+	}
+
+	checkStatus(t, serve(handleCollection, "books", http.MethodPut, "/api/books/missing", `{"$inc": {"stock": 2}}`), http.StatusNotFound)
+	checkStatus(t, serve(handleCollection, "books", http.MethodPut, "/api/books/"+docID, `{"$inc": {"title": 2}}`), http.StatusBadRequest)
+}
@@ -0,0 +1,127 @@
+package database
+
+// accumulator calcule un champ d'un groupe à partir des valeurs de ses
+// documents ; exists est faux lorsque le document n'a pas la valeur
+type accumulator interface {
+	add(value interface{}, exists bool)
+	result() interface{}
+}
+
+// newAccumulator crée l'accumulateur d'un opérateur, nil s'il est inconnu
+func newAccumulator(operator string) accumulator {
+	switch operator {
+	case "$sum":
+		return &sumAccumulator{}
+	case "$avg":
+		return &avgAccumulator{}
+	case "$min":
+		return &extremumAccumulator{}
+	case "$max":
+		return &extremumAccumulator{max: true}
+	case "$push":
+		return &pushAccumulator{}
+	case "$addToSet":
+		return &setAccumulator{seen: map[interface{}]bool{}}
+	case "$count":
+		return &countAccumulator{}
+	}
+	return nil
+}
+
+// sumAccumulator additionne les valeurs numériques ({"$sum": 1} compte)
+type sumAccumulator struct {
+	total float64
+}
+
+func (a *sumAccumulator) add(value interface{}, exists bool) {
+	if n, ok := normalizeKey(value).(float64); ok {
+		a.total += n
+	}
+}
+
+func (a *sumAccumulator) result() interface{} { return a.total }
+
+// avgAccumulator calcule la moyenne des valeurs numériques, null sans valeur
+type avgAccumulator struct {
+	total float64
+	count int
+}
+
+func (a *avgAccumulator) add(value interface{}, exists bool) {
+	if n, ok := normalizeKey(value).(float64); ok {
+		a.total += n
+		a.count++
+	}
+}
+
+func (a *avgAccumulator) result() interface{} {
+	if a.count == 0 {
+		return nil
+	}
+	return a.total / float64(a.count)
+}
+
+// extremumAccumulator garde la plus petite (ou la plus grande) valeur,
+// selon l'ordre des index ; null et les champs absents sont ignorés
+type extremumAccumulator struct {
+	max   bool
+	value interface{}
+	key   interface{}
+	set   bool
+}
+
+func (a *extremumAccumulator) add(value interface{}, exists bool) {
+	if !exists || value == nil {
+		return
+	}
+	key := normalizeKey(value)
+	if cmp := compareValues(key, a.key); !a.set || (cmp < 0 && !a.max) || (cmp > 0 && a.max) {
+		a.value, a.key, a.set = value, key, true
+	}
+}
+
+func (a *extremumAccumulator) result() interface{} { return a.value }
+
+// pushAccumulator liste les valeurs, dans l'ordre des documents
+type pushAccumulator struct {
+	values []interface{}
+}
+
+func (a *pushAccumulator) add(value interface{}, exists bool) {
+	if exists {
+		a.values = append(a.values, value)
+	}
+}
+
+func (a *pushAccumulator) result() interface{} {
+	if a.values == nil {
+		return []interface{}{}
+	}
+	return a.values
+}
+
+// setAccumulator liste les valeurs distinctes
+type setAccumulator struct {
+	pushAccumulator
+	seen map[interface{}]bool
+}
+
+func (a *setAccumulator) add(value interface{}, exists bool) {
+	if !exists {
+		return
+	}
+	key := normalizeKey(value)
+	if !a.seen[key] {
+		a.seen[key] = true
+		a.values = append(a.values, value)
+	}
+}
+
+// countAccumulator compte les documents du groupe
+type countAccumulator struct {
+	count int
+}
+
+func (a *countAccumulator) add(value interface{}, exists bool) { a.count++ }
+
+func (a *countAccumulator) result() interface{} { return float64(a.count) }
@@ -0,0 +1,828 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Pipeline est une suite d'étapes d'agrégation à la MongoDB, par exemple
+//
+//	[{"$match": {"status": "paid"}},
+//	 {"$group": {"_id": "$city", "total": {"$sum": "$amount"}}},
+//	 {"$sort": {"total": -1}}, {"$limit": 10}]
+//
+// Chaque étape est un objet à une seule clé, son opérateur : $match,
+// $project, $unwind, $group, $sort, $skip, $limit, $count ou $lookup.
+type Pipeline []Stage
+
+// Stage est une étape d'un pipeline
+type Stage map[string]interface{}
+
+// ErrInvalidPipeline signale un pipeline d'agrégation mal formé
+var ErrInvalidPipeline = errors.New("pipeline invalide")
+
+// UnmarshalJSON décode une étape en conservant l'ordre des champs d'un
+// $sort, qu'une map Go ne garde pas
+func (s *Stage) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	stage := make(Stage, len(raw))
+	for operator, value := range raw {
+		if operator == "$sort" && bytes.HasPrefix(bytes.TrimSpace(value), []byte("{")) {
+			fields, err := decodeSortSpec(value)
+			if err != nil {
+				return err
+			}
+			stage[operator] = fields
+			continue
+		}
+		var decoded interface{}
+		if err := json.Unmarshal(value, &decoded); err != nil {
+			return err
+		}
+		stage[operator] = decoded
+	}
+	*s = stage
+	return nil
+}
+
+// decodeSortSpec décode {"champ": 1, "autre": -1} dans l'ordre des champs
+func decodeSortSpec(data []byte) ([]SortField, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	var fields []SortField
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		var direction float64
+		if err := decoder.Decode(&direction); err != nil || (direction != 1 && direction != -1) {
+			return nil, fmt.Errorf("%w: le sens de tri de %v doit être 1 ou -1", ErrInvalidPipeline, token)
+		}
+		fields = append(fields, SortField{Path: token.(string), Desc: direction < 0})
+	}
+	return fields, nil
+}
+
+// Aggregate exécute un pipeline et retourne les documents produits
+func (c *Collection) Aggregate(pipeline Pipeline) ([]Document, error) {
+	var documents []Document
+	err := c.AggregateFunc(pipeline, func(doc Document) error {
+		documents = append(documents, doc)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return documents, nil
+}
+
+// AggregateFunc exécute un pipeline en transmettant à fn chaque document
+// produit, dès qu'il l'est : seules les étapes $group, $sort et $count
+// retiennent des documents (les groupes, ou les $limit premiers pour un
+// $sort suivi d'un $limit). Les premières étapes $match, $sort, $skip et
+// $limit sont confiées au planificateur de requêtes, qui peut utiliser
+// les index. Une erreur retournée par fn interrompt l'agrégation.
+func (c *Collection) AggregateFunc(pipeline Pipeline, fn func(doc Document) error) error {
+	filter, opts, rest, err := pushdown(pipeline)
+	if err != nil {
+		return err
+	}
+	head, err := c.compileStages(rest, &sinkStage{fn: fn})
+	if err != nil {
+		return err
+	}
+	if joins(rest) {
+		return c.aggregateDetached(filter, opts, head)
+	}
+
+	var pushErr error
+	_, err = c.stream(filter, opts, func(entry *sortedDocument) bool {
+		pushErr = head.push(entry.doc)
+		return pushErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	if pushErr != nil && pushErr != errStopScan {
+		return pushErr
+	}
+	// Les étapes bloquantes se vident hors du verrou de la collection
+	return head.flush()
+}
+
+// joins indique si un pipeline lit d'autres collections
+func joins(pipeline Pipeline) bool {
+	for _, stage := range pipeline {
+		if _, ok := stage["$lookup"]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// aggregateDetached alimente un pipeline qui lit d'autres collections sans
+// garder le verrou de la collection, pour ne pas l'imbriquer avec le leur
+// (ou avec lui-même) : seuls les IDs des documents sont relevés sous le
+// verrou, puis chaque document est relu et vérifié de nouveau
+func (c *Collection) aggregateDetached(filter Filter, opts FindOptions, head pipelineStage) error {
+	match, err := compileFilter(filter)
+	if err != nil {
+		return err
+	}
+	var docIDs []string
+	_, err = c.stream(filter, opts, func(entry *sortedDocument) bool {
+		docIDs = append(docIDs, entry.id)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, docID := range docIDs {
+		doc, err := c.GetDocument(docID)
+		if err != nil || !match(doc) {
+			continue
+		}
+		if err := head.push(doc); err != nil {
+			if err == errStopScan {
+				break
+			}
+			return err
+		}
+	}
+	return head.flush()
+}
+
+// stageOperator retourne l'opérateur et l'argument d'une étape
+func stageOperator(stage Stage) (string, interface{}, error) {
+	if len(stage) != 1 {
+		return "", nil, fmt.Errorf("%w: une étape doit avoir un seul opérateur", ErrInvalidPipeline)
+	}
+	for operator, value := range stage {
+		return operator, value, nil
+	}
+	return "", nil, nil
+}
+
+// pushdown extrait des premières étapes le filtre et les options de la
+// recherche qui alimente le pipeline, et retourne les étapes restantes
+func pushdown(pipeline Pipeline) (Filter, FindOptions, Pipeline, error) {
+	var opts FindOptions
+	var clauses []interface{}
+	i := 0
+	next := func(expected string) (interface{}, bool, error) {
+		if i >= len(pipeline) {
+			return nil, false, nil
+		}
+		operator, value, err := stageOperator(pipeline[i])
+		if err != nil || operator != expected {
+			return nil, false, err
+		}
+		i++
+		return value, true, nil
+	}
+
+	for {
+		value, ok, err := next("$match")
+		if err != nil {
+			return nil, opts, nil, err
+		}
+		if !ok {
+			break
+		}
+		filter, isMap := asMap(value)
+		if !isMap {
+			return nil, opts, nil, fmt.Errorf("%w: $match attend un filtre", ErrInvalidPipeline)
+		}
+		clauses = append(clauses, filter)
+	}
+	if value, ok, err := next("$sort"); err != nil {
+		return nil, opts, nil, err
+	} else if ok {
+		if opts.Sort, err = sortFields(value); err != nil {
+			return nil, opts, nil, err
+		}
+	}
+	if value, ok, err := next("$skip"); err != nil {
+		return nil, opts, nil, err
+	} else if ok {
+		if opts.Skip, err = stageCount("$skip", value, 0); err != nil {
+			return nil, opts, nil, err
+		}
+	}
+	if value, ok, err := next("$limit"); err != nil {
+		return nil, opts, nil, err
+	} else if ok {
+		if opts.Limit, err = stageCount("$limit", value, 1); err != nil {
+			return nil, opts, nil, err
+		}
+	}
+
+	filter := Filter{}
+	switch len(clauses) {
+	case 0:
+	case 1:
+		filter, _ = asMap(clauses[0])
+	default:
+		filter = Filter{"$and": clauses}
+	}
+	return filter, opts, pipeline[i:], nil
+}
+
+// sortFields lit l'argument d'un $sort : une liste de SortField, ou un
+// objet d'un seul champ (l'ordre des champs d'une map Go est perdu)
+func sortFields(value interface{}) ([]SortField, error) {
+	if fields, ok := value.([]SortField); ok {
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("%w: $sort sans champ", ErrInvalidPipeline)
+		}
+		return fields, nil
+	}
+	spec, ok := asMap(value)
+	if !ok || len(spec) != 1 {
+		return nil, fmt.Errorf("%w: $sort attend un champ, ou une liste de SortField pour plusieurs champs", ErrInvalidPipeline)
+	}
+	for path, direction := range spec {
+		switch normalizeKey(direction) {
+		case 1.0:
+			return []SortField{{Path: path}}, nil
+		case -1.0:
+			return []SortField{{Path: path, Desc: true}}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: le sens de tri doit être 1 ou -1", ErrInvalidPipeline)
+}
+
+// stageCount lit l'argument entier d'un $skip ou d'un $limit
+func stageCount(operator string, value interface{}, min int) (int, error) {
+	n, ok := normalizeKey(value).(float64)
+	if !ok || n != float64(int(n)) || int(n) < min {
+		return 0, fmt.Errorf("%w: %s attend un entier supérieur ou égal à %d", ErrInvalidPipeline, operator, min)
+	}
+	return int(n), nil
+}
+
+// pipelineStage est une étape compilée. push reçoit les documents un à
+// un et retourne errStopScan lorsque l'étape n'en attend plus ; flush
+// signale la fin des documents et se propage aux étapes suivantes.
+type pipelineStage interface {
+	push(doc Document) error
+	flush() error
+}
+
+// compileStages compile les étapes, de la dernière à la première
+func (c *Collection) compileStages(pipeline Pipeline, sink pipelineStage) (pipelineStage, error) {
+	next := sink
+	for i := len(pipeline) - 1; i >= 0; i-- {
+		operator, value, err := stageOperator(pipeline[i])
+		if err != nil {
+			return nil, err
+		}
+
+		var stage pipelineStage
+		switch operator {
+		case "$match":
+			filter, ok := asMap(value)
+			if !ok {
+				return nil, fmt.Errorf("%w: $match attend un filtre", ErrInvalidPipeline)
+			}
+			var match matcher
+			if match, err = compileFilter(filter); err == nil {
+				stage = &matchStage{match: match, next: next}
+			}
+		case "$project":
+			stage, err = compileProject(value, next)
+		case "$unwind":
+			stage, err = compileUnwind(value, next)
+		case "$group":
+			stage, err = compileGroup(value, next)
+		case "$sort":
+			var fields []SortField
+			if fields, err = sortFields(value); err == nil {
+				sorter := &documentSorter{fields: fields}
+				if limit, ok := next.(*limitStage); ok {
+					// Seuls les premiers documents triés sont gardés
+					sorter.k = limit.n
+				}
+				stage = &sortStage{sorter: sorter, next: next}
+			}
+		case "$skip":
+			var n int
+			if n, err = stageCount(operator, value, 0); err == nil {
+				stage = &skipStage{n: n, next: next}
+			}
+		case "$limit":
+			var n int
+			if n, err = stageCount(operator, value, 1); err == nil {
+				stage = &limitStage{n: n, next: next}
+			}
+		case "$lookup":
+			stage, err = c.compileLookup(value, next)
+		case "$count":
+			field, ok := value.(string)
+			if !ok || field == "" || strings.HasPrefix(field, "$") || strings.Contains(field, ".") {
+				return nil, fmt.Errorf("%w: $count attend un nom de champ", ErrInvalidPipeline)
+			}
+			stage = &countStage{field: field, next: next}
+		default:
+			err = fmt.Errorf("%w: étape %s inconnue", ErrInvalidPipeline, operator)
+		}
+		if err != nil {
+			return nil, err
+		}
+		next = stage
+	}
+	return next, nil
+}
+
+// sinkStage transmet les documents produits par le pipeline
+type sinkStage struct {
+	fn func(doc Document) error
+}
+
+func (s *sinkStage) push(doc Document) error { return s.fn(doc) }
+func (s *sinkStage) flush() error            { return nil }
+
+// matchStage ne garde que les documents vérifiant un filtre
+type matchStage struct {
+	match matcher
+	next  pipelineStage
+}
+
+func (s *matchStage) push(doc Document) error {
+	if !s.match(doc) {
+		return nil
+	}
+	return s.next.push(doc)
+}
+
+func (s *matchStage) flush() error { return s.next.flush() }
+
+// skipStage ignore les n premiers documents
+type skipStage struct {
+	n, skipped int
+	next       pipelineStage
+}
+
+func (s *skipStage) push(doc Document) error {
+	if s.skipped < s.n {
+		s.skipped++
+		return nil
+	}
+	return s.next.push(doc)
+}
+
+func (s *skipStage) flush() error { return s.next.flush() }
+
+// limitStage transmet les n premiers documents puis interrompt la lecture
+type limitStage struct {
+	n, count int
+	next     pipelineStage
+}
+
+func (s *limitStage) push(doc Document) error {
+	if s.count >= s.n {
+		return errStopScan
+	}
+	s.count++
+	if err := s.next.push(doc); err != nil {
+		return err
+	}
+	if s.count >= s.n {
+		return errStopScan
+	}
+	return nil
+}
+
+func (s *limitStage) flush() error { return s.next.flush() }
+
+// sortStage trie les documents, dans leur ordre d'arrivée à égalité
+type sortStage struct {
+	sorter *documentSorter
+	seq    int
+	next   pipelineStage
+}
+
+func (s *sortStage) push(doc Document) error {
+	s.seq++
+	s.sorter.add(&sortedDocument{id: fmt.Sprintf("%016d", s.seq), doc: doc})
+	return nil
+}
+
+func (s *sortStage) flush() error {
+	if err := emitAll(s.sorter.sorted(), s.next); err != nil {
+		return err
+	}
+	return s.next.flush()
+}
+
+// emitAll transmet des documents retenus par une étape bloquante
+func emitAll(entries []*sortedDocument, next pipelineStage) error {
+	for _, entry := range entries {
+		if err := next.push(entry.doc); err != nil {
+			if err == errStopScan {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// countStage produit un document {field: nombre de documents reçus}
+type countStage struct {
+	field string
+	n     int
+	next  pipelineStage
+}
+
+func (s *countStage) push(doc Document) error {
+	s.n++
+	return nil
+}
+
+func (s *countStage) flush() error {
+	if s.n > 0 {
+		if err := s.next.push(Document{s.field: float64(s.n)}); err != nil && err != errStopScan {
+			return err
+		}
+	}
+	return s.next.flush()
+}
+
+// projectStage réduit les documents à des champs inclus, en retire des
+// champs exclus, ou ajoute des champs calculés
+type projectStage struct {
+	projection Projection
+	computed   map[string]expression
+	// exclusion retire des champs au lieu de construire un document
+	exclusion bool
+	next      pipelineStage
+}
+
+// compileProject compile {"champ": 1, "autre": 0, "calculé": "$chemin"}
+func compileProject(value interface{}, next pipelineStage) (pipelineStage, error) {
+	spec, ok := asMap(value)
+	if !ok || len(spec) == 0 {
+		return nil, fmt.Errorf("%w: $project attend un objet non vide", ErrInvalidPipeline)
+	}
+
+	stage := &projectStage{projection: Projection{}, computed: map[string]expression{}, next: next}
+	excluded := false
+	for path, field := range spec {
+		if err := validatePath(path); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPipeline, err)
+		}
+		switch flag := normalizeKey(field).(type) {
+		case bool:
+			stage.projection[path] = flag
+			excluded = excluded || (!flag && path != IDField)
+			continue
+		case float64:
+			stage.projection[path] = flag != 0
+			excluded = excluded || (flag == 0 && path != IDField)
+			continue
+		}
+		expr, err := compileExpression(field)
+		if err != nil {
+			return nil, err
+		}
+		stage.computed[path] = expr
+	}
+
+	if excluded && len(spec) != len(stage.projection) {
+		return nil, fmt.Errorf("%w: $project ne peut mélanger exclusions et champs calculés", ErrInvalidPipeline)
+	}
+	stage.exclusion = excluded || len(stage.computed) == 0 && !stage.projection.inclusive()
+	if err := (FindOptions{Projection: stage.projection}).validate(); err != nil {
+		return nil, fmt.Errorf("%w: $project ne peut mélanger inclusions et exclusions", ErrInvalidPipeline)
+	}
+	return stage, nil
+}
+
+func (s *projectStage) push(doc Document) error {
+	// Une inclusion retourne les champs inclus, _id et les champs calculés
+	var projected Document
+	if s.exclusion {
+		projected = project(doc, s.projection)
+	} else {
+		projected = includeFields(doc, s.projection)
+	}
+	for path, expr := range s.computed {
+		if value, exists := expr(doc); exists {
+			if err := setPath(projected, path, value); err != nil {
+				return err
+			}
+		}
+	}
+	return s.next.push(projected)
+}
+
+func (s *projectStage) flush() error { return s.next.flush() }
+
+// unwindStage produit un document par élément d'un tableau
+type unwindStage struct {
+	path       string
+	indexField string
+	preserve   bool
+	next       pipelineStage
+}
+
+// compileUnwind compile "$chemin" ou {"path": "$chemin",
+// "includeArrayIndex": "champ", "preserveNullAndEmptyArrays": true}
+func compileUnwind(value interface{}, next pipelineStage) (pipelineStage, error) {
+	stage := &unwindStage{next: next}
+	path, ok := value.(string)
+	if options, isMap := asMap(value); isMap {
+		path, ok = options["path"].(string)
+		if field, exists := options["includeArrayIndex"]; exists {
+			if stage.indexField, _ = field.(string); stage.indexField == "" {
+				return nil, fmt.Errorf("%w: includeArrayIndex attend un nom de champ", ErrInvalidPipeline)
+			}
+		}
+		if preserve, exists := options["preserveNullAndEmptyArrays"]; exists {
+			if stage.preserve, isMap = preserve.(bool); !isMap {
+				return nil, fmt.Errorf("%w: preserveNullAndEmptyArrays attend un booléen", ErrInvalidPipeline)
+			}
+		}
+	}
+	if !ok || !strings.HasPrefix(path, "$") || validatePath(path[1:]) != nil {
+		return nil, fmt.Errorf("%w: $unwind attend un chemin de champ préfixé par $", ErrInvalidPipeline)
+	}
+	stage.path = path[1:]
+	return stage, nil
+}
+
+func (s *unwindStage) push(doc Document) error {
+	value, exists := getPath(doc, s.path)
+	array, isArray := value.([]interface{})
+	if isArray && len(array) > 0 {
+		for i, element := range array {
+			unwound := copyDocument(doc)
+			if err := s.unwound(unwound, element, float64(i)); err != nil {
+				return err
+			}
+			if err := s.next.push(unwound); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if exists && value != nil && !isArray {
+		// Une valeur isolée est un tableau d'un élément
+		if err := s.unwound(doc, value, nil); err != nil {
+			return err
+		}
+		return s.next.push(doc)
+	}
+	if !s.preserve {
+		return nil
+	}
+	if isArray {
+		unsetPath(doc, s.path)
+	}
+	if s.indexField != "" {
+		if err := setPath(doc, s.indexField, nil); err != nil {
+			return err
+		}
+	}
+	return s.next.push(doc)
+}
+
+// unwound place un élément et sa position dans un document produit
+func (s *unwindStage) unwound(doc Document, element, position interface{}) error {
+	if err := setPath(doc, s.path, element); err != nil {
+		return err
+	}
+	if s.indexField != "" {
+		return setPath(doc, s.indexField, position)
+	}
+	return nil
+}
+
+func (s *unwindStage) flush() error { return s.next.flush() }
+
+// groupStage regroupe les documents par valeur de _id et calcule les
+// accumulateurs de chaque groupe ; seuls les groupes sont gardés en mémoire
+type groupStage struct {
+	id     expression
+	fields []groupField
+	groups map[interface{}]*documentGroup
+	order  []*documentGroup
+	next   pipelineStage
+}
+
+// groupField est un champ calculé d'un $group
+type groupField struct {
+	name     string
+	operator string
+	value    expression
+}
+
+// documentGroup est un groupe en cours de calcul
+type documentGroup struct {
+	id           interface{}
+	accumulators []accumulator
+}
+
+// compileGroup compile {"_id": expression, "champ": {"$sum": expression}}
+func compileGroup(value interface{}, next pipelineStage) (pipelineStage, error) {
+	spec, ok := asMap(value)
+	if !ok {
+		return nil, fmt.Errorf("%w: $group attend un objet", ErrInvalidPipeline)
+	}
+	idSpec, ok := spec["_id"]
+	if !ok {
+		return nil, fmt.Errorf("%w: $group exige un champ _id", ErrInvalidPipeline)
+	}
+	id, err := compileExpression(idSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	stage := &groupStage{id: id, groups: map[interface{}]*documentGroup{}, next: next}
+	for name, field := range spec {
+		if name == "_id" {
+			continue
+		}
+		if name == "" || strings.Contains(name, ".") || strings.HasPrefix(name, "$") {
+			return nil, fmt.Errorf("%w: nom de champ %q invalide dans $group", ErrInvalidPipeline, name)
+		}
+		operators, ok := asMap(field)
+		if !ok || len(operators) != 1 {
+			return nil, fmt.Errorf("%w: le champ %s de $group attend un accumulateur", ErrInvalidPipeline, name)
+		}
+		for operator, operand := range operators {
+			if newAccumulator(operator) == nil {
+				return nil, fmt.Errorf("%w: accumulateur %s inconnu", ErrInvalidPipeline, operator)
+			}
+			var valueExpr expression
+			if operator != "$count" {
+				if valueExpr, err = compileExpression(operand); err != nil {
+					return nil, err
+				}
+			}
+			stage.fields = append(stage.fields, groupField{name: name, operator: operator, value: valueExpr})
+		}
+	}
+	return stage, nil
+}
+
+func (s *groupStage) push(doc Document) error {
+	id, _ := s.id(doc)
+	key := normalizeKey(id)
+	group, exists := s.groups[key]
+	if !exists {
+		group = &documentGroup{id: id, accumulators: make([]accumulator, len(s.fields))}
+		for i, field := range s.fields {
+			group.accumulators[i] = newAccumulator(field.operator)
+		}
+		s.groups[key] = group
+		s.order = append(s.order, group)
+	}
+
+	for i, field := range s.fields {
+		var value interface{}
+		exists := false
+		if field.value != nil {
+			value, exists = field.value(doc)
+		}
+		group.accumulators[i].add(value, exists)
+	}
+	return nil
+}
+
+func (s *groupStage) flush() error {
+	for _, group := range s.order {
+		doc := Document{"_id": group.id}
+		for i, field := range s.fields {
+			doc[field.name] = group.accumulators[i].result()
+		}
+		if err := s.next.push(doc); err != nil {
+			if err == errStopScan {
+				break
+			}
+			return err
+		}
+	}
+	s.groups, s.order = nil, nil
+	return s.next.flush()
+}
+
+// expression calcule une valeur à partir d'un document ; exists est faux
+// pour un champ absent
+type expression func(doc map[string]interface{}) (value interface{}, exists bool)
+
+// compileExpression compile une expression : "$chemin" désigne un champ,
+// {"$literal": v} une valeur telle quelle, un objet ou un tableau sont
+// calculés champ par champ, toute autre valeur est une constante
+func compileExpression(expr interface{}) (expression, error) {
+	if path, ok := expr.(string); ok && strings.HasPrefix(path, "$") {
+		path = path[1:]
+		if err := validatePath(path); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPipeline, err)
+		}
+		return func(doc map[string]interface{}) (interface{}, bool) {
+			return fieldValue(doc, path)
+		}, nil
+	}
+
+	if object, ok := asMap(expr); ok {
+		if literal, ok := object["$literal"]; ok && len(object) == 1 {
+			return constant(literal), nil
+		}
+		if isOperatorMap(object) {
+			return nil, fmt.Errorf("%w: opérateur d'expression inconnu dans %v", ErrInvalidPipeline, expr)
+		}
+		fields := make(map[string]expression, len(object))
+		for name, field := range object {
+			compiled, err := compileExpression(field)
+			if err != nil {
+				return nil, err
+			}
+			fields[name] = compiled
+		}
+		return func(doc map[string]interface{}) (interface{}, bool) {
+			result := make(map[string]interface{}, len(fields))
+			for name, field := range fields {
+				if value, exists := field(doc); exists {
+					result[name] = value
+				}
+			}
+			return result, true
+		}, nil
+	}
+
+	if array, ok := expr.([]interface{}); ok {
+		elements := make([]expression, len(array))
+		for i, element := range array {
+			compiled, err := compileExpression(element)
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = compiled
+		}
+		return func(doc map[string]interface{}) (interface{}, bool) {
+			result := make([]interface{}, len(elements))
+			for i, element := range elements {
+				result[i], _ = element(doc)
+			}
+			return result, true
+		}, nil
+	}
+	return constant(expr), nil
+}
+
+// constant retourne une expression de valeur fixe
+func constant(value interface{}) expression {
+	return func(map[string]interface{}) (interface{}, bool) { return value, true }
+}
+
+// fieldValue retourne la valeur d'un chemin ; un chemin traversant un
+// tableau d'objets donne le tableau de leurs valeurs
+func fieldValue(doc map[string]interface{}, path string) (interface{}, bool) {
+	if value, exists := getPath(doc, path); exists {
+		return value, true
+	}
+	values := pathValues(doc, path)
+	if len(values) == 0 {
+		return nil, false
+	}
+	return values, true
+}
+
+// copyDocument copie un document en profondeur
+func copyDocument(doc Document) Document {
+	return Document(copyValue(map[string]interface{}(doc)).(map[string]interface{}))
+}
+
+// copyValue copie en profondeur les objets et tableaux d'une valeur
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, element := range v {
+			copied[key] = copyValue(element)
+		}
+		return copied
+	case Document:
+		return Document(copyValue(map[string]interface{}(v)).(map[string]interface{}))
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, element := range v {
+			copied[i] = copyValue(element)
+		}
+		return copied
+	}
+	return value
+}
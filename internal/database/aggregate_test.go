@@ -0,0 +1,95 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// decodePipeline décode un pipeline JSON comme le ferait l'API
+func decodePipeline(t *testing.T, data string) Pipeline {
+	t.Helper()
+	var pipeline Pipeline
+	if err := json.Unmarshal([]byte(data), &pipeline); err != nil {
+		t.Fatalf("pipeline %s: %v", data, err)
+	}
+	return pipeline
+}
+
+// ordersTestCollection crée des commandes à plusieurs lignes
+func ordersTestCollection(t *testing.T, db *Database) *Collection {
+	t.Helper()
+	c := createTestCollection(t, db, "orders")
+	for _, data := range []string{
+		`{"_id": "o1", "customer": "ann", "status": "paid", "items": [{"sku": "pen", "qty": 2}, {"sku": "ink", "qty": 1}]}`,
+		`{"_id": "o2", "customer": "bob", "status": "paid", "items": [{"sku": "pen", "qty": 5}]}`,
+		`{"_id": "o3", "customer": "ann", "status": "open", "items": [{"sku": "pad", "qty": 9}]}`,
+		`{"_id": "o4", "customer": "cid", "status": "paid", "items": []}`,
+	} {
+		mustInsert(t, c, decodeDocument(t, data))
+	}
+	return c
+}
+
+// TestAggregatePipeline vérifie l'enchaînement des étapes du pipeline
+func TestAggregatePipeline(t *testing.T) {
+	c := ordersTestCollection(t, openTestDatabase(t))
+	tests := []struct {
+		pipeline string
+		want     string
+	}{
+		{
+			`[{"$match": {"status": "paid"}}, {"$unwind": "$items"},
+			  {"$group": {"_id": "$items.sku", "qty": {"$sum": "$items.qty"}, "lines": {"$count": {}}}},
+			  {"$sort": {"qty": -1, "_id": 1}}]`,
+			`[{"_id": "pen", "qty": 7, "lines": 2}, {"_id": "ink", "qty": 1, "lines": 1}]`,
+		},
+		{
+			`[{"$group": {"_id": "$customer", "orders": {"$sum": 1}}}, {"$sort": {"orders": -1, "_id": 1}}, {"$skip": 1}, {"$limit": 1}]`,
+			`[{"_id": "bob", "orders": 1}]`,
+		},
+		{
+			`[{"$match": {"_id": "o1"}}, {"$project": {"_id": 0, "who": "$customer", "status": 1}}]`,
+			`[{"who": "ann", "status": "paid"}]`,
+		},
+		{
+			`[{"$unwind": {"path": "$items", "preserveNullAndEmptyArrays": true}}, {"$match": {"customer": "cid"}}, {"$project": {"items": 1}}]`,
+			`[{"_id": "o4"}]`,
+		},
+		{
+			`[{"$match": {"status": "paid"}}, {"$count": "paid"}]`,
+			`[{"paid": 3}]`,
+		},
+	}
+	for _, test := range tests {
+		docs, err := c.Aggregate(decodePipeline(t, test.pipeline))
+		if err != nil {
+			t.Errorf("Aggregate(%s): %v", test.pipeline, err)
+			continue
+		}
+		var want []Document
+		if err := json.Unmarshal([]byte(test.want), &want); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(docs, want) {
+			t.Errorf("Aggregate(%s) = %v, attendu %v", test.pipeline, docs, want)
+		}
+	}
+}
+
+// TestAggregateInvalidPipeline vérifie qu'une étape inconnue ou mal formée
+// est refusée avec ErrInvalidPipeline
+func TestAggregateInvalidPipeline(t *testing.T) {
+	c := ordersTestCollection(t, openTestDatabase(t))
+	for _, pipeline := range []string{
+		`[{"$explode": {}}]`,
+		`[{"$limit": -1}]`,
+		`[{"$match": {}, "$limit": 1}]`,
+		`[{"$group": {"total": {"$sum": "$qty"}}}]`,
+	} {
+		if _, err := c.Aggregate(decodePipeline(t, pipeline)); !errors.Is(err, ErrInvalidPipeline) {
+			t.Errorf("Aggregate(%s) = %v, attendu ErrInvalidPipeline", pipeline, err)
+		}
+	}
+}
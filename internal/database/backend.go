@@ -0,0 +1,95 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// StorageKind identifie un moteur de stockage de documents
+type StorageKind string
+
+const (
+	// StorageFiles stocke chaque document dans son propre fichier JSON
+	StorageFiles StorageKind = "files"
+	// StorageLog stocke les documents dans des segments en ajout seul
+	StorageLog StorageKind = "log"
+)
+
+// Storage est le moteur de stockage utilisé par une Collection.
+// Les implémentations sont sûres pour un usage concurrent ; un document
+// absent est signalé par une erreur vérifiant os.IsNotExist.
+type Storage interface {
+	// Get lit un document
+	Get(docID string) (Document, error)
+	// Put écrit un document, en le forçant sur disque si sync est vrai
+	Put(docID string, doc map[string]interface{}, sync bool) error
+	// Delete supprime un document (absent = succès)
+	Delete(docID string, sync bool) error
+	// Scan parcourt tous les documents par ordre d'ID ; un document
+	// illisible interrompt le parcours avec une erreur
+	Scan(fn func(docID string, doc Document) error) error
+	// Count retourne le nombre de documents, sans les lire
+	Count() (int, error)
+	// Sync force sur disque les écritures des documents donnés
+	Sync(docIDs []string) error
+	// Fingerprint résume l'état des données : il change dès qu'un
+	// document est écrit ou supprimé
+	Fingerprint() (string, error)
+	// Close libère les ressources du moteur
+	Close() error
+}
+
+// CollectionOptions regroupe les options de création d'une collection
+type CollectionOptions struct {
+	Storage StorageKind `json:"storage,omitempty"`
+	// IDGenerator génère les ID des documents insérés sans _id
+	// (IDGeneratorULID par défaut)
+	IDGenerator IDGenerator `json:"id_generator,omitempty"`
+}
+
+// openStorage ouvre le moteur de stockage d'une collection. Si le
+// répertoire contient déjà des données, le moteur est déduit de leur
+// format et doit correspondre à celui demandé.
+func openStorage(path string, kind StorageKind) (Storage, error) {
+	detected, hasData, err := detectStorageKind(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if kind == "" {
+		kind = detected
+	} else if hasData && kind != detected {
+		return nil, fmt.Errorf("la collection %s utilise déjà le stockage %s", filepath.Base(path), detected)
+	}
+
+	switch kind {
+	case StorageFiles:
+		return newFileStorage(path)
+	case StorageLog:
+		return newLogStorage(path)
+	default:
+		return nil, fmt.Errorf("moteur de stockage inconnu: %s", kind)
+	}
+}
+
+// detectStorageKind déduit le moteur d'un répertoire de collection
+func detectStorageKind(path string) (StorageKind, bool, error) {
+	if info, err := os.Stat(filepath.Join(path, logSegmentsDir)); err == nil && info.IsDir() {
+		return StorageLog, true, nil
+	}
+
+	files, err := os.ReadDir(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return StorageFiles, false, nil
+		}
+		return "", false, err
+	}
+	for _, file := range files {
+		if filepath.Ext(file.Name()) == ".json" {
+			return StorageFiles, true, nil
+		}
+	}
+	return StorageFiles, false, nil
+}
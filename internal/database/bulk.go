@@ -0,0 +1,320 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidWriteOp signale une opération de lot mal formée
+var ErrInvalidWriteOp = errors.New("opération de lot invalide")
+
+// WriteOp est une opération d'un lot d'écritures :
+//   - "insert" insère Document, avec son _id ou un ID généré
+//   - "update" remplace (ou crée) le document ID par Document, ou le
+//     modifie par les opérateurs de Update
+//   - "delete" supprime le document ID
+type WriteOp struct {
+	Op       string   `json:"op"`
+	ID       string   `json:"id,omitempty"`
+	Document Document `json:"document,omitempty"`
+	Update   Update   `json:"update,omitempty"`
+}
+
+// WriteResult est le résultat d'une opération d'un lot
+type WriteResult struct {
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+	err   error
+}
+
+// Err retourne l'erreur de l'opération, nil si elle a réussi
+func (r WriteResult) Err() error {
+	return r.err
+}
+
+// BulkResult résume un lot d'écritures ; Results suit l'ordre des
+// opérations et s'arrête, pour un lot ordonné, à la première en échec
+type BulkResult struct {
+	Inserted int           `json:"inserted"`
+	Modified int           `json:"modified"`
+	Deleted  int           `json:"deleted"`
+	Failed   int           `json:"failed"`
+	Results  []WriteResult `json:"results"`
+}
+
+// BulkWrite exécute un lot d'insertions, de mises à jour et de
+// suppressions sous un seul verrou de la collection, après avoir verrouillé
+// en mode exclusif chacun des documents écrits. Les documents sont
+// écrits sans fsync, les index sont mis à jour une fois par index en fin de
+// lot, puis le lot entier est forcé sur disque en une fois si la durabilité
+// l'exige. Un lot ordonné s'arrête à la première opération en échec ;
+// sinon les suivantes sont exécutées. Les opérations réussies ne sont pas
+// annulées. L'erreur retournée concerne la synchronisation du lot, ou
+// le verrouillage de ses documents (ErrLockTimeout) : rien n'est alors écrit.
+func (c *Collection) BulkWrite(ops []WriteOp, ordered bool) (BulkResult, error) {
+	// Les ID des documents insérés sont choisis avant d'être verrouillés
+	inserted := make([]insertID, len(ops))
+	idErrs := make([]error, len(ops))
+	var result BulkResult
+	var syncErr error
+	err := c.writeLocked("lot d'écritures sur "+c.currentName(), func() ([]string, error) {
+		var docIDs []string
+		for i, op := range ops {
+			switch {
+			case op.Op == "insert" && op.Document != nil:
+				var docID string
+				if docID, idErrs[i] = inserted[i].choose(c, op.Document); idErrs[i] == nil {
+					docIDs = append(docIDs, docID)
+				}
+			case validateDocumentID(op.ID) == nil:
+				docIDs = append(docIDs, op.ID)
+			}
+		}
+		return docIDs, nil
+	}, func() error {
+		result, syncErr = c.bulkWriteLocked(ops, ordered, inserted, idErrs)
+		return nil
+	})
+	if err != nil {
+		return BulkResult{}, err
+	}
+	return result, syncErr
+}
+
+// bulkWriteLocked exécute le lot une fois ses documents verrouillés ;
+// inserted et idErrs donnent l'ID choisi pour chaque insertion. L'appelant
+// détient c.mu en écriture.
+func (c *Collection) bulkWriteLocked(ops []WriteOp, ordered bool, inserted []insertID, idErrs []error) (BulkResult, error) {
+	// Une transaction voit le lot entier ou rien
+	defer c.db.stampWrites([]*Collection{c})()
+
+	batch := newIndexBatch()
+	result := BulkResult{Results: make([]WriteResult, 0, len(ops))}
+	for i, op := range ops {
+		docID, modified, err := c.bulkApply(batch, op, inserted[i].docID, idErrs[i])
+		if err != nil {
+			result.Failed++
+			result.Results = append(result.Results, WriteResult{ID: docID, Error: err.Error(), err: err})
+			if ordered {
+				break
+			}
+			continue
+		}
+
+		switch {
+		case op.Op == "insert":
+			result.Inserted++
+		case op.Op == "delete":
+			result.Deleted++
+		case modified:
+			result.Modified++
+		}
+		result.Results = append(result.Results, WriteResult{ID: docID})
+	}
+
+	batch.apply(c.indexes)
+	if c.syncWrites() && len(batch.docIDs) > 0 {
+		if err := c.storage.Sync(batch.docIDs); err != nil {
+			return result, fmt.Errorf("erreur synchronisation du lot: %v", err)
+		}
+	}
+	return result, nil
+}
+
+// bulkApply exécute une opération d'un lot et retourne l'ID du document et
+// s'il a changé ; une insertion se fait sous insertID, l'ID choisi (ou
+// l'erreur idErr). L'appelant détient c.mu en écriture.
+func (c *Collection) bulkApply(batch *indexBatch, op WriteOp, insertID string, idErr error) (string, bool, error) {
+	switch op.Op {
+	case "insert":
+		if op.Document == nil {
+			return "", false, fmt.Errorf("%w: document manquant", ErrInvalidWriteOp)
+		}
+		if idErr != nil {
+			return "", false, idErr
+		}
+		docID := insertID
+		if c.documentExists(docID) {
+			return "", false, fmt.Errorf("%w: %s", ErrDuplicateID, docID)
+		}
+		if err := c.bulkPut(batch, docID, nil, withDocumentID(docID, op.Document)); err != nil {
+			return "", false, err
+		}
+		return docID, true, nil
+
+	case "update":
+		if op.ID == "" || (op.Document == nil) == (op.Update == nil) {
+			return op.ID, false, fmt.Errorf("%w: update attend id et soit document, soit update", ErrInvalidWriteOp)
+		}
+		if err := validateDocumentID(op.ID); err != nil {
+			return op.ID, false, err
+		}
+		oldDoc := c.readCurrent(op.ID)
+		doc := op.Document
+		if op.Update != nil {
+			compiled, err := compileUpdate(op.Update)
+			if err != nil {
+				return op.ID, false, err
+			}
+			// Les opérateurs ne s'appliquent qu'à un document existant
+			if oldDoc, err = c.readDocument(op.ID); err != nil {
+				return op.ID, false, err
+			}
+			if doc, err = compiled.apply(oldDoc); err != nil {
+				return op.ID, false, err
+			}
+		} else if err := checkDocumentID(op.ID, doc); err != nil {
+			return op.ID, false, err
+		}
+		doc = withDocumentID(op.ID, doc)
+		if sameDocument(oldDoc, doc) {
+			return op.ID, false, nil
+		}
+		return op.ID, true, c.bulkPut(batch, op.ID, oldDoc, doc)
+
+	case "delete":
+		if op.ID == "" {
+			return "", false, fmt.Errorf("%w: id manquant", ErrInvalidWriteOp)
+		}
+		if err := validateDocumentID(op.ID); err != nil {
+			return op.ID, false, err
+		}
+		oldDoc, err := c.readDocument(op.ID)
+		if err != nil {
+			return op.ID, false, err
+		}
+		if err := c.deleteDocument(op.ID, false); err != nil {
+			return op.ID, false, err
+		}
+		batch.record(c.indexes, op.ID, oldDoc, nil)
+		return op.ID, true, nil
+	}
+	return op.ID, false, fmt.Errorf("%w: opération %q inconnue (insert, update ou delete)", ErrInvalidWriteOp, op.Op)
+}
+
+// bulkPut écrit doc sans fsync et enregistre ses modifications d'index
+// dans le lot ; l'appelant détient c.mu en écriture
+func (c *Collection) bulkPut(batch *indexBatch, docID string, oldDoc, doc Document) error {
+	if err := batch.checkUnique(c.indexes, docID, doc); err != nil {
+		return err
+	}
+	if err := c.writeDocument(docID, doc, false); err != nil {
+		return err
+	}
+	batch.record(c.indexes, docID, oldDoc, doc)
+	return nil
+}
+
+// indexBatch accumule les modifications d'index d'un lot d'écritures pour
+// les appliquer en fin de lot, une fois par index. En attendant, l'unicité
+// est vérifiée contre les index et les clés prises ou libérées par le lot.
+type indexBatch struct {
+	changes []indexChange
+	docIDs  []string
+	// claimed associe les clés uniques prises dans le lot à leur document
+	claimed map[*Index]map[interface{}]string
+	// released liste les couples clé unique/document retirés dans le lot
+	released map[*Index]map[interface{}]map[string]bool
+}
+
+// indexChange remplace oldDoc par doc (nil pour une insertion ou une
+// suppression) dans les index
+type indexChange struct {
+	docID       string
+	oldDoc, doc map[string]interface{}
+}
+
+func newIndexBatch() *indexBatch {
+	return &indexBatch{
+		claimed:  make(map[*Index]map[interface{}]string),
+		released: make(map[*Index]map[interface{}]map[string]bool),
+	}
+}
+
+// checkUnique vérifie que doc ne viole aucun index unique, compte tenu des
+// écritures déjà faites dans le lot
+func (b *indexBatch) checkUnique(indexes map[string]*Index, docID string, doc map[string]interface{}) error {
+	for _, index := range indexes {
+		if !index.unique {
+			continue
+		}
+		for _, key := range index.uniqueKeys(doc) {
+			if owner, claimed := b.claimed[index][key]; claimed {
+				if owner == docID {
+					continue
+				}
+			} else if !b.taken(index, key, docID) {
+				continue
+			}
+			if index.compound() {
+				return fmt.Errorf("valeurs des champs %s déjà utilisées (index unique %s)", index.fieldPaths(), index.name)
+			}
+			return fmt.Errorf("valeur '%v' du champ '%s' déjà utilisée (index unique)", key, index.fields[0].Path)
+		}
+	}
+	return nil
+}
+
+// taken indique si key est indexée pour un autre document que docID et
+// n'a pas été libérée dans le lot
+func (b *indexBatch) taken(index *Index, key interface{}, docID string) bool {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+	for _, id := range index.store.lookup(key) {
+		if id != docID && !b.released[index][key][id] {
+			return true
+		}
+	}
+	return false
+}
+
+// record enregistre le remplacement de oldDoc par doc pour docID
+func (b *indexBatch) record(indexes map[string]*Index, docID string, oldDoc, doc map[string]interface{}) {
+	b.changes = append(b.changes, indexChange{docID: docID, oldDoc: oldDoc, doc: doc})
+	b.docIDs = append(b.docIDs, docID)
+
+	for _, index := range indexes {
+		if !index.unique {
+			continue
+		}
+		for _, key := range index.uniqueKeys(oldDoc) {
+			if b.claimed[index][key] == docID {
+				delete(b.claimed[index], key)
+			}
+			if b.released[index] == nil {
+				b.released[index] = make(map[interface{}]map[string]bool)
+			}
+			if b.released[index][key] == nil {
+				b.released[index][key] = make(map[string]bool)
+			}
+			b.released[index][key][docID] = true
+		}
+		for _, key := range index.uniqueKeys(doc) {
+			if b.claimed[index] == nil {
+				b.claimed[index] = make(map[interface{}]string)
+			}
+			b.claimed[index][key] = docID
+			delete(b.released[index][key], docID)
+		}
+	}
+}
+
+// apply reporte les modifications du lot dans les index, dans l'ordre des
+// écritures, en prenant le verrou de chaque index une seule fois
+func (b *indexBatch) apply(indexes map[string]*Index) {
+	if len(b.changes) == 0 {
+		return
+	}
+	for _, index := range indexes {
+		index.mu.Lock()
+		for _, change := range b.changes {
+			if change.oldDoc != nil {
+				index.removeDocument(change.docID, change.oldDoc)
+			}
+			if change.doc != nil {
+				index.addDocument(change.docID, change.doc)
+			}
+		}
+		index.mu.Unlock()
+	}
+}
@@ -0,0 +1,134 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// bulkTestOps est un lot dont la troisième opération échoue : l'e-mail
+// inséré est déjà pris par la première, dans le même lot
+func bulkTestOps() []WriteOp {
+	return []WriteOp{
+		{Op: "insert", Document: Document{"_id": "c", "email": "c@example.com"}},
+		{Op: "update", ID: "a", Update: Update{"$set": map[string]interface{}{"email": "a2@example.com"}}},
+		{Op: "insert", Document: Document{"email": "c@example.com"}},
+		{Op: "delete", ID: "b"},
+		{Op: "update", ID: "d", Document: Document{"email": "d@example.com"}},
+	}
+}
+
+// bulkTestCollection crée des utilisateurs a et b, avec un index unique
+// sur email
+func bulkTestCollection(t *testing.T) *Collection {
+	t.Helper()
+	c := createTestCollection(t, openTestDatabase(t), "users")
+	if err := c.CreateIndex("email", true); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	mustInsert(t, c, Document{"_id": "a", "email": "a@example.com"})
+	mustInsert(t, c, Document{"_id": "b", "email": "b@example.com"})
+	return c
+}
+
+// TestBulkWriteUnordered vérifie qu'un lot non ordonné poursuit après une
+// opération en échec et tient les index à jour
+func TestBulkWriteUnordered(t *testing.T) {
+	c := bulkTestCollection(t)
+	result, err := c.BulkWrite(bulkTestOps(), false)
+	if err != nil {
+		t.Fatalf("BulkWrite: %v", err)
+	}
+	// Le remplacement de d, absent, le crée
+	if result.Inserted != 1 || result.Modified != 2 || result.Deleted != 1 || result.Failed != 1 {
+		t.Fatalf("résultat = %+v, attendu 1 inséré, 2 modifiés, 1 supprimé, 1 en échec", result)
+	}
+	if len(result.Results) != 5 || result.Results[2].Err() == nil || result.Results[4].ID != "d" {
+		t.Fatalf("résultats = %+v", result.Results)
+	}
+
+	for email, want := range map[string]int{"a@example.com": 0, "a2@example.com": 1, "b@example.com": 0, "c@example.com": 1, "d@example.com": 1} {
+		if docs, _ := c.FindByIndex("email", email); len(docs) != want {
+			t.Errorf("index: %d documents pour %s, attendu %d", len(docs), email, want)
+		}
+	}
+}
+
+// TestBulkWriteOrdered vérifie qu'un lot ordonné s'arrête à la première
+// opération en échec sans annuler les précédentes
+func TestBulkWriteOrdered(t *testing.T) {
+	c := bulkTestCollection(t)
+	result, err := c.BulkWrite(bulkTestOps(), true)
+	if err != nil {
+		t.Fatalf("BulkWrite: %v", err)
+	}
+	if result.Inserted != 1 || result.Modified != 1 || result.Failed != 1 || len(result.Results) != 3 {
+		t.Fatalf("résultat = %+v, attendu l'arrêt à la troisième opération", result)
+	}
+	if _, err := c.FindByID("b"); err != nil {
+		t.Fatalf("b supprimé après l'arrêt du lot: %v", err)
+	}
+	if doc := mustGet(t, c, "a"); doc["email"] != "a2@example.com" {
+		t.Fatalf("a = %v, attendu la mise à jour gardée", doc)
+	}
+}
+
+// TestBulkWriteInvalidOp vérifie qu'une opération mal formée échoue seule,
+// avec ErrInvalidWriteOp
+func TestBulkWriteInvalidOp(t *testing.T) {
+	c := bulkTestCollection(t)
+	result, err := c.BulkWrite([]WriteOp{
+		{Op: "upsert", ID: "a"},
+		{Op: "delete"},
+		{Op: "update", ID: "a", Document: Document{"email": "x@example.com"}, Update: Update{"$set": map[string]interface{}{"n": 1}}},
+		{Op: "delete", ID: "b"},
+	}, false)
+	if err != nil {
+		t.Fatalf("BulkWrite: %v", err)
+	}
+	for i, write := range result.Results[:3] {
+		if !errors.Is(write.Err(), ErrInvalidWriteOp) {
+			t.Errorf("opération %d: %v, attendu ErrInvalidWriteOp", i, write.Err())
+		}
+	}
+	if result.Deleted != 1 || result.Failed != 3 {
+		t.Fatalf("résultat = %+v, attendu 3 en échec et 1 supprimé", result)
+	}
+}
+
+// TestBulkWriteInvalidID vérifie qu'un ID de mise à jour ou de suppression
+// invalide fait échouer sa seule opération, sans rien écrire hors de la
+// collection
+func TestBulkWriteInvalidID(t *testing.T) {
+	c := bulkTestCollection(t)
+	result, err := c.BulkWrite([]WriteOp{
+		{Op: "update", ID: "../escaped", Document: Document{"email": "x@example.com"}},
+		{Op: "update", ID: "../../escaped", Update: Update{"$set": map[string]interface{}{"n": 1}}},
+		{Op: "delete", ID: "../users/a"},
+		{Op: "update", ID: ".a.json.tmp-1", Document: Document{"email": "y@example.com"}},
+		{Op: "delete", ID: "b"},
+	}, false)
+	if err != nil {
+		t.Fatalf("BulkWrite: %v", err)
+	}
+	for i, write := range result.Results[:4] {
+		if !errors.Is(write.Err(), ErrInvalidID) {
+			t.Errorf("opération %d: %v, attendu ErrInvalidID", i, write.Err())
+		}
+	}
+	if result.Deleted != 1 || result.Failed != 4 {
+		t.Fatalf("résultat = %+v, attendu 4 en échec et 1 supprimé", result)
+	}
+
+	mustGet(t, c, "a")
+	root := filepath.Dir(filepath.Dir(c.path))
+	for _, name := range []string{filepath.Join(filepath.Dir(c.path), "escaped.json"), filepath.Join(root, "escaped.json")} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s écrit hors de la collection", name)
+		}
+	}
+	if docs, _ := c.GetAllDocuments(); len(docs) != 1 {
+		t.Fatalf("documents = %v, attendu a seul", docs)
+	}
+}
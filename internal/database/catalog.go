@@ -0,0 +1,335 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrCollectionInUse signale une collection qu'une transaction active
+// utilise encore
+var ErrCollectionInUse = errors.New("collection utilisée")
+
+const (
+	// catalogFileName est le fichier du catalogue à la racine de la base
+	catalogFileName = "catalog.json"
+	catalogVersion  = 1
+)
+
+// CollectionInfo décrit une collection enregistrée dans le catalogue
+type CollectionInfo struct {
+	Name      string            `json:"name"`
+	Options   CollectionOptions `json:"options"`
+	Indexes   []IndexDefinition `json:"indexes"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// catalogFile est le format sur disque du catalogue
+type catalogFile struct {
+	Version     int              `json:"version"`
+	Collections []CollectionInfo `json:"collections"`
+}
+
+// validCollectionName indique si name peut nommer une collection : son
+// répertoire doit rester directement sous la racine de la base, sans
+// masquer le WAL ni le catalogue
+func validCollectionName(name string) bool {
+	return name != "" && name != "wal" && !strings.ContainsAny(name, `/\.`)
+}
+
+// catalogPath retourne le chemin du catalogue
+func (db *Database) catalogPath() string {
+	return filepath.Join(db.path, catalogFileName)
+}
+
+// loadCatalog lit le catalogue ; une base sans catalogue démarre vide
+func (db *Database) loadCatalog() error {
+	data, err := os.ReadFile(db.catalogPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var file catalogFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("catalogue illisible: %v", err)
+	}
+	if file.Version > catalogVersion {
+		return fmt.Errorf("version du catalogue non supportée: %d", file.Version)
+	}
+
+	for i := range file.Collections {
+		info := file.Collections[i]
+		db.catalog[info.Name] = &info
+	}
+	return nil
+}
+
+// saveCatalog écrit le catalogue sur disque ; l'appelant détient db.catalogMu
+func (db *Database) saveCatalog() error {
+	file := catalogFile{Version: catalogVersion}
+	for _, info := range db.catalog {
+		file.Collections = append(file.Collections, *info)
+	}
+	sort.Slice(file.Collections, func(i, j int) bool {
+		return file.Collections[i].Name < file.Collections[j].Name
+	})
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(db.catalogPath(), data, true)
+}
+
+// openCatalogCollections ouvre toutes les collections du catalogue avec
+// leurs index
+func (db *Database) openCatalogCollections() error {
+	db.catalogMu.Lock()
+	defer db.catalogMu.Unlock()
+
+	changed := false
+	for name, info := range db.catalog {
+		collection, err := db.openCollection(name, info.Options)
+		if err != nil {
+			return fmt.Errorf("erreur ouverture collection %s: %v", name, err)
+		}
+		if err := collection.ensureIndexes(info.Indexes); err != nil {
+			collection.storage.Close()
+			return fmt.Errorf("erreur création index collection %s: %v", name, err)
+		}
+
+		// Les index persistés absents du catalogue y sont ajoutés
+		definitions := collection.Indexes()
+		if len(definitions) != len(info.Indexes) {
+			info.Indexes = definitions
+			changed = true
+		}
+		db.collections[name] = collection
+	}
+
+	if changed {
+		return db.saveCatalog()
+	}
+	return nil
+}
+
+// registerCollection ajoute une collection au catalogue
+func (db *Database) registerCollection(collection *Collection) error {
+	db.catalogMu.Lock()
+	defer db.catalogMu.Unlock()
+
+	db.catalog[collection.name] = &CollectionInfo{
+		Name:      collection.name,
+		Options:   collection.options,
+		Indexes:   collection.Indexes(),
+		CreatedAt: time.Now().UTC(),
+	}
+	return db.saveCatalog()
+}
+
+// setCatalogIndexes enregistre les définitions d'index d'une collection
+// du catalogue ; les collections hors catalogue sont ignorées
+func (db *Database) setCatalogIndexes(name string, definitions []IndexDefinition) error {
+	db.catalogMu.Lock()
+	defer db.catalogMu.Unlock()
+
+	info, exists := db.catalog[name]
+	if !exists {
+		return nil
+	}
+	info.Indexes = definitions
+	return db.saveCatalog()
+}
+
+// ListCollections retourne les collections du catalogue, triées par nom
+func (db *Database) ListCollections() []CollectionInfo {
+	db.catalogMu.Lock()
+	defer db.catalogMu.Unlock()
+
+	collections := make([]CollectionInfo, 0, len(db.catalog))
+	for _, info := range db.catalog {
+		collection := *info
+		collection.Indexes = append([]IndexDefinition(nil), info.Indexes...)
+		collections = append(collections, collection)
+	}
+	sort.Slice(collections, func(i, j int) bool {
+		return collections[i].Name < collections[j].Name
+	})
+	return collections
+}
+
+// DropCollection supprime une collection, ses documents et ses index.
+// Elle échoue avec ErrCollectionInUse si une transaction active y a écrit
+// ou lu ; sinon elle attend, sous le verrou exclusif de la collection, la
+// fin des transactions et écritures qui y détiennent des verrous.
+func (db *Database) DropCollection(name string) error {
+	collection, err := db.GetCollection(name)
+	if err != nil {
+		return fmt.Errorf("collection %s not found", name)
+	}
+	if txID, used := db.txManager.usingCollection(name); used {
+		return fmt.Errorf("%w: %s, par la transaction %s", ErrCollectionInUse, name, txID)
+	}
+
+	// Le verrou est pris hors de db.mu : son attente peut durer jusqu'à la
+	// fin d'une transaction, qui a besoin de db.mu pour valider
+	owner := db.locks().newOwner("suppression de la collection " + name)
+	defer db.locks().release(owner)
+	if err := db.locks().lock(owner, lockResource{collection: name}, LockExclusive); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrCollectionInUse, name, err)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// La collection a pu être renommée ou supprimée pendant l'attente
+	if db.collections[name] != collection {
+		return fmt.Errorf("collection %s not found", name)
+	}
+
+	// Retirer la collection du catalogue d'abord : après un arrêt brutal,
+	// un répertoire orphelin est préférable à une entrée sans données
+	db.catalogMu.Lock()
+	delete(db.catalog, name)
+	err = db.saveCatalog()
+	db.catalogMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("erreur mise à jour catalogue: %v", err)
+	}
+	delete(db.collections, name)
+
+	collection.mu.Lock()
+	defer collection.mu.Unlock()
+	collection.storage.Close()
+	collection.indexes = make(map[string]*Index)
+	if err := os.RemoveAll(collection.path); err != nil {
+		return fmt.Errorf("erreur suppression répertoire collection: %v", err)
+	}
+	return nil
+}
+
+// RenameCollection renomme une collection. L'objet *Collection existant
+// reste valide et pointe sur le nouveau nom. Comme DropCollection, elle
+// échoue avec ErrCollectionInUse si une transaction active utilise la
+// collection, et attend sous son verrou exclusif la fin des verrous pris
+// sous l'ancien nom, qui ne protégeraient plus rien après le renommage.
+func (db *Database) RenameCollection(oldName, newName string) error {
+	collection, err := db.GetCollection(oldName)
+	if err != nil {
+		return fmt.Errorf("collection %s not found", oldName)
+	}
+	if txID, used := db.txManager.usingCollection(oldName); used {
+		return fmt.Errorf("%w: %s, par la transaction %s", ErrCollectionInUse, oldName, txID)
+	}
+
+	// Le verrou est pris hors de db.mu, comme dans DropCollection
+	owner := db.locks().newOwner("renommage de la collection " + oldName)
+	defer db.locks().release(owner)
+	if err := db.locks().lock(owner, lockResource{collection: oldName}, LockExclusive); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrCollectionInUse, oldName, err)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// La collection a pu être renommée ou supprimée pendant l'attente
+	if db.collections[oldName] != collection {
+		return fmt.Errorf("collection %s not found", oldName)
+	}
+	if !validCollectionName(newName) {
+		return fmt.Errorf("nom de collection invalide: %q", newName)
+	}
+	if _, exists := db.collections[newName]; exists {
+		return fmt.Errorf("collection %s existe déjà", newName)
+	}
+	newPath := filepath.Join(db.path, newName)
+	if _, err := os.Stat(newPath); err == nil {
+		return fmt.Errorf("le répertoire %s existe déjà", newPath)
+	}
+
+	collection.mu.Lock()
+	defer collection.mu.Unlock()
+
+	// Les index sont persistés avant le déplacement pour être rechargés tels quels
+	if err := collection.saveIndexes(); err != nil {
+		return err
+	}
+	if err := collection.storage.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(collection.path, newPath); err != nil {
+		// Rouvrir le stockage à son emplacement d'origine
+		if storage, openErr := openStorage(collection.path, collection.options.Storage); openErr == nil {
+			collection.storage = storage
+		}
+		return fmt.Errorf("erreur renommage répertoire collection: %v", err)
+	}
+
+	// Passé ce point, un échec remet le répertoire à sa place et rouvre
+	// le stockage : la collection reste utilisable sous son ancien nom
+	restore := func(err error) error {
+		if renameErr := os.Rename(newPath, collection.path); renameErr != nil {
+			return fmt.Errorf("%v (restauration du répertoire impossible: %v)", err, renameErr)
+		}
+		if syncErr := syncDir(db.path); syncErr != nil {
+			fmt.Printf("Avertissement: synchronisation de %s impossible: %v\n", db.path, syncErr)
+		}
+		storage, openErr := openStorage(collection.path, collection.options.Storage)
+		if openErr != nil {
+			return fmt.Errorf("%v (réouverture du stockage impossible: %v)", err, openErr)
+		}
+		collection.storage = storage
+		return err
+	}
+
+	if err := syncDir(db.path); err != nil {
+		return restore(err)
+	}
+	storage, err := openStorage(newPath, collection.options.Storage)
+	if err != nil {
+		return restore(fmt.Errorf("erreur ouverture stockage collection: %v", err))
+	}
+
+	db.catalogMu.Lock()
+	defer db.catalogMu.Unlock()
+	if info, exists := db.catalog[oldName]; exists {
+		delete(db.catalog, oldName)
+		info.Name = newName
+		db.catalog[newName] = info
+		if err := db.saveCatalog(); err != nil {
+			delete(db.catalog, newName)
+			info.Name = oldName
+			db.catalog[oldName] = info
+			// Le catalogue a pu être écrit avant l'échec : le réécrire
+			// sous l'ancien nom, que le répertoire va retrouver
+			if saveErr := db.saveCatalog(); saveErr != nil {
+				fmt.Printf("Avertissement: restauration du catalogue impossible: %v\n", saveErr)
+			}
+			storage.Close()
+			return restore(fmt.Errorf("erreur mise à jour catalogue: %v", err))
+		}
+	}
+
+	collection.storage = storage
+	collection.name = newName
+	collection.path = newPath
+	delete(db.collections, oldName)
+	db.collections[newName] = collection
+	return nil
+}
+
+// currentName retourne le nom de la collection, que RenameCollection
+// change sous c.mu ; l'appelant ne détient pas c.mu
+func (c *Collection) currentName() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.name
+}
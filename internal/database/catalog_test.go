@@ -0,0 +1,303 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestCatalogSurvivesRestart vérifie que les collections, leurs options et
+// leurs index sont rouverts sans fichier de configuration
+func TestCatalogSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.CreateCollectionWithOptions("items", CollectionOptions{Storage: StorageLog})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateIndex("sku", true); err != nil {
+		t.Fatal(err)
+	}
+	mustInsert(t, c, Document{"sku": "a"})
+	db.Close()
+
+	db, err = NewDatabase(dir)
+	if err != nil {
+		t.Fatalf("réouverture: %v", err)
+	}
+	defer db.Close()
+	c, err = db.GetCollection("items")
+	if err != nil {
+		t.Fatalf("collection perdue au redémarrage: %v", err)
+	}
+	if c.Options().Storage != StorageLog {
+		t.Fatalf("stockage = %s, attendu log", c.Options().Storage)
+	}
+	if docs, err := c.FindByField("sku", "a"); err != nil || len(docs) != 1 {
+		t.Fatalf("FindByField = %v (%v), attendu un document", docs, err)
+	}
+	if _, err := c.Insert(Document{"sku": "a"}); err == nil {
+		t.Fatal("index unique perdu au redémarrage")
+	}
+}
+
+// TestRenameCollection vérifie le renommage, persistant, et le refus des
+// noms qui sortiraient de la racine de la base
+func TestRenameCollection(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := createTestCollection(t, db, "a")
+	docID := mustInsert(t, c, Document{"n": 1})
+
+	for _, name := range []string{"", "wal", "../x", "b/c", `b\c`, "catalog.json"} {
+		if err := db.RenameCollection("a", name); err == nil {
+			t.Errorf("RenameCollection(a, %q) accepté", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "x")); err == nil {
+		t.Fatal("collection déplacée hors de la base")
+	}
+
+	if err := db.RenameCollection("a", "b"); err != nil {
+		t.Fatalf("RenameCollection: %v", err)
+	}
+	db.Close()
+
+	db, err = NewDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.GetCollection("a"); err == nil {
+		t.Fatal("l'ancien nom existe encore")
+	}
+	b, err := db.GetCollection("b")
+	if err != nil {
+		t.Fatalf("collection renommée perdue: %v", err)
+	}
+	mustGet(t, b, docID)
+}
+
+// TestRenameCollectionRestoresOnFailure vérifie qu'un catalogue
+// impossible à écrire laisse la collection à sa place, utilisable
+func TestRenameCollectionRestoresOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDatabaseAt(t, dir)
+	c := createTestCollection(t, db, "a")
+	docID := mustInsert(t, c, Document{"n": 1})
+
+	// Un répertoire non vide ne peut être remplacé par le catalogue
+	catalog := filepath.Join(dir, catalogFileName)
+	if err := os.Remove(catalog); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(catalog, "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.RenameCollection("a", "b"); err == nil {
+		t.Fatal("RenameCollection a réussi sans catalogue")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b")); !os.IsNotExist(err) {
+		t.Fatalf("répertoire b: %v, attendu absent", err)
+	}
+	if got, err := db.GetCollection("a"); err != nil || got != c {
+		t.Fatalf("GetCollection(a) = %v, %v", got, err)
+	}
+	mustGet(t, c, docID)
+	mustInsert(t, c, Document{"n": 2})
+}
+
+// TestDropCollection vérifie que la suppression retire données et entrée
+// du catalogue
+func TestDropCollection(t *testing.T) {
+	db := openTestDatabase(t)
+	c := createTestCollection(t, db, "items")
+	docID := mustInsert(t, c, Document{"n": 1})
+
+	if err := db.DropCollection("items"); err != nil {
+		t.Fatalf("DropCollection: %v", err)
+	}
+	if len(db.ListCollections()) != 0 {
+		t.Fatalf("catalogue = %v, attendu vide", db.ListCollections())
+	}
+	c = createTestCollection(t, db, "items")
+	if _, err := c.FindByID(docID); !os.IsNotExist(err) {
+		t.Fatalf("FindByID après suppression: %v, attendu absent", err)
+	}
+}
+
+// TestDropCollectionInUse vérifie qu'une collection utilisée par une
+// transaction active n'est pas supprimée
+func TestDropCollectionInUse(t *testing.T) {
+	db := openTestDatabase(t)
+	createTestCollection(t, db, "items")
+	db.SetLockTimeout(50 * time.Millisecond)
+
+	tx := db.BeginTransaction()
+	if _, err := db.InsertWithTransaction(tx, "items", Document{"n": 1}); err != nil {
+		t.Fatalf("InsertWithTransaction: %v", err)
+	}
+	if err := db.DropCollection("items"); !errors.Is(err, ErrCollectionInUse) {
+		t.Fatalf("DropCollection = %v, attendu ErrCollectionInUse", err)
+	}
+	if err := db.Rollback(tx); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+
+	// Un verrou de collection sans écriture fait attendre la suppression
+	tx = db.BeginTransaction()
+	if err := db.LockCollection(tx, "items", LockShared); err != nil {
+		t.Fatalf("LockCollection: %v", err)
+	}
+	if err := db.DropCollection("items"); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("DropCollection = %v, attendu ErrLockTimeout", err)
+	}
+	if err := db.Commit(tx); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if err := db.DropCollection("items"); err != nil {
+		t.Fatalf("DropCollection après la transaction: %v", err)
+	}
+}
+
+// TestRenameCollectionInUse vérifie qu'une collection dans laquelle une
+// transaction active a écrit n'est pas renommée
+func TestRenameCollectionInUse(t *testing.T) {
+	db := openTestDatabase(t)
+	c := createTestCollection(t, db, "books")
+	docID := mustInsert(t, c, Document{"n": 1})
+
+	tx := db.BeginTransaction()
+	if err := db.UpdateWithTransaction(tx, "books", docID, Document{"n": 2}); err != nil {
+		t.Fatalf("UpdateWithTransaction: %v", err)
+	}
+	if err := db.RenameCollection("books", "novels"); !errors.Is(err, ErrCollectionInUse) {
+		t.Fatalf("RenameCollection = %v, attendu ErrCollectionInUse", err)
+	}
+	if err := db.Commit(tx); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	if err := db.RenameCollection("books", "novels"); err != nil {
+		t.Fatalf("RenameCollection après la transaction: %v", err)
+	}
+	if doc := mustGet(t, c, docID); doc["n"] != float64(2) {
+		t.Fatalf("document = %v, attendu l'écriture validée", doc)
+	}
+}
+
+// TestRenameCollectionKeepsLocks vérifie qu'un renommage ne fait pas
+// perdre les verrous qu'une transaction détient sous l'ancien nom
+func TestRenameCollectionKeepsLocks(t *testing.T) {
+	db := openTestDatabase(t)
+	c := createTestCollection(t, db, "books")
+	docID := mustInsert(t, c, Document{"n": 1})
+	db.SetLockTimeout(50 * time.Millisecond)
+
+	tx := db.BeginTransaction()
+	if err := db.LockDocument(tx, "books", docID, LockExclusive); err != nil {
+		t.Fatalf("LockDocument: %v", err)
+	}
+	if err := db.RenameCollection("books", "novels"); !errors.Is(err, ErrCollectionInUse) {
+		t.Fatalf("RenameCollection = %v, attendu ErrCollectionInUse", err)
+	}
+	if err := c.Update(docID, Document{"n": 2}); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("Update = %v, attendu ErrLockTimeout", err)
+	}
+	if err := db.Rollback(tx); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+
+	if err := db.RenameCollection("books", "novels"); err != nil {
+		t.Fatalf("RenameCollection: %v", err)
+	}
+	tx = db.BeginTransaction()
+	defer db.Rollback(tx)
+	if err := db.LockCollection(tx, "novels", LockExclusive); err != nil {
+		t.Fatalf("LockCollection: %v", err)
+	}
+	if err := c.Update(docID, Document{"n": 3}); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("Update = %v, attendu ErrLockTimeout sous le nouveau nom", err)
+	}
+}
+
+// insertDuring exécute change pendant que 8 goroutines insèrent chacune 25
+// documents dans c, et échoue au lieu de rester bloqué si les deux sont en
+// interblocage ; les erreurs d'insertion sont ignorées si ignoreErrors
+func insertDuring(t *testing.T, c *Collection, ignoreErrors bool, change func() error) {
+	t.Helper()
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				if _, err := c.Insert(Document{"worker": w, "n": i}); err != nil && !ignoreErrors {
+					t.Errorf("Insert: %v", err)
+				}
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := change(); err != nil {
+			t.Errorf("changement du catalogue: %v", err)
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("interblocage entre les insertions et le catalogue")
+	}
+}
+
+// TestRenameDuringWrites vérifie que renommer une collection pendant des
+// insertions ne provoque ni interblocage ni perte de document
+func TestRenameDuringWrites(t *testing.T) {
+	db := openTestDatabase(t)
+	c := createTestCollection(t, db, "items")
+
+	names := []string{"items", "renamed"}
+	insertDuring(t, c, false, func() error {
+		for i := 0; i < 20; i++ {
+			if err := db.RenameCollection(names[i%2], names[(i+1)%2]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if docs, err := c.GetAllDocuments(); err != nil || len(docs) != 8*25 {
+		t.Fatalf("%d documents (%v), attendu %d", len(docs), err, 8*25)
+	}
+}
+
+// TestDropDuringWrites vérifie que supprimer une collection pendant des
+// insertions ne provoque pas d'interblocage ; les insertions suivantes
+// peuvent échouer
+func TestDropDuringWrites(t *testing.T) {
+	db := openTestDatabase(t)
+	c := createTestCollection(t, db, "items")
+
+	insertDuring(t, c, true, func() error {
+		time.Sleep(time.Millisecond)
+		return db.DropCollection("items")
+	})
+}
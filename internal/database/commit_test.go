@@ -0,0 +1,185 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+)
+
+// commitTestCollection crée des utilisateurs a et b, avec un index unique
+// sur email
+func commitTestCollection(t *testing.T, db *Database) *Collection {
+	t.Helper()
+	c := createTestCollection(t, db, "users")
+	if err := c.CreateIndex("email", true); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	mustInsert(t, c, Document{"_id": "a", "email": "a@example.com"})
+	mustInsert(t, c, Document{"_id": "b", "email": "b@example.com"})
+	return c
+}
+
+// checkCommitTestState vérifie que la collection et son index sont restés
+// dans l'état de commitTestCollection
+func checkCommitTestState(t *testing.T, c *Collection) {
+	t.Helper()
+	if doc := mustGet(t, c, "a"); doc["email"] != "a@example.com" {
+		t.Errorf("a = %v, attendu inchangé", doc)
+	}
+	mustGet(t, c, "b")
+	if _, err := c.FindByID("c"); !os.IsNotExist(err) {
+		t.Errorf("c: %v, attendu absent", err)
+	}
+	for email, want := range map[string]int{"a@example.com": 1, "a2@example.com": 0, "b@example.com": 1, "c@example.com": 0} {
+		if docs, _ := c.FindByIndex("email", email); len(docs) != want {
+			t.Errorf("index: %d documents pour %s, attendu %d", len(docs), email, want)
+		}
+	}
+}
+
+// TestCommitAllOrNothing vérifie qu'une entrée invalide, même la dernière,
+// fait échouer la validation sans qu'aucune entrée ne soit appliquée
+func TestCommitAllOrNothing(t *testing.T) {
+	failures := map[string]func(db *Database, tx *Transaction) error{
+		"index unique": func(db *Database, tx *Transaction) error {
+			_, err := db.InsertWithTransaction(tx, "users", Document{"_id": "d", "email": "c@example.com"})
+			return err
+		},
+		// Entrées du log que les écritures transactionnelles auraient
+		// refusées : seule la validation les arrête
+		"document absent": func(db *Database, tx *Transaction) error {
+			tx.AddLogEntry(LogEntry{Operation: OpDelete, Collection: "users", DocumentID: "missing"})
+			return nil
+		},
+		"ID déjà utilisé": func(db *Database, tx *Transaction) error {
+			tx.AddLogEntry(LogEntry{Operation: OpInsert, Collection: "users", DocumentID: "c", Data: Document{"email": "d@example.com"}})
+			return nil
+		},
+	}
+	for name, fail := range failures {
+		t.Run(name, func(t *testing.T) {
+			db := openTestDatabase(t)
+			c := commitTestCollection(t, db)
+
+			tx := db.BeginTransaction()
+			if _, err := db.InsertWithTransaction(tx, "users", Document{"_id": "c", "email": "c@example.com"}); err != nil {
+				t.Fatalf("InsertWithTransaction: %v", err)
+			}
+			if err := db.UpdateWithTransaction(tx, "users", "a", Document{"email": "a2@example.com"}); err != nil {
+				t.Fatalf("UpdateWithTransaction: %v", err)
+			}
+			if err := db.DeleteWithTransaction(tx, "users", "b"); err != nil {
+				t.Fatalf("DeleteWithTransaction: %v", err)
+			}
+			if err := fail(db, tx); err != nil {
+				t.Fatalf("écriture: %v", err)
+			}
+
+			if err := db.Commit(tx); err == nil {
+				t.Fatal("Commit réussi, attendu un échec")
+			}
+			if tx.State != TransactionAborted {
+				t.Fatalf("état = %v, attendu annulée", tx.State)
+			}
+			checkCommitTestState(t, c)
+		})
+	}
+}
+
+// TestUndoLogEntries vérifie que des entrées appliquées sont défaites, avec
+// les index, comme après l'échec du marqueur de validation
+func TestUndoLogEntries(t *testing.T) {
+	db := openTestDatabase(t)
+	c := commitTestCollection(t, db)
+
+	tx := db.BeginTransaction()
+	defer db.Rollback(tx)
+	if _, err := db.InsertWithTransaction(tx, "users", Document{"_id": "c", "email": "c@example.com"}); err != nil {
+		t.Fatalf("InsertWithTransaction: %v", err)
+	}
+	if err := db.ModifyWithTransaction(tx, "users", "a", Update{"$set": map[string]interface{}{"email": "a2@example.com"}}); err != nil {
+		t.Fatalf("ModifyWithTransaction: %v", err)
+	}
+	if err := db.DeleteWithTransaction(tx, "users", "b"); err != nil {
+		t.Fatalf("DeleteWithTransaction: %v", err)
+	}
+
+	errUndone := errors.New("annulée")
+	err := db.applyAtomically(logCollections(tx.Log), func(collections map[string]*Collection) error {
+		if err := db.applyLogEntriesLocked(tx.Log, collections); err != nil {
+			return err
+		}
+		if _, err := c.readDocument("b"); !os.IsNotExist(err) {
+			t.Errorf("b avant l'annulation: %v, attendu supprimé", err)
+		}
+		undoLogEntriesLocked(tx.Log, collections)
+		return errUndone
+	})
+	if err != errUndone {
+		t.Fatalf("applyAtomically: %v", err)
+	}
+	checkCommitTestState(t, c)
+}
+
+// TestCommitVisibleAtOnce vérifie qu'un lecteur concurrent voit toutes les
+// écritures d'une transaction ou aucune : le total des deux comptes ne
+// varie jamais
+func TestCommitVisibleAtOnce(t *testing.T) {
+	db := openTestDatabase(t)
+	c := createTestCollection(t, db, "accounts")
+	mustInsert(t, c, Document{"_id": "a", "balance": 50})
+	mustInsert(t, c, Document{"_id": "b", "balance": 50})
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				tx := db.BeginTransaction()
+				total := 0.0
+				for _, id := range []string{"a", "b"} {
+					doc, err := db.GetDocumentWithTransaction(tx, "accounts", id)
+					if err != nil {
+						t.Errorf("GetDocumentWithTransaction: %v", err)
+					} else {
+						total += doc["balance"].(float64)
+					}
+				}
+				db.Rollback(tx)
+				if total != 100 {
+					t.Errorf("total lu = %v, attendu 100", total)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		tx := db.BeginTransaction()
+		from, to := "a", "b"
+		if i%2 == 1 {
+			from, to = to, from
+		}
+		if err := db.ModifyWithTransaction(tx, "accounts", from, Update{"$inc": map[string]interface{}{"balance": -10}}); err != nil {
+			t.Fatalf("ModifyWithTransaction: %v", err)
+		}
+		if err := db.ModifyWithTransaction(tx, "accounts", to, Update{"$inc": map[string]interface{}{"balance": 10}}); err != nil {
+			t.Fatalf("ModifyWithTransaction: %v", err)
+		}
+		if err := db.Commit(tx); err != nil {
+			t.Fatalf("Commit: %v", err)
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package database
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// IndexField est un champ d'un index composé, avec son sens de tri
+type IndexField struct {
+	Path string `json:"path"`
+	Desc bool   `json:"desc,omitempty"`
+}
+
+// missingKey marque un champ absent du document dans un tuple indexé ;
+// il se classe avant null et ne correspond à aucune recherche
+type missingKey struct{}
+
+// tupleKey est la clé d'un index composé : la concaténation des encodages
+// de ses composants, qui préserve l'ordre (composant par composant, dans
+// le sens de chaque champ) sous une simple comparaison d'octets. Un
+// encodage des premiers composants est un préfixe de la clé complète.
+type tupleKey string
+
+// MarshalJSON encode la clé en base64, ses octets n'étant pas de l'UTF-8
+func (k tupleKey) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]byte(k))
+}
+
+// Marqueurs de type des composants, dans l'ordre de typeRank
+const (
+	tupleMissing byte = iota + 1
+	tupleNull
+	tupleNumber
+	tupleString
+	tupleComposite
+	tupleBool
+)
+
+// indexName retourne le nom par défaut d'un index : le champ seul pour un
+// index simple croissant, sinon chemin_1 / chemin_-1 pour chaque champ
+func indexName(fields []IndexField) string {
+	if len(fields) == 1 && !fields[0].Desc {
+		return fields[0].Path
+	}
+	parts := make([]string, 0, len(fields))
+	for _, field := range fields {
+		direction := "1"
+		if field.Desc {
+			direction = "-1"
+		}
+		parts = append(parts, field.Path+"_"+direction)
+	}
+	return strings.Join(parts, "_")
+}
+
+// validateIndexFields vérifie la liste des champs d'un index
+func validateIndexFields(fields []IndexField) error {
+	if len(fields) == 0 {
+		return fmt.Errorf("un index doit porter sur au moins un champ")
+	}
+	seen := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		if field.Path == "" {
+			return fmt.Errorf("champ d'index vide")
+		}
+		if err := validatePath(field.Path); err != nil {
+			return err
+		}
+		if seen[field.Path] {
+			return fmt.Errorf("champ %s présent deux fois dans l'index", field.Path)
+		}
+		seen[field.Path] = true
+	}
+	return nil
+}
+
+// compound indique si l'index porte sur plusieurs champs
+func (index *Index) compound() bool {
+	return len(index.fields) > 1
+}
+
+// tuples retourne les tuples de valeurs normalisées des champs de l'index
+// dans doc (produit des valeurs de chaque champ lorsque des champs sont
+// des tableaux), missingKey pour les champs absents, et le nombre de
+// champs présents
+func (index *Index) tuples(doc map[string]interface{}) ([][]interface{}, int) {
+	tuples := [][]interface{}{{}}
+	present := 0
+	for _, field := range index.fields {
+		values := matchValues(doc, field.Path)
+		if len(values) == 0 {
+			values = []interface{}{missingKey{}}
+		} else {
+			present++
+		}
+
+		next := make([][]interface{}, 0, len(tuples)*len(values))
+		for _, tuple := range tuples {
+			for _, value := range values {
+				next = append(next, append(tuple[:len(tuple):len(tuple)], value))
+			}
+		}
+		tuples = next
+	}
+	return tuples, present
+}
+
+// encodeTuple encode les premiers composants d'une clé composée ;
+// values contient des valeurs normalisées
+func (index *Index) encodeTuple(values []interface{}) tupleKey {
+	var buf []byte
+	for i, value := range values {
+		start := len(buf)
+		buf = appendKeyComponent(buf, value)
+		if index.fields[i].Desc {
+			// Le complément inverse l'ordre, l'encodage étant sans préfixe commun
+			for j := start; j < len(buf); j++ {
+				buf[j] = ^buf[j]
+			}
+		}
+	}
+	return tupleKey(buf)
+}
+
+// appendKeyComponent ajoute l'encodage ordonné d'une valeur normalisée
+func appendKeyComponent(buf []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case missingKey:
+		return append(buf, tupleMissing)
+	case nil:
+		return append(buf, tupleNull)
+	case float64:
+		bits := math.Float64bits(v)
+		if v == 0 {
+			bits = 0 // -0 et 0 sont égaux
+		}
+		if bits>>63 == 1 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		buf = append(buf, tupleNumber)
+		return binary.BigEndian.AppendUint64(buf, bits)
+	case string:
+		return appendKeyString(append(buf, tupleString), v)
+	case compositeKey:
+		return appendKeyString(append(buf, tupleComposite), v.encoded)
+	case bool:
+		if v {
+			return append(buf, tupleBool, 1)
+		}
+		return append(buf, tupleBool, 0)
+	}
+	return append(buf, tupleNull)
+}
+
+// appendKeyString encode une chaîne sans préfixe commun : 0x00 devient
+// 0x00 0xFF et la chaîne se termine par 0x00 0x00
+func appendKeyString(buf []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if s[i] == 0 {
+			buf = append(buf, 0, 0xFF)
+			continue
+		}
+		buf = append(buf, s[i])
+	}
+	return append(buf, 0, 0)
+}
+
+// decodeKeyComponent décode une valeur encodée par appendKeyComponent et
+// retourne la suite du tampon
+func decodeKeyComponent(buf []byte) (interface{}, []byte, error) {
+	if len(buf) == 0 {
+		return nil, nil, fmt.Errorf("composant de clé vide")
+	}
+	marker, buf := buf[0], buf[1:]
+	switch marker {
+	case tupleMissing:
+		return missingKey{}, buf, nil
+	case tupleNull:
+		return nil, buf, nil
+	case tupleNumber:
+		if len(buf) < 8 {
+			return nil, nil, fmt.Errorf("nombre tronqué dans la clé")
+		}
+		bits := binary.BigEndian.Uint64(buf)
+		if bits>>63 == 1 {
+			bits &^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		return math.Float64frombits(bits), buf[8:], nil
+	case tupleString, tupleComposite:
+		var decoded []byte
+		for i := 0; i+1 < len(buf); i++ {
+			if buf[i] != 0 {
+				decoded = append(decoded, buf[i])
+				continue
+			}
+			switch buf[i+1] {
+			case 0:
+				if marker == tupleComposite {
+					return compositeKey{encoded: string(decoded)}, buf[i+2:], nil
+				}
+				return string(decoded), buf[i+2:], nil
+			case 0xFF:
+				decoded = append(decoded, 0)
+				i++
+				continue
+			}
+			break
+		}
+		return nil, nil, fmt.Errorf("chaîne mal terminée dans la clé")
+	case tupleBool:
+		if len(buf) < 1 {
+			return nil, nil, fmt.Errorf("booléen tronqué dans la clé")
+		}
+		return buf[0] == 1, buf[1:], nil
+	}
+	return nil, nil, fmt.Errorf("type de composant de clé inconnu: %d", marker)
+}
+
+// loadKey reconvertit une valeur lue d'un fichier d'index en clé
+func (index *Index) loadKey(value interface{}) (interface{}, error) {
+	if !index.compound() {
+		return normalizeKey(value), nil
+	}
+	var raw []byte
+	encoded, err := json.Marshal(value)
+	if err == nil {
+		err = json.Unmarshal(encoded, &raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("clé d'index composé invalide: %v", err)
+	}
+	return tupleKey(raw), nil
+}
+
+// lookupPrefix retourne les IDs des documents dont les premiers champs de
+// l'index valent values
+func (index *Index) lookupPrefix(values []interface{}) []string {
+	var docIDs []string
+	index.scanEqual(values, func(key interface{}, ids []string) bool {
+		docIDs = append(docIDs, ids...)
+		return true
+	})
+	return docIDs
+}
+
+// scanEqual parcourt les valeurs de l'index dont les premiers champs
+// valent values et retourne le nombre de clés examinées ; un index hash
+// parcourt toutes ses clés si le préfixe ne couvre pas tous les champs
+func (index *Index) scanEqual(values []interface{}, fn func(key interface{}, ids []string) bool) int {
+	var key interface{}
+	if index.compound() {
+		normalized := make([]interface{}, len(values))
+		for i, value := range values {
+			normalized[i] = normalizeKey(value)
+		}
+		key = index.encodeTuple(normalized)
+	} else {
+		key = normalizeKey(values[0])
+	}
+
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+	if len(values) == len(index.fields) {
+		if ids := index.store.lookup(key); len(ids) > 0 {
+			fn(key, append([]string(nil), ids...))
+		}
+		return 1
+	}
+
+	prefix := string(key.(tupleKey))
+	examined := 0
+	if list, ok := index.store.(*skipList); ok {
+		for node := list.seek(key, false); node != nil; node = node.next[0] {
+			examined++
+			if !strings.HasPrefix(string(node.key.(tupleKey)), prefix) || !fn(node.key, node.ids) {
+				break
+			}
+		}
+		return examined
+	}
+	index.store.ascend(func(candidate interface{}, ids []string) bool {
+		examined++
+		if strings.HasPrefix(string(candidate.(tupleKey)), prefix) {
+			return fn(candidate, ids)
+		}
+		return true
+	})
+	return examined
+}
+
+// CreateCompoundIndex crée un index sur une liste ordonnée de champs. Il
+// sert les recherches par égalité sur tout préfixe de ses champs ; unique,
+// il refuse deux documents ayant le même tuple complet (un document auquel
+// manque l'un des champs n'est pas contraint).
+func (c *Collection) CreateCompoundIndex(fields []IndexField, options IndexOptions) error {
+	if err := validateIndexFields(fields); err != nil {
+		return err
+	}
+	if options.Type != "" && options.Type != IndexHash && options.Type != IndexOrdered {
+		return fmt.Errorf("type d'index inconnu: %s", options.Type)
+	}
+	return c.createIndex(newIndex(IndexDefinition{
+		Name:   options.Name,
+		Fields: fields,
+		Unique: options.Unique,
+		Type:   options.Type,
+	}))
+}
+
+// FindByFields trouve les documents dont chaque champ de values a la
+// valeur donnée, en s'appuyant sur l'index qui couvre le plus long
+// préfixe de ces champs
+func (c *Collection) FindByFields(values map[string]interface{}) ([]Document, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	match := func(doc Document) bool {
+		for field, value := range values {
+			expected := normalizeKey(value)
+			if !matchPath(doc, field, func(docValue interface{}) bool {
+				return compareValues(docValue, expected) == 0
+			}) {
+				return false
+			}
+		}
+		return true
+	}
+
+	index, covered := c.equalityIndex(values)
+	if index == nil {
+		return c.scanDocuments(match, 0)
+	}
+
+	prefix := make([]interface{}, covered)
+	for i := range prefix {
+		prefix[i] = values[index.fields[i].Path]
+	}
+	documents, err := c.readDocuments(index.lookupPrefix(prefix))
+	if err != nil || covered == len(values) {
+		return documents, err
+	}
+
+	var filtered []Document
+	for _, doc := range documents {
+		if match(doc) {
+			filtered = append(filtered, doc)
+		}
+	}
+	return filtered, nil
+}
+
+// equalityIndex choisit l'index dont le plus long préfixe de champs est
+// couvert par values, en préférant une recherche sur la clé complète ;
+// l'appelant détient c.mu
+func (c *Collection) equalityIndex(values map[string]interface{}) (*Index, int) {
+	var best *Index
+	bestCovered := 0
+	for _, index := range c.indexes {
+		covered := 0
+		for _, field := range index.fields {
+			if _, exists := values[field.Path]; !exists {
+				break
+			}
+			covered++
+		}
+		if covered == 0 {
+			continue
+		}
+		if best == nil || covered > bestCovered ||
+			(covered == bestCovered && betterEqualityIndex(index, best, covered)) {
+			best, bestCovered = index, covered
+		}
+	}
+	return best, bestCovered
+}
+
+// betterEqualityIndex départage deux index couvrant le même préfixe
+func betterEqualityIndex(index, other *Index, covered int) bool {
+	exact, otherExact := covered == len(index.fields), covered == len(other.fields)
+	if exact != otherExact {
+		return exact
+	}
+	if len(index.fields) != len(other.fields) {
+		return len(index.fields) < len(other.fields)
+	}
+	return index.name < other.name
+}
+
+// fieldIndex retourne l'index simple d'un champ, ordonné si ordered ;
+// l'appelant détient c.mu
+func (c *Collection) fieldIndex(field string, ordered bool) *Index {
+	var found *Index
+	for _, index := range c.indexes {
+		if index.compound() || index.fields[0].Path != field || (ordered && !index.Ordered()) {
+			continue
+		}
+		if found == nil || index.name < found.name {
+			found = index
+		}
+	}
+	return found
+}
+
+// fieldPaths retourne les chemins des champs de l'index, entre parenthèses
+func (index *Index) fieldPaths() string {
+	paths := make([]string, len(index.fields))
+	for i, field := range index.fields {
+		paths[i] = field.Path
+	}
+	return "(" + strings.Join(paths, ", ") + ")"
+}
@@ -0,0 +1,80 @@
+package database
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// TestCompoundUniqueIndex vérifie qu'un index composé unique refuse un
+// tuple complet déjà pris, mais pas un document auquel manque un champ
+func TestCompoundUniqueIndex(t *testing.T) {
+	c := createTestCollection(t, openTestDatabase(t), "addresses")
+	fields := []IndexField{{Path: "city"}, {Path: "zip"}}
+	if err := c.CreateCompoundIndex(fields, IndexOptions{Unique: true}); err != nil {
+		t.Fatalf("CreateCompoundIndex: %v", err)
+	}
+	mustInsert(t, c, Document{"city": "Paris", "zip": "75001"})
+	docID := mustInsert(t, c, Document{"city": "Paris", "zip": "75002"})
+	mustInsert(t, c, Document{"city": "Paris"})
+	mustInsert(t, c, Document{"city": "Paris"})
+
+	if _, err := c.Insert(Document{"city": "Paris", "zip": "75001"}); err == nil {
+		t.Fatal("Insert a accepté un tuple déjà pris")
+	}
+	if err := c.Update(docID, Document{"city": "Paris", "zip": "75001"}); err == nil {
+		t.Fatal("Update a accepté un tuple déjà pris")
+	}
+	if doc := mustGet(t, c, docID); doc["zip"] != "75002" {
+		t.Fatalf("document = %v après une mise à jour refusée", doc)
+	}
+}
+
+// TestCompoundIndexPrefix vérifie les recherches par égalité sur un
+// préfixe des champs d'un index composé, et sur tous ses champs
+func TestCompoundIndexPrefix(t *testing.T) {
+	c := createTestCollection(t, openTestDatabase(t), "addresses")
+	fields := []IndexField{{Path: "city"}, {Path: "zip"}}
+	if err := c.CreateCompoundIndex(fields, IndexOptions{}); err != nil {
+		t.Fatalf("CreateCompoundIndex: %v", err)
+	}
+	mustInsert(t, c, Document{"name": "a", "city": "Paris", "zip": "75001"})
+	mustInsert(t, c, Document{"name": "b", "city": "Paris", "zip": "75002"})
+	mustInsert(t, c, Document{"name": "c", "city": "Lyon", "zip": "69001"})
+
+	tests := []struct {
+		values map[string]interface{}
+		want   []string
+	}{
+		{map[string]interface{}{"city": "Paris"}, []string{"a", "b"}},
+		{map[string]interface{}{"city": "Paris", "zip": "75002"}, []string{"b"}},
+		{map[string]interface{}{"zip": "69001"}, []string{"c"}},
+	}
+	for _, test := range tests {
+		docs, err := c.FindByFields(test.values)
+		if err != nil {
+			t.Fatalf("FindByFields: %v", err)
+		}
+		got := documentNames(docs)
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("FindByFields(%v) = %v, attendu %v", test.values, got, test.want)
+		}
+	}
+}
+
+// TestCompoundUniqueIndexOnDuplicates vérifie qu'un index unique ne peut
+// être créé sur des données qui le violent déjà
+func TestCompoundUniqueIndexOnDuplicates(t *testing.T) {
+	c := createTestCollection(t, openTestDatabase(t), "addresses")
+	mustInsert(t, c, Document{"city": "Paris", "zip": "75001"})
+	mustInsert(t, c, Document{"city": "Paris", "zip": "75001"})
+
+	fields := []IndexField{{Path: "city"}, {Path: "zip"}}
+	if err := c.CreateCompoundIndex(fields, IndexOptions{Unique: true}); err == nil {
+		t.Fatal("CreateCompoundIndex a accepté des tuples en double")
+	}
+	if definitions := c.Indexes(); len(definitions) != 0 {
+		t.Fatalf("Indexes = %v, attendu aucun index", definitions)
+	}
+}
@@ -0,0 +1,144 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// resumeToken est le contenu d'un jeton de reprise : le tri de la
+// recherche, puis la clé de tri et l'ID du dernier document retourné. La
+// position ne dépend que de ces valeurs, pas d'un rang : les documents
+// insérés ou supprimés entre deux pages ne décalent pas la suite.
+type resumeToken struct {
+	Sort []SortField `json:"s,omitempty"`
+	Key  []byte      `json:"k,omitempty"`
+	ID   string      `json:"id"`
+}
+
+// encodeResumeToken encode la position d'un document dans l'ordre du tri
+func encodeResumeToken(fields []SortField, entry *sortedDocument) string {
+	key := entry.key
+	if key == nil {
+		key = sortKey(entry.doc, fields)
+	}
+	var buf []byte
+	for _, value := range key {
+		buf = appendKeyComponent(buf, value)
+	}
+	encoded, _ := json.Marshal(resumeToken{Sort: fields, Key: buf, ID: entry.id})
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// decodeResumeToken décode un jeton de reprise produit pour le même tri ;
+// un jeton vide ne désigne aucune position
+func decodeResumeToken(token string, fields []SortField) (*sortedDocument, error) {
+	if token == "" {
+		return nil, nil
+	}
+	invalid := func(reason string) error {
+		return fmt.Errorf("%w: jeton de reprise invalide (%s)", ErrInvalidFilter, reason)
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, invalid("encodage")
+	}
+	var decoded resumeToken
+	if err := json.Unmarshal(raw, &decoded); err != nil || decoded.ID == "" {
+		return nil, invalid("contenu")
+	}
+	if len(decoded.Sort) != len(fields) {
+		return nil, invalid("tri différent")
+	}
+	for i, field := range fields {
+		if decoded.Sort[i] != field {
+			return nil, invalid("tri différent")
+		}
+	}
+
+	position := &sortedDocument{id: decoded.ID, key: make([]interface{}, 0, len(fields))}
+	buf := decoded.Key
+	for range fields {
+		var value interface{}
+		if value, buf, err = decodeKeyComponent(buf); err != nil {
+			return nil, invalid(err.Error())
+		}
+		position.key = append(position.key, value)
+	}
+	if len(buf) > 0 {
+		return nil, invalid("clé trop longue")
+	}
+	return position, nil
+}
+
+// Iterator parcourt les résultats d'une recherche par lots, dans l'ordre
+// du tri puis des IDs. Chaque lot reprend après le dernier document du
+// précédent, sans décalage si des documents sont insérés entre-temps, et
+// Token permet de reprendre le parcours plus tard, avec un autre Iterator.
+type Iterator struct {
+	collection *Collection
+	filter     Filter
+	opts       FindOptions
+	token      string
+	done       bool
+}
+
+// Iterate prépare le parcours des documents vérifiant filter par lots de
+// opts.Limit documents (un seul lot si Limit est nul), à partir de la
+// position du jeton opts.After s'il est donné
+func (c *Collection) Iterate(filter Filter, opts FindOptions) (*Iterator, error) {
+	if _, err := compileFilter(filter); err != nil {
+		return nil, err
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if _, err := decodeResumeToken(opts.After, opts.Sort); err != nil {
+		return nil, err
+	}
+	opts.byID = true
+	return &Iterator{collection: c, filter: filter, opts: opts, token: opts.After}, nil
+}
+
+// Next retourne le lot suivant, vide lorsque le parcours est terminé
+func (it *Iterator) Next() ([]Document, error) {
+	if it.done {
+		return nil, nil
+	}
+
+	// Un document de plus indique s'il reste un lot à lire
+	opts := it.opts
+	opts.After = it.token
+	if opts.Limit > 0 {
+		opts.Limit++
+	}
+	entries, _, err := it.collection.query(it.filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	if it.opts.Limit <= 0 || len(entries) <= it.opts.Limit {
+		it.done = true
+	} else {
+		entries = entries[:it.opts.Limit]
+	}
+	it.opts.Skip = 0
+
+	documents := make([]Document, len(entries))
+	for i, entry := range entries {
+		if i == len(entries)-1 {
+			it.token = encodeResumeToken(it.opts.Sort, entry)
+		}
+		documents[i] = project(entry.doc, it.opts.Projection)
+	}
+	return documents, nil
+}
+
+// Token retourne le jeton de reprise après le dernier lot, "" lorsque le
+// parcours est terminé
+func (it *Iterator) Token() string {
+	if it.done {
+		return ""
+	}
+	return it.token
+}
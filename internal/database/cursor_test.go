@@ -0,0 +1,90 @@
+package database
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// TestIteratePages vérifie la pagination par jeton : des lots dans l'ordre
+// du tri puis des IDs (ici, d'insertion), sans doublon ni décalage quand
+// un document est inséré avant la position courante, et la reprise par un
+// autre Iterator
+func TestIteratePages(t *testing.T) {
+	c := createTestCollection(t, openTestDatabase(t), "scores")
+	for _, data := range []string{
+		`{"name": "a", "score": 3}`,
+		`{"name": "b", "score": 1}`,
+		`{"name": "c", "score": 2}`,
+		`{"name": "d", "score": 2}`,
+		`{"name": "e", "score": 5}`,
+		`{"name": "f", "score": 4}`,
+	} {
+		mustInsert(t, c, decodeDocument(t, data))
+	}
+	opts := FindOptions{Sort: []SortField{{Path: "score"}}, Limit: 2}
+
+	it, err := c.Iterate(Filter{}, opts)
+	if err != nil {
+		t.Fatalf("Iterate: %v", err)
+	}
+	first, err := it.Next()
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if got := documentNames(first); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Fatalf("premier lot = %v, attendu [b c]", got)
+	}
+
+	// Inséré avant la position courante : ne décale pas la suite
+	mustInsert(t, c, Document{"name": "0", "score": 0})
+
+	opts.After = it.Token()
+	resumed, err := c.Iterate(Filter{}, opts)
+	if err != nil {
+		t.Fatalf("Iterate depuis le jeton: %v", err)
+	}
+	var rest []string
+	for {
+		batch, err := resumed.Next()
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+		rest = append(rest, documentNames(batch)...)
+	}
+	if !reflect.DeepEqual(rest, []string{"d", "a", "f", "e"}) {
+		t.Fatalf("lots suivants = %v, attendu [d a f e]", rest)
+	}
+	if token := resumed.Token(); token != "" {
+		t.Fatalf("Token = %q après le dernier lot, attendu vide", token)
+	}
+}
+
+// TestIterateInvalidToken vérifie qu'un jeton illisible ou produit pour un
+// autre tri est refusé
+func TestIterateInvalidToken(t *testing.T) {
+	c := createTestCollection(t, openTestDatabase(t), "scores")
+	mustInsert(t, c, Document{"score": 1})
+	mustInsert(t, c, Document{"score": 2})
+
+	it, err := c.Iterate(Filter{}, FindOptions{Sort: []SortField{{Path: "score"}}, Limit: 1})
+	if err != nil {
+		t.Fatalf("Iterate: %v", err)
+	}
+	if _, err := it.Next(); err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+
+	for _, opts := range []FindOptions{
+		{Sort: []SortField{{Path: "score", Desc: true}}, After: it.Token()},
+		{After: it.Token()},
+		{After: "pas-un-jeton"},
+	} {
+		if _, err := c.Iterate(Filter{}, opts); !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("Iterate(%+v) = %v, attendu ErrInvalidFilter", opts, err)
+		}
+	}
+}
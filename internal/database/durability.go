@@ -0,0 +1,156 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Durability indique à quel moment les écritures de documents sont
+// forcées sur disque
+type Durability int
+
+const (
+	// DurabilityNone n'appelle jamais fsync : les écritures restent
+	// atomiques (fichier temporaire + rename) mais peuvent être perdues
+	// en cas de coupure de courant
+	DurabilityNone Durability = iota
+	// DurabilityWrite force chaque écriture de document sur disque
+	DurabilityWrite
+	// DurabilityCommit force sur disque les documents touchés par une
+	// transaction une seule fois, au moment du commit ; hors transaction,
+	// chaque écriture, ou chaque lot de BulkWrite, est son propre commit
+	DurabilityCommit
+)
+
+// ErrNotDurable signale une transaction validée, visible et définitive,
+// dont les documents n'ont pu être forcés sur disque : elle peut être
+// perdue en cas de coupure de courant
+var ErrNotDurable = errors.New("transaction validée mais non synchronisée")
+
+// String retourne le nom du niveau de durabilité
+func (d Durability) String() string {
+	switch d {
+	case DurabilityNone:
+		return "none"
+	case DurabilityWrite:
+		return "write"
+	case DurabilityCommit:
+		return "commit"
+	default:
+		return fmt.Sprintf("Durability(%d)", int(d))
+	}
+}
+
+// ParseDurability convertit un nom ("none", "write", "commit") en niveau de durabilité
+func ParseDurability(name string) (Durability, error) {
+	switch strings.ToLower(name) {
+	case "none":
+		return DurabilityNone, nil
+	case "write", "per-write":
+		return DurabilityWrite, nil
+	case "commit", "per-commit":
+		return DurabilityCommit, nil
+	default:
+		return DurabilityNone, fmt.Errorf("niveau de durabilité inconnu: %s", name)
+	}
+}
+
+// writeFileAtomic écrit data dans path via un fichier temporaire renommé,
+// de sorte qu'un lecteur ne voie jamais de fichier tronqué. Si sync est
+// vrai, le fichier puis son répertoire sont forcés sur disque.
+func writeFileAtomic(path string, data []byte, sync bool) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if sync {
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if sync {
+		return syncDir(dir)
+	}
+	return nil
+}
+
+// removeFile supprime path (absent = succès) et force le répertoire sur disque si demandé
+func removeFile(path string, sync bool) error {
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if sync {
+		return syncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+// syncFile force le contenu d'un fichier existant sur disque
+func syncFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// syncDir force les entrées d'un répertoire (créations, renommages,
+// suppressions) sur disque
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// removeTempFiles supprime les fichiers temporaires laissés par une
+// écriture interrompue
+func removeTempFiles(dir string) error {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), ".") && strings.Contains(file.Name(), ".tmp-") {
+			if err := os.Remove(filepath.Join(dir, file.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
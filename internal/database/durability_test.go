@@ -0,0 +1,50 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestWriteFileAtomic vérifie qu'une écriture remplace le fichier en
+// entier sans laisser de fichier temporaire
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "doc.json")
+	for _, data := range []string{`{"n":1}`, `{"n":2}`} {
+		if err := writeFileAtomic(path, []byte(data), true); err != nil {
+			t.Fatalf("writeFileAtomic: %v", err)
+		}
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil || string(content) != `{"n":2}` {
+		t.Fatalf("contenu = %q (%v), attendu la dernière écriture", content, err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("%d fichiers dans le répertoire, attendu 1", len(entries))
+	}
+}
+
+// TestScanReportsUnreadableDocument vérifie qu'un document corrompu fait
+// échouer les parcours au lieu d'être ignoré
+func TestScanReportsUnreadableDocument(t *testing.T) {
+	db := openTestDatabase(t)
+	c := createTestCollection(t, db, "items")
+	mustInsert(t, c, Document{"n": 1})
+	if err := os.WriteFile(c.storage.(*fileStorage).documentPath("b"), []byte(`{"n": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.GetAllDocuments(); err == nil || !strings.Contains(err.Error(), "b") {
+		t.Fatalf("GetAllDocuments: %v, attendu une erreur nommant le document b", err)
+	}
+	if _, err := c.FindByField("n", float64(1)); err == nil {
+		t.Fatal("FindByField a ignoré le document corrompu")
+	}
+	if err := c.CreateIndex("n", false); err == nil {
+		t.Fatal("CreateIndex a indexé une vue partielle de la collection")
+	}
+}
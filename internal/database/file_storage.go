@@ -0,0 +1,151 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// fileStorage stocke chaque document dans un fichier <id>.json
+type fileStorage struct {
+	path string
+}
+
+// newFileStorage ouvre un stockage fichier-par-document
+func newFileStorage(path string) (*fileStorage, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	if err := removeTempFiles(path); err != nil {
+		return nil, err
+	}
+	return &fileStorage{path: path}, nil
+}
+
+// documentPath retourne le chemin du fichier d'un document
+func (s *fileStorage) documentPath(docID string) string {
+	return filepath.Join(s.path, docID+".json")
+}
+
+// Get lit un document depuis son fichier
+func (s *fileStorage) Get(docID string) (Document, error) {
+	data, err := os.ReadFile(s.documentPath(docID))
+	if err != nil {
+		return nil, err
+	}
+
+	var doc Document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Put écrit un document de manière atomique
+func (s *fileStorage) Put(docID string, doc map[string]interface{}, sync bool) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.documentPath(docID), data, sync)
+}
+
+// Delete supprime le fichier d'un document
+func (s *fileStorage) Delete(docID string, sync bool) error {
+	return removeFile(s.documentPath(docID), sync)
+}
+
+// Scan parcourt les fichiers .json du répertoire ; un fichier illisible ou
+// corrompu interrompt le parcours avec une erreur nommant le document
+func (s *fileStorage) Scan(fn func(docID string, doc Document) error) error {
+	files, err := os.ReadDir(s.path)
+	if err != nil {
+		return err
+	}
+
+	// L'ordre des noms de fichier diffère de celui des ID : "abc-d.json"
+	// précède "abc.json"
+	var docIDs []string
+	for _, file := range files {
+		if filepath.Ext(file.Name()) == ".json" {
+			docIDs = append(docIDs, strings.TrimSuffix(file.Name(), ".json"))
+		}
+	}
+	sort.Strings(docIDs)
+
+	for _, docID := range docIDs {
+		doc, err := s.Get(docID)
+		if os.IsNotExist(err) {
+			// Supprimé pendant le parcours
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("document %s illisible: %w", docID, err)
+		}
+		if err := fn(docID, doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Count compte les fichiers .json du répertoire
+func (s *fileStorage) Count() (int, error) {
+	files, err := os.ReadDir(s.path)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, file := range files {
+		if filepath.Ext(file.Name()) == ".json" {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Sync force les fichiers donnés puis le répertoire sur disque
+func (s *fileStorage) Sync(docIDs []string) error {
+	for _, docID := range docIDs {
+		if err := syncFile(s.documentPath(docID)); err != nil {
+			return err
+		}
+	}
+	return syncDir(s.path)
+}
+
+// Fingerprint hache le nom, la taille et la date de modification de chaque
+// document, sans lire leur contenu
+func (s *fileStorage) Fingerprint() (string, error) {
+	files, err := os.ReadDir(s.path)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", err
+		}
+		fmt.Fprintf(hash, "%s:%d:%d\n", file.Name(), info.Size(), info.ModTime().UnixNano())
+	}
+	return "files:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Close ne fait rien : aucun fichier n'est gardé ouvert
+func (s *fileStorage) Close() error {
+	return nil
+}
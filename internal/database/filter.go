@@ -0,0 +1,369 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Filter est un document de filtre à la MongoDB, par exemple
+//
+//	{"age": {"$gte": 18}, "$or": [{"city": "Paris"}, {"tags": {"$in": ["vip"]}}]}
+//
+// Chaque clé est un chemin de champ (notation pointée) associé à une valeur
+// (égalité) ou à des opérateurs, ou un opérateur logique ($and, $or).
+type Filter map[string]interface{}
+
+// ErrInvalidFilter signale un filtre mal formé
+var ErrInvalidFilter = errors.New("filtre invalide")
+
+// errStopScan interrompt un parcours du stockage sans erreur
+var errStopScan = errors.New("parcours interrompu")
+
+// matcher teste un document
+type matcher func(doc map[string]interface{}) bool
+
+// valueMatcher teste les valeurs brutes d'un chemin dans un document
+// (vide si le chemin n'existe pas)
+type valueMatcher func(raw []interface{}) bool
+
+// Find retourne les documents vérifiant filter, selon le plan choisi par
+// le planificateur de requêtes (voir Explain)
+func (c *Collection) Find(filter Filter, opts FindOptions) ([]Document, error) {
+	documents, _, err := c.find(filter, opts)
+	return documents, err
+}
+
+// compileFilter compile un filtre en fonction de test
+func compileFilter(filter map[string]interface{}) (matcher, error) {
+	var matchers []matcher
+	for key, condition := range filter {
+		var m matcher
+		var err error
+		switch {
+		case key == "$and" || key == "$or":
+			m, err = compileLogical(key, condition)
+		case strings.HasPrefix(key, "$"):
+			err = fmt.Errorf("%w: opérateur %s inconnu au niveau du document", ErrInvalidFilter, key)
+		default:
+			if err = validatePath(key); err != nil {
+				err = fmt.Errorf("%w: %v", ErrInvalidFilter, err)
+				break
+			}
+			var test valueMatcher
+			if test, err = compileCondition(condition); err == nil {
+				path := key
+				m = func(doc map[string]interface{}) bool {
+					return test(pathValues(doc, path))
+				}
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+
+	return func(doc map[string]interface{}) bool {
+		for _, m := range matchers {
+			if !m(doc) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// compileLogical compile $and et $or, dont la valeur est une liste non vide de filtres
+func compileLogical(operator string, condition interface{}) (matcher, error) {
+	clauses, ok := asArray(condition)
+	if !ok || len(clauses) == 0 {
+		return nil, fmt.Errorf("%w: %s attend une liste non vide de filtres", ErrInvalidFilter, operator)
+	}
+
+	matchers := make([]matcher, 0, len(clauses))
+	for _, clause := range clauses {
+		sub, ok := asMap(clause)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s attend une liste de filtres", ErrInvalidFilter, operator)
+		}
+		m, err := compileFilter(sub)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+
+	or := operator == "$or"
+	return func(doc map[string]interface{}) bool {
+		for _, m := range matchers {
+			if m(doc) == or {
+				return or
+			}
+		}
+		return !or
+	}, nil
+}
+
+// compileCondition compile la condition associée à un champ : une valeur
+// littérale (égalité) ou un objet d'opérateurs
+func compileCondition(condition interface{}) (valueMatcher, error) {
+	operators, ok := asMap(condition)
+	if !ok || !isOperatorMap(operators) {
+		return equalMatcher(condition), nil
+	}
+	if _, hasRegex := operators["$regex"]; !hasRegex {
+		if _, hasOptions := operators["$options"]; hasOptions {
+			return nil, fmt.Errorf("%w: $options sans $regex", ErrInvalidFilter)
+		}
+	}
+
+	var tests []valueMatcher
+	for operator, operand := range operators {
+		if operator == "$options" {
+			continue
+		}
+		test, err := compileOperator(operator, operand, operators)
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, test)
+	}
+
+	return func(raw []interface{}) bool {
+		for _, test := range tests {
+			if !test(raw) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// isOperatorMap indique si un objet est une liste d'opérateurs plutôt
+// qu'une valeur littérale ; un objet vide est une valeur
+func isOperatorMap(m map[string]interface{}) bool {
+	for key := range m {
+		if strings.HasPrefix(key, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+// compileOperator compile un opérateur de champ ; siblings donne accès à
+// $options pour $regex
+func compileOperator(operator string, operand interface{}, siblings map[string]interface{}) (valueMatcher, error) {
+	switch operator {
+	case "$eq":
+		return equalMatcher(operand), nil
+	case "$ne":
+		eq := equalMatcher(operand)
+		return func(raw []interface{}) bool { return !eq(raw) }, nil
+	case "$gt", "$gte", "$lt", "$lte":
+		bound := &Bound{Value: normalizeKey(operand), Inclusive: strings.HasSuffix(operator, "e")}
+		var r Range
+		if strings.HasPrefix(operator, "$g") {
+			r.Lower = bound
+		} else {
+			r.Upper = bound
+		}
+		return anyValue(r.contains), nil
+	case "$in", "$nin":
+		values, ok := asArray(operand)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s attend une liste", ErrInvalidFilter, operator)
+		}
+		tests := make([]valueMatcher, len(values))
+		for i, value := range values {
+			tests[i] = equalMatcher(value)
+		}
+		in := func(raw []interface{}) bool {
+			for _, test := range tests {
+				if test(raw) {
+					return true
+				}
+			}
+			return false
+		}
+		if operator == "$nin" {
+			return func(raw []interface{}) bool { return !in(raw) }, nil
+		}
+		return in, nil
+	case "$exists":
+		want, ok := operand.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%w: $exists attend un booléen", ErrInvalidFilter)
+		}
+		return func(raw []interface{}) bool { return (len(raw) > 0) == want }, nil
+	case "$regex":
+		pattern, ok := operand.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: $regex attend une chaîne", ErrInvalidFilter)
+		}
+		options, _ := siblings["$options"].(string)
+		re, err := compileRegex(pattern, options)
+		if err != nil {
+			return nil, err
+		}
+		return anyValue(func(value interface{}) bool {
+			str, ok := value.(string)
+			return ok && re.MatchString(str)
+		}), nil
+	case "$not":
+		var test valueMatcher
+		var err error
+		if pattern, ok := operand.(string); ok {
+			test, err = compileOperator("$regex", pattern, nil)
+		} else if operators, ok := asMap(operand); ok && isOperatorMap(operators) {
+			test, err = compileCondition(operators)
+		} else {
+			err = fmt.Errorf("%w: $not attend des opérateurs ou une expression régulière", ErrInvalidFilter)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return func(raw []interface{}) bool { return !test(raw) }, nil
+	case "$elemMatch":
+		return compileElemMatch(operand)
+	}
+	return nil, fmt.Errorf("%w: opérateur %s inconnu", ErrInvalidFilter, operator)
+}
+
+// compileElemMatch compile $elemMatch : un élément au moins d'un tableau
+// vérifie toutes les conditions. Des opérateurs seuls ({"$gte": 80})
+// s'appliquent aux éléments eux-mêmes, un filtre ({"sku": "x"}) aux
+// éléments qui sont des objets.
+func compileElemMatch(operand interface{}) (valueMatcher, error) {
+	conditions, ok := asMap(operand)
+	if !ok {
+		return nil, fmt.Errorf("%w: $elemMatch attend un objet", ErrInvalidFilter)
+	}
+
+	var matchElement func(element interface{}) bool
+	if valueOperators(conditions) {
+		test, err := compileCondition(conditions)
+		if err != nil {
+			return nil, err
+		}
+		matchElement = func(element interface{}) bool {
+			return test([]interface{}{element})
+		}
+	} else {
+		match, err := compileFilter(conditions)
+		if err != nil {
+			return nil, err
+		}
+		matchElement = func(element interface{}) bool {
+			doc, ok := asMap(element)
+			return ok && match(doc)
+		}
+	}
+
+	return func(raw []interface{}) bool {
+		for _, value := range raw {
+			array, ok := value.([]interface{})
+			if !ok {
+				continue
+			}
+			for _, element := range array {
+				if matchElement(element) {
+					return true
+				}
+			}
+		}
+		return false
+	}, nil
+}
+
+// valueOperators indique si un objet ne contient que des opérateurs de
+// champ ($and et $or en font un filtre de document)
+func valueOperators(m map[string]interface{}) bool {
+	for key := range m {
+		if !strings.HasPrefix(key, "$") || key == "$and" || key == "$or" {
+			return false
+		}
+	}
+	return len(m) > 0
+}
+
+// compileRegex compile une expression régulière avec les options
+// MongoDB i, m et s
+func compileRegex(pattern, options string) (*regexp.Regexp, error) {
+	var flags string
+	for _, option := range options {
+		switch option {
+		case 'i', 'm', 's':
+			flags += string(option)
+		default:
+			return nil, fmt.Errorf("%w: option %q de $regex non supportée", ErrInvalidFilter, option)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%w: expression régulière invalide: %v", ErrInvalidFilter, err)
+	}
+	return re, nil
+}
+
+// equalMatcher teste l'égalité avec value : une valeur du chemin, un
+// élément d'un tableau ou le tableau entier. null correspond aussi à un
+// champ absent.
+func equalMatcher(value interface{}) valueMatcher {
+	expected := normalizeKey(value)
+	equal := anyValue(func(candidate interface{}) bool {
+		return compareValues(candidate, expected) == 0
+	})
+	if expected != nil {
+		return equal
+	}
+	return func(raw []interface{}) bool {
+		return len(raw) == 0 || equal(raw)
+	}
+}
+
+// anyValue teste si l'une des valeurs (tableaux développés) vérifie match
+func anyValue(match func(value interface{}) bool) valueMatcher {
+	return func(raw []interface{}) bool {
+		for _, value := range expandValues(raw) {
+			if match(value) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// asMap convertit un objet de filtre (décodé du JSON ou construit en Go)
+func asMap(value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return v, true
+	case Filter:
+		return v, true
+	case Document:
+		return v, true
+	}
+	return nil, false
+}
+
+// asArray convertit une liste de filtre, quel que soit son type de slice Go
+func asArray(value interface{}) ([]interface{}, bool) {
+	if array, ok := value.([]interface{}); ok {
+		return array, true
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice {
+		return nil, false
+	}
+	array := make([]interface{}, v.Len())
+	for i := range array {
+		array[i] = v.Index(i).Interface()
+	}
+	return array, true
+}
@@ -0,0 +1,71 @@
+package database
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// TestFilterOperators vérifie chaque opérateur du langage de filtre sur
+// des documents décodés depuis JSON
+func TestFilterOperators(t *testing.T) {
+	c := createTestCollection(t, openTestDatabase(t), "products")
+	for _, data := range []string{
+		`{"name": "Apple", "price": 3, "tags": ["fruit", "red"], "stock": [{"shop": "x", "qty": 5}]}`,
+		`{"name": "banana", "price": 1.5, "tags": ["fruit"], "stock": [{"shop": "y", "qty": 0}]}`,
+		`{"name": "Carrot", "price": 2, "tags": ["vegetable"], "discontinued": true}`,
+	} {
+		mustInsert(t, c, decodeDocument(t, data))
+	}
+
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{`{"price": 2}`, []string{"Carrot"}},
+		{`{"price": {"$ne": 2}}`, []string{"Apple", "banana"}},
+		{`{"price": {"$gt": 1.5, "$lte": 3}}`, []string{"Apple", "Carrot"}},
+		{`{"name": {"$in": ["Apple", "Carrot"]}}`, []string{"Apple", "Carrot"}},
+		{`{"name": {"$nin": ["Apple", "Carrot"]}}`, []string{"banana"}},
+		{`{"tags": "red"}`, []string{"Apple"}},
+		{`{"tags": ["fruit"]}`, []string{"banana"}},
+		{`{"discontinued": {"$exists": false}}`, []string{"Apple", "banana"}},
+		{`{"name": {"$regex": "^[ab]", "$options": "i"}}`, []string{"Apple", "banana"}},
+		{`{"name": {"$not": {"$regex": "^B"}}}`, []string{"Apple", "Carrot", "banana"}},
+		{`{"stock": {"$elemMatch": {"shop": "y", "qty": {"$lt": 1}}}}`, []string{"banana"}},
+		{`{"stock.qty": {"$gte": 5}}`, []string{"Apple"}},
+		{`{"$or": [{"price": {"$lt": 2}}, {"tags": "vegetable"}]}`, []string{"Carrot", "banana"}},
+		{`{"$and": [{"tags": "fruit"}, {"price": {"$gte": 2}}]}`, []string{"Apple"}},
+	}
+	for _, test := range tests {
+		docs, err := c.Find(Filter(decodeDocument(t, test.filter)), FindOptions{})
+		if err != nil {
+			t.Errorf("Find(%s): %v", test.filter, err)
+			continue
+		}
+		got := documentNames(docs)
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Find(%s) = %v, attendu %v", test.filter, got, test.want)
+		}
+	}
+}
+
+// TestInvalidFilter vérifie qu'un filtre mal formé est refusé avec
+// ErrInvalidFilter plutôt qu'ignoré
+func TestInvalidFilter(t *testing.T) {
+	c := createTestCollection(t, openTestDatabase(t), "products")
+	for _, filter := range []string{
+		`{"price": {"$between": [1, 2]}}`,
+		`{"$nor": [{"price": 1}]}`,
+		`{"$or": []}`,
+		`{"name": {"$regex": "("}}`,
+		`{"name": {"$exists": "yes"}}`,
+		`{"a..b": 1}`,
+	} {
+		if _, err := c.Find(Filter(decodeDocument(t, filter)), FindOptions{}); !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("Find(%s) = %v, attendu ErrInvalidFilter", filter, err)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FindAndModifyOptions regroupe les options de FindOneAndUpdate et
+// FindOneAndDelete
+type FindAndModifyOptions struct {
+	// Sort choisit le document modifié lorsque plusieurs vérifient le
+	// filtre : le premier dans cet ordre (par ID à égalité)
+	Sort []SortField `json:"sort,omitempty"`
+	// Projection réduit le document retourné
+	Projection Projection `json:"projection,omitempty"`
+	// ReturnAfter retourne le document après la mise à jour plutôt qu'avant
+	ReturnAfter bool `json:"return_after,omitempty"`
+	// Upsert insère un document si aucun ne vérifie le filtre (voir Upsert)
+	Upsert bool `json:"upsert,omitempty"`
+}
+
+// Upsert remplace par doc le premier document vérifiant filter ou, s'il
+// n'y en a pas, insère doc, sous le verrou exclusif de ce document et celui
+// de la collection : deux appels concurrents avec le même filtre
+// n'insèrent qu'un document. Le
+// document inséré prend le _id du filtre ({"_id": "x"}) s'il n'en a pas.
+func (c *Collection) Upsert(filter Filter, doc Document) (UpdateResult, error) {
+	match, err := compileFilter(filter)
+	if err != nil {
+		return UpdateResult{}, err
+	}
+	// Le document inséré prend le _id du filtre ; doc reste inchangé
+	if docID, ok := filter[IDField].(string); ok {
+		if _, exists := doc[IDField]; !exists {
+			doc = withDocumentID(docID, doc)
+		}
+	}
+
+	var entry *sortedDocument
+	var inserted insertID
+	var result UpdateResult
+	err = c.writeLocked("upsert dans "+c.currentName(), func() ([]string, error) {
+		return c.findOneOrInsert(filter, match, nil, &entry, &inserted, doc)
+	}, func() error {
+		if entry == nil {
+			if _, err := c.insertDocument(inserted.docID, doc); err != nil {
+				return err
+			}
+			result = UpdateResult{UpsertedID: inserted.docID}
+			return nil
+		}
+
+		result = UpdateResult{Matched: 1}
+		replacement := withDocumentID(entry.id, doc)
+		if !sameDocument(entry.doc, replacement) {
+			if _, err := c.putDocument(entry.id, entry.doc, replacement); err != nil {
+				return err
+			}
+			result.Modified = 1
+		}
+		return nil
+	})
+	if err != nil {
+		return UpdateResult{}, err
+	}
+	return result, nil
+}
+
+// FindOneAndUpdate applique update au premier document vérifiant filter et
+// le retourne, tel qu'il était avant la mise à jour ou, avec
+// opts.ReturnAfter, après. Avec opts.Upsert et sans document, un document
+// construit à partir des égalités du filtre puis modifié par update est
+// inséré. Retourne nil si aucun document n'a été trouvé ni inséré.
+func (c *Collection) FindOneAndUpdate(filter Filter, update Update, opts FindAndModifyOptions) (Document, error) {
+	compiled, err := compileUpdate(update)
+	if err != nil {
+		return nil, err
+	}
+	match, err := compileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if err := (FindOptions{Sort: opts.Sort, Projection: opts.Projection}).validate(); err != nil {
+		return nil, err
+	}
+	var doc Document
+	if opts.Upsert {
+		seed, err := upsertSeed(filter)
+		if err != nil {
+			return nil, err
+		}
+		if doc, err = compiled.apply(seed); err != nil {
+			return nil, err
+		}
+	}
+
+	var entry *sortedDocument
+	var inserted insertID
+	var returned Document
+	err = c.writeLocked("find-and-update dans "+c.currentName(), func() ([]string, error) {
+		return c.findOneOrInsert(filter, match, opts.Sort, &entry, &inserted, doc)
+	}, func() error {
+		if entry == nil {
+			if doc == nil {
+				return nil
+			}
+			stored, err := c.insertDocument(inserted.docID, doc)
+			if err != nil {
+				return err
+			}
+			// Avant la mise à jour, il n'y avait pas de document
+			if opts.ReturnAfter {
+				returned = project(copyDocument(stored), opts.Projection)
+			}
+			return nil
+		}
+
+		updated, err := compiled.apply(entry.doc)
+		if err != nil {
+			return err
+		}
+		if !sameDocument(entry.doc, updated) {
+			err := c.replaceDocument(entry.id, entry.doc, updated, c.affectedIndexes(compiled.paths), c.syncWrites())
+			if err != nil {
+				return err
+			}
+		}
+		if opts.ReturnAfter {
+			returned = project(updated, opts.Projection)
+		} else {
+			returned = project(entry.doc, opts.Projection)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return returned, nil
+}
+
+// FindOneAndDelete supprime le premier document vérifiant filter (selon
+// opts.Sort) et le retourne ; nil si aucun document ne vérifie le filtre
+func (c *Collection) FindOneAndDelete(filter Filter, opts FindAndModifyOptions) (Document, error) {
+	match, err := compileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if err := (FindOptions{Sort: opts.Sort, Projection: opts.Projection}).validate(); err != nil {
+		return nil, err
+	}
+
+	var entry *sortedDocument
+	var returned Document
+	err = c.writeLocked("find-and-delete dans "+c.currentName(), func() ([]string, error) {
+		return c.findOneOrInsert(filter, match, opts.Sort, &entry, nil, nil)
+	}, func() error {
+		if entry == nil {
+			return nil
+		}
+		if err := c.removeDocument(entry.id, entry.doc); err != nil {
+			return err
+		}
+		returned = project(entry.doc, opts.Projection)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return returned, nil
+}
+
+// findOneOrInsert cherche, pour writeLocked, le document que modifiera une
+// écriture find-and-modify et le range dans entry ; s'il n'y en a pas et
+// que doc est à insérer, l'ID de doc est choisi dans inserted. Retourne
+// l'ID à verrouiller.
+func (c *Collection) findOneOrInsert(filter Filter, match matcher, sort []SortField, entry **sortedDocument, inserted *insertID, doc Document) ([]string, error) {
+	found, err := c.findOne(filter, match, sort)
+	*entry = found
+	switch {
+	case err != nil:
+		return nil, err
+	case found != nil:
+		return []string{found.id}, nil
+	case doc == nil:
+		return nil, nil
+	}
+	docID, err := inserted.choose(c, doc)
+	if err != nil {
+		return nil, err
+	}
+	return []string{docID}, nil
+}
+
+// findOne retourne le premier document vérifiant filter dans l'ordre de
+// sort, nil s'il n'y en a pas ; l'appelant détient c.mu
+func (c *Collection) findOne(filter Filter, match matcher, sort []SortField) (*sortedDocument, error) {
+	opts := FindOptions{Sort: sort, Limit: 1}
+	planner, err := c.planQuery(filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var found *sortedDocument
+	err = c.execute(planner, match, opts, nil, &Explanation{}, func(entry *sortedDocument) bool {
+		found = entry
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// upsertSeed construit le document d'un upsert à partir des égalités de
+// premier niveau du filtre ({"sku": "x"} ou {"sku": {"$eq": "x"}})
+func upsertSeed(filter Filter) (Document, error) {
+	seed := Document{}
+	for path, condition := range filter {
+		if strings.HasPrefix(path, "$") {
+			continue
+		}
+		value := condition
+		if operators, ok := asMap(condition); ok && isOperatorMap(operators) {
+			eq, hasEq := operators["$eq"]
+			if !hasEq || len(operators) != 1 {
+				continue
+			}
+			value = eq
+		}
+		if err := setPath(seed, path, copyValue(value)); err != nil {
+			return nil, fmt.Errorf("%w: upsert impossible pour %s: %v", ErrInvalidUpdate, path, err)
+		}
+	}
+	return seed, nil
+}
@@ -0,0 +1,115 @@
+package database
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// TestUpsert vérifie qu'Upsert insère avec le _id du filtre, puis
+// remplace le document trouvé
+func TestUpsert(t *testing.T) {
+	c := createTestCollection(t, openTestDatabase(t), "settings")
+
+	result, err := c.Upsert(Filter{IDField: "theme"}, Document{"value": "dark"})
+	if err != nil {
+		t.Fatalf("Upsert: %v", err)
+	}
+	if result.UpsertedID != "theme" || result.Matched != 0 {
+		t.Fatalf("résultat = %+v, attendu l'insertion de theme", result)
+	}
+
+	result, err = c.Upsert(Filter{IDField: "theme"}, Document{"value": "light"})
+	if err != nil {
+		t.Fatalf("Upsert: %v", err)
+	}
+	if result.UpsertedID != "" || result.Matched != 1 || result.Modified != 1 {
+		t.Fatalf("résultat = %+v, attendu le remplacement de theme", result)
+	}
+	if doc := mustGet(t, c, "theme"); doc["value"] != "light" {
+		t.Fatalf("theme = %v", doc)
+	}
+}
+
+// TestConcurrentUpsert vérifie que des upserts concurrents avec le même
+// filtre n'insèrent qu'un document
+func TestConcurrentUpsert(t *testing.T) {
+	c := createTestCollection(t, openTestDatabase(t), "users")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := c.Upsert(Filter{"email": "a@example.com"}, Document{"email": "a@example.com", "writer": i}); err != nil {
+				t.Errorf("Upsert: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if docs, _ := c.Find(Filter{"email": "a@example.com"}, FindOptions{}); len(docs) != 1 {
+		t.Fatalf("%d documents insérés, attendu 1", len(docs))
+	}
+}
+
+// TestFindOneAndUpdate vérifie le choix du document selon le tri, le
+// document retourné avant ou après la mise à jour, et l'upsert construit
+// à partir des égalités du filtre
+func TestFindOneAndUpdate(t *testing.T) {
+	c := createTestCollection(t, openTestDatabase(t), "jobs")
+	mustInsert(t, c, Document{"_id": "a", "state": "ready", "priority": 1})
+	mustInsert(t, c, Document{"_id": "b", "state": "ready", "priority": 5})
+
+	claim := Update{"$set": map[string]interface{}{"state": "running"}}
+	opts := FindAndModifyOptions{Sort: []SortField{{Path: "priority", Desc: true}}}
+	doc, err := c.FindOneAndUpdate(Filter{"state": "ready"}, claim, opts)
+	if err != nil {
+		t.Fatalf("FindOneAndUpdate: %v", err)
+	}
+	if doc[IDField] != "b" || doc["state"] != "ready" {
+		t.Fatalf("retourné %v, attendu b avant la mise à jour", doc)
+	}
+
+	opts.ReturnAfter = true
+	opts.Projection = Projection{"state": true}
+	doc, err = c.FindOneAndUpdate(Filter{"state": "ready"}, claim, opts)
+	if err != nil {
+		t.Fatalf("FindOneAndUpdate: %v", err)
+	}
+	if want := (Document{IDField: "a", "state": "running"}); !reflect.DeepEqual(doc, want) {
+		t.Fatalf("retourné %v, attendu %v", doc, want)
+	}
+
+	if doc, err := c.FindOneAndUpdate(Filter{"state": "ready"}, claim, FindAndModifyOptions{}); err != nil || doc != nil {
+		t.Fatalf("FindOneAndUpdate sans document = %v (%v), attendu nil", doc, err)
+	}
+
+	upsert := FindAndModifyOptions{Upsert: true, ReturnAfter: true}
+	doc, err = c.FindOneAndUpdate(Filter{"state": "ready", "kind": map[string]interface{}{"$eq": "mail"}}, claim, upsert)
+	if err != nil {
+		t.Fatalf("FindOneAndUpdate avec upsert: %v", err)
+	}
+	if doc["state"] != "running" || doc["kind"] != "mail" || doc[IDField] == nil {
+		t.Fatalf("inséré %v, attendu kind du filtre et state de la mise à jour", doc)
+	}
+}
+
+// TestFindOneAndDelete vérifie que le premier document selon le tri est
+// supprimé et retourné
+func TestFindOneAndDelete(t *testing.T) {
+	c := createTestCollection(t, openTestDatabase(t), "jobs")
+	mustInsert(t, c, Document{"_id": "a", "priority": 1})
+	mustInsert(t, c, Document{"_id": "b", "priority": 5})
+
+	doc, err := c.FindOneAndDelete(Filter{}, FindAndModifyOptions{Sort: []SortField{{Path: "priority"}}})
+	if err != nil {
+		t.Fatalf("FindOneAndDelete: %v", err)
+	}
+	if doc[IDField] != "a" {
+		t.Fatalf("retourné %v, attendu a", doc)
+	}
+	if docs, _ := c.GetAllDocuments(); len(docs) != 1 || docs[0][IDField] != "b" {
+		t.Fatalf("restent %v, attendu b seul", docs)
+	}
+}
@@ -0,0 +1,295 @@
+package database
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+)
+
+// SortField est une clé de tri : un chemin de champ et son sens
+type SortField struct {
+	Path string `json:"path"`
+	Desc bool   `json:"desc,omitempty"`
+}
+
+// Projection choisit les champs retournés : uniquement des inclusions
+// (true) ou uniquement des exclusions (false), en notation pointée. Une
+// inclusion retourne aussi _id, sauf si la projection l'exclut.
+type Projection map[string]bool
+
+// FindOptions regroupe les options d'une recherche. Les documents sont
+// triés selon Sort (à égalité, par ID), les Skip premiers sont ignorés et
+// au plus Limit sont retournés (sans limite si Limit est nul), réduits
+// aux champs de Projection. After, un jeton de reprise (voir Iterator),
+// ne retient que les documents qui suivent sa position dans cet ordre.
+type FindOptions struct {
+	Sort       []SortField `json:"sort,omitempty"`
+	Skip       int         `json:"skip,omitempty"`
+	Limit      int         `json:"limit,omitempty"`
+	Projection Projection  `json:"projection,omitempty"`
+	After      string      `json:"after,omitempty"`
+
+	// byID ordonne les documents par ID en l'absence de Sort
+	byID bool
+}
+
+// validate vérifie les options
+func (opts FindOptions) validate() error {
+	if opts.Skip < 0 || opts.Limit < 0 {
+		return fmt.Errorf("%w: skip et limit doivent être positifs", ErrInvalidFilter)
+	}
+	for _, field := range opts.Sort {
+		if err := validatePath(field.Path); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidFilter, err)
+		}
+	}
+	include, exclude := 0, 0
+	for path, included := range opts.Projection {
+		if err := validatePath(path); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidFilter, err)
+		}
+		switch {
+		case included:
+			include++
+		case path != IDField:
+			exclude++
+		}
+	}
+	if include > 0 && exclude > 0 {
+		return fmt.Errorf("%w: une projection ne peut mélanger inclusions et exclusions", ErrInvalidFilter)
+	}
+	return nil
+}
+
+// ordered indique si les documents doivent être triés
+func (opts FindOptions) ordered() bool {
+	return len(opts.Sort) > 0 || opts.After != "" || opts.byID
+}
+
+// window retourne le nombre de documents triés à conserver (skip + limit),
+// 0 s'il faut tout conserver
+func (opts FindOptions) window() int {
+	if opts.Limit <= 0 {
+		return 0
+	}
+	return opts.Skip + opts.Limit
+}
+
+// sortedDocument est un document accompagné de son ID et de sa clé de tri
+type sortedDocument struct {
+	id  string
+	doc Document
+	key []interface{}
+}
+
+// sortKey calcule la clé de tri d'un document : pour chaque champ, sa
+// valeur normalisée ou, pour un tableau, son plus petit élément (tri
+// croissant) ou son plus grand (tri décroissant). Un champ absent se
+// classe avant null.
+func sortKey(doc map[string]interface{}, fields []SortField) []interface{} {
+	key := make([]interface{}, len(fields))
+	for i, field := range fields {
+		var candidates []interface{}
+		for _, value := range pathValues(doc, field.Path) {
+			array, ok := value.([]interface{})
+			if !ok || len(array) == 0 {
+				candidates = append(candidates, normalizeKey(value))
+				continue
+			}
+			for _, element := range array {
+				candidates = append(candidates, normalizeKey(element))
+			}
+		}
+
+		if len(candidates) == 0 {
+			key[i] = missingKey{}
+			continue
+		}
+		best := candidates[0]
+		for _, candidate := range candidates[1:] {
+			cmp := compareValues(candidate, best)
+			if (cmp < 0 && !field.Desc) || (cmp > 0 && field.Desc) {
+				best = candidate
+			}
+		}
+		key[i] = best
+	}
+	return key
+}
+
+// compareSorted compare deux documents selon les clés de tri puis leur ID
+func compareSorted(a, b *sortedDocument, fields []SortField) int {
+	for i, field := range fields {
+		cmp := compareValues(a.key[i], b.key[i])
+		if field.Desc {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp
+		}
+	}
+	switch {
+	case a.id < b.id:
+		return -1
+	case a.id > b.id:
+		return 1
+	}
+	return 0
+}
+
+// documentSorter accumule des documents et les restitue triés. Avec une
+// fenêtre k non nulle, seuls les k premiers sont gardés dans un tas
+// borné, dont la racine est le pire document retenu.
+type documentSorter struct {
+	fields []SortField
+	k      int
+	docs   []*sortedDocument
+}
+
+func (s *documentSorter) Len() int { return len(s.docs) }
+func (s *documentSorter) Less(i, j int) bool {
+	return compareSorted(s.docs[i], s.docs[j], s.fields) > 0
+}
+func (s *documentSorter) Swap(i, j int)      { s.docs[i], s.docs[j] = s.docs[j], s.docs[i] }
+func (s *documentSorter) Push(x interface{}) { s.docs = append(s.docs, x.(*sortedDocument)) }
+func (s *documentSorter) Pop() interface{} {
+	last := s.docs[len(s.docs)-1]
+	s.docs = s.docs[:len(s.docs)-1]
+	return last
+}
+
+// add ajoute un document, en calculant sa clé de tri au besoin
+func (s *documentSorter) add(entry *sortedDocument) {
+	if entry.key == nil {
+		entry.key = sortKey(entry.doc, s.fields)
+	}
+	if s.k <= 0 {
+		s.docs = append(s.docs, entry)
+		return
+	}
+	if len(s.docs) < s.k {
+		heap.Push(s, entry)
+		return
+	}
+	if compareSorted(entry, s.docs[0], s.fields) < 0 {
+		s.docs[0] = entry
+		heap.Fix(s, 0)
+	}
+}
+
+// sorted retourne les documents triés
+func (s *documentSorter) sorted() []*sortedDocument {
+	sort.Slice(s.docs, func(i, j int) bool {
+		return compareSorted(s.docs[i], s.docs[j], s.fields) < 0
+	})
+	return s.docs
+}
+
+// project applique une projection à un document lu du stockage
+func project(doc Document, projection Projection) Document {
+	if len(projection) == 0 {
+		return doc
+	}
+
+	if !projection.inclusive() {
+		for path := range projection {
+			excludePath(doc, splitPath(path))
+		}
+		return doc
+	}
+	return includeFields(doc, projection)
+}
+
+// inclusive indique si la projection liste les champs retournés plutôt que
+// les champs retirés
+func (projection Projection) inclusive() bool {
+	for _, included := range projection {
+		if included {
+			return true
+		}
+	}
+	return false
+}
+
+// includeFields retourne les champs inclus par projection, et _id s'il
+// n'est pas exclu
+func includeFields(doc Document, projection Projection) Document {
+	projected := Document{}
+	for path, included := range projection {
+		if included {
+			includePath(doc, projected, splitPath(path))
+		}
+	}
+	if _, set := projection[IDField]; !set {
+		if docID, exists := doc[IDField]; exists {
+			projected[IDField] = docID
+		}
+	}
+	return projected
+}
+
+// includePath copie dans dst le champ désigné par segments ; un tableau
+// d'objets est projeté élément par élément
+func includePath(src, dst map[string]interface{}, segments []string) {
+	value, exists := src[segments[0]]
+	if !exists {
+		return
+	}
+	if len(segments) == 1 {
+		dst[segments[0]] = value
+		return
+	}
+
+	switch node := value.(type) {
+	case map[string]interface{}:
+		sub, _ := dst[segments[0]].(map[string]interface{})
+		if sub == nil {
+			sub = map[string]interface{}{}
+		}
+		includePath(node, sub, segments[1:])
+		if len(sub) > 0 {
+			dst[segments[0]] = sub
+		}
+	case []interface{}:
+		// Les éléments déjà projetés par un autre chemin sont complétés
+		existing, _ := dst[segments[0]].([]interface{})
+		var projected []interface{}
+		for _, element := range node {
+			object, ok := element.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			var sub map[string]interface{}
+			if len(projected) < len(existing) {
+				sub, _ = existing[len(projected)].(map[string]interface{})
+			}
+			if sub == nil {
+				sub = map[string]interface{}{}
+			}
+			includePath(object, sub, segments[1:])
+			projected = append(projected, sub)
+		}
+		if projected != nil {
+			dst[segments[0]] = projected
+		}
+	}
+}
+
+// excludePath retire de m le champ désigné par segments, dans chaque
+// élément des tableaux traversés
+func excludePath(m map[string]interface{}, segments []string) {
+	if len(segments) == 1 {
+		delete(m, segments[0])
+		return
+	}
+	switch node := m[segments[0]].(type) {
+	case map[string]interface{}:
+		excludePath(node, segments[1:])
+	case []interface{}:
+		for _, element := range node {
+			if object, ok := element.(map[string]interface{}); ok {
+				excludePath(object, segments[1:])
+			}
+		}
+	}
+}
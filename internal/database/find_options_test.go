@@ -0,0 +1,88 @@
+package database
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// sortTestCollection crée des élèves de notes et de classes variées, avec
+// un index ordonné sur score si indexed
+func sortTestCollection(t *testing.T, indexed bool) *Collection {
+	t.Helper()
+	c := createTestCollection(t, openTestDatabase(t), "students")
+	if indexed {
+		if err := c.CreateIndexWithOptions("score", IndexOptions{Type: IndexOrdered}); err != nil {
+			t.Fatalf("CreateIndexWithOptions: %v", err)
+		}
+	}
+	for _, data := range []string{
+		`{"_id": "e", "class": "B", "score": 12, "profile": {"city": "Lyon", "age": 17}}`,
+		`{"_id": "a", "class": "A", "score": 15, "profile": {"city": "Paris", "age": 16}}`,
+		`{"_id": "d", "class": "A", "score": 12, "profile": {"city": "Nice", "age": 18}}`,
+		`{"_id": "c", "class": "B", "score": 19}`,
+		`{"_id": "b", "class": "A"}`,
+	} {
+		mustInsert(t, c, decodeDocument(t, data))
+	}
+	return c
+}
+
+// TestFindSortSkipLimit vérifie le tri sur plusieurs clés, l'égalité
+// départagée par ID, les documents sans le champ en tête, skip et limit,
+// avec et sans index ordonné
+func TestFindSortSkipLimit(t *testing.T) {
+	for _, indexed := range []bool{true, false} {
+		c := sortTestCollection(t, indexed)
+		tests := []struct {
+			opts FindOptions
+			want []string
+		}{
+			{FindOptions{Sort: []SortField{{Path: "score"}}}, []string{"b", "d", "e", "a", "c"}},
+			{FindOptions{Sort: []SortField{{Path: "score", Desc: true}}}, []string{"c", "a", "d", "e", "b"}},
+			{FindOptions{Sort: []SortField{{Path: "class"}, {Path: "score", Desc: true}}}, []string{"a", "d", "b", "c", "e"}},
+			{FindOptions{Sort: []SortField{{Path: "score"}}, Skip: 1, Limit: 2}, []string{"d", "e"}},
+			{FindOptions{Sort: []SortField{{Path: "score"}}, Skip: 10}, []string{}},
+		}
+		for _, test := range tests {
+			docs, err := c.Find(Filter{}, test.opts)
+			if err != nil {
+				t.Fatalf("Find: %v", err)
+			}
+			if got := documentIDs(docs); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("index %v, Find(%+v) = %v, attendu %v", indexed, test.opts, got, test.want)
+			}
+		}
+	}
+}
+
+// TestFindProjection vérifie les projections par inclusion, y compris de
+// champs imbriqués, et par exclusion
+func TestFindProjection(t *testing.T) {
+	c := sortTestCollection(t, false)
+	tests := []struct {
+		projection Projection
+		want       string
+	}{
+		{Projection{"score": true, "profile.city": true}, `{"_id": "a", "score": 15, "profile": {"city": "Paris"}}`},
+		{Projection{"score": true, IDField: false}, `{"score": 15}`},
+		{Projection{"profile": false, "class": false}, `{"_id": "a", "score": 15}`},
+	}
+	for _, test := range tests {
+		docs, err := c.Find(Filter{IDField: "a"}, FindOptions{Projection: test.projection})
+		if err != nil {
+			t.Fatalf("Find: %v", err)
+		}
+		if want := decodeDocument(t, test.want); len(docs) != 1 || !reflect.DeepEqual(docs[0], want) {
+			t.Errorf("projection %v = %v, attendu %v", test.projection, docs, want)
+		}
+	}
+
+	_, err := c.Find(Filter{}, FindOptions{Projection: Projection{"score": true, "class": false}})
+	if !errors.Is(err, ErrInvalidFilter) {
+		t.Fatalf("projection mixte: %v, attendu ErrInvalidFilter", err)
+	}
+	if _, err := c.Find(Filter{}, FindOptions{Limit: -1}); !errors.Is(err, ErrInvalidFilter) {
+		t.Fatalf("limite négative: %v, attendu ErrInvalidFilter", err)
+	}
+}
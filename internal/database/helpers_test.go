@@ -0,0 +1,85 @@
+package database
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// openTestDatabase ouvre une base dans un répertoire temporaire, fermée à
+// la fin du test
+func openTestDatabase(t *testing.T) *Database {
+	t.Helper()
+	return openTestDatabaseAt(t, t.TempDir())
+}
+
+// openTestDatabaseAt ouvre la base du répertoire dir, fermée à la fin du
+// test
+func openTestDatabaseAt(t *testing.T, dir string) *Database {
+	t.Helper()
+	db, err := NewDatabase(dir)
+	if err != nil {
+		t.Fatalf("NewDatabase: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// createTestCollection crée la collection name dans db
+func createTestCollection(t *testing.T, db *Database, name string) *Collection {
+	t.Helper()
+	collection, err := db.CreateCollection(name)
+	if err != nil {
+		t.Fatalf("CreateCollection(%s): %v", name, err)
+	}
+	return collection
+}
+
+// mustInsert insère doc dans c et retourne son ID
+func mustInsert(t *testing.T, c *Collection, doc Document) string {
+	t.Helper()
+	docID, err := c.Insert(doc)
+	if err != nil {
+		t.Fatalf("Insert(%v): %v", doc, err)
+	}
+	return docID
+}
+
+// mustGet lit le document docID de c
+func mustGet(t *testing.T, c *Collection, docID string) Document {
+	t.Helper()
+	doc, err := c.FindByID(docID)
+	if err != nil {
+		t.Fatalf("FindByID(%s): %v", docID, err)
+	}
+	return doc
+}
+
+// documentNames retourne le champ name de docs, dans leur ordre
+func documentNames(docs []Document) []string {
+	names := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		name, _ := doc["name"].(string)
+		names = append(names, name)
+	}
+	return names
+}
+
+// documentIDs retourne les _id de docs, dans leur ordre
+func documentIDs(docs []Document) []string {
+	ids := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		id, _ := doc[IDField].(string)
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// decodeDocument décode un document JSON comme le ferait l'API
+func decodeDocument(t *testing.T, data string) Document {
+	t.Helper()
+	var doc Document
+	if err := json.Unmarshal([]byte(data), &doc); err != nil {
+		t.Fatalf("document %s: %v", data, err)
+	}
+	return doc
+}
@@ -0,0 +1,330 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// IDField est le champ réservé qui porte l'ID d'un document : il est
+// ajouté aux documents lus et peut être fourni à l'insertion
+const IDField = "_id"
+
+// IDGenerator choisit comment une collection génère l'ID des documents
+// insérés sans _id
+type IDGenerator string
+
+const (
+	// IDGeneratorULID génère des ULID : 26 caractères, triés par date de
+	// création, y compris dans une même milliseconde
+	IDGeneratorULID IDGenerator = "ulid"
+	// IDGeneratorUUIDv7 génère des UUID version 7 (RFC 9562), triés par
+	// date de création
+	IDGeneratorUUIDv7 IDGenerator = "uuidv7"
+	// IDGeneratorHex génère 128 bits aléatoires en hexadécimal
+	IDGeneratorHex IDGenerator = "hex"
+	// IDGeneratorCounter génère un compteur croissant : 1, 2, 3...
+	IDGeneratorCounter IDGenerator = "counter"
+)
+
+// ErrInvalidID signale un _id fourni invalide ou modifié
+var ErrInvalidID = errors.New("ID de document invalide")
+
+// ErrDuplicateID signale l'insertion d'un _id déjà utilisé
+var ErrDuplicateID = errors.New("ID de document déjà utilisé")
+
+// validDocumentID restreint les ID fournis à des noms de fichier sûrs
+var validDocumentID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._@-]{0,127}$`)
+
+// reservedDocumentIDs nomment les actions de l'API HTTP d'une collection
+// (/api/{collection}/query...) : un document portant l'un de ces ID ne
+// pourrait y être ni lu, ni modifié, ni supprimé
+var reservedDocumentIDs = map[string]bool{
+	"search":          true,
+	"query":           true,
+	"aggregate":       true,
+	"update":          true,
+	"upsert":          true,
+	"find-and-update": true,
+	"find-and-delete": true,
+}
+
+// crockford est l'alphabet base32 des ULID
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// idGenerator génère les ID d'une collection ; sûr pour un usage concurrent
+type idGenerator struct {
+	kind IDGenerator
+
+	mu     sync.Mutex
+	lastMS uint64
+	// random est la partie aléatoire du dernier ULID, incrémentée dans
+	// une même milliseconde
+	random [10]byte
+	// sequence est le compteur des UUIDv7 d'une même milliseconde
+	sequence uint16
+	// counter est le dernier ID de IDGeneratorCounter, lu au premier usage
+	counter       uint64
+	counterLoaded bool
+}
+
+// newIDGenerator crée le générateur kind (IDGeneratorULID par défaut)
+func newIDGenerator(kind IDGenerator) (*idGenerator, error) {
+	switch kind {
+	case "":
+		kind = IDGeneratorULID
+	case IDGeneratorULID, IDGeneratorUUIDv7, IDGeneratorHex, IDGeneratorCounter:
+	default:
+		return nil, fmt.Errorf("générateur d'ID inconnu: %s", kind)
+	}
+	return &idGenerator{kind: kind}, nil
+}
+
+// next retourne un nouvel ID ; scan parcourt les documents existants pour
+// initialiser le compteur
+func (g *idGenerator) next(scan func(fn func(docID string, doc Document) error) error) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch g.kind {
+	case IDGeneratorUUIDv7:
+		return g.uuidv7()
+	case IDGeneratorHex:
+		var buf [16]byte
+		if _, err := rand.Read(buf[:]); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(buf[:]), nil
+	case IDGeneratorCounter:
+		if !g.counterLoaded {
+			err := scan(func(docID string, doc Document) error {
+				if n, err := strconv.ParseUint(docID, 10, 64); err == nil && n > g.counter {
+					g.counter = n
+				}
+				return nil
+			})
+			if err != nil {
+				return "", err
+			}
+			g.counterLoaded = true
+		}
+		g.counter++
+		return strconv.FormatUint(g.counter, 10), nil
+	}
+	return g.ulid()
+}
+
+// tick avance l'horloge du générateur et indique si la milliseconde est
+// nouvelle ; une horloge qui recule garde la dernière milliseconde
+func (g *idGenerator) tick() bool {
+	ms := uint64(time.Now().UnixMilli())
+	if ms > g.lastMS {
+		g.lastMS = ms
+		return true
+	}
+	return false
+}
+
+// ulid génère un ULID : 48 bits de millisecondes puis 80 bits aléatoires,
+// incrémentés dans une même milliseconde pour rester triés
+func (g *idGenerator) ulid() (string, error) {
+	if g.tick() {
+		if _, err := rand.Read(g.random[:]); err != nil {
+			return "", err
+		}
+	} else {
+		i := len(g.random) - 1
+		for ; i >= 0; i-- {
+			g.random[i]++
+			if g.random[i] != 0 {
+				break
+			}
+		}
+		if i < 0 {
+			// Partie aléatoire épuisée : emprunter la milliseconde suivante
+			g.lastMS++
+		}
+	}
+
+	var buf [16]byte
+	binary.BigEndian.PutUint16(buf[0:2], uint16(g.lastMS>>32))
+	binary.BigEndian.PutUint32(buf[2:6], uint32(g.lastMS))
+	copy(buf[6:], g.random[:])
+
+	// 26 caractères de 5 bits, les 2 bits de tête étant nuls
+	hi, lo := binary.BigEndian.Uint64(buf[:8]), binary.BigEndian.Uint64(buf[8:])
+	var out [26]byte
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:]), nil
+}
+
+// uuidv7 génère un UUID version 7 : 48 bits de millisecondes, un compteur
+// de 12 bits dans la milliseconde (RFC 9562, méthode 1) puis 62 bits
+// aléatoires
+func (g *idGenerator) uuidv7() (string, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+
+	// Le compteur démarre au hasard sur 11 bits pour garder de la marge
+	switch {
+	case g.tick():
+		g.sequence = binary.BigEndian.Uint16(buf[6:8]) & 0x7FF
+	case g.sequence < 0xFFF:
+		g.sequence++
+	default:
+		// Compteur épuisé : emprunter la milliseconde suivante
+		g.lastMS++
+		g.sequence = binary.BigEndian.Uint16(buf[6:8]) & 0x7FF
+	}
+
+	binary.BigEndian.PutUint16(buf[0:2], uint16(g.lastMS>>32))
+	binary.BigEndian.PutUint32(buf[2:6], uint32(g.lastMS))
+	binary.BigEndian.PutUint16(buf[6:8], 0x7000|g.sequence)
+	buf[8] = buf[8]&0x3F | 0x80
+
+	encoded := hex.EncodeToString(buf[:])
+	return encoded[0:8] + "-" + encoded[8:12] + "-" + encoded[12:16] + "-" + encoded[16:20] + "-" + encoded[20:], nil
+}
+
+// insertID est l'ID choisi pour un document à insérer par une écriture
+// verrouillant ses documents avant de les écrire (voir writeLocked)
+type insertID struct {
+	docID     string
+	generated bool
+}
+
+// choose retourne l'ID du document doc à insérer : son _id, ou un ID
+// généré une fois puis gardé tant qu'il reste libre ; l'existence d'un _id
+// fourni est vérifiée à l'insertion. L'appelant détient c.mu.
+func (id *insertID) choose(c *Collection, doc Document) (string, error) {
+	if id.docID == "" || id.generated && c.documentExists(id.docID) {
+		docID, generated, err := c.candidateID(doc)
+		if err != nil {
+			return "", err
+		}
+		*id = insertID{docID: docID, generated: generated}
+	}
+	return id.docID, nil
+}
+
+// validateDocumentID vérifie qu'un ID reçu pour une écriture est un nom de
+// fichier sûr, comme le _id d'un document inséré
+func validateDocumentID(docID string) error {
+	if !validDocumentID.MatchString(docID) {
+		return invalidIDError(docID)
+	}
+	if reservedDocumentIDs[docID] {
+		return fmt.Errorf("%w: %s est réservé à une action de l'API", ErrInvalidID, docID)
+	}
+	return nil
+}
+
+// invalidIDError signale un _id fourni invalide, avec les règles à suivre
+func invalidIDError(raw interface{}) error {
+	return fmt.Errorf("%w: %v (lettres, chiffres, . _ @ -, 128 caractères au plus)", ErrInvalidID, raw)
+}
+
+// candidateID retourne le _id de doc, validé, ou un ID généré (generated),
+// sans vérifier qu'il est libre ; l'appelant détient c.mu
+func (c *Collection) candidateID(doc Document) (docID string, generated bool, err error) {
+	if raw, exists := doc[IDField]; exists {
+		docID, ok := raw.(string)
+		if !ok {
+			return "", false, invalidIDError(raw)
+		}
+		if err := validateDocumentID(docID); err != nil {
+			return "", false, err
+		}
+		return docID, false, nil
+	}
+	if docID, err = c.ids.next(c.scan); err != nil {
+		return "", true, fmt.Errorf("erreur génération ID: %v", err)
+	}
+	return docID, true, nil
+}
+
+// reserveDocumentID choisit l'ID d'un document à insérer, son _id ou un ID
+// généré, et le verrouille avec lock avant de vérifier qu'il est libre : un ID
+// fourni déjà pris reste à vérifier par l'appelant, un ID généré pris est
+// remplacé. L'appelant ne détient pas c.mu.
+func (c *Collection) reserveDocumentID(doc Document, lock func(docID string) error) (string, error) {
+	for {
+		c.mu.RLock()
+		docID, generated, err := c.candidateID(doc)
+		c.mu.RUnlock()
+		if err != nil {
+			return "", err
+		}
+		if err := lock(docID); err != nil {
+			return "", err
+		}
+		if !generated {
+			return docID, nil
+		}
+
+		c.mu.RLock()
+		exists := c.documentExists(docID)
+		c.mu.RUnlock()
+		if !exists {
+			return docID, nil
+		}
+	}
+}
+
+// documentExists indique si le document docID existe ; l'appelant détient c.mu
+func (c *Collection) documentExists(docID string) bool {
+	_, err := c.storage.Get(docID)
+	return err == nil
+}
+
+// setDocumentID inscrit docID dans le _id de doc, qui ne peut désigner un
+// autre document ; doc appartient à l'appelant (sinon voir checkDocumentID)
+func setDocumentID(docID string, doc map[string]interface{}) error {
+	if err := checkDocumentID(docID, doc); err != nil {
+		return err
+	}
+	doc[IDField] = docID
+	return nil
+}
+
+// checkDocumentID vérifie que le _id de doc, s'il en a un, est docID
+func checkDocumentID(docID string, doc map[string]interface{}) error {
+	if raw, exists := doc[IDField]; exists && raw != docID {
+		return fmt.Errorf("%w: le champ _id (%v) du document %s ne peut être modifié", ErrInvalidID, raw, docID)
+	}
+	return nil
+}
+
+// withDocumentID retourne doc avec son _id, copié s'il faut l'ajouter
+// (images du WAL antérieures au champ _id)
+func withDocumentID(docID string, doc map[string]interface{}) map[string]interface{} {
+	if _, exists := doc[IDField]; exists || doc == nil {
+		return doc
+	}
+	copied := make(map[string]interface{}, len(doc)+1)
+	for key, value := range doc {
+		copied[key] = value
+	}
+	copied[IDField] = docID
+	return copied
+}
+
+// scan parcourt les documents de la collection, avec leur _id ; l'appelant
+// détient c.mu
+func (c *Collection) scan(fn func(docID string, doc Document) error) error {
+	return c.storage.Scan(func(docID string, doc Document) error {
+		return fn(docID, withDocumentID(docID, doc))
+	})
+}
@@ -0,0 +1,168 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+// TestInsertLeavesArgumentUnmodified vérifie qu'un document peut être
+// réutilisé : Insert n'y inscrit pas l'ID généré
+func TestInsertLeavesArgumentUnmodified(t *testing.T) {
+	db := openTestDatabase(t)
+	c := createTestCollection(t, db, "items")
+
+	doc := Document{"name": "lampe"}
+	first := mustInsert(t, c, doc)
+	second := mustInsert(t, c, doc)
+	if first == second {
+		t.Fatalf("deux insertions du même document ont le même ID %s", first)
+	}
+	if _, exists := doc[IDField]; exists {
+		t.Fatalf("Insert a modifié son argument: %v", doc)
+	}
+	if stored := mustGet(t, c, first); stored[IDField] != first {
+		t.Fatalf("_id lu = %v, attendu %s", stored[IDField], first)
+	}
+}
+
+// TestWritesLeaveArgumentUnmodified vérifie que les autres écritures ne
+// modifient pas non plus le document reçu
+func TestWritesLeaveArgumentUnmodified(t *testing.T) {
+	db := openTestDatabase(t)
+	c := createTestCollection(t, db, "items")
+	mustInsert(t, c, Document{"_id": "a", "n": 1})
+
+	doc := Document{"n": 2}
+	rev, err := c.UpdateWithPrecondition("a", doc, Precondition{})
+	if err != nil {
+		t.Fatalf("UpdateWithPrecondition: %v", err)
+	}
+	if rev != Revision(mustGet(t, c, "a")) {
+		t.Fatalf("révision retournée %s, attendu celle du document enregistré", rev)
+	}
+
+	if _, err := c.Upsert(Filter{"_id": "b"}, doc); err != nil {
+		t.Fatalf("Upsert: %v", err)
+	}
+	if _, err := c.Upsert(Filter{"_id": "a"}, doc); err != nil {
+		t.Fatalf("Upsert: %v", err)
+	}
+	if _, err := c.BulkWrite([]WriteOp{{Op: "insert", Document: doc}, {Op: "update", ID: "a", Document: doc}}, true); err != nil {
+		t.Fatalf("BulkWrite: %v", err)
+	}
+	tx := db.BeginTransaction()
+	if _, err := db.InsertWithTransaction(tx, "items", doc); err != nil {
+		t.Fatalf("InsertWithTransaction: %v", err)
+	}
+	if err := db.UpdateWithTransaction(tx, "items", "b", doc); err != nil {
+		t.Fatalf("UpdateWithTransaction: %v", err)
+	}
+	if err := db.Commit(tx); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	if len(doc) != 1 || doc["n"] != 2 {
+		t.Fatalf("document modifié par les écritures: %v", doc)
+	}
+	if stored := mustGet(t, c, "b"); stored[IDField] != "b" {
+		t.Fatalf("_id de l'upsert = %v, attendu b", stored[IDField])
+	}
+}
+
+// TestClientSuppliedID vérifie qu'un _id fourni est gardé, validé et unique
+func TestClientSuppliedID(t *testing.T) {
+	db := openTestDatabase(t)
+	c := createTestCollection(t, db, "items")
+
+	if docID := mustInsert(t, c, Document{"_id": "sku-1"}); docID != "sku-1" {
+		t.Fatalf("ID = %s, attendu sku-1", docID)
+	}
+	if _, err := c.Insert(Document{"_id": "sku-1"}); !errors.Is(err, ErrDuplicateID) {
+		t.Fatalf("_id en double: %v, attendu ErrDuplicateID", err)
+	}
+	if _, err := c.Insert(Document{"_id": "../x"}); !errors.Is(err, ErrInvalidID) {
+		t.Fatalf("_id invalide: %v, attendu ErrInvalidID", err)
+	}
+	if _, err := c.Insert(Document{"_id": "query"}); !errors.Is(err, ErrInvalidID) {
+		t.Fatalf("_id réservé: %v, attendu ErrInvalidID", err)
+	}
+	if err := c.Update("sku-1", Document{"_id": "sku-2"}); !errors.Is(err, ErrInvalidID) {
+		t.Fatalf("_id modifié: %v, attendu ErrInvalidID", err)
+	}
+}
+
+// TestCounterGenerator vérifie que le compteur reprend après le plus grand
+// ID existant
+func TestCounterGenerator(t *testing.T) {
+	db := openTestDatabase(t)
+	c, err := db.CreateCollectionWithOptions("items", CollectionOptions{IDGenerator: IDGeneratorCounter})
+	if err != nil {
+		t.Fatalf("CreateCollectionWithOptions: %v", err)
+	}
+	mustInsert(t, c, Document{"_id": "41"})
+	if docID := mustInsert(t, c, Document{}); docID != "42" {
+		t.Fatalf("ID généré = %s, attendu 42", docID)
+	}
+}
+
+// TestWritesRejectInvalidID vérifie que chaque écriture par ID refuse,
+// comme l'insertion, un ID vide, un chemin, un nom de fichier temporaire ou
+// un ID réservé à l'API, sans rien écrire
+func TestWritesRejectInvalidID(t *testing.T) {
+	writes := map[string]func(db *Database, c *Collection, docID string) error{
+		"Update": func(db *Database, c *Collection, docID string) error {
+			return c.Update(docID, Document{"n": 1})
+		},
+		"Delete": func(db *Database, c *Collection, docID string) error {
+			return c.Delete(docID)
+		},
+		"UpdateByID": func(db *Database, c *Collection, docID string) error {
+			_, err := c.UpdateByID(docID, Update{"$set": map[string]interface{}{"n": 1}})
+			return err
+		},
+		"MergePatch": func(db *Database, c *Collection, docID string) error {
+			_, err := c.MergePatch(docID, map[string]interface{}{"n": 1})
+			return err
+		},
+		"Upsert": func(db *Database, c *Collection, docID string) error {
+			_, err := c.Upsert(Filter{IDField: docID}, Document{"n": 1})
+			return err
+		},
+		"UpdateWithTransaction": func(db *Database, c *Collection, docID string) error {
+			tx := db.BeginTransaction()
+			defer db.Rollback(tx)
+			return db.UpdateWithTransaction(tx, "items", docID, Document{"n": 1})
+		},
+		"DeleteWithTransaction": func(db *Database, c *Collection, docID string) error {
+			tx := db.BeginTransaction()
+			defer db.Rollback(tx)
+			return db.DeleteWithTransaction(tx, "items", docID)
+		},
+		"entrée du log": func(db *Database, c *Collection, docID string) error {
+			tx := db.BeginTransaction()
+			tx.AddLogEntry(LogEntry{Operation: OpInsert, Collection: "items", DocumentID: docID, Data: Document{"n": 1}})
+			return db.Commit(tx)
+		},
+		"ApplyLogEntry": func(db *Database, c *Collection, docID string) error {
+			return db.ApplyLogEntry(LogEntry{Operation: OpInsert, Collection: "items", DocumentID: docID, Data: Document{"n": 1}})
+		},
+	}
+	for name, write := range writes {
+		t.Run(name, func(t *testing.T) {
+			for _, docID := range []string{"", "../escaped", ".x.json.tmp-1", "find-and-update"} {
+				db := openTestDatabase(t)
+				c := createTestCollection(t, db, "items")
+				if err := write(db, c, docID); !errors.Is(err, ErrInvalidID) {
+					t.Errorf("ID %q: %v, attendu ErrInvalidID", docID, err)
+				}
+				if docs, _ := c.GetAllDocuments(); len(docs) != 0 {
+					t.Errorf("ID %q: documents écrits %v", docID, docs)
+				}
+				if entries, _ := os.ReadDir(db.path); len(entries) != 3 {
+					t.Errorf("ID %q: %d entrées dans la base, attendu items, wal et le catalogue", docID, len(entries))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,786 @@
+package database
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+)
+
+// IndexType identifie la structure d'un index
+type IndexType string
+
+const (
+	// IndexHash ne sert que les recherches par égalité
+	IndexHash IndexType = "hash"
+	// IndexOrdered garde les valeurs triées : recherches par intervalle,
+	// par préfixe et parcours ordonné pour les tris
+	IndexOrdered IndexType = "ordered"
+)
+
+// IndexOptions regroupe les options de création d'un index ; un Name vide
+// donne le nom par défaut (voir indexName)
+type IndexOptions struct {
+	Name   string
+	Unique bool
+	Type   IndexType
+}
+
+// Index représente un index sur un champ ou, composé, sur plusieurs champs
+type Index struct {
+	name     string
+	fields   []IndexField
+	unique   bool       // indique si l'index est unique
+	kind     IndexType  // structure de l'index
+	store    indexStore // valeur -> liste d'IDs
+	entries  int        // nombre de couples valeur/document
+	multikey bool       // un document figure sous plusieurs valeurs
+	mu       sync.RWMutex
+}
+
+// IndexStats résume le contenu d'un index ; le planificateur de requêtes
+// s'en sert pour estimer le nombre de documents d'un parcours d'index
+type IndexStats struct {
+	Keys     int  `json:"keys"`     // valeurs distinctes
+	Entries  int  `json:"entries"`  // couples valeur/document
+	Multikey bool `json:"multikey"` // un document figure sous plusieurs valeurs
+}
+
+// Bound est une borne d'intervalle
+type Bound struct {
+	Value     interface{}
+	Inclusive bool
+}
+
+// Range est un intervalle de valeurs ; une borne nil n'est pas bornée
+type Range struct {
+	Lower *Bound
+	Upper *Bound
+}
+
+// Between retourne l'intervalle fermé [min, max]
+func Between(min, max interface{}) Range {
+	return Range{
+		Lower: &Bound{Value: min, Inclusive: true},
+		Upper: &Bound{Value: max, Inclusive: true},
+	}
+}
+
+// contains indique si une valeur normalisée est dans l'intervalle. Comme
+// dans MongoDB, une borne ne retient que les valeurs de son propre type :
+// {Lower: 18} ne contient pas de chaînes.
+func (r Range) contains(value interface{}) bool {
+	if r.Lower != nil {
+		lower := normalizeKey(r.Lower.Value)
+		cmp := compareValues(value, lower)
+		if typeRank(value) != typeRank(lower) || cmp < 0 || (cmp == 0 && !r.Lower.Inclusive) {
+			return false
+		}
+	}
+	if r.Upper != nil {
+		upper := normalizeKey(r.Upper.Value)
+		cmp := compareValues(value, upper)
+		if typeRank(value) != typeRank(upper) || cmp > 0 || (cmp == 0 && !r.Upper.Inclusive) {
+			return false
+		}
+	}
+	return true
+}
+
+// indexStore associe des valeurs normalisées aux IDs des documents
+type indexStore interface {
+	add(key interface{}, docID string)
+	// remove indique si docID figurait sous key
+	remove(key interface{}, docID string) bool
+	lookup(key interface{}) []string
+	// ascend parcourt les valeurs ; l'ordre n'est garanti que pour un store ordonné
+	ascend(fn func(key interface{}, ids []string) bool)
+	len() int
+}
+
+// newIndex crée un index vide à partir de sa définition
+func newIndex(definition IndexDefinition) *Index {
+	fields := definition.Fields
+	if len(fields) == 0 && definition.Field != "" {
+		fields = []IndexField{{Path: definition.Field}}
+	}
+	index := &Index{
+		name:   definition.Name,
+		fields: append([]IndexField(nil), fields...),
+		unique: definition.Unique,
+		kind:   definition.Type,
+	}
+	if index.name == "" {
+		index.name = indexName(fields)
+	}
+	if index.kind == "" {
+		index.kind = IndexHash
+	}
+
+	if index.kind == IndexOrdered {
+		index.store = newSkipList()
+	} else {
+		index.store = make(hashStore)
+	}
+	return index
+}
+
+// Definition retourne la définition canonique de l'index : un index
+// simple croissant portant le nom de son champ s'écrit avec Field seul
+func (index *Index) Definition() IndexDefinition {
+	definition := IndexDefinition{Unique: index.unique}
+	if len(index.fields) == 1 && !index.fields[0].Desc && index.name == index.fields[0].Path {
+		definition.Field = index.fields[0].Path
+	} else {
+		definition.Name = index.name
+		definition.Fields = append([]IndexField(nil), index.fields...)
+	}
+	if index.kind != IndexHash {
+		definition.Type = index.kind
+	}
+	return definition
+}
+
+// Ordered indique si l'index garde ses valeurs triées
+func (index *Index) Ordered() bool {
+	return index.kind == IndexOrdered
+}
+
+// Name retourne le nom de l'index
+func (index *Index) Name() string {
+	return index.name
+}
+
+// keys retourne les valeurs indexées d'un document, sans doublon. Un
+// champ tableau est indexé en entier et élément par élément (multikey) ;
+// un document n'ayant aucun des champs de l'index n'y figure pas.
+func (index *Index) keys(doc map[string]interface{}) []interface{} {
+	var keys []interface{}
+	if !index.compound() {
+		keys = matchValues(doc, index.fields[0].Path)
+	} else {
+		tuples, present := index.tuples(doc)
+		if present == 0 {
+			return nil
+		}
+		for _, tuple := range tuples {
+			keys = append(keys, index.encodeTuple(tuple))
+		}
+	}
+	if len(keys) < 2 {
+		return keys
+	}
+
+	seen := make(map[interface{}]bool, len(keys))
+	unique := keys[:0]
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+		}
+	}
+	return unique
+}
+
+// Stats retourne les statistiques de l'index
+func (index *Index) Stats() IndexStats {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+	return IndexStats{Keys: index.store.len(), Entries: index.entries, Multikey: index.multikey}
+}
+
+// add indexe les valeurs de doc pour docID
+func (index *Index) add(docID string, doc map[string]interface{}) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	index.addDocument(docID, doc)
+}
+
+// addDocument indexe doc sans prendre index.mu, pour un index en cours
+// de construction ou dont l'appelant détient le verrou
+func (index *Index) addDocument(docID string, doc map[string]interface{}) {
+	keys := index.keys(doc)
+	if len(keys) > 1 {
+		index.multikey = true
+	}
+	for _, key := range keys {
+		index.insertKey(key, docID)
+	}
+}
+
+// insertKey ajoute docID sous key ; l'appelant détient index.mu
+func (index *Index) insertKey(key interface{}, docID string) {
+	index.store.add(key, docID)
+	index.entries++
+}
+
+// remove retire docID des valeurs de doc
+func (index *Index) remove(docID string, doc map[string]interface{}) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	index.removeDocument(docID, doc)
+}
+
+// removeDocument retire doc sans prendre index.mu ; l'appelant détient le verrou
+func (index *Index) removeDocument(docID string, doc map[string]interface{}) {
+	for _, key := range index.keys(doc) {
+		if index.store.remove(key, docID) {
+			index.entries--
+		}
+	}
+}
+
+// conflict retourne la première valeur unique de doc déjà prise par un
+// autre document que docID ; pour un index composé, la valeur retournée
+// est le tuple des champs, et seuls les tuples complets sont contraints
+func (index *Index) conflict(docID string, doc map[string]interface{}) (interface{}, bool) {
+	if !index.unique {
+		return nil, false
+	}
+
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+	return index.conflictLocked(docID, doc)
+}
+
+// conflictLocked est conflict pour un appelant détenant index.mu
+func (index *Index) conflictLocked(docID string, doc map[string]interface{}) (interface{}, bool) {
+	if !index.unique {
+		return nil, false
+	}
+	if !index.compound() {
+		for _, key := range index.keys(doc) {
+			if index.taken(key, docID) {
+				return key, true
+			}
+		}
+		return nil, false
+	}
+
+	tuples, present := index.tuples(doc)
+	if present < len(index.fields) {
+		return nil, false
+	}
+	for _, tuple := range tuples {
+		if index.taken(index.encodeTuple(tuple), docID) {
+			return tuple, true
+		}
+	}
+	return nil, false
+}
+
+// claim indexe les clés de doc absentes de oldDoc (nil pour une
+// insertion) après avoir vérifié, sous le même verrou, qu'elles respectent
+// l'unicité : deux écritures concurrentes ne peuvent prendre la même
+// valeur. Les clés de oldDoc restent indexées jusqu'à settle.
+func (index *Index) claim(docID string, oldDoc, doc map[string]interface{}) error {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	if value, taken := index.conflictLocked(docID, doc); taken {
+		return index.conflictError(value)
+	}
+	if len(index.keys(doc)) > 1 {
+		index.multikey = true
+	}
+	for _, key := range index.changedKeys(doc, oldDoc) {
+		index.insertKey(key, docID)
+	}
+	return nil
+}
+
+// settle retire de l'index les clés de oldDoc absentes de doc, une fois
+// doc écrit ; settle(docID, doc, oldDoc) annule un claim
+func (index *Index) settle(docID string, oldDoc, doc map[string]interface{}) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	for _, key := range index.changedKeys(oldDoc, doc) {
+		if index.store.remove(key, docID) {
+			index.entries--
+		}
+	}
+}
+
+// changedKeys retourne les clés de doc qui ne sont pas celles de other
+func (index *Index) changedKeys(doc, other map[string]interface{}) []interface{} {
+	keys := index.keys(doc)
+	if len(keys) == 0 || other == nil {
+		return keys
+	}
+	kept := make(map[interface{}]bool)
+	for _, key := range index.keys(other) {
+		kept[key] = true
+	}
+	changed := keys[:0]
+	for _, key := range keys {
+		if !kept[key] {
+			changed = append(changed, key)
+		}
+	}
+	return changed
+}
+
+// uniqueKeys retourne les clés de doc soumises à l'unicité : toutes ses
+// valeurs ou, pour un index composé, ses seuls tuples complets
+func (index *Index) uniqueKeys(doc map[string]interface{}) []interface{} {
+	if !index.compound() {
+		return index.keys(doc)
+	}
+	tuples, present := index.tuples(doc)
+	if present < len(index.fields) {
+		return nil
+	}
+	keys := make([]interface{}, len(tuples))
+	for i, tuple := range tuples {
+		keys[i] = index.encodeTuple(tuple)
+	}
+	return keys
+}
+
+// taken indique si key est indexée pour un autre document que docID ;
+// l'appelant détient index.mu
+func (index *Index) taken(key interface{}, docID string) bool {
+	for _, id := range index.store.lookup(key) {
+		if id != docID {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup retourne les IDs des documents ayant la valeur donnée
+func (index *Index) lookup(value interface{}) []string {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+	return append([]string(nil), index.store.lookup(normalizeKey(value))...)
+}
+
+// scanRange parcourt dans l'ordre les valeurs de l'intervalle ; réservé aux index ordonnés
+func (index *Index) scanRange(r Range, fn func(key interface{}, ids []string) bool) {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+	index.store.(*skipList).scanRange(r, fn)
+}
+
+// scanPrefix parcourt dans l'ordre les chaînes commençant par prefix ; réservé aux index ordonnés
+func (index *Index) scanPrefix(prefix string, fn func(key interface{}, ids []string) bool) {
+	r := Range{Lower: &Bound{Value: prefix, Inclusive: true}}
+	index.scanRange(r, func(key interface{}, ids []string) bool {
+		str, ok := key.(string)
+		if !ok || !strings.HasPrefix(str, prefix) {
+			return false
+		}
+		return fn(key, ids)
+	})
+}
+
+// ascend parcourt les valeurs (dans l'ordre pour un index ordonné)
+func (index *Index) ascend(fn func(key interface{}, ids []string) bool) {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+	index.store.ascend(fn)
+}
+
+// descend parcourt les valeurs par ordre décroissant ; réservé aux index ordonnés
+func (index *Index) descend(fn func(key interface{}, ids []string) bool) {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+	index.store.(*skipList).descend(fn)
+}
+
+// compositeKey représente un objet ou un tableau indexé par son encodage
+// JSON canonique, ce qui le rend utilisable comme clé de map
+type compositeKey struct {
+	encoded string
+}
+
+// MarshalJSON restitue la valeur d'origine
+func (k compositeKey) MarshalJSON() ([]byte, error) {
+	return []byte(k.encoded), nil
+}
+
+// normalizeKey ramène une valeur à sa forme indexée : tous les nombres
+// deviennent des float64 (comme après un aller-retour JSON), objets et
+// tableaux deviennent des compositeKey
+func normalizeKey(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, float64, string, bool, compositeKey:
+		return v
+	case int:
+		return float64(v)
+	case int8:
+		return float64(v)
+	case int16:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint:
+		return float64(v)
+	case uint8:
+		return float64(v)
+	case uint16:
+		return float64(v)
+	case uint32:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case json.Number:
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case json.RawMessage:
+		var decoded interface{}
+		if err := json.Unmarshal(v, &decoded); err == nil {
+			return normalizeKey(decoded)
+		}
+		return string(v)
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return compositeKey{encoded: "null"}
+		}
+		// Réencoder après décodage pour que les nombres aient une seule forme
+		var decoded interface{}
+		json.Unmarshal(data, &decoded)
+		data, _ = json.Marshal(decoded)
+		return compositeKey{encoded: string(data)}
+	}
+}
+
+// typeRank ordonne les types entre eux : champ absent (clés de tri) < null
+// < nombres < chaînes < objets et tableaux < booléens ; les clés composées
+// ne se mêlent jamais aux autres types
+func typeRank(value interface{}) int {
+	switch value.(type) {
+	case missingKey:
+		return -1
+	case nil:
+		return 0
+	case float64:
+		return 1
+	case string:
+		return 2
+	case compositeKey:
+		return 3
+	case bool:
+		return 4
+	case tupleKey:
+		return 5
+	default:
+		return 6
+	}
+}
+
+// compareValues compare deux valeurs normalisées (-1, 0 ou 1)
+func compareValues(a, b interface{}) int {
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		if ra < rb {
+			return -1
+		}
+		return 1
+	}
+
+	switch x := a.(type) {
+	case float64:
+		y := b.(float64)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(x, b.(string))
+	case compositeKey:
+		return strings.Compare(x.encoded, b.(compositeKey).encoded)
+	case tupleKey:
+		return strings.Compare(string(x), string(b.(tupleKey)))
+	case bool:
+		y := b.(bool)
+		switch {
+		case x == y:
+			return 0
+		case !x:
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+// hashStore est le store d'un index hash
+type hashStore map[interface{}][]string
+
+func (s hashStore) add(key interface{}, docID string) {
+	s[key] = append(s[key], docID)
+}
+
+func (s hashStore) remove(key interface{}, docID string) bool {
+	ids, exists := s[key]
+	if !exists {
+		return false
+	}
+	remaining := removeID(ids, docID)
+	if len(remaining) == 0 {
+		delete(s, key)
+	} else {
+		s[key] = remaining
+	}
+	return len(remaining) < len(ids)
+}
+
+func (s hashStore) lookup(key interface{}) []string {
+	return s[key]
+}
+
+func (s hashStore) ascend(fn func(key interface{}, ids []string) bool) {
+	for key, ids := range s {
+		if !fn(key, ids) {
+			return
+		}
+	}
+}
+
+func (s hashStore) len() int {
+	return len(s)
+}
+
+// removeID retire la première occurrence de docID
+func removeID(ids []string, docID string) []string {
+	for i, id := range ids {
+		if id == docID {
+			return append(ids[:i], ids[i+1:]...)
+		}
+	}
+	return ids
+}
+
+const (
+	skipListMaxLevel = 32
+	skipListP        = 0.25
+)
+
+// skipListNode est un nœud de la skip list ; le niveau 0 est doublement chaîné
+type skipListNode struct {
+	key  interface{}
+	ids  []string
+	next []*skipListNode
+	prev *skipListNode
+}
+
+// skipList est le store ordonné d'un index, trié par compareValues
+type skipList struct {
+	head   *skipListNode
+	tail   *skipListNode
+	level  int
+	length int
+	rand   *rand.Rand
+}
+
+// newSkipList crée une skip list vide
+func newSkipList() *skipList {
+	return &skipList{
+		head:  &skipListNode{next: make([]*skipListNode, skipListMaxLevel)},
+		level: 1,
+		rand:  rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+// randomLevel tire le niveau d'un nouveau nœud
+func (s *skipList) randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && s.rand.Float64() < skipListP {
+		level++
+	}
+	return level
+}
+
+// findPath retourne, pour chaque niveau, le dernier nœud de clé < key
+func (s *skipList) findPath(key interface{}) []*skipListNode {
+	path := make([]*skipListNode, skipListMaxLevel)
+	node := s.head
+	for level := s.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && compareValues(node.next[level].key, key) < 0 {
+			node = node.next[level]
+		}
+		path[level] = node
+	}
+	return path
+}
+
+// seek retourne le premier nœud de clé >= key (ou > key si strict)
+func (s *skipList) seek(key interface{}, strict bool) *skipListNode {
+	node := s.head
+	for level := s.level - 1; level >= 0; level-- {
+		for node.next[level] != nil {
+			cmp := compareValues(node.next[level].key, key)
+			if cmp < 0 || (strict && cmp == 0) {
+				node = node.next[level]
+				continue
+			}
+			break
+		}
+	}
+	return node.next[0]
+}
+
+func (s *skipList) add(key interface{}, docID string) {
+	path := s.findPath(key)
+	if node := path[0].next[0]; node != nil && compareValues(node.key, key) == 0 {
+		node.ids = append(node.ids, docID)
+		return
+	}
+
+	level := s.randomLevel()
+	if level > s.level {
+		for i := s.level; i < level; i++ {
+			path[i] = s.head
+		}
+		s.level = level
+	}
+
+	node := &skipListNode{key: key, ids: []string{docID}, next: make([]*skipListNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = path[i].next[i]
+		path[i].next[i] = node
+	}
+	if path[0] != s.head {
+		node.prev = path[0]
+	}
+	if node.next[0] != nil {
+		node.next[0].prev = node
+	} else {
+		s.tail = node
+	}
+	s.length++
+}
+
+func (s *skipList) remove(key interface{}, docID string) bool {
+	path := s.findPath(key)
+	node := path[0].next[0]
+	if node == nil || compareValues(node.key, key) != 0 {
+		return false
+	}
+
+	count := len(node.ids)
+	node.ids = removeID(node.ids, docID)
+	if len(node.ids) == count {
+		return false
+	}
+	if len(node.ids) > 0 {
+		return true
+	}
+
+	for i := 0; i < len(node.next); i++ {
+		if path[i].next[i] == node {
+			path[i].next[i] = node.next[i]
+		}
+	}
+	if node.next[0] != nil {
+		node.next[0].prev = node.prev
+	} else {
+		s.tail = node.prev
+	}
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+	s.length--
+	return true
+}
+
+func (s *skipList) lookup(key interface{}) []string {
+	node := s.seek(key, false)
+	if node == nil || compareValues(node.key, key) != 0 {
+		return nil
+	}
+	return node.ids
+}
+
+func (s *skipList) ascend(fn func(key interface{}, ids []string) bool) {
+	for node := s.head.next[0]; node != nil; node = node.next[0] {
+		if !fn(node.key, node.ids) {
+			return
+		}
+	}
+}
+
+// descend parcourt les valeurs par ordre décroissant
+func (s *skipList) descend(fn func(key interface{}, ids []string) bool) {
+	for node := s.tail; node != nil; node = node.prev {
+		if !fn(node.key, node.ids) {
+			return
+		}
+	}
+}
+
+// scanRange parcourt dans l'ordre les valeurs de l'intervalle, limitées
+// au type de ses bornes (voir Range.contains)
+func (s *skipList) scanRange(r Range, fn func(key interface{}, ids []string) bool) {
+	var node *skipListNode
+	rank := -1
+	switch {
+	case r.Lower != nil:
+		lower := normalizeKey(r.Lower.Value)
+		rank = typeRank(lower)
+		node = s.seek(lower, !r.Lower.Inclusive)
+	case r.Upper != nil:
+		rank = typeRank(normalizeKey(r.Upper.Value))
+		node = s.seek(typeFloor(rank), false)
+	default:
+		node = s.head.next[0]
+	}
+
+	for ; node != nil; node = node.next[0] {
+		if rank >= 0 && typeRank(node.key) != rank {
+			return
+		}
+		if !r.contains(node.key) {
+			return
+		}
+		if !fn(node.key, node.ids) {
+			return
+		}
+	}
+}
+
+// typeFloor retourne la plus petite valeur d'un rang de type
+func typeFloor(rank int) interface{} {
+	switch rank {
+	case 1:
+		return math.Inf(-1)
+	case 2:
+		return ""
+	case 3:
+		return compositeKey{}
+	case 4:
+		return false
+	default:
+		return nil
+	}
+}
+
+// numericBounds retourne la plus petite et la plus grande valeur numérique
+func (s *skipList) numericBounds() (float64, float64, bool) {
+	first := s.seek(typeFloor(1), false)
+	if first == nil || typeRank(first.key) != 1 {
+		return 0, 0, false
+	}
+	last := s.tail
+	if next := s.seek(typeFloor(2), false); next != nil {
+		last = next.prev
+	}
+	return first.key.(float64), last.key.(float64), true
+}
+
+func (s *skipList) len() int {
+	return s.length
+}
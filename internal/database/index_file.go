@@ -0,0 +1,251 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	// indexesDir est le sous-répertoire d'une collection contenant ses index
+	indexesDir = "_indexes"
+	// indexFileExt est l'extension des fichiers d'index
+	indexFileExt = ".idx"
+)
+
+// IndexDefinition décrit un index tel qu'il est déclaré et persisté. Un
+// index simple se déclare par Field, un index composé par Fields ; un Name
+// vide donne le nom par défaut et un Type vide désigne un index hash.
+type IndexDefinition struct {
+	Name   string       `json:"name,omitempty"`
+	Field  string       `json:"field,omitempty"`
+	Fields []IndexField `json:"fields,omitempty"`
+	Unique bool         `json:"unique"`
+	Type   IndexType    `json:"type,omitempty"`
+}
+
+// equal compare deux définitions sous leur forme canonique
+func (d IndexDefinition) equal(other IndexDefinition) bool {
+	return reflect.DeepEqual(newIndex(d).Definition(), newIndex(other).Definition())
+}
+
+// indexFile est le format sur disque d'un index : sa définition, son
+// contenu et l'empreinte des données à partir desquelles il a été construit
+type indexFile struct {
+	Definition  IndexDefinition  `json:"definition"`
+	Fingerprint string           `json:"fingerprint"`
+	Entries     []indexFileEntry `json:"entries"`
+}
+
+// indexFileEntry associe une valeur indexée aux IDs des documents
+type indexFileEntry struct {
+	Value interface{} `json:"value"`
+	IDs   []string    `json:"ids"`
+}
+
+// Indexes retourne les définitions des index de la collection
+func (c *Collection) Indexes() []IndexDefinition {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.indexDefinitions()
+}
+
+// indexDefinitions retourne les définitions triées par nom ; l'appelant détient c.mu
+func (c *Collection) indexDefinitions() []IndexDefinition {
+	names := make([]string, 0, len(c.indexes))
+	for name := range c.indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	definitions := make([]IndexDefinition, 0, len(names))
+	for _, name := range names {
+		definitions = append(definitions, c.indexes[name].Definition())
+	}
+	return definitions
+}
+
+// ensureIndexes construit, en un seul parcours, les index déclarés qui
+// n'ont pas pu être rechargés du disque avec la même définition
+func (c *Collection) ensureIndexes(definitions []IndexDefinition) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var missing []*Index
+	for _, definition := range definitions {
+		index := newIndex(definition)
+		if existing, exists := c.indexes[index.name]; exists && existing.Definition().equal(definition) {
+			continue
+		}
+		missing = append(missing, index)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	if err := c.buildIndexes(missing); err != nil {
+		return err
+	}
+	fingerprint, err := c.storage.Fingerprint()
+	if err != nil {
+		return err
+	}
+	for _, index := range missing {
+		c.indexes[index.name] = index
+		if err := c.saveIndex(index, fingerprint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexPath retourne le chemin du fichier d'un index
+func (c *Collection) indexPath(name string) string {
+	return filepath.Join(c.path, indexesDir, url.PathEscape(name)+indexFileExt)
+}
+
+// buildIndexes remplit les index donnés en un seul parcours des documents ;
+// l'appelant détient c.mu
+func (c *Collection) buildIndexes(indexes []*Index) error {
+	return c.scan(func(docID string, doc Document) error {
+		for _, index := range indexes {
+			index.addDocument(docID, doc)
+		}
+		return nil
+	})
+}
+
+// saveIndexes persiste tous les index avec l'empreinte courante des
+// données ; l'appelant détient c.mu
+func (c *Collection) saveIndexes() error {
+	if len(c.indexes) == 0 {
+		return nil
+	}
+
+	fingerprint, err := c.storage.Fingerprint()
+	if err != nil {
+		return err
+	}
+	for _, index := range c.indexes {
+		if err := c.saveIndex(index, fingerprint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveIndex écrit un index sur disque ; l'appelant détient c.mu
+func (c *Collection) saveIndex(index *Index, fingerprint string) error {
+	if err := os.MkdirAll(filepath.Join(c.path, indexesDir), 0755); err != nil {
+		return err
+	}
+
+	index.mu.RLock()
+	file := indexFile{
+		Definition:  index.Definition(),
+		Fingerprint: fingerprint,
+		Entries:     make([]indexFileEntry, 0, index.store.len()),
+	}
+	index.store.ascend(func(key interface{}, ids []string) bool {
+		file.Entries = append(file.Entries, indexFileEntry{Value: key, IDs: ids})
+		return true
+	})
+	data, err := json.Marshal(file)
+	index.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(c.indexPath(index.name), data, true)
+}
+
+// loadIndexes recharge les index persistés de la collection. Un index dont
+// l'empreinte ne correspond plus aux données est reconstruit, en un seul
+// parcours pour tous les index concernés, puis réécrit.
+func (c *Collection) loadIndexes() error {
+	dir := filepath.Join(c.path, indexesDir)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := removeTempFiles(dir); err != nil {
+		return err
+	}
+
+	fingerprint, err := c.storage.Fingerprint()
+	if err != nil {
+		return err
+	}
+
+	var stale []*Index
+	for _, entry := range files {
+		if !strings.HasSuffix(entry.Name(), indexFileExt) {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var file indexFile
+		if err := json.Unmarshal(data, &file); err == nil && validateIndexFields(newIndex(file.Definition).fields) != nil {
+			err = fmt.Errorf("définition d'index invalide")
+		}
+		if err != nil {
+			fmt.Printf("Index illisible ignoré %s: %v\n", path, err)
+			os.Remove(path)
+			continue
+		}
+
+		index := newIndex(file.Definition)
+		if file.Fingerprint != fingerprint || !index.loadEntries(file.Entries) {
+			index = newIndex(file.Definition)
+			stale = append(stale, index)
+		}
+		c.indexes[index.name] = index
+	}
+
+	if len(stale) == 0 {
+		return nil
+	}
+
+	fmt.Printf("Collection %s: reconstruction de %d index obsolètes\n", c.name, len(stale))
+	if err := c.buildIndexes(stale); err != nil {
+		return err
+	}
+	for _, index := range stale {
+		if err := c.saveIndex(index, fingerprint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadEntries remplit l'index à partir des entrées d'un fichier ; false si
+// une clé est illisible et que l'index doit être reconstruit
+func (index *Index) loadEntries(entries []indexFileEntry) bool {
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		key, err := index.loadKey(entry.Value)
+		if err != nil {
+			return false
+		}
+		for _, id := range entry.IDs {
+			if seen[id] {
+				index.multikey = true
+			}
+			seen[id] = true
+			index.insertKey(key, id)
+		}
+	}
+	return true
+}
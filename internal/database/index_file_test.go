@@ -0,0 +1,69 @@
+package database
+
+import (
+	"os"
+	"testing"
+)
+
+// TestIndexesSurviveRestart vérifie qu'un index rechargé du disque garde
+// ses entrées et sa contrainte d'unicité
+func TestIndexesSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDatabaseAt(t, dir)
+	c := createTestCollection(t, db, "users")
+	if err := c.CreateIndex("email", true); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	docID := mustInsert(t, c, Document{"email": "a@example.com"})
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := os.Stat(c.indexPath("email")); err != nil {
+		t.Fatalf("fichier d'index absent: %v", err)
+	}
+
+	c, err := openTestDatabaseAt(t, dir).GetCollection("users")
+	if err != nil {
+		t.Fatalf("GetCollection: %v", err)
+	}
+	if definitions := c.Indexes(); len(definitions) != 1 || !definitions[0].Unique {
+		t.Fatalf("Indexes = %v, attendu l'index unique email", definitions)
+	}
+	if docs, err := c.FindByIndex("email", "a@example.com"); err != nil || len(docs) != 1 {
+		t.Fatalf("FindByIndex = %v (%v), attendu le document %s", docs, err, docID)
+	}
+	if _, err := c.Insert(Document{"email": "a@example.com"}); err == nil {
+		t.Fatal("Insert a accepté un doublon après réouverture")
+	}
+}
+
+// TestStaleIndexRebuilt vérifie qu'un index dont les données ont changé
+// hors de la base est reconstruit à l'ouverture
+func TestStaleIndexRebuilt(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDatabaseAt(t, dir)
+	c := createTestCollection(t, db, "users")
+	if err := c.CreateIndex("city", false); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	docID := mustInsert(t, c, Document{"city": "Paris"})
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	path := c.storage.(*fileStorage).documentPath(docID)
+	if err := os.WriteFile(path, []byte(`{"city":"Lyon"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := openTestDatabaseAt(t, dir).GetCollection("users")
+	if err != nil {
+		t.Fatalf("GetCollection: %v", err)
+	}
+	if docs, _ := c.FindByIndex("city", "Paris"); len(docs) != 0 {
+		t.Fatalf("FindByIndex(Paris) = %v, attendu l'ancienne valeur oubliée", docs)
+	}
+	if docs, _ := c.FindByIndex("city", "Lyon"); len(docs) != 1 {
+		t.Fatalf("FindByIndex(Lyon) = %v, attendu le document %s", docs, docID)
+	}
+}
@@ -0,0 +1,74 @@
+package database
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// rangeTestCollection crée une collection de personnes d'âges variés,
+// avec un index ordonné sur age si indexed
+func rangeTestCollection(t *testing.T, indexed bool) *Collection {
+	t.Helper()
+	c := createTestCollection(t, openTestDatabase(t), "people")
+	if indexed {
+		if err := c.CreateIndexWithOptions("age", IndexOptions{Type: IndexOrdered}); err != nil {
+			t.Fatalf("CreateIndexWithOptions: %v", err)
+		}
+	}
+	for _, doc := range []Document{
+		{"age": 40, "name": "dora"},
+		{"age": 10, "name": "alice"},
+		{"age": 30, "name": "carl"},
+		{"age": 20, "name": "bob"},
+		{"age": "25", "name": "bea"},
+	} {
+		mustInsert(t, c, doc)
+	}
+	return c
+}
+
+// TestFindRange vérifie les bornes incluses et exclues, l'ordre du champ
+// avec un index ordonné et l'exclusion des valeurs d'un autre type
+func TestFindRange(t *testing.T) {
+	for _, indexed := range []bool{true, false} {
+		c := rangeTestCollection(t, indexed)
+		tests := []struct {
+			r    Range
+			want []string
+		}{
+			{Between(20, 30), []string{"bob", "carl"}},
+			{Range{Lower: &Bound{Value: 20}}, []string{"carl", "dora"}},
+			{Range{Upper: &Bound{Value: 30}}, []string{"alice", "bob"}},
+			{Range{Lower: &Bound{Value: "2", Inclusive: true}}, []string{"bea"}},
+		}
+		for _, test := range tests {
+			docs, err := c.FindRange("age", test.r)
+			if err != nil {
+				t.Fatalf("FindRange: %v", err)
+			}
+			got := documentNames(docs)
+			if !indexed {
+				sort.Strings(got)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("index %v, FindRange(%+v) = %v, attendu %v", indexed, test.r, got, test.want)
+			}
+		}
+	}
+}
+
+// TestFindByPrefix vérifie la recherche par préfixe de chaîne
+func TestFindByPrefix(t *testing.T) {
+	c := rangeTestCollection(t, false)
+	if err := c.CreateIndexWithOptions("name", IndexOptions{Type: IndexOrdered}); err != nil {
+		t.Fatalf("CreateIndexWithOptions: %v", err)
+	}
+	docs, err := c.FindByPrefix("name", "b")
+	if err != nil {
+		t.Fatalf("FindByPrefix: %v", err)
+	}
+	if got := documentNames(docs); !reflect.DeepEqual(got, []string{"bea", "bob"}) {
+		t.Fatalf("FindByPrefix(b) = %v, attendu bea puis bob", got)
+	}
+}
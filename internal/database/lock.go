@@ -0,0 +1,523 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LockMode est le mode d'un verrou du gestionnaire de verrous
+type LockMode string
+
+const (
+	// LockShared (S) est compatible avec les autres verrous partagés
+	LockShared LockMode = "shared"
+	// LockExclusive (X) n'est compatible avec aucun autre verrou
+	LockExclusive LockMode = "exclusive"
+
+	// Verrous d'intention, pris sur la collection avant un verrou de
+	// document : un verrou S ou X sur la collection entière attend la fin
+	// des verrous de documents incompatibles
+	lockIntentShared    LockMode = "intent_shared"
+	lockIntentExclusive LockMode = "intent_exclusive"
+)
+
+// defaultLockTimeout borne l'attente d'un verrou (voir SetLockTimeout)
+const defaultLockTimeout = 5 * time.Second
+
+// ErrDeadlock signale une demande de verrou choisie comme victime d'un
+// interblocage ; une transaction victime est annulée
+var ErrDeadlock = errors.New("interblocage")
+
+// ErrLockTimeout signale un verrou qui n'a pu être obtenu à temps
+var ErrLockTimeout = errors.New("délai d'attente du verrou dépassé")
+
+// lockCompatible[a][b] indique si a peut être accordé pendant qu'un autre
+// propriétaire détient b
+var lockCompatible = map[LockMode]map[LockMode]bool{
+	lockIntentShared:    {lockIntentShared: true, lockIntentExclusive: true, LockShared: true},
+	lockIntentExclusive: {lockIntentShared: true, lockIntentExclusive: true},
+	LockShared:          {lockIntentShared: true, LockShared: true},
+	LockExclusive:       {},
+}
+
+// covers indique si un verrou détenu en mode m suffit pour une demande en
+// mode requested
+func (m LockMode) covers(requested LockMode) bool {
+	switch m {
+	case LockExclusive:
+		return true
+	case LockShared:
+		return requested == LockShared || requested == lockIntentShared
+	case lockIntentExclusive:
+		return requested == lockIntentExclusive || requested == lockIntentShared
+	case lockIntentShared:
+		return requested == lockIntentShared
+	}
+	return false
+}
+
+// upgrade retourne le mode couvrant à la fois le mode détenu m (vide si
+// aucun) et requested ; S et IX réunis donnent X
+func (m LockMode) upgrade(requested LockMode) LockMode {
+	switch {
+	case m == "" || requested.covers(m):
+		return requested
+	case m.covers(requested):
+		return m
+	}
+	return LockExclusive
+}
+
+// lockResource désigne une collection (docID vide) ou un document
+type lockResource struct {
+	collection string
+	docID      string
+}
+
+func (r lockResource) String() string {
+	if r.docID == "" {
+		return "collection " + r.collection
+	}
+	return fmt.Sprintf("document %s de %s", r.docID, r.collection)
+}
+
+// lockOwner détient des verrous : une transaction, jusqu'à sa fin, ou une
+// écriture hors transaction, le temps de l'écriture
+type lockOwner struct {
+	name string
+	// seq ordonne les propriétaires par âge : le plus jeune d'un
+	// interblocage en est la victime
+	seq  uint64
+	held map[lockResource]LockMode
+	// waiting est la demande en attente ; acquire n'en laisse qu'une
+	waiting  *lockRequest
+	released bool
+	acquire  sync.Mutex
+}
+
+// lockRequest est une demande de verrou en attente
+type lockRequest struct {
+	owner    *lockOwner
+	resource lockResource
+	mode     LockMode
+	done     chan error
+}
+
+// lockEntry est l'état d'une ressource verrouillée : verrous accordés et
+// demandes en attente, servies dans l'ordre (les conversions d'abord)
+type lockEntry struct {
+	granted map[*lockOwner]LockMode
+	queue   []*lockRequest
+}
+
+// lockManager accorde des verrous partagés et exclusifs sur les
+// collections et les documents. Une demande incompatible attend ; chaque
+// attente met à jour le graphe des attentes, et un cycle désigne comme
+// victime la demande du propriétaire le plus jeune, qui échoue avec
+// ErrDeadlock.
+type lockManager struct {
+	mu      sync.Mutex
+	entries map[lockResource]*lockEntry
+	seq     uint64
+	timeout time.Duration
+}
+
+func newLockManager() *lockManager {
+	return &lockManager{
+		entries: make(map[lockResource]*lockEntry),
+		timeout: defaultLockTimeout,
+	}
+}
+
+// newOwner crée un propriétaire de verrous, plus jeune que tous les autres
+func (lm *lockManager) newOwner(name string) *lockOwner {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	lm.seq++
+	return &lockOwner{name: name, seq: lm.seq, held: make(map[lockResource]LockMode)}
+}
+
+// setTimeout change la durée d'attente maximale d'un verrou (0 : sans limite)
+func (lm *lockManager) setTimeout(timeout time.Duration) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	lm.timeout = timeout
+}
+
+// lock obtient pour owner un verrou en mode mode sur resource, en
+// convertissant au besoin celui qu'il détient déjà. L'appelant ne doit
+// détenir aucun verrou de collection (c.mu) : l'attente peut durer jusqu'à
+// la fin d'une transaction.
+func (lm *lockManager) lock(owner *lockOwner, resource lockResource, mode LockMode) error {
+	owner.acquire.Lock()
+	defer owner.acquire.Unlock()
+
+	lm.mu.Lock()
+	if owner.released {
+		lm.mu.Unlock()
+		return fmt.Errorf("verrou sur %s demandé par %s, déjà terminé", resource, owner.name)
+	}
+	held := owner.held[resource]
+	if held.covers(mode) {
+		lm.mu.Unlock()
+		return nil
+	}
+	mode = held.upgrade(mode)
+
+	entry, exists := lm.entries[resource]
+	if !exists {
+		entry = &lockEntry{granted: make(map[*lockOwner]LockMode)}
+		lm.entries[resource] = entry
+	}
+	conversion := held != ""
+	if (conversion || len(entry.queue) == 0) && entry.compatible(owner, mode) {
+		entry.grant(owner, resource, mode)
+		lm.mu.Unlock()
+		return nil
+	}
+
+	request := &lockRequest{owner: owner, resource: resource, mode: mode, done: make(chan error, 1)}
+	position := len(entry.queue)
+	if conversion {
+		position = 0
+		for position < len(entry.queue) && entry.queue[position].owner.held[resource] != "" {
+			position++
+		}
+	}
+	entry.queue = append(entry.queue[:position], append([]*lockRequest{request}, entry.queue[position:]...)...)
+	owner.waiting = request
+
+	if victim := lm.deadlockVictim(owner); victim != nil {
+		lm.cancel(victim.waiting, fmt.Errorf("%w: %s n'obtient pas le verrou %s sur %s", ErrDeadlock, victim.name, victim.waiting.mode, victim.waiting.resource))
+	}
+	timeout := lm.timeout
+	lm.mu.Unlock()
+
+	if timeout <= 0 {
+		return <-request.done
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-request.done:
+		return err
+	case <-timer.C:
+	}
+	lm.mu.Lock()
+	if owner.waiting == request {
+		lm.cancel(request, fmt.Errorf("%w: verrou %s sur %s", ErrLockTimeout, mode, resource))
+	}
+	lm.mu.Unlock()
+	return <-request.done
+}
+
+// release libère tous les verrous de owner et sert les demandes qu'ils
+// bloquaient ; owner ne peut plus en obtenir
+func (lm *lockManager) release(owner *lockOwner) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	owner.released = true
+	if owner.waiting != nil {
+		lm.cancel(owner.waiting, fmt.Errorf("verrou abandonné: %s est terminé", owner.name))
+	}
+	for resource := range owner.held {
+		entry := lm.entries[resource]
+		delete(entry.granted, owner)
+		lm.serve(resource, entry)
+	}
+	owner.held = make(map[lockResource]LockMode)
+}
+
+// cancel retire une demande en attente, qui échoue avec err ; l'appelant
+// détient lm.mu
+func (lm *lockManager) cancel(request *lockRequest, err error) {
+	entry := lm.entries[request.resource]
+	for i, queued := range entry.queue {
+		if queued == request {
+			entry.queue = append(entry.queue[:i], entry.queue[i+1:]...)
+			break
+		}
+	}
+	request.owner.waiting = nil
+	request.done <- err
+	lm.serve(request.resource, entry)
+}
+
+// serve accorde dans l'ordre les demandes en attente devenues compatibles
+// et oublie une ressource libre ; l'appelant détient lm.mu
+func (lm *lockManager) serve(resource lockResource, entry *lockEntry) {
+	for len(entry.queue) > 0 {
+		request := entry.queue[0]
+		if !entry.compatible(request.owner, request.mode) {
+			break
+		}
+		entry.queue = entry.queue[1:]
+		entry.grant(request.owner, resource, request.mode)
+		request.owner.waiting = nil
+		request.done <- nil
+	}
+	if len(entry.granted) == 0 && len(entry.queue) == 0 {
+		delete(lm.entries, resource)
+	}
+}
+
+// deadlockVictim cherche un cycle passant par owner, qui vient de se
+// mettre en attente, dans le graphe des attentes, et retourne le
+// propriétaire le plus jeune du cycle (nil sans cycle) ; l'appelant
+// détient lm.mu
+func (lm *lockManager) deadlockVictim(owner *lockOwner) *lockOwner {
+	visited := make(map[*lockOwner]bool)
+	var path []*lockOwner
+	var search func(current *lockOwner) bool
+	search = func(current *lockOwner) bool {
+		path = append(path, current)
+		for _, next := range lm.waitsFor(current) {
+			if next == owner {
+				return true
+			}
+			if !visited[next] {
+				visited[next] = true
+				if search(next) {
+					return true
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+	if !search(owner) {
+		return nil
+	}
+
+	victim := path[0]
+	for _, member := range path[1:] {
+		if member.seq > victim.seq {
+			victim = member
+		}
+	}
+	return victim
+}
+
+// waitsFor retourne les propriétaires dont owner attend la libération :
+// ceux qui détiennent un verrou incompatible avec sa demande, et ceux dont
+// la demande la précède ; l'appelant détient lm.mu
+func (lm *lockManager) waitsFor(owner *lockOwner) []*lockOwner {
+	request := owner.waiting
+	if request == nil {
+		return nil
+	}
+	entry := lm.entries[request.resource]
+	var blockers []*lockOwner
+	for holder, mode := range entry.granted {
+		if holder != owner && !lockCompatible[request.mode][mode] {
+			blockers = append(blockers, holder)
+		}
+	}
+	for _, queued := range entry.queue {
+		if queued == request {
+			break
+		}
+		blockers = append(blockers, queued.owner)
+	}
+	return blockers
+}
+
+// compatible indique si owner peut obtenir mode compte tenu des verrous
+// accordés aux autres propriétaires
+func (e *lockEntry) compatible(owner *lockOwner, mode LockMode) bool {
+	for holder, held := range e.granted {
+		if holder != owner && !lockCompatible[mode][held] {
+			return false
+		}
+	}
+	return true
+}
+
+// grant accorde mode à owner sur resource
+func (e *lockEntry) grant(owner *lockOwner, resource lockResource, mode LockMode) {
+	e.granted[owner] = mode
+	owner.held[resource] = mode
+}
+
+// locks retourne le gestionnaire de verrous de la base
+func (db *Database) locks() *lockManager {
+	return db.txManager.locks
+}
+
+// SetLockTimeout borne l'attente d'un verrou de document ou de collection
+// (5 secondes par défaut, 0 pour attendre sans limite) ; une demande
+// expirée échoue avec ErrLockTimeout
+func (db *Database) SetLockTimeout(timeout time.Duration) {
+	db.locks().setTimeout(timeout)
+}
+
+// lockDocument prend pour owner un verrou sur le document docID, après le
+// verrou d'intention correspondant sur la collection ; l'appelant ne
+// détient pas c.mu
+func (c *Collection) lockDocument(owner *lockOwner, docID string, mode LockMode) error {
+	intent := lockIntentShared
+	if mode == LockExclusive {
+		intent = lockIntentExclusive
+	}
+	return c.lockNamed(func(name string) error {
+		if err := c.db.locks().lock(owner, lockResource{collection: name}, intent); err != nil {
+			return err
+		}
+		return c.db.locks().lock(owner, lockResource{collection: name, docID: docID}, mode)
+	})
+}
+
+// lockNamed prend les verrous de lock sous le nom courant de la
+// collection, et les reprend sous le nouveau nom si elle a été renommée
+// pendant l'attente : les verrous sont désignés par nom. Une fois le
+// verrou de collection accordé, RenameCollection attend sa libération.
+func (c *Collection) lockNamed(lock func(name string) error) error {
+	for {
+		name := c.currentName()
+		if err := lock(name); err != nil {
+			return err
+		}
+		if c.currentName() == name {
+			return nil
+		}
+	}
+}
+
+// lockForWrite vérifie docID et prend son verrou exclusif pour une
+// écriture hors transaction ; l'appelant libère le propriétaire retourné
+// une fois l'écriture faite
+func (c *Collection) lockForWrite(docID string) (*lockOwner, error) {
+	if err := validateDocumentID(docID); err != nil {
+		return nil, err
+	}
+	owner := c.db.locks().newOwner(fmt.Sprintf("écriture du document %s de %s", docID, c.currentName()))
+	if err := c.lockDocument(owner, docID, LockExclusive); err != nil {
+		c.db.locks().release(owner)
+		return nil, err
+	}
+	return owner, nil
+}
+
+// writeLocked exécute une écriture hors transaction de plusieurs
+// documents : find, sous c.mu en écriture, retourne les ID des documents
+// que write écrira. Ceux qui ne sont pas encore verrouillés le sont en mode
+// exclusif, c.mu relâché, puis find est repris ; write s'exécute sous le
+// même verrou c.mu que le find dont tous les documents sont verrouillés.
+// Victime d'un interblocage entre deux tours, l'écriture libère ses
+// verrous et recommence après une attente aléatoire, au plus
+// writeAttempts fois ; elle échoue ensuite avec ErrDeadlock.
+func (c *Collection) writeLocked(name string, find func() ([]string, error), write func() error) error {
+	var err error
+	for attempt := 0; attempt < writeAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(deadlockBackoff(attempt))
+		}
+		err = c.tryWriteLocked(name, find, write)
+		// find et write ne prennent aucun verrou : l'interblocage est
+		// survenu avant l'écriture
+		if !errors.Is(err, ErrDeadlock) {
+			return err
+		}
+	}
+	return err
+}
+
+// writeAttempts borne les tentatives d'une écriture hors transaction
+// victime d'interblocages : chaque tentative a un nouveau propriétaire,
+// le plus jeune, donc la prochaine victime
+const writeAttempts = 8
+
+// deadlockBackoff retourne l'attente avant la tentative attempt (à partir
+// de 1) : aléatoire, sous une borne qui double à chaque tentative
+func deadlockBackoff(attempt int) time.Duration {
+	return time.Duration(rand.Int63n(int64(time.Millisecond << attempt)))
+}
+
+// tryWriteLocked est une tentative de writeLocked
+func (c *Collection) tryWriteLocked(name string, find func() ([]string, error), write func() error) error {
+	owner := c.db.locks().newOwner(name)
+	defer c.db.locks().release(owner)
+
+	locked := make(map[string]bool)
+	for {
+		c.mu.Lock()
+		docIDs, err := find()
+		var missing []string
+		for _, docID := range docIDs {
+			if !locked[docID] {
+				missing = append(missing, docID)
+			}
+		}
+		if err != nil || len(missing) == 0 {
+			if err == nil {
+				err = write()
+			}
+			c.mu.Unlock()
+			return err
+		}
+		c.mu.Unlock()
+
+		// Dans l'ordre des ID : deux écritures concurrentes ne s'attendent
+		// l'une l'autre qu'entre deux tours
+		sort.Strings(missing)
+		for _, docID := range missing {
+			if err := c.lockDocument(owner, docID, LockExclusive); err != nil {
+				return err
+			}
+			locked[docID] = true
+		}
+	}
+}
+
+// LockDocument verrouille le document docID pour tx jusqu'à sa fin, en
+// mode partagé ou exclusif ; un verrou partagé déjà détenu est converti.
+// Les écritures de tx prennent elles-mêmes un verrou exclusif. Si tx est
+// victime d'un interblocage, elle est annulée.
+func (db *Database) LockDocument(tx *Transaction, collectionName string, docID string, mode LockMode) error {
+	collection, err := db.GetCollection(collectionName)
+	if err != nil {
+		return fmt.Errorf("collection %s not found", collectionName)
+	}
+	return db.lockForTransaction(tx, collection, docID, mode)
+}
+
+// LockCollection verrouille toute la collection pour tx jusqu'à sa fin :
+// en mode partagé, aucune autre transaction ni écriture ne peut y écrire ;
+// en mode exclusif, aucune ne peut non plus y verrouiller de document
+func (db *Database) LockCollection(tx *Transaction, collectionName string, mode LockMode) error {
+	collection, err := db.GetCollection(collectionName)
+	if err != nil {
+		return fmt.Errorf("collection %s not found", collectionName)
+	}
+	return db.lockForTransaction(tx, collection, "", mode)
+}
+
+// lockForTransaction prend un verrou de document (ou de collection si
+// docID est vide) pour tx et annule tx si elle est victime d'un
+// interblocage, pour libérer les verrous qu'elle détient
+func (db *Database) lockForTransaction(tx *Transaction, c *Collection, docID string, mode LockMode) error {
+	if mode != LockShared && mode != LockExclusive {
+		return fmt.Errorf("mode de verrou %q inconnu (shared ou exclusive)", mode)
+	}
+	var err error
+	if docID == "" {
+		err = c.lockNamed(func(name string) error {
+			return db.locks().lock(tx.locks, lockResource{collection: name}, mode)
+		})
+	} else {
+		err = c.lockDocument(tx.locks, docID, mode)
+	}
+	if errors.Is(err, ErrDeadlock) {
+		if rollbackErr := db.Rollback(tx); rollbackErr != nil {
+			fmt.Printf("Avertissement: annulation de la transaction %s impossible: %v\n", tx.ID, rollbackErr)
+		}
+		return fmt.Errorf("transaction %s annulée: %w", tx.ID, err)
+	}
+	return err
+}
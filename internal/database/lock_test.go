@@ -0,0 +1,246 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestWritesWaitForTransactionLock vérifie que chaque écriture hors
+// transaction attend le verrou exclusif d'une transaction sur le document
+func TestWritesWaitForTransactionLock(t *testing.T) {
+	writes := map[string]func(c *Collection) error{
+		"Update": func(c *Collection) error {
+			return c.Update("a", Document{"n": 99})
+		},
+		"Delete": func(c *Collection) error {
+			return c.Delete("a")
+		},
+		"UpdateByID": func(c *Collection) error {
+			_, err := c.UpdateByID("a", Update{"$set": map[string]interface{}{"n": 99}})
+			return err
+		},
+		"UpdateOne": func(c *Collection) error {
+			_, err := c.UpdateOne(Filter{"n": 1}, Update{"$set": map[string]interface{}{"n": 99}})
+			return err
+		},
+		"UpdateMany": func(c *Collection) error {
+			_, err := c.UpdateMany(Filter{}, Update{"$inc": map[string]interface{}{"n": 1}})
+			return err
+		},
+		"MergePatch": func(c *Collection) error {
+			_, err := c.MergePatch("a", map[string]interface{}{"n": 99})
+			return err
+		},
+		"JSONPatch": func(c *Collection) error {
+			_, err := c.JSONPatch("a", []PatchOperation{{Op: "replace", Path: "/n", Value: 99}})
+			return err
+		},
+		"Upsert": func(c *Collection) error {
+			_, err := c.Upsert(Filter{"_id": "a"}, Document{"n": 99})
+			return err
+		},
+		"FindOneAndUpdate": func(c *Collection) error {
+			_, err := c.FindOneAndUpdate(Filter{"n": 1}, Update{"$set": map[string]interface{}{"n": 99}}, FindAndModifyOptions{})
+			return err
+		},
+		"FindOneAndDelete": func(c *Collection) error {
+			_, err := c.FindOneAndDelete(Filter{"n": 1}, FindAndModifyOptions{})
+			return err
+		},
+		"BulkWrite": func(c *Collection) error {
+			_, err := c.BulkWrite([]WriteOp{{Op: "delete", ID: "a"}}, true)
+			return err
+		},
+		"Insert": func(c *Collection) error {
+			_, err := c.Insert(Document{"_id": "b"})
+			return err
+		},
+	}
+
+	for name, write := range writes {
+		t.Run(name, func(t *testing.T) {
+			db := openTestDatabase(t)
+			c := createTestCollection(t, db, "items")
+			mustInsert(t, c, Document{"_id": "a", "n": 1})
+			db.SetLockTimeout(50 * time.Millisecond)
+
+			tx := db.BeginTransaction()
+			if err := db.LockDocument(tx, "items", "a", LockExclusive); err != nil {
+				t.Fatalf("LockDocument: %v", err)
+			}
+			if err := db.LockDocument(tx, "items", "b", LockExclusive); err != nil {
+				t.Fatalf("LockDocument: %v", err)
+			}
+			if err := write(c); !errors.Is(err, ErrLockTimeout) {
+				t.Fatalf("écriture pendant la transaction: %v, attendu ErrLockTimeout", err)
+			}
+			if doc := mustGet(t, c, "a"); doc["n"] != float64(1) {
+				t.Fatalf("document modifié malgré le verrou: %v", doc)
+			}
+			if err := db.Commit(tx); err != nil {
+				t.Fatalf("Commit: %v", err)
+			}
+			if err := write(c); err != nil {
+				t.Fatalf("écriture après la transaction: %v", err)
+			}
+		})
+	}
+}
+
+// TestWriteProceedsAfterCommit vérifie qu'une écriture bloquée par une
+// transaction reprend à sa validation, sans conflit d'écriture
+func TestWriteProceedsAfterCommit(t *testing.T) {
+	db := openTestDatabase(t)
+	c := createTestCollection(t, db, "items")
+	mustInsert(t, c, Document{"_id": "a", "n": 1})
+
+	tx := db.BeginTransaction()
+	if err := db.UpdateWithTransaction(tx, "items", "a", Document{"n": 2}); err != nil {
+		t.Fatalf("UpdateWithTransaction: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.UpdateByID("a", Update{"$inc": map[string]interface{}{"n": 10}})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("UpdateByID n'a pas attendu la transaction: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := db.Commit(tx); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("UpdateByID: %v", err)
+	}
+	if doc := mustGet(t, c, "a"); doc["n"] != float64(12) {
+		t.Fatalf("n = %v, attendu 12", doc["n"])
+	}
+}
+
+// lockInBackground demande un verrou de document pour tx dans une
+// goroutine et retourne le canal de son résultat, après avoir vérifié que
+// la demande attend
+func lockInBackground(t *testing.T, db *Database, tx *Transaction, docID string, mode LockMode) <-chan error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		done <- db.LockDocument(tx, "items", docID, mode)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("LockDocument(%s) n'a pas attendu: %v", docID, err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	return done
+}
+
+// TestDeadlockVictim vérifie qu'un interblocage entre deux transactions
+// est détecté, que la plus jeune échoue avec ErrDeadlock et est annulée,
+// et que l'autre obtient alors son verrou
+func TestDeadlockVictim(t *testing.T) {
+	db := openTestDatabase(t)
+	c := createTestCollection(t, db, "items")
+	mustInsert(t, c, Document{"_id": "a", "n": 1})
+	mustInsert(t, c, Document{"_id": "b", "n": 1})
+	db.SetLockTimeout(0)
+
+	older := db.BeginTransaction()
+	younger := db.BeginTransaction()
+	if err := db.UpdateWithTransaction(older, "items", "a", Document{"n": 2}); err != nil {
+		t.Fatalf("UpdateWithTransaction: %v", err)
+	}
+	if err := db.UpdateWithTransaction(younger, "items", "b", Document{"n": 2}); err != nil {
+		t.Fatalf("UpdateWithTransaction: %v", err)
+	}
+
+	waiting := lockInBackground(t, db, older, "b", LockExclusive)
+	if err := db.LockDocument(younger, "items", "a", LockExclusive); !errors.Is(err, ErrDeadlock) {
+		t.Fatalf("LockDocument = %v, attendu ErrDeadlock", err)
+	}
+	if younger.State != TransactionAborted {
+		t.Fatalf("victime dans l'état %v, attendu annulée", younger.State)
+	}
+	if err := <-waiting; err != nil {
+		t.Fatalf("LockDocument après l'annulation de la victime: %v", err)
+	}
+	if err := db.Commit(older); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if doc := mustGet(t, c, "b"); doc["n"] != float64(1) {
+		t.Fatalf("b = %v, attendu aucune écriture de la victime", doc)
+	}
+}
+
+// TestLockUpgrade vérifie qu'un verrou partagé converti en exclusif attend
+// les autres lecteurs, et que deux conversions croisées forment un
+// interblocage
+func TestLockUpgrade(t *testing.T) {
+	db := openTestDatabase(t)
+	c := createTestCollection(t, db, "items")
+	mustInsert(t, c, Document{"_id": "a", "n": 1})
+	db.SetLockTimeout(0)
+
+	first := db.BeginTransaction()
+	second := db.BeginTransaction()
+	for _, tx := range []*Transaction{first, second} {
+		if err := db.LockDocument(tx, "items", "a", LockShared); err != nil {
+			t.Fatalf("LockDocument: %v", err)
+		}
+	}
+
+	waiting := lockInBackground(t, db, first, "a", LockExclusive)
+	if err := db.LockDocument(second, "items", "a", LockExclusive); !errors.Is(err, ErrDeadlock) {
+		t.Fatalf("conversion croisée = %v, attendu ErrDeadlock", err)
+	}
+	if err := <-waiting; err != nil {
+		t.Fatalf("conversion après l'annulation de l'autre lecteur: %v", err)
+	}
+	if err := db.Rollback(first); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+}
+
+// TestLockCollection vérifie qu'un verrou partagé sur la collection
+// bloque les écritures mais pas les verrous partagés de documents, et que
+// les verrous de documents n'empêchent pas d'écrire les autres documents
+func TestLockCollection(t *testing.T) {
+	db := openTestDatabase(t)
+	c := createTestCollection(t, db, "items")
+	mustInsert(t, c, Document{"_id": "a", "n": 1})
+	mustInsert(t, c, Document{"_id": "b", "n": 1})
+	db.SetLockTimeout(50 * time.Millisecond)
+
+	reader := db.BeginTransaction()
+	if err := db.LockCollection(reader, "items", LockShared); err != nil {
+		t.Fatalf("LockCollection: %v", err)
+	}
+	if err := c.Update("b", Document{"n": 2}); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("Update sous verrou de collection: %v, attendu ErrLockTimeout", err)
+	}
+	other := db.BeginTransaction()
+	if err := db.LockDocument(other, "items", "a", LockShared); err != nil {
+		t.Fatalf("LockDocument partagé: %v", err)
+	}
+	if err := db.LockDocument(other, "items", "b", LockExclusive); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("LockDocument exclusif: %v, attendu ErrLockTimeout", err)
+	}
+	if err := db.Rollback(reader); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+
+	// Seul a reste verrouillé, par other
+	if err := c.Update("b", Document{"n": 2}); err != nil {
+		t.Fatalf("Update d'un document non verrouillé: %v", err)
+	}
+	if err := c.Update("a", Document{"n": 2}); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("Update d'un document verrouillé: %v, attendu ErrLockTimeout", err)
+	}
+	if err := db.Rollback(other); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+}
@@ -0,0 +1,657 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// logSegmentsDir est le sous-répertoire des segments d'une collection
+	logSegmentsDir = "segments"
+	// logSegmentExt est l'extension des fichiers de segment
+	logSegmentExt = ".seg"
+
+	logRecordPut    byte = 1
+	logRecordDelete byte = 2
+
+	// En-tête d'un enregistrement : longueur du corps (4) + crc32 du corps (4).
+	// Corps : type (1) + longueur de l'ID (2) + ID + document JSON.
+	logHeaderSize = 8
+
+	defaultSegmentSize = 64 << 20
+	maxLogRecordSize   = 1 << 28
+
+	// La compaction se déclenche quand plus de la moitié des octets des
+	// segments sont morts et que les segments pèsent au moins 1 Mo
+	compactionInterval = 30 * time.Second
+	compactionRatio    = 0.5
+	compactionMinBytes = 1 << 20
+)
+
+// errCorruptRecord signale un enregistrement tronqué ou dont le crc est faux
+var errCorruptRecord = errors.New("enregistrement corrompu")
+
+// logLocation situe la dernière version d'un document dans les segments
+type logLocation struct {
+	segment uint64
+	offset  int64
+	size    int64
+	crc     uint32 // crc du corps, indépendant de la position de l'enregistrement
+}
+
+// logSegment est un fichier de segment ouvert
+type logSegment struct {
+	id   uint64
+	file *os.File
+	size int64
+}
+
+// logStorage stocke les documents dans des segments en ajout seul.
+// Une table en mémoire donne la position de la dernière version de chaque
+// document, les suppressions sont des enregistrements tombstone et une
+// compaction en arrière-plan réécrit les segments scellés sans les
+// versions mortes.
+type logStorage struct {
+	path           string
+	segments       map[uint64]*logSegment
+	active         *logSegment
+	offsets        map[string]logLocation
+	tombstones     map[string]uint64 // ID supprimé -> segment du tombstone
+	dirty          map[uint64]bool   // segments contenant des ajouts non synchronisés
+	maxSegmentSize int64
+	mu             sync.RWMutex
+	compactMu      sync.Mutex
+	stop           chan struct{}
+	done           chan struct{}
+	closeOnce      sync.Once
+}
+
+// newLogStorage ouvre les segments d'une collection, reconstruit la table
+// des positions et démarre la compaction en arrière-plan
+func newLogStorage(path string) (*logStorage, error) {
+	dir := filepath.Join(path, logSegmentsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &logStorage{
+		path:           dir,
+		segments:       make(map[uint64]*logSegment),
+		offsets:        make(map[string]logLocation),
+		tombstones:     make(map[string]uint64),
+		dirty:          make(map[uint64]bool),
+		maxSegmentSize: defaultSegmentSize,
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+
+	if err := s.load(); err != nil {
+		s.closeSegments()
+		return nil, err
+	}
+
+	go s.compactLoop()
+	return s, nil
+}
+
+// segmentPath retourne le chemin d'un segment
+func (s *logStorage) segmentPath(id uint64) string {
+	return filepath.Join(s.path, fmt.Sprintf("%08d%s", id, logSegmentExt))
+}
+
+// load rejoue les segments dans l'ordre. Une fin de segment tronquée n'est
+// tolérée que sur le dernier segment (écriture interrompue) et y est coupée.
+func (s *logStorage) load() error {
+	files, err := os.ReadDir(s.path)
+	if err != nil {
+		return err
+	}
+
+	var ids []uint64
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasSuffix(name, ".compact") {
+			// Compaction interrompue avant son renommage : sans effet
+			os.Remove(filepath.Join(s.path, name))
+			continue
+		}
+		if filepath.Ext(name) != logSegmentExt {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, logSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for i, id := range ids {
+		file, err := os.OpenFile(s.segmentPath(id), os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		segment := &logSegment{id: id, file: file}
+		s.segments[id] = segment
+
+		valid, err := s.replaySegment(segment)
+		if err != nil {
+			if !errors.Is(err, errCorruptRecord) || i != len(ids)-1 {
+				return fmt.Errorf("segment %d illisible: %v", id, err)
+			}
+			fmt.Printf("Stockage: fin tronquée du segment %d coupée à %d octets\n", id, valid)
+			if err := file.Truncate(valid); err != nil {
+				return err
+			}
+		}
+		segment.size = valid
+	}
+
+	if len(ids) == 0 {
+		return s.rollSegment(1)
+	}
+	s.active = s.segments[ids[len(ids)-1]]
+	return nil
+}
+
+// replaySegment applique les enregistrements d'un segment à la table des
+// positions et retourne la taille de la partie valide
+func (s *logStorage) replaySegment(segment *logSegment) (int64, error) {
+	reader := bufio.NewReader(io.NewSectionReader(segment.file, 0, 1<<62))
+	var offset int64
+	for {
+		record, err := readLogRecord(reader)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+
+		switch record.kind {
+		case logRecordPut:
+			s.offsets[record.docID] = logLocation{segment: segment.id, offset: offset, size: record.size, crc: record.crc}
+			delete(s.tombstones, record.docID)
+		case logRecordDelete:
+			// Un tombstone sans version antérieure ne masque rien
+			if _, exists := s.offsets[record.docID]; exists {
+				delete(s.offsets, record.docID)
+				s.tombstones[record.docID] = segment.id
+			}
+		}
+		offset += record.size
+	}
+}
+
+// encodeLogRecord sérialise un enregistrement
+func encodeLogRecord(kind byte, docID string, payload []byte) []byte {
+	bodySize := 1 + 2 + len(docID) + len(payload)
+	record := make([]byte, logHeaderSize+bodySize)
+	body := record[logHeaderSize:]
+	body[0] = kind
+	binary.LittleEndian.PutUint16(body[1:3], uint16(len(docID)))
+	copy(body[3:], docID)
+	copy(body[3+len(docID):], payload)
+	binary.LittleEndian.PutUint32(record[0:4], uint32(bodySize))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(body))
+	return record
+}
+
+// logRecord est un enregistrement décodé
+type logRecord struct {
+	kind    byte
+	docID   string
+	payload []byte
+	size    int64
+	crc     uint32
+}
+
+// readLogRecord lit l'enregistrement suivant ; io.EOF signale une fin propre
+func readLogRecord(reader io.Reader) (logRecord, error) {
+	header := make([]byte, logHeaderSize)
+	if n, err := io.ReadFull(reader, header); err != nil {
+		if err == io.EOF && n == 0 {
+			return logRecord{}, io.EOF
+		}
+		return logRecord{}, errCorruptRecord
+	}
+
+	bodySize := binary.LittleEndian.Uint32(header[0:4])
+	if bodySize < 3 || bodySize > maxLogRecordSize {
+		return logRecord{}, errCorruptRecord
+	}
+	body := make([]byte, bodySize)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return logRecord{}, errCorruptRecord
+	}
+	crc := binary.LittleEndian.Uint32(header[4:8])
+	if crc32.ChecksumIEEE(body) != crc {
+		return logRecord{}, errCorruptRecord
+	}
+
+	idSize := int(binary.LittleEndian.Uint16(body[1:3]))
+	if 3+idSize > len(body) {
+		return logRecord{}, errCorruptRecord
+	}
+	return logRecord{
+		kind:    body[0],
+		docID:   string(body[3 : 3+idSize]),
+		payload: body[3+idSize:],
+		size:    int64(logHeaderSize + bodySize),
+		crc:     crc,
+	}, nil
+}
+
+// rollSegment crée un nouveau segment actif ; l'appelant détient s.mu
+func (s *logStorage) rollSegment(id uint64) error {
+	file, err := os.OpenFile(s.segmentPath(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(s.path); err != nil {
+		file.Close()
+		return err
+	}
+	segment := &logSegment{id: id, file: file}
+	s.segments[id] = segment
+	s.active = segment
+	return nil
+}
+
+// append ajoute un enregistrement au segment actif ; l'appelant détient s.mu
+func (s *logStorage) append(record []byte, sync bool) (logLocation, error) {
+	if s.active.size > 0 && s.active.size+int64(len(record)) > s.maxSegmentSize {
+		if err := s.rollSegment(s.active.id + 1); err != nil {
+			return logLocation{}, err
+		}
+	}
+
+	segment := s.active
+	if _, err := segment.file.WriteAt(record, segment.size); err != nil {
+		return logLocation{}, err
+	}
+	location := logLocation{
+		segment: segment.id,
+		offset:  segment.size,
+		size:    int64(len(record)),
+		crc:     binary.LittleEndian.Uint32(record[4:8]),
+	}
+	segment.size += int64(len(record))
+
+	if sync {
+		if err := segment.file.Sync(); err != nil {
+			return logLocation{}, err
+		}
+		delete(s.dirty, segment.id)
+	} else {
+		s.dirty[segment.id] = true
+	}
+	return location, nil
+}
+
+// read lit et décode le document situé à location ; l'appelant détient s.mu
+func (s *logStorage) read(location logLocation) (Document, error) {
+	segment, exists := s.segments[location.segment]
+	if !exists {
+		return nil, fmt.Errorf("segment %d introuvable", location.segment)
+	}
+
+	buf := make([]byte, location.size)
+	if _, err := segment.file.ReadAt(buf, location.offset); err != nil {
+		return nil, err
+	}
+	record, err := readLogRecord(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+
+	var doc Document
+	if err := json.Unmarshal(record.payload, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Get lit la dernière version d'un document
+func (s *logStorage) Get(docID string) (Document, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	location, exists := s.offsets[docID]
+	if !exists {
+		return nil, &os.PathError{Op: "get", Path: docID, Err: os.ErrNotExist}
+	}
+	return s.read(location)
+}
+
+// Put ajoute une nouvelle version d'un document
+func (s *logStorage) Put(docID string, doc map[string]interface{}, sync bool) error {
+	payload, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	location, err := s.append(encodeLogRecord(logRecordPut, docID, payload), sync)
+	if err != nil {
+		return err
+	}
+	s.offsets[docID] = location
+	delete(s.tombstones, docID)
+	return nil
+}
+
+// Delete ajoute un tombstone pour un document existant
+func (s *logStorage) Delete(docID string, sync bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.offsets[docID]; !exists {
+		return nil
+	}
+	location, err := s.append(encodeLogRecord(logRecordDelete, docID, nil), sync)
+	if err != nil {
+		return err
+	}
+	delete(s.offsets, docID)
+	s.tombstones[docID] = location.segment
+	return nil
+}
+
+// Scan parcourt les documents vivants par ordre d'ID
+func (s *logStorage) Scan(fn func(docID string, doc Document) error) error {
+	s.mu.RLock()
+	ids := make([]string, 0, len(s.offsets))
+	for docID := range s.offsets {
+		ids = append(ids, docID)
+	}
+	s.mu.RUnlock()
+	sort.Strings(ids)
+
+	for _, docID := range ids {
+		doc, err := s.Get(docID)
+		if os.IsNotExist(err) {
+			// Supprimé pendant le parcours
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("document %s illisible: %w", docID, err)
+		}
+		if err := fn(docID, doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Count retourne le nombre de documents vivants
+func (s *logStorage) Count() (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.offsets), nil
+}
+
+// Sync force sur disque les segments contenant des ajouts non synchronisés
+func (s *logStorage) Sync(docIDs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id := range s.dirty {
+		if segment, exists := s.segments[id]; exists {
+			if err := segment.file.Sync(); err != nil {
+				return err
+			}
+		}
+		delete(s.dirty, id)
+	}
+	return nil
+}
+
+// Fingerprint hache l'ID et le crc de chaque document vivant : il ne
+// dépend que du contenu, si bien qu'une compaction ne le modifie pas
+func (s *logStorage) Fingerprint() (string, error) {
+	s.mu.RLock()
+	ids := make([]string, 0, len(s.offsets))
+	for docID := range s.offsets {
+		ids = append(ids, docID)
+	}
+	sort.Strings(ids)
+
+	hash := sha256.New()
+	for _, docID := range ids {
+		fmt.Fprintf(hash, "%s:%08x\n", docID, s.offsets[docID].crc)
+	}
+	s.mu.RUnlock()
+
+	return "log:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Close arrête la compaction et ferme les segments
+func (s *logStorage) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.done
+		err = s.close()
+	})
+	return err
+}
+
+// close synchronise puis ferme les segments une fois la compaction arrêtée
+func (s *logStorage) close() error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, segment := range s.segments {
+		if err := segment.file.Sync(); err != nil {
+			return err
+		}
+	}
+	return s.closeSegments()
+}
+
+// closeSegments ferme tous les fichiers de segment
+func (s *logStorage) closeSegments() error {
+	var firstErr error
+	for _, segment := range s.segments {
+		if err := segment.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// compactLoop déclenche la compaction quand la proportion d'octets morts le justifie
+func (s *logStorage) compactLoop() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(compactionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			total, dead := s.usage()
+			if total < compactionMinBytes || float64(dead)/float64(total) < compactionRatio {
+				continue
+			}
+			if err := s.Compact(); err != nil {
+				fmt.Printf("Erreur compaction %s: %v\n", s.path, err)
+			}
+		}
+	}
+}
+
+// usage retourne la taille totale des segments et la part occupée par des versions mortes
+func (s *logStorage) usage() (int64, int64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var total, live int64
+	for _, segment := range s.segments {
+		total += segment.size
+	}
+	for _, location := range s.offsets {
+		live += location.size
+	}
+	return total, total - live
+}
+
+// Compact réécrit les segments scellés en un seul segment ne contenant que
+// les versions vivantes. Le résultat remplace le plus récent des segments
+// compactés, puis les plus anciens sont supprimés ; il porte aussi des
+// tombstones pour que des suppressions ne soient pas annulées si l'arrêt
+// survient avant cette suppression.
+func (s *logStorage) Compact() error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	// Sceller le segment actif pour que tout ce qui précède soit immuable
+	s.mu.Lock()
+	if s.active.size > 0 {
+		if err := s.rollSegment(s.active.id + 1); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	var sealed []uint64
+	for id := range s.segments {
+		if id != s.active.id {
+			sealed = append(sealed, id)
+		}
+	}
+	if len(sealed) == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	sort.Slice(sealed, func(i, j int) bool { return sealed[i] < sealed[j] })
+	target := sealed[len(sealed)-1]
+
+	live := make(map[string]logLocation)
+	for docID, location := range s.offsets {
+		if location.segment <= target {
+			live[docID] = location
+		}
+	}
+	var deleted []string
+	for docID, segment := range s.tombstones {
+		if segment <= target {
+			deleted = append(deleted, docID)
+		}
+	}
+	s.mu.Unlock()
+
+	// Les segments scellés ne changent plus : la copie se fait sans verrou
+	ids := make([]string, 0, len(live))
+	for docID := range live {
+		ids = append(ids, docID)
+	}
+	sort.Strings(ids)
+
+	tmpPath := s.segmentPath(target) + ".compact"
+	out, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(out)
+	newLocations := make(map[string]logLocation, len(ids))
+	var offset int64
+	for _, docID := range ids {
+		location := live[docID]
+		buf := make([]byte, location.size)
+		s.mu.RLock()
+		_, err := s.segments[location.segment].file.ReadAt(buf, location.offset)
+		s.mu.RUnlock()
+		if err != nil {
+			out.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+		if _, err := writer.Write(buf); err != nil {
+			out.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+		newLocations[docID] = logLocation{segment: target, offset: offset, size: location.size, crc: location.crc}
+		offset += location.size
+	}
+	for _, docID := range deleted {
+		record := encodeLogRecord(logRecordDelete, docID, nil)
+		if _, err := writer.Write(record); err != nil {
+			out.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+		offset += int64(len(record))
+	}
+	if err := writer.Flush(); err != nil {
+		out.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Rename(tmpPath, s.segmentPath(target)); err != nil {
+		out.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := syncDir(s.path); err != nil {
+		out.Close()
+		return err
+	}
+
+	for _, id := range sealed {
+		s.segments[id].file.Close()
+		delete(s.segments, id)
+		delete(s.dirty, id)
+	}
+	s.segments[target] = &logSegment{id: target, file: out, size: offset}
+
+	// Ne repointer que les documents qui n'ont pas changé pendant la copie
+	for docID, location := range newLocations {
+		if current, exists := s.offsets[docID]; exists && current == live[docID] {
+			s.offsets[docID] = location
+		}
+	}
+	for _, docID := range deleted {
+		if s.tombstones[docID] <= target {
+			delete(s.tombstones, docID)
+		}
+	}
+
+	for _, id := range sealed[:len(sealed)-1] {
+		if err := os.Remove(s.segmentPath(id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return syncDir(s.path)
+}
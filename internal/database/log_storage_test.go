@@ -0,0 +1,136 @@
+package database
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// openTestLogStorage ouvre un stockage en journal dans dir, fermé à la fin
+// du test
+func openTestLogStorage(t *testing.T, dir string) *logStorage {
+	t.Helper()
+	s, err := newLogStorage(dir)
+	if err != nil {
+		t.Fatalf("newLogStorage: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// checkLogDocuments vérifie que s contient a dans sa dernière version et
+// plus b, supprimé
+func checkLogDocuments(t *testing.T, s *logStorage) {
+	t.Helper()
+	doc, err := s.Get("a")
+	if err != nil || doc["v"] != float64(3) {
+		t.Fatalf("Get(a) = %v (%v), attendu la dernière version", doc, err)
+	}
+	if _, err := s.Get("b"); !os.IsNotExist(err) {
+		t.Fatalf("Get(b) = %v, attendu le document supprimé", err)
+	}
+	count := 0
+	s.Scan(func(docID string, doc Document) error {
+		count++
+		return nil
+	})
+	if count != 1 {
+		t.Fatalf("%d documents parcourus, attendu 1", count)
+	}
+}
+
+// TestLogStorageCompactKeepsLatest vérifie que la compaction ne garde que
+// la dernière version de chaque document, y compris après réouverture
+func TestLogStorageCompactKeepsLatest(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestLogStorage(t, dir)
+	for v := 1; v <= 3; v++ {
+		if err := s.Put("a", Document{"v": v}, false); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if err := s.Put("b", Document{"v": 1}, false); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := s.Delete("b", false); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	_, before := s.usage()
+	if err := s.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	checkLogDocuments(t, s)
+	// Seul le tombstone de b reste mort
+	if _, dead := s.usage(); dead >= before || dead > int64(len(encodeLogRecord(logRecordDelete, "b", nil))) {
+		t.Fatalf("%d octets morts après compaction (%d avant)", dead, before)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	checkLogDocuments(t, openTestLogStorage(t, dir))
+}
+
+// TestLogStorageTruncatedTail vérifie qu'un enregistrement tronqué en fin
+// du dernier segment, reste d'une écriture interrompue, est coupé à la
+// réouverture sans perdre les précédents
+func TestLogStorageTruncatedTail(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestLogStorage(t, dir)
+	if err := s.Put("a", Document{"v": 1}, true); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	path := s.segmentPath(s.active.id)
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	record := encodeLogRecord(logRecordPut, "b", []byte(`{"v":1}`))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(record[:len(record)-3])
+	file.Close()
+
+	s = openTestLogStorage(t, dir)
+	if doc, err := s.Get("a"); err != nil || doc["v"] != float64(1) {
+		t.Fatalf("Get(a) = %v (%v)", doc, err)
+	}
+	if _, err := s.Get("b"); !os.IsNotExist(err) {
+		t.Fatalf("Get(b) = %v, attendu l'enregistrement tronqué ignoré", err)
+	}
+	if err := s.Put("c", Document{"v": 1}, true); err != nil {
+		t.Fatalf("Put après réouverture: %v", err)
+	}
+	if doc, err := s.Get("c"); err != nil || doc["v"] != float64(1) {
+		t.Fatalf("Get(c) = %v (%v)", doc, err)
+	}
+}
+
+// TestScanInIDOrder vérifie que les deux moteurs parcourent les documents
+// par ordre d'ID, y compris quand un ID prolonge un autre
+func TestScanInIDOrder(t *testing.T) {
+	for _, kind := range []StorageKind{StorageFiles, StorageLog} {
+		s, err := openStorage(t.TempDir(), kind)
+		if err != nil {
+			t.Fatalf("openStorage(%s): %v", kind, err)
+		}
+		for _, docID := range []string{"abc", "abc-d", "ab"} {
+			if err := s.Put(docID, map[string]interface{}{"n": 1}, false); err != nil {
+				t.Fatalf("Put(%s): %v", docID, err)
+			}
+		}
+
+		var got []string
+		err = s.Scan(func(docID string, doc Document) error {
+			got = append(got, docID)
+			return nil
+		})
+		s.Close()
+		if err != nil || strings.Join(got, ",") != "ab,abc,abc-d" {
+			t.Fatalf("%s: Scan = %v (%v), attendu ab,abc,abc-d", kind, got, err)
+		}
+	}
+}
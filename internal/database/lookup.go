@@ -0,0 +1,121 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// lookupStage joint à chaque document, dans le tableau as, les documents
+// d'une autre collection dont foreignField vaut l'une des valeurs de
+// localField. La recherche passe par le planificateur de la collection
+// jointe, qui utilise son index sur foreignField s'il existe ; "_id"
+// désigne l'ID des documents joints.
+type lookupStage struct {
+	from         *Collection
+	localField   string
+	foreignField string
+	as           string
+	next         pipelineStage
+}
+
+// compileLookup compile {"from": "users", "localField": "author_id",
+// "foreignField": "_id", "as": "author"}
+func (c *Collection) compileLookup(value interface{}, next pipelineStage) (pipelineStage, error) {
+	spec, ok := asMap(value)
+	if !ok {
+		return nil, fmt.Errorf("%w: $lookup attend un objet", ErrInvalidPipeline)
+	}
+	fields := make(map[string]string, 4)
+	for _, name := range []string{"from", "localField", "foreignField", "as"} {
+		field, _ := spec[name].(string)
+		if field == "" {
+			return nil, fmt.Errorf("%w: $lookup exige le champ %s", ErrInvalidPipeline, name)
+		}
+		if name != "from" {
+			if err := validatePath(field); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidPipeline, err)
+			}
+		}
+		fields[name] = field
+	}
+	if len(spec) != len(fields) {
+		return nil, fmt.Errorf("%w: $lookup accepte from, localField, foreignField et as", ErrInvalidPipeline)
+	}
+
+	if c.db == nil {
+		return nil, fmt.Errorf("%w: $lookup exige une collection rattachée à une base", ErrInvalidPipeline)
+	}
+	from, err := c.db.GetCollection(fields["from"])
+	if err != nil {
+		return nil, fmt.Errorf("%w: $lookup: %v", ErrInvalidPipeline, err)
+	}
+	return &lookupStage{
+		from:         from,
+		localField:   fields["localField"],
+		foreignField: fields["foreignField"],
+		as:           fields["as"],
+		next:         next,
+	}, nil
+}
+
+func (s *lookupStage) push(doc Document) error {
+	// Les éléments d'un tableau sont joints un à un ; un champ absent
+	// joint les documents où foreignField est null ou absent
+	var values []interface{}
+	for _, value := range pathValues(doc, s.localField) {
+		if array, ok := value.([]interface{}); ok {
+			values = append(values, array...)
+			continue
+		}
+		values = append(values, value)
+	}
+
+	joined, err := s.join(values)
+	if err != nil {
+		return err
+	}
+	if joined == nil {
+		joined = []Document{}
+	}
+	matches := make([]interface{}, len(joined))
+	for i, foreign := range joined {
+		matches[i] = map[string]interface{}(foreign)
+	}
+	if err := setPath(doc, s.as, matches); err != nil {
+		return err
+	}
+	return s.next.push(doc)
+}
+
+// join retourne les documents joints à des valeurs locales, par ID croissant
+func (s *lookupStage) join(values []interface{}) ([]Document, error) {
+	if s.foreignField != "_id" {
+		condition := interface{}(nil)
+		if len(values) > 0 {
+			condition = map[string]interface{}{"$in": values}
+		}
+		return s.from.Find(Filter{s.foreignField: condition}, FindOptions{byID: true})
+	}
+
+	// Seule une chaîne sans séparateur de chemin peut être un ID
+	var docIDs []string
+	for _, value := range values {
+		if docID, ok := value.(string); ok && docID != "" && !strings.Contains(docID, "/") {
+			docIDs = append(docIDs, docID)
+		}
+	}
+	sort.Strings(docIDs)
+	var documents []Document
+	for i, docID := range docIDs {
+		if i > 0 && docID == docIDs[i-1] {
+			continue
+		}
+		if doc, err := s.from.GetDocument(docID); err == nil {
+			documents = append(documents, doc)
+		}
+	}
+	return documents, nil
+}
+
+func (s *lookupStage) flush() error { return s.next.flush() }
@@ -0,0 +1,77 @@
+package database
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// TestLookupJoins vérifie la jointure sur l'_id d'une autre collection,
+// avec et sans index, sur un champ tableau et sur un champ absent
+func TestLookupJoins(t *testing.T) {
+	for _, indexed := range []bool{true, false} {
+		db := openTestDatabase(t)
+		orders := ordersTestCollection(t, db)
+		users := createTestCollection(t, db, "users")
+		if indexed {
+			if err := users.CreateIndex("name", false); err != nil {
+				t.Fatalf("CreateIndex: %v", err)
+			}
+		}
+		for _, data := range []string{
+			`{"_id": "u1", "name": "ann", "friends": ["bob", "cid"]}`,
+			`{"_id": "u2", "name": "bob"}`,
+			`{"_id": "u3", "name": "cid"}`,
+			`{"_id": "u4"}`,
+		} {
+			mustInsert(t, users, decodeDocument(t, data))
+		}
+
+		docs, err := orders.Aggregate(decodePipeline(t, `[
+			{"$match": {"status": "paid"}},
+			{"$lookup": {"from": "users", "localField": "customer", "foreignField": "name", "as": "buyer"}},
+			{"$project": {"buyer._id": 1}}]`))
+		if err != nil {
+			t.Fatalf("Aggregate: %v", err)
+		}
+		want := []Document{
+			decodeDocument(t, `{"_id": "o1", "buyer": [{"_id": "u1"}]}`),
+			decodeDocument(t, `{"_id": "o2", "buyer": [{"_id": "u2"}]}`),
+			decodeDocument(t, `{"_id": "o4", "buyer": [{"_id": "u3"}]}`),
+		}
+		if !reflect.DeepEqual(docs, want) {
+			t.Errorf("index %v, jointure = %v, attendu %v", indexed, docs, want)
+		}
+
+		docs, err = users.Aggregate(decodePipeline(t, `[
+			{"$match": {"_id": {"$in": ["u1", "u2"]}}},
+			{"$lookup": {"from": "users", "localField": "friends", "foreignField": "name", "as": "friends"}},
+			{"$project": {"friends._id": 1}},
+			{"$sort": {"_id": 1}}]`))
+		if err != nil {
+			t.Fatalf("Aggregate: %v", err)
+		}
+		want = []Document{
+			decodeDocument(t, `{"_id": "u1", "friends": [{"_id": "u2"}, {"_id": "u3"}]}`),
+			decodeDocument(t, `{"_id": "u2", "friends": [{"_id": "u4"}]}`),
+		}
+		if !reflect.DeepEqual(docs, want) {
+			t.Errorf("index %v, jointure sur la même collection = %v, attendu %v", indexed, docs, want)
+		}
+	}
+}
+
+// TestLookupInvalid vérifie qu'un $lookup incomplet ou vers une
+// collection inconnue est refusé
+func TestLookupInvalid(t *testing.T) {
+	orders := ordersTestCollection(t, openTestDatabase(t))
+	for _, pipeline := range []string{
+		`[{"$lookup": {"from": "users", "localField": "customer", "as": "buyer"}}]`,
+		`[{"$lookup": {"from": "nowhere", "localField": "customer", "foreignField": "name", "as": "buyer"}}]`,
+		`[{"$lookup": {"from": "orders", "localField": "customer", "foreignField": "name", "as": "buyer", "let": {}}}]`,
+	} {
+		if _, err := orders.Aggregate(decodePipeline(t, pipeline)); !errors.Is(err, ErrInvalidPipeline) {
+			t.Errorf("Aggregate(%s) = %v, attendu ErrInvalidPipeline", pipeline, err)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// IsolationLevel choisit l'isolation d'une transaction
+type IsolationLevel string
+
+const (
+	// IsolationSnapshot : les lectures de la transaction voient l'état
+	// validé à son début, quelles que soient les validations suivantes
+	IsolationSnapshot IsolationLevel = "snapshot"
+	// IsolationSerializable ajoute à l'instantané une validation (SSI) :
+	// la transaction échoue si une écriture validée depuis son début a
+	// touché ce qu'elle a lu
+	IsolationSerializable IsolationLevel = "serializable"
+)
+
+// TransactionOptions regroupe les options de BeginTransactionWithOptions
+type TransactionOptions struct {
+	// Isolation vaut IsolationSnapshot par défaut
+	Isolation IsolationLevel `json:"isolation,omitempty"`
+}
+
+// ErrSerializationFailure signale une transaction sérialisable dont les
+// lectures ont été modifiées par une validation concurrente ; elle est
+// annulée et peut être rejouée
+var ErrSerializationFailure = errors.New("échec de sérialisation")
+
+// ErrWriteConflict signale une transaction écrivant un document qu'une
+// autre a écrit et validé depuis son début (le premier à valider gagne) ;
+// elle est annulée et peut être rejouée
+var ErrWriteConflict = errors.New("conflit d'écriture")
+
+// commitClock attribue les horodatages de validation et suit les
+// instantanés des transactions actives. Une écriture réserve un
+// horodatage puis le publie une fois terminée ; visible est le plus grand
+// horodatage dont toutes les écritures, et celles qui le précèdent, sont
+// terminées.
+type commitClock struct {
+	mu       sync.Mutex
+	done     *sync.Cond
+	next     uint64
+	visible  uint64
+	inflight map[uint64]bool
+	// active compte les transactions actives par instantané
+	active map[uint64]int
+}
+
+func newCommitClock() *commitClock {
+	clock := &commitClock{
+		inflight: make(map[uint64]bool),
+		active:   make(map[uint64]int),
+	}
+	clock.done = sync.NewCond(&clock.mu)
+	return clock
+}
+
+// snapshot enregistre un instantané et le retourne : il comprend toutes les
+// écritures réservées jusque-là, dont il attend la fin
+func (k *commitClock) snapshot() uint64 {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	ts := k.next
+	k.active[ts]++
+	for k.visible < ts {
+		k.done.Wait()
+	}
+	return ts
+}
+
+// release retire un instantané enregistré par snapshot
+func (k *commitClock) release(ts uint64) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.active[ts]--; k.active[ts] <= 0 {
+		delete(k.active, ts)
+	}
+}
+
+// reserve attribue l'horodatage d'une écriture et indique si un instantané
+// actif peut avoir besoin des images qu'elle remplace
+func (k *commitClock) reserve() (uint64, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.next++
+	k.inflight[k.next] = true
+	return k.next, len(k.active) > 0
+}
+
+// publish marque l'écriture ts comme terminée
+func (k *commitClock) publish(ts uint64) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	delete(k.inflight, ts)
+	for k.visible < k.next && !k.inflight[k.visible+1] {
+		k.visible++
+	}
+	k.done.Broadcast()
+}
+
+// oldest retourne le plus ancien instantané actif, false s'il n'y en a pas
+func (k *commitClock) oldest() (uint64, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var oldest uint64
+	found := false
+	for ts := range k.active {
+		if !found || ts < oldest {
+			oldest, found = ts, true
+		}
+	}
+	return oldest, found
+}
+
+// docVersion est l'image d'un document (nil s'il n'existait pas) avant
+// l'écriture d'horodatage until
+type docVersion struct {
+	until uint64
+	doc   Document
+}
+
+// versioned exécute write, une écriture du document docID, avec
+// l'horodatage de la validation en cours sur la collection ou, à défaut,
+// le sien, publié une fois l'écriture faite. L'image remplacée est gardée
+// tant qu'un instantané actif peut la lire, avant l'écriture : un lecteur
+// qui lit le document puis ses versions ne manque aucune écriture.
+// L'appelant détient c.mu, en écriture ou en lecture avec le verrou
+// exclusif du document.
+func (c *Collection) versioned(docID string, write func() error) error {
+	ts, record := c.commitTS, c.commitRecord
+	if ts == 0 {
+		ts, record = c.db.clock().reserve()
+		defer c.db.clock().publish(ts)
+	}
+	if record {
+		previous, err := c.readDocument(docID)
+		if err != nil {
+			previous = nil
+		}
+		c.versionsMu.Lock()
+		if c.versions == nil {
+			c.versions = make(map[string][]docVersion)
+		}
+		c.versions[docID] = append(c.versions[docID], docVersion{until: ts, doc: previous})
+		c.versionsMu.Unlock()
+	}
+	return write()
+}
+
+// versionAt retourne l'image de docID dans l'instantané snapshot si le
+// document a été écrit depuis ; l'appelant détient c.mu
+func (c *Collection) versionAt(docID string, snapshot uint64) (Document, bool) {
+	c.versionsMu.Lock()
+	defer c.versionsMu.Unlock()
+	return c.versionAtLocked(docID, snapshot)
+}
+
+// versionAtLocked est versionAt pour un appelant détenant c.versionsMu
+func (c *Collection) versionAtLocked(docID string, snapshot uint64) (Document, bool) {
+	// Les versions d'un document sont dans l'ordre de leurs écritures
+	for _, version := range c.versions[docID] {
+		if version.until > snapshot {
+			return version.doc, true
+		}
+	}
+	return nil, false
+}
+
+// overlayAt retourne l'image, dans l'instantané snapshot, des documents
+// écrits depuis (nil pour un document qui n'existait pas) ; l'appelant
+// détient c.mu
+func (c *Collection) overlayAt(snapshot uint64) map[string]Document {
+	c.versionsMu.Lock()
+	defer c.versionsMu.Unlock()
+
+	overlay := make(map[string]Document)
+	for docID := range c.versions {
+		if doc, changed := c.versionAtLocked(docID, snapshot); changed {
+			overlay[docID] = doc
+		}
+	}
+	return overlay
+}
+
+// getDocumentAt lit le document docID tel qu'il était dans l'instantané
+// snapshot. Le document est lu avant ses versions : une écriture
+// concurrente enregistre l'image qu'elle remplace avant d'écrire.
+func (c *Collection) getDocumentAt(docID string, snapshot uint64) (Document, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	current, err := c.readDocument(docID)
+	doc, changed := c.versionAt(docID, snapshot)
+	if !changed {
+		return current, err
+	}
+	if doc == nil {
+		return nil, &os.PathError{Op: "get", Path: docID, Err: os.ErrNotExist}
+	}
+	return copyDocument(doc), nil
+}
+
+// pruneVersions oublie les versions qu'aucun instantané actif ne peut lire :
+// celles écrites avant le plus ancien (toutes s'il n'y en a pas). Il est lu
+// sous c.mu : un instantané pris ensuite est postérieur à toutes les
+// versions présentes.
+func (c *Collection) pruneVersions() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.versions) == 0 {
+		return
+	}
+	oldest, active := c.db.clock().oldest()
+	for docID, versions := range c.versions {
+		kept := versions[:0]
+		for _, version := range versions {
+			if active && version.until > oldest {
+				kept = append(kept, version)
+			}
+		}
+		if len(kept) == 0 {
+			delete(c.versions, docID)
+			continue
+		}
+		c.versions[docID] = kept
+	}
+}
+
+// readSet est ce qu'une transaction sérialisable a lu dans une collection :
+// des documents par ID et des filtres de recherche
+type readSet struct {
+	ids        map[string]bool
+	predicates []matcher
+}
+
+// recordRead ajoute une lecture à l'ensemble de lecture de tx, s'il est
+// sérialisable : le document docID ou, avec match, les documents vérifiant
+// le filtre
+func (tx *Transaction) recordRead(collectionName string, docID string, match matcher) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.reads == nil {
+		return
+	}
+	reads, exists := tx.reads[collectionName]
+	if !exists {
+		reads = &readSet{ids: make(map[string]bool)}
+		tx.reads[collectionName] = reads
+	}
+	if match != nil {
+		reads.predicates = append(reads.predicates, match)
+	} else {
+		reads.ids[docID] = true
+	}
+}
+
+// validateWrites échoue avec ErrWriteConflict si un document écrit par tx
+// l'a aussi été, et validé, depuis son instantané : la version lue par tx
+// lorsqu'elle a journalisé l'écriture n'est plus la version courante.
+// L'appelant détient tx.mu et le verrou des collections écrites.
+func (tx *Transaction) validateWrites(collections map[string]*Collection) error {
+	for _, entry := range tx.Log {
+		c := collections[entry.Collection]
+		if _, changed := c.versionAt(entry.DocumentID, tx.snapshot); changed {
+			return fmt.Errorf("%w: document %s de %s modifié depuis le début de la transaction", ErrWriteConflict, entry.DocumentID, entry.Collection)
+		}
+	}
+	return nil
+}
+
+// validateReads échoue avec ErrSerializationFailure si un document écrit
+// depuis l'instantané de tx a été lu par tx, ou vérifiait avant ou après
+// l'écriture l'un de ses filtres. L'appelant détient tx.mu et le verrou des
+// collections lues, données par nom.
+func (tx *Transaction) validateReads(collections map[string]*Collection) error {
+	for name, reads := range tx.reads {
+		c := collections[name]
+		for docID, versions := range c.versions {
+			var images []Document
+			for _, version := range versions {
+				if version.until > tx.snapshot {
+					images = append(images, version.doc)
+				}
+			}
+			if len(images) == 0 {
+				continue
+			}
+			if reads.ids[docID] {
+				return fmt.Errorf("%w: document %s de %s modifié depuis le début de la transaction", ErrSerializationFailure, docID, name)
+			}
+			if current, err := c.readDocument(docID); err == nil {
+				images = append(images, current)
+			}
+			for _, image := range images {
+				if image == nil {
+					continue
+				}
+				for _, match := range reads.predicates {
+					if match(image) {
+						return fmt.Errorf("%w: document %s de %s, lu par une recherche, modifié depuis le début de la transaction", ErrSerializationFailure, docID, name)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// clock retourne l'horloge de validation de la base
+func (db *Database) clock() *commitClock {
+	return db.txManager.clock
+}
+
+// collectVersions oublie, dans toutes les collections, les versions
+// qu'aucune transaction active ne peut plus lire
+func (db *Database) collectVersions() {
+	for _, collection := range db.GetCollections() {
+		collection.pruneVersions()
+	}
+}
+
+// applyAtomically exécute apply sous le verrou des collections names, pris
+// dans l'ordre des noms, avec un seul horodatage de validation publié une
+// fois apply terminé : un instantané voit toutes ses écritures ou aucune,
+// et un lecteur ne voit jamais une validation partielle
+func (db *Database) applyAtomically(names []string, apply func(collections map[string]*Collection) error) error {
+	sort.Strings(names)
+	collections := make(map[string]*Collection, len(names))
+	var locked []*Collection
+	for _, name := range names {
+		if _, seen := collections[name]; seen {
+			continue
+		}
+		collection, err := db.GetCollection(name)
+		if err != nil {
+			return fmt.Errorf("collection %s not found", name)
+		}
+		collections[name] = collection
+		locked = append(locked, collection)
+	}
+
+	for _, collection := range locked {
+		collection.mu.Lock()
+	}
+	defer func() {
+		for _, collection := range locked {
+			collection.mu.Unlock()
+		}
+	}()
+	defer db.stampWrites(locked)()
+
+	return apply(collections)
+}
+
+// stampWrites attribue un seul horodatage aux écritures faites sur les
+// collections jusqu'à l'appel de la fonction retournée, qui le publie.
+// L'appelant détient leur verrou en écriture ; si une validation est déjà
+// en cours sur la première, ses écritures en font partie.
+func (db *Database) stampWrites(collections []*Collection) func() {
+	if len(collections) == 0 || collections[0].commitTS != 0 {
+		return func() {}
+	}
+	ts, record := db.clock().reserve()
+	for _, collection := range collections {
+		collection.commitTS, collection.commitRecord = ts, record
+	}
+	return func() {
+		for _, collection := range collections {
+			collection.commitTS, collection.commitRecord = 0, false
+		}
+		db.clock().publish(ts)
+	}
+}
@@ -0,0 +1,178 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// TestSnapshotVisibility vérifie qu'une transaction lit l'état validé à
+// son début, malgré les écritures validées depuis hors d'elle
+func TestSnapshotVisibility(t *testing.T) {
+	db := openTestDatabase(t)
+	c := createTestCollection(t, db, "items")
+	mustInsert(t, c, Document{"_id": "a", "n": 1})
+	mustInsert(t, c, Document{"_id": "b", "n": 1})
+
+	tx := db.BeginTransaction()
+	defer db.Rollback(tx)
+
+	if err := c.Update("a", Document{"n": 2}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := c.Delete("b"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	mustInsert(t, c, Document{"_id": "c", "n": 1})
+
+	doc, err := db.GetDocumentWithTransaction(tx, "items", "a")
+	if err != nil || doc["n"] != float64(1) {
+		t.Fatalf("a dans la transaction = %v (%v), attendu la version de son instantané", doc, err)
+	}
+	if _, err := db.GetDocumentWithTransaction(tx, "items", "b"); err != nil {
+		t.Fatalf("b dans la transaction: %v, attendu encore visible", err)
+	}
+	docs, err := db.FindWithTransaction(tx, "items", Filter{"n": 1}, FindOptions{})
+	if err != nil {
+		t.Fatalf("FindWithTransaction: %v", err)
+	}
+	ids := documentIDs(docs)
+	sort.Strings(ids)
+	if !reflect.DeepEqual(ids, []string{"a", "b"}) {
+		t.Fatalf("FindWithTransaction = %v, attendu [a b] de l'instantané", ids)
+	}
+
+	// Une nouvelle transaction voit l'état courant
+	later := db.BeginTransaction()
+	defer db.Rollback(later)
+	if doc, err := db.GetDocumentWithTransaction(later, "items", "a"); err != nil || doc["n"] != float64(2) {
+		t.Fatalf("a dans une nouvelle transaction = %v (%v)", doc, err)
+	}
+}
+
+// writeSkew fait lire les médecins de garde à deux transactions de niveau
+// isolation, puis retirer chacune un médecin différent de la garde, et
+// retourne les erreurs de leurs validations
+func writeSkew(t *testing.T, isolation IsolationLevel) (error, error) {
+	t.Helper()
+	db := openTestDatabase(t)
+	c := createTestCollection(t, db, "doctors")
+	mustInsert(t, c, Document{"_id": "alice", "on_call": true})
+	mustInsert(t, c, Document{"_id": "bob", "on_call": true})
+
+	var txs [2]*Transaction
+	for i, name := range []string{"alice", "bob"} {
+		tx, err := db.BeginTransactionWithOptions(TransactionOptions{Isolation: isolation})
+		if err != nil {
+			t.Fatalf("BeginTransactionWithOptions: %v", err)
+		}
+		txs[i] = tx
+		docs, err := db.FindWithTransaction(tx, "doctors", Filter{"on_call": true}, FindOptions{})
+		if err != nil || len(docs) != 2 {
+			t.Fatalf("FindWithTransaction = %v (%v), attendu deux médecins de garde", docs, err)
+		}
+		if err := db.UpdateWithTransaction(tx, "doctors", name, Document{"on_call": false}); err != nil {
+			t.Fatalf("UpdateWithTransaction: %v", err)
+		}
+	}
+	return db.Commit(txs[0]), db.Commit(txs[1])
+}
+
+// TestWriteSkew vérifie que l'isolation sérialisable rejette l'écriture
+// biaisée que l'isolation par instantané laisse passer
+func TestWriteSkew(t *testing.T) {
+	first, second := writeSkew(t, IsolationSnapshot)
+	if first != nil || second != nil {
+		t.Fatalf("instantané: validations %v et %v, attendu les deux acceptées", first, second)
+	}
+
+	first, second = writeSkew(t, IsolationSerializable)
+	if first != nil {
+		t.Fatalf("sérialisable: première validation %v", first)
+	}
+	if !errors.Is(second, ErrSerializationFailure) {
+		t.Fatalf("sérialisable: seconde validation %v, attendu ErrSerializationFailure", second)
+	}
+}
+
+// TestVersionsCollected vérifie que les versions gardées pour un
+// instantané sont oubliées une fois la transaction terminée
+func TestVersionsCollected(t *testing.T) {
+	db := openTestDatabase(t)
+	c := createTestCollection(t, db, "items")
+	mustInsert(t, c, Document{"_id": "a", "n": 1})
+
+	tx := db.BeginTransaction()
+	if err := c.Update("a", Document{"n": 2}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	c.versionsMu.Lock()
+	kept := len(c.versions["a"])
+	c.versionsMu.Unlock()
+	if kept == 0 {
+		t.Fatal("aucune version gardée pour l'instantané de la transaction")
+	}
+
+	if err := db.Rollback(tx); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	c.versionsMu.Lock()
+	defer c.versionsMu.Unlock()
+	if len(c.versions) != 0 {
+		t.Fatalf("versions = %v après la fin de la transaction, attendu aucune", c.versions)
+	}
+}
+
+// TestWriteConflict vérifie que le premier à valider gagne : une
+// transaction écrivant un document validé depuis son début est annulée,
+// sans toucher au document ni laisser de WAL
+func TestWriteConflict(t *testing.T) {
+	db := openTestDatabase(t)
+	c := createTestCollection(t, db, "items")
+	mustInsert(t, c, Document{"_id": "a", "n": 1})
+	mustInsert(t, c, Document{"_id": "b", "n": 1})
+
+	first := db.BeginTransaction()
+	second := db.BeginTransaction()
+	if err := db.UpdateWithTransaction(first, "items", "a", Document{"n": 2}); err != nil {
+		t.Fatalf("UpdateWithTransaction: %v", err)
+	}
+	if err := db.Commit(first); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	// second ne voit pas l'écriture de first, mais ne peut l'écraser
+	if err := db.ModifyWithTransaction(second, "items", "a", Update{"$inc": map[string]interface{}{"n": 10}}); err != nil {
+		t.Fatalf("ModifyWithTransaction: %v", err)
+	}
+	if err := db.UpdateWithTransaction(second, "items", "b", Document{"n": 3}); err != nil {
+		t.Fatalf("UpdateWithTransaction: %v", err)
+	}
+	if err := db.Commit(second); !errors.Is(err, ErrWriteConflict) {
+		t.Fatalf("Commit = %v, attendu ErrWriteConflict", err)
+	}
+	if doc := mustGet(t, c, "a"); doc["n"] != float64(2) {
+		t.Fatalf("a = %v, attendu l'écriture de la première transaction", doc)
+	}
+	if doc := mustGet(t, c, "b"); doc["n"] != float64(1) {
+		t.Fatalf("b = %v, attendu aucune écriture de la transaction annulée", doc)
+	}
+	if files, _ := os.ReadDir(db.txManager.walPath); len(files) != 0 {
+		t.Fatalf("%d fichiers restent dans le WAL", len(files))
+	}
+
+	// Une écriture hors transaction compte aussi
+	third := db.BeginTransaction()
+	if err := c.Update("b", Document{"n": 4}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := db.DeleteWithTransaction(third, "items", "b"); err != nil {
+		t.Fatalf("DeleteWithTransaction: %v", err)
+	}
+	if err := db.Commit(third); !errors.Is(err, ErrWriteConflict) {
+		t.Fatalf("Commit = %v, attendu ErrWriteConflict", err)
+	}
+	mustGet(t, c, "b")
+}
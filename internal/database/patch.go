@@ -0,0 +1,353 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// PatchOperation est une opération JSON Patch (RFC 6902) : add, remove,
+// replace, move, copy ou test. Path et From sont des pointeurs JSON
+// (RFC 6901), par exemple "/address/city" ou "/tags/-".
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// ErrInvalidPatch signale un patch mal formé ou inapplicable au document
+var ErrInvalidPatch = errors.New("patch invalide")
+
+// ErrPatchTestFailed signale l'échec d'une opération test d'un JSON Patch
+var ErrPatchTestFailed = errors.New("test du patch en échec")
+
+// MergePatch applique un JSON Merge Patch (RFC 7396) au document docID :
+// les champs du patch remplacent ceux du document, récursivement pour les
+// objets, et un champ null est retiré. Retourne le document modifié.
+func (c *Collection) MergePatch(docID string, patch map[string]interface{}) (Document, error) {
+	return c.MergePatchWithPrecondition(docID, patch, Precondition{})
+}
+
+// MergePatchWithPrecondition applique un JSON Merge Patch si la
+// précondition sur la révision du document est vérifiée
+func (c *Collection) MergePatchWithPrecondition(docID string, patch map[string]interface{}, pre Precondition) (Document, error) {
+	// Seuls les champs de premier niveau du patch peuvent changer
+	paths := make([]string, 0, len(patch))
+	for key := range patch {
+		paths = append(paths, key)
+	}
+
+	return c.patchDocument(docID, pre, paths, func(doc Document) (Document, error) {
+		return Document(mergePatch(map[string]interface{}(doc), patch).(map[string]interface{})), nil
+	})
+}
+
+// mergePatch applique patch à target selon l'algorithme de la RFC 7396
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	fields, ok := asMap(patch)
+	if !ok {
+		return copyValue(patch)
+	}
+	object, ok := asMap(target)
+	if !ok {
+		object = map[string]interface{}{}
+	}
+	for key, value := range fields {
+		if value == nil {
+			delete(object, key)
+			continue
+		}
+		object[key] = mergePatch(object[key], value)
+	}
+	return object
+}
+
+// JSONPatch applique un JSON Patch (RFC 6902) au document docID. Les
+// opérations sont appliquées dans l'ordre et toutes ou aucune : si l'une
+// échoue (ErrInvalidPatch, ErrPatchTestFailed), le document est inchangé.
+func (c *Collection) JSONPatch(docID string, operations []PatchOperation) (Document, error) {
+	return c.JSONPatchWithPrecondition(docID, operations, Precondition{})
+}
+
+// JSONPatchWithPrecondition applique un JSON Patch si la précondition sur
+// la révision du document est vérifiée
+func (c *Collection) JSONPatchWithPrecondition(docID string, operations []PatchOperation, pre Precondition) (Document, error) {
+	var paths []string
+	for _, operation := range operations {
+		if err := operation.validate(); err != nil {
+			return nil, err
+		}
+		if operation.Op == "test" {
+			continue
+		}
+		paths = append(paths, pointerPath(operation.Path))
+		if operation.Op == "move" {
+			paths = append(paths, pointerPath(operation.From))
+		}
+	}
+
+	return c.patchDocument(docID, pre, paths, func(doc Document) (Document, error) {
+		var root interface{} = map[string]interface{}(doc)
+		for i, operation := range operations {
+			var err error
+			if root, err = operation.apply(root); err != nil {
+				return nil, fmt.Errorf("opération %d (%s %s): %w", i, operation.Op, operation.Path, err)
+			}
+		}
+		object, ok := asMap(root)
+		if !ok {
+			return nil, fmt.Errorf("%w: le document doit rester un objet", ErrInvalidPatch)
+		}
+		return Document(object), nil
+	})
+}
+
+// patchDocument applique apply à une copie du document docID puis l'écrit,
+// sous le verrou exclusif du document et celui de la collection, si pre est
+// vérifiée. paths sont les champs que le patch peut modifier, "" désignant
+// le document entier : seuls les index portant sur ces champs sont
+// vérifiés et mis à jour.
+func (c *Collection) patchDocument(docID string, pre Precondition, paths []string, apply func(doc Document) (Document, error)) (Document, error) {
+	owner, err := c.lockForWrite(docID)
+	if err != nil {
+		return nil, err
+	}
+	defer c.db.locks().release(owner)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current, err := c.readDocument(docID)
+	if err != nil {
+		current = nil
+	}
+	if checkErr := pre.check(current); checkErr != nil {
+		return nil, checkErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	updated, err := apply(copyDocument(current))
+	if err != nil {
+		return nil, err
+	}
+	if err := setDocumentID(docID, updated); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+	if sameDocument(current, updated) {
+		return updated, nil
+	}
+
+	var indexes []*Index
+	if containsRoot(paths) {
+		for _, index := range c.indexes {
+			indexes = append(indexes, index)
+		}
+	} else {
+		indexes = c.affectedIndexes(paths)
+	}
+	if err := c.replaceDocument(docID, current, updated, indexes, c.syncWrites()); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// containsRoot indique si l'un des chemins désigne le document entier
+func containsRoot(paths []string) bool {
+	for _, path := range paths {
+		if path == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// validate vérifie la forme d'une opération avant toute application
+func (operation PatchOperation) validate() error {
+	switch operation.Op {
+	case "add", "remove", "replace", "test":
+	case "move", "copy":
+		if _, err := parsePointer(operation.From); err != nil {
+			return err
+		}
+		if operation.Op == "move" && strings.HasPrefix(operation.Path, operation.From+"/") {
+			return fmt.Errorf("%w: move de %s vers l'un de ses descendants %s", ErrInvalidPatch, operation.From, operation.Path)
+		}
+	default:
+		return fmt.Errorf("%w: opération %q inconnue", ErrInvalidPatch, operation.Op)
+	}
+	_, err := parsePointer(operation.Path)
+	return err
+}
+
+// apply applique l'opération à root et retourne la nouvelle racine
+func (operation PatchOperation) apply(root interface{}) (interface{}, error) {
+	tokens, _ := parsePointer(operation.Path)
+	switch operation.Op {
+	case "add":
+		return pointerAdd(root, tokens, copyValue(operation.Value))
+	case "remove":
+		root, _, err := pointerRemove(root, tokens)
+		return root, err
+	case "replace":
+		if len(tokens) == 0 {
+			return copyValue(operation.Value), nil
+		}
+		if _, err := pointerGet(root, tokens); err != nil {
+			return nil, err
+		}
+		root, _, err := pointerRemove(root, tokens)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(root, tokens, copyValue(operation.Value))
+	case "move":
+		from, _ := parsePointer(operation.From)
+		root, value, err := pointerRemove(root, from)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(root, tokens, value)
+	case "copy":
+		from, _ := parsePointer(operation.From)
+		value, err := pointerGet(root, from)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(root, tokens, copyValue(value))
+	case "test":
+		value, err := pointerGet(root, tokens)
+		if err != nil {
+			return nil, err
+		}
+		if compareValues(normalizeKey(value), normalizeKey(operation.Value)) != 0 {
+			return nil, fmt.Errorf("%w: %s ne vaut pas %v", ErrPatchTestFailed, operation.Path, operation.Value)
+		}
+	}
+	return root, nil
+}
+
+// parsePointer découpe un pointeur JSON en segments, ~1 et ~0 désignant
+// / et ~ ; le pointeur vide désigne le document entier
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%w: pointeur JSON %q sans / initial", ErrInvalidPatch, pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// pointerPath convertit un pointeur JSON en chemin pointé, pour retrouver
+// les index concernés
+func pointerPath(pointer string) string {
+	tokens, _ := parsePointer(pointer)
+	return strings.Join(tokens, ".")
+}
+
+// pointerGet retourne la valeur désignée par tokens
+func pointerGet(node interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		switch container := node.(type) {
+		case map[string]interface{}:
+			value, exists := container[token]
+			if !exists {
+				return nil, fmt.Errorf("%w: champ %q absent", ErrInvalidPatch, token)
+			}
+			node = value
+		case []interface{}:
+			i, ok := arrayIndex(token, len(container))
+			if !ok {
+				return nil, fmt.Errorf("%w: position %q hors du tableau", ErrInvalidPatch, token)
+			}
+			node = container[i]
+		default:
+			return nil, fmt.Errorf("%w: %q n'est pas dans un objet ou un tableau", ErrInvalidPatch, token)
+		}
+	}
+	return node, nil
+}
+
+// pointerUpdate remplace le conteneur parent de la cible de tokens par le
+// résultat de fn (un tableau peut changer de longueur) et retourne la
+// nouvelle racine
+func pointerUpdate(root interface{}, tokens []string, fn func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return fn(root, tokens[0])
+	}
+	child, err := pointerGet(root, tokens[:1])
+	if err != nil {
+		return nil, err
+	}
+	if child, err = pointerUpdate(child, tokens[1:], fn); err != nil {
+		return nil, err
+	}
+	switch container := root.(type) {
+	case map[string]interface{}:
+		container[tokens[0]] = child
+	case []interface{}:
+		i, _ := arrayIndex(tokens[0], len(container))
+		container[i] = child
+	}
+	return root, nil
+}
+
+// pointerAdd ajoute value à la cible de tokens : remplace un champ ou
+// s'insère dans un tableau ("-" pour la fin)
+func pointerAdd(root interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return pointerUpdate(root, tokens, func(parent interface{}, token string) (interface{}, error) {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			container[token] = value
+			return container, nil
+		case []interface{}:
+			i := len(container)
+			if token != "-" {
+				var ok bool
+				if i, ok = arrayIndex(token, len(container)+1); !ok {
+					return nil, fmt.Errorf("%w: position %q hors du tableau", ErrInvalidPatch, token)
+				}
+			}
+			container = append(container, nil)
+			copy(container[i+1:], container[i:])
+			container[i] = value
+			return container, nil
+		}
+		return nil, fmt.Errorf("%w: %q n'est pas dans un objet ou un tableau", ErrInvalidPatch, token)
+	})
+}
+
+// pointerRemove retire la cible de tokens et retourne la nouvelle racine
+// et la valeur retirée
+func pointerRemove(root interface{}, tokens []string) (interface{}, interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, nil, fmt.Errorf("%w: le document entier ne peut être retiré", ErrInvalidPatch)
+	}
+	var removed interface{}
+	root, err := pointerUpdate(root, tokens, func(parent interface{}, token string) (interface{}, error) {
+		value, err := pointerGet(parent, []string{token})
+		if err != nil {
+			return nil, err
+		}
+		removed = value
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			delete(container, token)
+			return container, nil
+		case []interface{}:
+			i, _ := arrayIndex(token, len(container))
+			return append(container[:i], container[i+1:]...), nil
+		}
+		return parent, nil
+	})
+	return root, removed, err
+}
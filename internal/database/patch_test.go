@@ -0,0 +1,88 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// decodePatch décode un JSON Patch comme le ferait l'API
+func decodePatch(t *testing.T, data string) []PatchOperation {
+	t.Helper()
+	var operations []PatchOperation
+	if err := json.Unmarshal([]byte(data), &operations); err != nil {
+		t.Fatalf("patch %s: %v", data, err)
+	}
+	return operations
+}
+
+// TestMergePatch vérifie le remplacement récursif des objets et le
+// retrait des champs null (RFC 7396)
+func TestMergePatch(t *testing.T) {
+	c := createTestCollection(t, openTestDatabase(t), "users")
+	mustInsert(t, c, decodeDocument(t, `{"_id": "a", "name": "ann", "tags": ["x"], "address": {"city": "Paris", "zip": "75001"}}`))
+
+	doc, err := c.MergePatch("a", decodeDocument(t, `{"tags": ["y"], "address": {"city": "Lyon", "zip": null}, "age": 30}`))
+	if err != nil {
+		t.Fatalf("MergePatch: %v", err)
+	}
+	want := decodeDocument(t, `{"_id": "a", "name": "ann", "tags": ["y"], "address": {"city": "Lyon"}, "age": 30}`)
+	if !reflect.DeepEqual(doc, want) {
+		t.Fatalf("MergePatch = %v, attendu %v", doc, want)
+	}
+	if stored := mustGet(t, c, "a"); !reflect.DeepEqual(stored, want) {
+		t.Fatalf("a = %v, attendu %v", stored, want)
+	}
+}
+
+// TestJSONPatch vérifie les opérations JSON Patch (RFC 6902)
+func TestJSONPatch(t *testing.T) {
+	c := createTestCollection(t, openTestDatabase(t), "users")
+	mustInsert(t, c, decodeDocument(t, `{"_id": "a", "name": "ann", "tags": ["x", "y"], "address": {"city": "Paris"}, "a/b": 1}`))
+
+	doc, err := c.JSONPatch("a", decodePatch(t, `[
+		{"op": "test", "path": "/name", "value": "ann"},
+		{"op": "add", "path": "/tags/-", "value": "z"},
+		{"op": "add", "path": "/tags/0", "value": "w"},
+		{"op": "remove", "path": "/tags/1"},
+		{"op": "replace", "path": "/address/city", "value": "Lyon"},
+		{"op": "copy", "from": "/address", "path": "/billing"},
+		{"op": "move", "from": "/name", "path": "/nickname"},
+		{"op": "remove", "path": "/a~1b"}]`))
+	if err != nil {
+		t.Fatalf("JSONPatch: %v", err)
+	}
+	want := decodeDocument(t, `{"_id": "a", "nickname": "ann", "tags": ["w", "y", "z"],
+		"address": {"city": "Lyon"}, "billing": {"city": "Lyon"}}`)
+	if !reflect.DeepEqual(doc, want) {
+		t.Fatalf("JSONPatch = %v, attendu %v", doc, want)
+	}
+}
+
+// TestJSONPatchAllOrNothing vérifie qu'un patch en échec, par un test ou
+// une opération inapplicable, ne modifie pas le document
+func TestJSONPatchAllOrNothing(t *testing.T) {
+	c := createTestCollection(t, openTestDatabase(t), "users")
+	original := decodeDocument(t, `{"_id": "a", "name": "ann", "tags": ["x"]}`)
+	mustInsert(t, c, original)
+
+	tests := []struct {
+		patch string
+		err   error
+	}{
+		{`[{"op": "add", "path": "/age", "value": 1}, {"op": "test", "path": "/name", "value": "bob"}]`, ErrPatchTestFailed},
+		{`[{"op": "add", "path": "/age", "value": 1}, {"op": "remove", "path": "/missing"}]`, ErrInvalidPatch},
+		{`[{"op": "add", "path": "/tags/5", "value": "y"}]`, ErrInvalidPatch},
+		{`[{"op": "replace", "path": "/_id", "value": "b"}]`, ErrInvalidPatch},
+		{`[{"op": "jump", "path": "/name"}]`, ErrInvalidPatch},
+	}
+	for _, test := range tests {
+		if _, err := c.JSONPatch("a", decodePatch(t, test.patch)); !errors.Is(err, test.err) {
+			t.Errorf("JSONPatch(%s) = %v, attendu %v", test.patch, err, test.err)
+		}
+	}
+	if doc := mustGet(t, c, "a"); !reflect.DeepEqual(doc, original) {
+		t.Fatalf("a = %v après des patchs refusés, attendu %v", doc, original)
+	}
+}
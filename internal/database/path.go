@@ -0,0 +1,216 @@
+package database
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Les chemins de champs utilisent la notation pointée : "address.city"
+// désigne le champ city de l'objet address, "items.0.sku" le champ sku du
+// premier élément du tableau items. Un segment non numérique appliqué à un
+// tableau porte sur chacun de ses éléments ("items.sku" désigne les sku de
+// tous les éléments). Ces fonctions sont partagées par les index, les
+// recherches, les opérateurs de mise à jour et les projections.
+
+// splitPath découpe un chemin en segments
+func splitPath(path string) []string {
+	return strings.Split(path, ".")
+}
+
+// validatePath vérifie qu'un chemin n'a pas de segment vide
+func validatePath(path string) error {
+	for _, segment := range splitPath(path) {
+		if segment == "" {
+			return fmt.Errorf("chemin de champ invalide: %q", path)
+		}
+	}
+	return nil
+}
+
+// arrayIndex interprète un segment comme position dans un tableau
+func arrayIndex(segment string, length int) (int, bool) {
+	i, err := strconv.Atoi(segment)
+	if err != nil || i < 0 || i >= length || segment != strconv.Itoa(i) {
+		return 0, false
+	}
+	return i, true
+}
+
+// getPath retourne la valeur désignée exactement par path, sans parcourir
+// les éléments des tableaux autrement que par leur position
+func getPath(doc map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = doc
+	for _, segment := range splitPath(path) {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, exists := node[segment]
+			if !exists {
+				return nil, false
+			}
+			current = value
+		case Document:
+			value, exists := node[segment]
+			if !exists {
+				return nil, false
+			}
+			current = value
+		case []interface{}:
+			i, ok := arrayIndex(segment, len(node))
+			if !ok {
+				return nil, false
+			}
+			current = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// pathValues retourne toutes les valeurs désignées par path, en
+// parcourant chaque élément des tableaux rencontrés en chemin
+func pathValues(doc map[string]interface{}, path string) []interface{} {
+	return collectPath(doc, splitPath(path), nil)
+}
+
+func collectPath(current interface{}, segments []string, values []interface{}) []interface{} {
+	if len(segments) == 0 {
+		return append(values, current)
+	}
+
+	segment, rest := segments[0], segments[1:]
+	switch node := current.(type) {
+	case map[string]interface{}:
+		if value, exists := node[segment]; exists {
+			values = collectPath(value, rest, values)
+		}
+	case Document:
+		if value, exists := node[segment]; exists {
+			values = collectPath(value, rest, values)
+		}
+	case []interface{}:
+		if i, ok := arrayIndex(segment, len(node)); ok {
+			return collectPath(node[i], rest, values)
+		}
+		for _, element := range node {
+			if _, nested := element.([]interface{}); nested {
+				continue
+			}
+			values = collectPath(element, segments, values)
+		}
+	}
+	return values
+}
+
+// matchValues retourne les valeurs normalisées auxquelles une recherche
+// sur path est comparée : les valeurs du chemin et, pour un tableau, le
+// tableau entier et chacun de ses éléments (multikey). Le résultat est
+// vide si le chemin n'existe pas.
+func matchValues(doc map[string]interface{}, path string) []interface{} {
+	return expandValues(pathValues(doc, path))
+}
+
+// expandValues normalise des valeurs brutes et y ajoute les éléments des tableaux
+func expandValues(raw []interface{}) []interface{} {
+	var values []interface{}
+	for _, value := range raw {
+		values = append(values, normalizeKey(value))
+		if array, ok := value.([]interface{}); ok {
+			for _, element := range array {
+				values = append(values, normalizeKey(element))
+			}
+		}
+	}
+	return values
+}
+
+// matchPath indique si l'une des valeurs de path dans doc vérifie match
+func matchPath(doc map[string]interface{}, path string, match func(value interface{}) bool) bool {
+	for _, value := range matchValues(doc, path) {
+		if match(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// setPath affecte value au chemin path, en créant les objets
+// intermédiaires manquants ; un tableau n'est traversé que par position
+func setPath(doc map[string]interface{}, path string, value interface{}) error {
+	segments := splitPath(path)
+	var current interface{} = doc
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		switch node := current.(type) {
+		case map[string]interface{}:
+			if last {
+				node[segment] = value
+				return nil
+			}
+			next, exists := node[segment]
+			if !exists || next == nil {
+				next = map[string]interface{}{}
+				node[segment] = next
+			}
+			current = next
+		case Document:
+			if last {
+				node[segment] = value
+				return nil
+			}
+			next, exists := node[segment]
+			if !exists || next == nil {
+				next = map[string]interface{}{}
+				node[segment] = next
+			}
+			current = next
+		case []interface{}:
+			index, ok := arrayIndex(segment, len(node))
+			if !ok {
+				return fmt.Errorf("position %q invalide dans le tableau du chemin %s", segment, path)
+			}
+			if last {
+				node[index] = value
+				return nil
+			}
+			current = node[index]
+		default:
+			return fmt.Errorf("le chemin %s traverse une valeur qui n'est pas un objet", path)
+		}
+	}
+	return nil
+}
+
+// unsetPath supprime le champ désigné par path ; l'élément d'un tableau
+// désigné par sa position devient null, comme dans MongoDB
+func unsetPath(doc map[string]interface{}, path string) bool {
+	segments := splitPath(path)
+	parentPath := strings.Join(segments[:len(segments)-1], ".")
+	last := segments[len(segments)-1]
+
+	var parent interface{} = doc
+	if parentPath != "" {
+		var exists bool
+		if parent, exists = getPath(doc, parentPath); !exists {
+			return false
+		}
+	}
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		_, exists := node[last]
+		delete(node, last)
+		return exists
+	case Document:
+		_, exists := node[last]
+		delete(node, last)
+		return exists
+	case []interface{}:
+		if i, ok := arrayIndex(last, len(node)); ok {
+			node[i] = nil
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package database
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// pathTestDocument est un document imbriqué, décodé comme depuis JSON
+func pathTestDocument() map[string]interface{} {
+	return map[string]interface{}{
+		"address": map[string]interface{}{"city": "Paris"},
+		"tags":    []interface{}{"a", "b"},
+		"items": []interface{}{
+			map[string]interface{}{"sku": "x"},
+			map[string]interface{}{"sku": "y"},
+		},
+	}
+}
+
+// TestPathValues vérifie la notation pointée : objets imbriqués,
+// positions dans un tableau et parcours des éléments
+func TestPathValues(t *testing.T) {
+	doc := pathTestDocument()
+	tests := []struct {
+		path string
+		want []interface{}
+	}{
+		{"address.city", []interface{}{"Paris"}},
+		{"items.1.sku", []interface{}{"y"}},
+		{"items.sku", []interface{}{"x", "y"}},
+		{"address.zip", nil},
+		{"tags.0", []interface{}{"a"}},
+	}
+	for _, test := range tests {
+		if got := pathValues(doc, test.path); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("pathValues(%s) = %v, attendu %v", test.path, got, test.want)
+		}
+	}
+
+	if value, ok := getPath(doc, "items.sku"); ok {
+		t.Errorf("getPath(items.sku) = %v, attendu aucune valeur sans position", value)
+	}
+	if err := validatePath("address..city"); err == nil {
+		t.Error("validatePath a accepté un segment vide")
+	}
+}
+
+// TestNestedAndMultikeyIndexes vérifie les index sur un champ imbriqué et
+// sur les éléments d'un tableau, avec et sans index
+func TestNestedAndMultikeyIndexes(t *testing.T) {
+	for _, indexed := range []bool{true, false} {
+		c := createTestCollection(t, openTestDatabase(t), "orders")
+		if indexed {
+			for _, field := range []string{"address.city", "tags", "items.sku"} {
+				if err := c.CreateIndex(field, false); err != nil {
+					t.Fatalf("CreateIndex(%s): %v", field, err)
+				}
+			}
+		}
+		doc := pathTestDocument()
+		doc["name"] = "a"
+		mustInsert(t, c, doc)
+		mustInsert(t, c, Document{"name": "b", "address": map[string]interface{}{"city": "Lyon"}, "tags": []interface{}{"b"}})
+
+		tests := []struct {
+			field string
+			value interface{}
+			want  []string
+		}{
+			{"address.city", "Paris", []string{"a"}},
+			{"tags", "b", []string{"a", "b"}},
+			{"items.sku", "y", []string{"a"}},
+		}
+		for _, test := range tests {
+			docs, err := c.FindByField(test.field, test.value)
+			if err != nil {
+				t.Fatalf("FindByField: %v", err)
+			}
+			got := documentNames(docs)
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("index %v, FindByField(%s, %v) = %v, attendu %v", indexed, test.field, test.value, got, test.want)
+			}
+		}
+	}
+}
+
+// TestUniqueMultikeyIndex vérifie qu'un index unique sur un tableau
+// refuse une valeur prise par un autre document, pas une valeur répétée
+// dans le même document
+func TestUniqueMultikeyIndex(t *testing.T) {
+	c := createTestCollection(t, openTestDatabase(t), "users")
+	if err := c.CreateIndex("emails", true); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	mustInsert(t, c, Document{"emails": []interface{}{"a@example.com", "a@example.com"}})
+	if _, err := c.Insert(Document{"emails": []interface{}{"b@example.com", "a@example.com"}}); err == nil {
+		t.Fatal("Insert a accepté une adresse déjà prise")
+	}
+	mustInsert(t, c, Document{"emails": []interface{}{"b@example.com"}})
+}
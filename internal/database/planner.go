@@ -0,0 +1,852 @@
+package database
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Étapes d'un plan de requête
+const (
+	StageCollScan  = "COLLSCAN"  // parcours de tous les documents
+	StageIndexScan = "IXSCAN"    // parcours d'un index
+	StageIntersect = "INTERSECT" // intersection des IDs de deux index
+)
+
+// Stratégies de tri d'un plan de requête
+const (
+	SortIndex    = "INDEX" // ordre d'un index ordonné
+	SortTopK     = "TOP_K" // tas borné aux skip + limit premiers documents
+	SortInMemory = "SORT"  // tri de tous les documents retenus
+)
+
+// fetchCost est le coût relatif de la lecture d'un document face à
+// l'examen d'une clé d'index
+const fetchCost = 10.0
+
+// QueryPlan décrit une manière d'exécuter une requête
+type QueryPlan struct {
+	Stage   string   `json:"stage"`
+	Indexes []string `json:"indexes,omitempty"`
+	Bounds  []string `json:"bounds,omitempty"`
+	// Covered indique que les index répondent seuls au filtre : les
+	// documents ne sont lus que pour être retournés
+	Covered   bool    `json:"covered"`
+	Sort      string  `json:"sort,omitempty"`
+	Estimated int     `json:"estimated_docs"`
+	Cost      float64 `json:"cost"`
+}
+
+// Explanation rend compte du plan choisi pour une requête et de son exécution
+type Explanation struct {
+	Plan          QueryPlan     `json:"plan"`
+	RejectedPlans []QueryPlan   `json:"rejected_plans"`
+	KeysExamined  int           `json:"keys_examined"`
+	DocsExamined  int           `json:"docs_examined"`
+	Returned      int           `json:"returned"`
+	ExecutionTime time.Duration `json:"execution_time_ns"`
+}
+
+// fieldPredicate regroupe les conditions d'un filtre sur un chemin qu'un
+// index sait traduire
+type fieldPredicate struct {
+	eq    interface{}
+	hasEq bool
+	in    []interface{}
+	lower *Bound
+	upper *Bound
+	other bool // une condition du chemin n'est pas traduisible
+}
+
+// exact indique si une seule sorte de condition porte sur le chemin
+func (p *fieldPredicate) exact() bool {
+	kinds := 0
+	if p.hasEq {
+		kinds++
+	}
+	if p.in != nil {
+		kinds++
+	}
+	if p.lower != nil || p.upper != nil {
+		kinds++
+	}
+	return kinds == 1 && !p.other
+}
+
+// queryPredicates est l'analyse d'un filtre par le planificateur
+type queryPredicates struct {
+	fields map[string]*fieldPredicate
+	// residual signale des conditions hors de portée des index ($or...)
+	residual bool
+}
+
+// analyzeFilter extrait les conditions de premier niveau d'un filtre
+// (y compris dans un $and) ; le filtre est supposé valide
+func analyzeFilter(filter map[string]interface{}) queryPredicates {
+	predicates := queryPredicates{fields: make(map[string]*fieldPredicate)}
+	predicates.collect(filter)
+	return predicates
+}
+
+func (q *queryPredicates) collect(filter map[string]interface{}) {
+	for key, condition := range filter {
+		if key == "$and" {
+			clauses, _ := asArray(condition)
+			for _, clause := range clauses {
+				if sub, ok := asMap(clause); ok {
+					q.collect(sub)
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(key, "$") {
+			q.residual = true
+			continue
+		}
+
+		predicate, exists := q.fields[key]
+		if !exists {
+			predicate = &fieldPredicate{}
+			q.fields[key] = predicate
+		}
+		operators, ok := asMap(condition)
+		if !ok || !isOperatorMap(operators) {
+			predicate.addEqual(condition)
+			continue
+		}
+		for operator, operand := range operators {
+			if options, _ := operators["$options"].(string); operator == "$regex" && options != "" {
+				// Une option (i, m...) change le sens de l'ancrage ou de la casse
+				predicate.other = true
+				continue
+			}
+			predicate.addOperator(operator, operand)
+		}
+	}
+}
+
+// addEqual enregistre une égalité ; null correspond aussi aux champs
+// absents, qui ne sont pas indexés
+func (p *fieldPredicate) addEqual(value interface{}) {
+	if value == nil || p.hasEq {
+		p.other = true
+		return
+	}
+	p.eq, p.hasEq = value, true
+}
+
+func (p *fieldPredicate) addOperator(operator string, operand interface{}) {
+	switch operator {
+	case "$eq":
+		p.addEqual(operand)
+	case "$in":
+		values, _ := asArray(operand)
+		for _, value := range values {
+			if value == nil {
+				p.other = true
+				return
+			}
+		}
+		if p.in != nil {
+			p.other = true
+			return
+		}
+		p.in = values
+	case "$gt", "$gte":
+		if p.lower != nil {
+			p.other = true
+			return
+		}
+		p.lower = &Bound{Value: operand, Inclusive: operator == "$gte"}
+	case "$lt", "$lte":
+		if p.upper != nil {
+			p.other = true
+			return
+		}
+		p.upper = &Bound{Value: operand, Inclusive: operator == "$lte"}
+	case "$regex":
+		// Une expression ancrée ^préfixe borne l'intervalle des chaînes
+		// examinées ; l'expression reste vérifiée sur chaque document
+		p.other = true
+		pattern, _ := operand.(string)
+		if prefix := regexPrefix(pattern); prefix != "" && p.lower == nil && p.upper == nil {
+			p.lower = &Bound{Value: prefix, Inclusive: true}
+			if successor := prefixSuccessor(prefix); successor != "" {
+				p.upper = &Bound{Value: successor}
+			}
+		}
+	default:
+		p.other = true
+	}
+}
+
+// regexPrefix retourne le préfixe littéral imposé par une expression
+// ancrée par ^ et sans alternative, "" sinon
+func regexPrefix(pattern string) string {
+	if !strings.HasPrefix(pattern, "^") || strings.Contains(pattern, "|") {
+		return ""
+	}
+	re, err := regexp.Compile(pattern[1:])
+	if err != nil {
+		return ""
+	}
+	prefix, _ := re.LiteralPrefix()
+	return prefix
+}
+
+// prefixSuccessor retourne la plus petite chaîne supérieure à toutes
+// celles commençant par prefix, "" s'il n'y en a pas
+func prefixSuccessor(prefix string) string {
+	bytes := []byte(prefix)
+	for i := len(bytes) - 1; i >= 0; i-- {
+		if bytes[i] < 0xFF {
+			bytes[i]++
+			return string(bytes[:i+1])
+		}
+	}
+	return ""
+}
+
+// covers indique si les chemins traduits exactement par un plan couvrent
+// toutes les conditions du filtre
+func (q queryPredicates) covers(paths map[string]bool) bool {
+	if q.residual {
+		return false
+	}
+	for path := range q.fields {
+		if !paths[path] {
+			return false
+		}
+	}
+	return true
+}
+
+// indexScan est un parcours d'index candidat
+type indexScan struct {
+	index    *Index
+	eq       []interface{} // valeurs des premiers champs de l'index
+	in       []interface{} // valeurs possibles du champ (index simple)
+	r        *Range        // intervalle du champ (index simple ordonné)
+	paths    []string      // chemins dont les conditions sont traduites exactement
+	estimate float64
+}
+
+// describe décrit les bornes du parcours
+func (s *indexScan) describe() string {
+	switch {
+	case s.eq != nil:
+		parts := make([]string, len(s.eq))
+		for i, value := range s.eq {
+			parts[i] = fmt.Sprintf("%s == %v", s.index.fields[i].Path, value)
+		}
+		return strings.Join(parts, ", ")
+	case s.in != nil:
+		return fmt.Sprintf("%s in %v", s.index.fields[0].Path, s.in)
+	default:
+		lower, upper := "(-inf", "+inf)"
+		if s.r.Lower != nil {
+			lower = fmt.Sprintf("(%v", s.r.Lower.Value)
+			if s.r.Lower.Inclusive {
+				lower = fmt.Sprintf("[%v", s.r.Lower.Value)
+			}
+		}
+		if s.r.Upper != nil {
+			upper = fmt.Sprintf("%v)", s.r.Upper.Value)
+			if s.r.Upper.Inclusive {
+				upper = fmt.Sprintf("%v]", s.r.Upper.Value)
+			}
+		}
+		return fmt.Sprintf("%s in %s, %s", s.index.fields[0].Path, lower, upper)
+	}
+}
+
+// run retourne les IDs du parcours et le nombre de clés examinées
+func (s *indexScan) run() ([]string, int) {
+	var docIDs []string
+	collect := func(key interface{}, ids []string) bool {
+		docIDs = append(docIDs, ids...)
+		return true
+	}
+
+	examined := 0
+	switch {
+	case s.eq != nil:
+		examined = s.index.scanEqual(s.eq, collect)
+	case s.in != nil:
+		for _, value := range s.in {
+			examined += s.index.scanEqual([]interface{}{value}, collect)
+		}
+	default:
+		s.index.scanRange(*s.r, func(key interface{}, ids []string) bool {
+			examined++
+			return collect(key, ids)
+		})
+	}
+	return docIDs, examined
+}
+
+// candidateScan construit le meilleur parcours d'un index pour les
+// conditions du filtre, ou nil si l'index ne sert pas
+func candidateScan(index *Index, predicates queryPredicates) *indexScan {
+	stats := index.Stats()
+	perKey := 0.0
+	if stats.Keys > 0 {
+		perKey = float64(stats.Entries) / float64(stats.Keys)
+	}
+	scan := &indexScan{index: index}
+
+	// Égalités sur les premiers champs de l'index
+	for _, field := range index.fields {
+		predicate, exists := predicates.fields[field.Path]
+		if !exists || !predicate.hasEq {
+			break
+		}
+		scan.eq = append(scan.eq, predicate.eq)
+		if predicate.exact() {
+			scan.paths = append(scan.paths, field.Path)
+		}
+	}
+	if len(scan.eq) > 0 {
+		if len(scan.eq) == len(index.fields) || stats.Keys == 0 {
+			scan.estimate = perKey
+		} else {
+			// Sans statistique par préfixe, la sélectivité d'un préfixe de
+			// k champs sur n est interpolée : entries / keys^(k/n)
+			fraction := float64(len(scan.eq)) / float64(len(index.fields))
+			scan.estimate = float64(stats.Entries) / math.Pow(float64(stats.Keys), fraction)
+		}
+		return scan
+	}
+	if index.compound() {
+		return nil
+	}
+
+	predicate, exists := predicates.fields[index.fields[0].Path]
+	if !exists {
+		return nil
+	}
+	exact := predicate.exact()
+	switch {
+	case predicate.in != nil:
+		scan.in = predicate.in
+		scan.estimate = float64(len(predicate.in)) * perKey
+	case (predicate.lower != nil || predicate.upper != nil) && index.Ordered():
+		r := Range{Lower: predicate.lower, Upper: predicate.upper}
+		if stats.Multikey && r.Lower != nil && r.Upper != nil {
+			// Dans un tableau, chaque borne peut être vérifiée par un élément
+			// différent : une seule borne est appliquée, l'autre est filtrée
+			r.Upper = nil
+			exact = false
+		}
+		scan.r = &r
+		scan.estimate = index.rangeEstimate(r, stats)
+	default:
+		return nil
+	}
+	if exact {
+		scan.paths = []string{index.fields[0].Path}
+	}
+	return scan
+}
+
+// rangeEstimate estime le nombre d'entrées d'un intervalle : par
+// interpolation entre les valeurs extrêmes pour des bornes numériques,
+// un tiers des entrées sinon
+func (index *Index) rangeEstimate(r Range, stats IndexStats) float64 {
+	index.mu.RLock()
+	min, max, ok := index.store.(*skipList).numericBounds()
+	index.mu.RUnlock()
+
+	lower, upper := min, max
+	numeric := ok
+	if r.Lower != nil {
+		value, isNumber := normalizeKey(r.Lower.Value).(float64)
+		numeric = numeric && isNumber
+		lower = math.Max(lower, value)
+	}
+	if r.Upper != nil {
+		value, isNumber := normalizeKey(r.Upper.Value).(float64)
+		numeric = numeric && isNumber
+		upper = math.Min(upper, value)
+	}
+	if !numeric {
+		return float64(stats.Entries) / 3
+	}
+	if upper < lower {
+		return 0
+	}
+	if max == min {
+		return float64(stats.Entries)
+	}
+	return float64(stats.Entries) * (upper - lower) / (max - min)
+}
+
+// queryPlanner retient le plan choisi et ses parcours
+type queryPlanner struct {
+	plan     QueryPlan
+	scans    []*indexScan
+	rejected []QueryPlan
+	// sortIndex, s'il est choisi, est parcouru dans l'ordre du tri
+	sortIndex  *Index
+	descending bool
+}
+
+// planQuery choisit le plan le moins coûteux entre le parcours complet,
+// le meilleur parcours de chaque index et l'intersection des deux
+// parcours les plus sélectifs, puis la manière de trier ; l'appelant
+// détient c.mu
+func (c *Collection) planQuery(filter map[string]interface{}, opts FindOptions) (*queryPlanner, error) {
+	total, err := c.storage.Count()
+	if err != nil {
+		return nil, err
+	}
+	predicates := analyzeFilter(filter)
+
+	type option struct {
+		plan  QueryPlan
+		scans []*indexScan
+	}
+	options := []option{{plan: QueryPlan{
+		Stage:     StageCollScan,
+		Estimated: total,
+		Cost:      float64(total) * fetchCost,
+	}}}
+
+	var scans []*indexScan
+	names := make([]string, 0, len(c.indexes))
+	for name := range c.indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		scan := candidateScan(c.indexes[name], predicates)
+		if scan == nil {
+			continue
+		}
+		scan.estimate = math.Min(scan.estimate, float64(total))
+		scans = append(scans, scan)
+		options = append(options, option{
+			plan:  scanPlan(StageIndexScan, []*indexScan{scan}, scan.estimate, predicates),
+			scans: []*indexScan{scan},
+		})
+	}
+
+	// Intersection des deux parcours les plus sélectifs
+	if len(scans) >= 2 && total > 0 {
+		sorted := append([]*indexScan(nil), scans...)
+		sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].estimate < sorted[j].estimate })
+		pair := sorted[:2]
+		estimate := pair[0].estimate * pair[1].estimate / float64(total)
+		options = append(options, option{
+			plan:  scanPlan(StageIntersect, pair, estimate, predicates),
+			scans: pair,
+		})
+	}
+
+	best := 0
+	for i, candidate := range options {
+		if candidate.plan.Cost < options[best].plan.Cost {
+			best = i
+		}
+	}
+
+	planner := &queryPlanner{plan: options[best].plan, scans: options[best].scans}
+	for i, candidate := range options {
+		if i != best {
+			planner.rejected = append(planner.rejected, candidate.plan)
+		}
+	}
+	if opts.ordered() {
+		c.planSort(planner, predicates, opts, total)
+	}
+	return planner, nil
+}
+
+// planSort choisit entre trier les documents retenus par le plan et
+// parcourir un index ordonné dans l'ordre du tri, qui évite de lire plus
+// de documents que nécessaire lorsqu'une limite est donnée
+func (c *Collection) planSort(planner *queryPlanner, predicates queryPredicates, opts FindOptions, total int) {
+	estimate := float64(planner.plan.Estimated)
+	window := opts.window()
+	kept := estimate
+	planner.plan.Sort = SortInMemory
+	if window > 0 {
+		kept = math.Min(estimate, float64(window))
+		planner.plan.Sort = SortTopK
+	}
+	planner.plan.Cost += estimate * math.Log2(math.Max(kept, 2))
+
+	index, descending := c.sortIndex(opts.Sort, total)
+	if index == nil {
+		return
+	}
+
+	// Documents lus avant d'en trouver window vérifiant le filtre
+	fetched := float64(total)
+	if window > 0 && estimate > 0 {
+		fetched = math.Min(fetched, float64(window)*float64(total)/estimate)
+	}
+	direction := "croissant"
+	if descending {
+		direction = "décroissant"
+	}
+	plan := QueryPlan{
+		Stage:     StageIndexScan,
+		Indexes:   []string{index.name},
+		Bounds:    []string{"ordre " + direction + " de l'index"},
+		Covered:   predicates.covers(nil),
+		Sort:      SortIndex,
+		Estimated: planner.plan.Estimated,
+		Cost:      fetched * (1 + fetchCost),
+	}
+	if plan.Cost >= planner.plan.Cost {
+		planner.rejected = append(planner.rejected, plan)
+		return
+	}
+
+	planner.rejected = append(planner.rejected, planner.plan)
+	planner.plan = plan
+	planner.scans = nil
+	planner.sortIndex, planner.descending = index, descending
+}
+
+// sortIndex retourne un index ordonné dont l'ordre est celui du tri (ou
+// son inverse, descending) : mêmes champs, sens identiques ou tous
+// inversés. L'index doit contenir chaque document exactement une fois
+// (non multikey, aucun document sans les champs), faute de quoi son
+// ordre ne serait pas celui du tri en mémoire ; l'appelant détient c.mu
+func (c *Collection) sortIndex(fields []SortField, total int) (*Index, bool) {
+	names := make([]string, 0, len(c.indexes))
+	for name := range c.indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		index := c.indexes[name]
+		if !index.Ordered() || len(index.fields) != len(fields) {
+			continue
+		}
+		if stats := index.Stats(); stats.Multikey || stats.Entries != total {
+			continue
+		}
+
+		// Un index simple garde ses valeurs croissantes quel que soit son sens
+		descending := fields[0].Desc
+		if index.compound() {
+			descending = fields[0].Desc != index.fields[0].Desc
+		}
+		matches := true
+		for i, field := range fields {
+			flipped := field.Desc
+			if index.compound() {
+				flipped = field.Desc != index.fields[i].Desc
+			}
+			if field.Path != index.fields[i].Path || flipped != descending {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return index, descending
+		}
+	}
+	return nil, false
+}
+
+// scanPlan décrit un plan utilisant des parcours d'index ; son coût est
+// celui des clés examinées puis des documents lus
+func scanPlan(stage string, scans []*indexScan, estimate float64, predicates queryPredicates) QueryPlan {
+	plan := QueryPlan{Stage: stage, Estimated: int(math.Ceil(estimate))}
+	covered := make(map[string]bool)
+	for _, scan := range scans {
+		plan.Indexes = append(plan.Indexes, scan.index.name)
+		plan.Bounds = append(plan.Bounds, scan.describe())
+		plan.Cost += scan.estimate
+		for _, path := range scan.paths {
+			covered[path] = true
+		}
+	}
+	plan.Cost += estimate * fetchCost
+	plan.Covered = predicates.covers(covered)
+	return plan
+}
+
+// candidates retourne les IDs des documents à examiner pour un plan
+// d'index, dans l'ordre du premier parcours, et le nombre de clés examinées
+func (p *queryPlanner) candidates() ([]string, int) {
+	docIDs, examined := p.scans[0].run()
+	if len(p.scans) == 1 {
+		return docIDs, examined
+	}
+
+	others, keys := p.scans[1].run()
+	examined += keys
+	keep := make(map[string]bool, len(others))
+	for _, id := range others {
+		keep[id] = true
+	}
+	var intersection []string
+	for _, id := range docIDs {
+		if keep[id] {
+			intersection = append(intersection, id)
+		}
+	}
+	return intersection, examined
+}
+
+// execute exécute un plan et transmet à emit, jusqu'à ce qu'il retourne
+// false, les documents vérifiant match, triés et paginés selon opts mais
+// non projetés ; seuls les documents suivant la position after sont
+// retenus. L'appelant détient c.mu.
+func (c *Collection) execute(planner *queryPlanner, match matcher, opts FindOptions, after *sortedDocument, explanation *Explanation, emit func(entry *sortedDocument) bool) error {
+	var sorter *documentSorter
+	if opts.ordered() && planner.sortIndex == nil {
+		sorter = &documentSorter{fields: opts.Sort, k: opts.window()}
+	}
+
+	skipped := 0
+	accept := func(docID string, doc Document) bool {
+		explanation.DocsExamined++
+		if !match(doc) {
+			return true
+		}
+		entry := &sortedDocument{id: docID, doc: doc}
+		if after != nil {
+			entry.key = sortKey(doc, opts.Sort)
+			if compareSorted(entry, after, opts.Sort) <= 0 {
+				return true
+			}
+		}
+		if sorter != nil {
+			sorter.add(entry)
+			return true
+		}
+		if skipped < opts.Skip {
+			skipped++
+			return true
+		}
+		explanation.Returned++
+		return emit(entry) && (opts.Limit <= 0 || explanation.Returned < opts.Limit)
+	}
+	// Un document listé par un index mais illisible interrompt la requête
+	var readErr error
+	fetch := func(docID string) bool {
+		doc, err := c.readDocument(docID)
+		if os.IsNotExist(err) {
+			return true
+		}
+		if err != nil {
+			readErr = fmt.Errorf("document %s illisible: %w", docID, err)
+			return false
+		}
+		return accept(docID, doc)
+	}
+
+	switch {
+	case planner.sortIndex != nil:
+		var from []interface{}
+		if after != nil {
+			from = after.key
+		}
+		explanation.KeysExamined = planner.sortIndex.walk(planner.descending, from, fetch)
+	case planner.scans == nil:
+		err := c.scan(func(docID string, doc Document) error {
+			if !accept(docID, doc) {
+				return errStopScan
+			}
+			return nil
+		})
+		if err != nil && err != errStopScan {
+			return err
+		}
+	default:
+		docIDs, examined := planner.candidates()
+		explanation.KeysExamined = examined
+		seen := make(map[string]bool, len(docIDs))
+		for _, docID := range docIDs {
+			if seen[docID] {
+				continue
+			}
+			seen[docID] = true
+			if !fetch(docID) {
+				break
+			}
+		}
+	}
+	if readErr != nil {
+		return readErr
+	}
+
+	if sorter != nil {
+		for i, entry := range sorter.sorted() {
+			if i < opts.Skip {
+				continue
+			}
+			explanation.Returned++
+			if !emit(entry) {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// walk parcourt les documents d'un index ordonné dans l'ordre de l'index
+// (ou l'ordre inverse) à partir de la position from, valeurs des champs de
+// l'index (depuis le début si from est nil), par ID croissant à valeur
+// égale, jusqu'à ce que fn retourne false ; retourne le nombre de clés
+// examinées
+func (index *Index) walk(descending bool, from []interface{}, fn func(docID string) bool) int {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+	list := index.store.(*skipList)
+
+	var node *skipListNode
+	switch {
+	case from == nil && descending:
+		node = list.tail
+	case from == nil:
+		node = list.head.next[0]
+	case descending:
+		// Dernière clé <= from
+		if node = list.seek(index.positionKey(from), true); node == nil {
+			node = list.tail
+		} else {
+			node = node.prev
+		}
+	default:
+		node = list.seek(index.positionKey(from), false)
+	}
+
+	examined := 0
+	for node != nil {
+		examined++
+		sorted := append([]string(nil), node.ids...)
+		sort.Strings(sorted)
+		for _, docID := range sorted {
+			if !fn(docID) {
+				return examined
+			}
+		}
+		if descending {
+			node = node.prev
+		} else {
+			node = node.next[0]
+		}
+	}
+	return examined
+}
+
+// positionKey retourne la clé de l'index correspondant aux valeurs
+// normalisées de ses champs
+func (index *Index) positionKey(values []interface{}) interface{} {
+	if index.compound() {
+		return index.encodeTuple(values)
+	}
+	return values[0]
+}
+
+// Explain exécute une recherche et décrit le plan choisi, les plans
+// écartés, les clés et documents examinés et la durée d'exécution
+func (c *Collection) Explain(filter Filter, opts FindOptions) (*Explanation, error) {
+	_, explanation, err := c.query(filter, opts)
+	return explanation, err
+}
+
+// find planifie et exécute une recherche
+func (c *Collection) find(filter Filter, opts FindOptions) ([]Document, *Explanation, error) {
+	entries, explanation, err := c.query(filter, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	documents := make([]Document, len(entries))
+	for i, entry := range entries {
+		documents[i] = project(entry.doc, opts.Projection)
+	}
+	return documents, explanation, nil
+}
+
+// query planifie et exécute une recherche, sans projeter les documents
+func (c *Collection) query(filter Filter, opts FindOptions) ([]*sortedDocument, *Explanation, error) {
+	var entries []*sortedDocument
+	explanation, err := c.stream(filter, opts, func(entry *sortedDocument) bool {
+		entries = append(entries, entry)
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return entries, explanation, nil
+}
+
+// stream planifie et exécute une recherche en transmettant les documents
+// non projetés à emit au fil de leur lecture, tant qu'il retourne true ;
+// emit est appelé sous le verrou de la collection
+func (c *Collection) stream(filter Filter, opts FindOptions, emit func(entry *sortedDocument) bool) (*Explanation, error) {
+	match, err := compileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	after, err := decodeResumeToken(opts.After, opts.Sort)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	start := time.Now()
+	planner, err := c.planQuery(filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	explanation := &Explanation{Plan: planner.plan, RejectedPlans: planner.rejected}
+	if err := c.execute(planner, match, opts, after, explanation, emit); err != nil {
+		return nil, err
+	}
+	explanation.ExecutionTime = time.Since(start)
+	return explanation, nil
+}
+
+// Count compte les documents vérifiant filter. Avec un plan couvert, les
+// IDs fournis par les index suffisent et aucun document n'est lu.
+func (c *Collection) Count(filter Filter) (int, error) {
+	match, err := compileFilter(filter)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	planner, err := c.planQuery(filter, FindOptions{})
+	if err != nil {
+		return 0, err
+	}
+	if planner.plan.Covered && planner.scans != nil {
+		docIDs, _ := planner.candidates()
+		seen := make(map[string]bool, len(docIDs))
+		for _, id := range docIDs {
+			seen[id] = true
+		}
+		return len(seen), nil
+	}
+	if len(filter) == 0 {
+		return c.storage.Count()
+	}
+
+	count := 0
+	err = c.execute(planner, match, FindOptions{}, nil, &Explanation{}, func(*sortedDocument) bool {
+		count++
+		return true
+	})
+	return count, err
+}
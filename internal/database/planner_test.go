@@ -0,0 +1,96 @@
+package database
+
+import (
+	"fmt"
+	"testing"
+)
+
+// plannerTestCollection crée 100 produits : sku unique indexé, price
+// indexé en ordre, kind identique pour tous et indexé
+func plannerTestCollection(t *testing.T) *Collection {
+	t.Helper()
+	c := createTestCollection(t, openTestDatabase(t), "products")
+	if err := c.CreateIndex("sku", true); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	if err := c.CreateIndexWithOptions("price", IndexOptions{Type: IndexOrdered}); err != nil {
+		t.Fatalf("CreateIndexWithOptions: %v", err)
+	}
+	if err := c.CreateIndex("kind", false); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		mustInsert(t, c, Document{"sku": fmt.Sprintf("x%d", i), "price": i, "kind": "book", "rank": 100 - i})
+	}
+	return c
+}
+
+// explain retourne l'explication de la requête, exécutée
+func explain(t *testing.T, c *Collection, filter Filter, opts FindOptions) *Explanation {
+	t.Helper()
+	explanation, err := c.Explain(filter, opts)
+	if err != nil {
+		t.Fatalf("Explain(%v): %v", filter, err)
+	}
+	return explanation
+}
+
+// TestExplainChoosesIndex vérifie que le planificateur choisit l'index le
+// plus sélectif et garde le parcours complet parmi les plans rejetés
+func TestExplainChoosesIndex(t *testing.T) {
+	c := plannerTestCollection(t)
+
+	explanation := explain(t, c, Filter{"sku": "x5", "kind": "book"}, FindOptions{})
+	plan := explanation.Plan
+	if plan.Stage != StageIndexScan || len(plan.Indexes) != 1 || plan.Indexes[0] != "sku" {
+		t.Fatalf("plan = %+v, attendu un IXSCAN sur sku", plan)
+	}
+	if explanation.DocsExamined != 1 || explanation.Returned != 1 {
+		t.Fatalf("%d documents examinés, %d retournés, attendu 1 et 1", explanation.DocsExamined, explanation.Returned)
+	}
+	rejected := false
+	for _, other := range explanation.RejectedPlans {
+		rejected = rejected || other.Stage == StageCollScan
+	}
+	if !rejected {
+		t.Fatalf("plans rejetés = %+v, attendu le COLLSCAN", explanation.RejectedPlans)
+	}
+}
+
+// TestExplainRangeAndCollScan vérifie qu'un intervalle étroit passe par
+// l'index ordonné et qu'un filtre sans index parcourt la collection
+func TestExplainRangeAndCollScan(t *testing.T) {
+	c := plannerTestCollection(t)
+
+	explanation := explain(t, c, Filter{"price": map[string]interface{}{"$gte": 10, "$lt": 13}}, FindOptions{})
+	if plan := explanation.Plan; plan.Stage != StageIndexScan || plan.Indexes[0] != "price" {
+		t.Fatalf("plan = %+v, attendu un IXSCAN sur price", plan)
+	}
+	if explanation.Returned != 3 {
+		t.Fatalf("%d documents retournés, attendu 3", explanation.Returned)
+	}
+
+	explanation = explain(t, c, Filter{"rank": 7}, FindOptions{})
+	if explanation.Plan.Stage != StageCollScan || explanation.DocsExamined != 100 {
+		t.Fatalf("plan = %+v, %d documents examinés, attendu un COLLSCAN des 100", explanation.Plan, explanation.DocsExamined)
+	}
+}
+
+// TestExplainSortStrategy vérifie la stratégie de tri : ordre de l'index
+// ordonné, tas borné avec une limite, tri complet sinon
+func TestExplainSortStrategy(t *testing.T) {
+	c := plannerTestCollection(t)
+	tests := []struct {
+		opts FindOptions
+		want string
+	}{
+		{FindOptions{Sort: []SortField{{Path: "price"}}, Limit: 3}, SortIndex},
+		{FindOptions{Sort: []SortField{{Path: "rank"}}, Limit: 3}, SortTopK},
+		{FindOptions{Sort: []SortField{{Path: "rank"}}}, SortInMemory},
+	}
+	for _, test := range tests {
+		if got := explain(t, c, Filter{}, test.opts).Plan.Sort; got != test.want {
+			t.Errorf("tri %+v: stratégie %s, attendu %s", test.opts, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrRevisionMismatch signale une écriture dont la précondition sur la
+// révision du document n'est pas vérifiée
+var ErrRevisionMismatch = errors.New("révision du document différente")
+
+// Revision retourne la révision d'un document : une empreinte de son
+// contenu, qui change dès que le document est modifié. Elle est calculée à
+// la lecture, quel que soit le moteur de stockage.
+func Revision(doc Document) string {
+	// json.Marshal trie les clés : un même contenu donne une même révision
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Precondition conditionne une écriture à la révision courante du
+// document, comme les en-têtes HTTP If-Match et If-None-Match : IfMatch
+// exige l'une des révisions données, IfNoneMatch n'en accepte aucune. "*"
+// désigne n'importe quelle révision d'un document existant. Une
+// précondition vide est toujours vérifiée.
+type Precondition struct {
+	IfMatch     []string
+	IfNoneMatch []string
+}
+
+// check vérifie la précondition pour le document courant (nil s'il est absent)
+func (p Precondition) check(current Document) error {
+	if len(p.IfMatch) == 0 && len(p.IfNoneMatch) == 0 {
+		return nil
+	}
+
+	revision := ""
+	if current != nil {
+		revision = Revision(current)
+	}
+	if len(p.IfMatch) > 0 && (current == nil || !matchRevision(p.IfMatch, revision)) {
+		return fmt.Errorf("%w: attendue %v", ErrRevisionMismatch, p.IfMatch)
+	}
+	if current != nil && matchRevision(p.IfNoneMatch, revision) {
+		return fmt.Errorf("%w: le document existe en révision %s", ErrRevisionMismatch, revision)
+	}
+	return nil
+}
+
+// matchRevision indique si revision figure parmi revisions ou si "*" y figure
+func matchRevision(revisions []string, revision string) bool {
+	for _, candidate := range revisions {
+		if candidate == "*" || candidate == revision {
+			return true
+		}
+	}
+	return false
+}
+
+// readCurrent lit le document docID pour vérifier une précondition : nil
+// s'il est absent ; l'appelant détient c.mu
+func (c *Collection) readCurrent(docID string) Document {
+	doc, err := c.readDocument(docID)
+	if err != nil {
+		return nil
+	}
+	return doc
+}
+
+// UpdateIfRevision remplace le document docID seulement si sa révision est
+// toujours rev, et retourne la nouvelle révision ; sinon l'erreur vérifie
+// ErrRevisionMismatch et le document est inchangé
+func (c *Collection) UpdateIfRevision(docID, rev string, doc Document) (string, error) {
+	return c.UpdateWithPrecondition(docID, doc, Precondition{IfMatch: []string{rev}})
+}
+
+// UpdateWithPrecondition remplace (ou crée) le document docID si la
+// précondition est vérifiée, et retourne la nouvelle révision
+func (c *Collection) UpdateWithPrecondition(docID string, doc Document, pre Precondition) (string, error) {
+	stored, err := c.ReplaceWithPrecondition(docID, doc, pre)
+	if err != nil {
+		return "", err
+	}
+	return Revision(stored), nil
+}
+
+// ReplaceWithPrecondition est UpdateWithPrecondition, mais retourne le
+// document écrit, avec son _id : une écriture concurrente a pu le modifier
+// depuis, une relecture ne le donnerait pas
+func (c *Collection) ReplaceWithPrecondition(docID string, doc Document, pre Precondition) (Document, error) {
+	owner, err := c.lockForWrite(docID)
+	if err != nil {
+		return nil, err
+	}
+	defer c.db.locks().release(owner)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	oldDoc := c.readCurrent(docID)
+	if err := pre.check(oldDoc); err != nil {
+		return nil, err
+	}
+	return c.putDocument(docID, oldDoc, doc)
+}
+
+// putDocument remplace oldDoc (nil s'il est absent) par doc, en vérifiant
+// et maintenant tous les index ; l'appelant détient c.mu en écriture, ou en
+// lecture avec le verrou exclusif du document
+func (c *Collection) putDocument(docID string, oldDoc, doc Document) (Document, error) {
+	if err := checkDocumentID(docID, doc); err != nil {
+		return nil, err
+	}
+	doc = withDocumentID(docID, doc)
+	if err := c.storeDocument(docID, oldDoc, doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// DeleteIfRevision supprime le document docID seulement si sa révision est
+// toujours rev
+func (c *Collection) DeleteIfRevision(docID, rev string) error {
+	return c.DeleteWithPrecondition(docID, Precondition{IfMatch: []string{rev}})
+}
+
+// DeleteWithPrecondition supprime le document docID si la précondition est
+// vérifiée
+func (c *Collection) DeleteWithPrecondition(docID string, pre Precondition) error {
+	owner, err := c.lockForWrite(docID)
+	if err != nil {
+		return err
+	}
+	defer c.db.locks().release(owner)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	oldDoc := c.readCurrent(docID)
+	if err := pre.check(oldDoc); err != nil {
+		return err
+	}
+	return c.removeDocument(docID, oldDoc)
+}
+
+// removeDocument supprime le document docID et ses entrées d'index ;
+// l'appelant détient c.mu comme pour putDocument
+func (c *Collection) removeDocument(docID string, oldDoc Document) error {
+	return c.storeDocument(docID, oldDoc, nil)
+}
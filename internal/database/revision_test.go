@@ -0,0 +1,134 @@
+package database
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+// TestRevisionPreconditions vérifie que chaque écriture conditionnelle
+// refuse une révision périmée et laisse le document inchangé
+func TestRevisionPreconditions(t *testing.T) {
+	c := createTestCollection(t, openTestDatabase(t), "users")
+	docID := mustInsert(t, c, Document{"n": 1})
+	stale := Revision(mustGet(t, c, docID))
+
+	current, err := c.UpdateIfRevision(docID, stale, Document{"n": 2})
+	if err != nil {
+		t.Fatalf("UpdateIfRevision: %v", err)
+	}
+	if current != Revision(mustGet(t, c, docID)) || current == stale {
+		t.Fatalf("révision retournée %s, attendu celle du document écrit", current)
+	}
+
+	pre := Precondition{IfMatch: []string{stale}}
+	writes := map[string]func() error{
+		"UpdateIfRevision": func() error {
+			_, err := c.UpdateIfRevision(docID, stale, Document{"n": 3})
+			return err
+		},
+		"UpdateByIDWithPrecondition": func() error {
+			_, err := c.UpdateByIDWithPrecondition(docID, Update{"$set": map[string]interface{}{"n": 3}}, pre)
+			return err
+		},
+		"MergePatchWithPrecondition": func() error {
+			_, err := c.MergePatchWithPrecondition(docID, map[string]interface{}{"n": 3}, pre)
+			return err
+		},
+		"DeleteIfRevision": func() error {
+			return c.DeleteIfRevision(docID, stale)
+		},
+		"IfNoneMatch": func() error {
+			_, err := c.UpdateWithPrecondition(docID, Document{"n": 3}, Precondition{IfNoneMatch: []string{"*"}})
+			return err
+		},
+	}
+	for name, write := range writes {
+		if err := write(); !errors.Is(err, ErrRevisionMismatch) {
+			t.Errorf("%s = %v, attendu ErrRevisionMismatch", name, err)
+		}
+	}
+	if doc := mustGet(t, c, docID); doc["n"] != float64(2) {
+		t.Fatalf("document = %v après des écritures refusées", doc)
+	}
+
+	if err := c.DeleteWithPrecondition(docID, Precondition{IfMatch: []string{"*"}}); err != nil {
+		t.Fatalf("DeleteWithPrecondition(*): %v", err)
+	}
+}
+
+// TestRevisionCompareAndSwap vérifie qu'avec des écritures conditionnelles
+// concurrentes, aucune incrémentation n'est perdue
+func TestRevisionCompareAndSwap(t *testing.T) {
+	c := createTestCollection(t, openTestDatabase(t), "counters")
+	docID := mustInsert(t, c, Document{"n": 0})
+
+	const writers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				doc, err := c.FindByID(docID)
+				if err != nil {
+					errs <- err
+					return
+				}
+				n := doc["n"].(float64)
+				_, err = c.UpdateIfRevision(docID, Revision(doc), Document{"n": n + 1})
+				if !errors.Is(err, ErrRevisionMismatch) {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("écriture: %v", err)
+		}
+	}
+	if doc := mustGet(t, c, docID); doc["n"] != float64(writers) {
+		t.Fatalf("n = %v, attendu %d", doc["n"], writers)
+	}
+}
+
+// TestWritesReturnStoredDocument vérifie que ReplaceWithPrecondition et
+// ModifyWithPrecondition retournent le document écrit, dont la révision
+// est celle retournée par UpdateWithPrecondition
+func TestWritesReturnStoredDocument(t *testing.T) {
+	c := createTestCollection(t, openTestDatabase(t), "users")
+	docID := mustInsert(t, c, Document{"n": 1})
+	rev := Revision(mustGet(t, c, docID))
+
+	stored, err := c.ReplaceWithPrecondition(docID, Document{"n": 2}, Precondition{IfMatch: []string{rev}})
+	if err != nil {
+		t.Fatalf("ReplaceWithPrecondition: %v", err)
+	}
+	if stored["n"] != 2 {
+		t.Fatalf("retourné %v, attendu n = 2", stored)
+	}
+	rev = Revision(stored)
+	if rev != Revision(mustGet(t, c, docID)) {
+		t.Fatalf("révision du document retourné %s, différente de celle écrite", rev)
+	}
+
+	stored, err = c.ModifyWithPrecondition(docID, Update{"$inc": map[string]interface{}{"n": 1}}, Precondition{IfMatch: []string{rev}})
+	if err != nil {
+		t.Fatalf("ModifyWithPrecondition: %v", err)
+	}
+	if stored["n"] != float64(3) || Revision(stored) != Revision(mustGet(t, c, docID)) {
+		t.Fatalf("retourné %v, attendu le document écrit avec n = 3", stored)
+	}
+
+	if stored, err := c.ModifyWithPrecondition(docID, Update{"$inc": map[string]interface{}{"n": 1}}, Precondition{IfMatch: []string{rev}}); stored != nil || !errors.Is(err, ErrRevisionMismatch) {
+		t.Fatalf("révision périmée: %v (%v), attendu ErrRevisionMismatch", stored, err)
+	}
+	if stored, err := c.ModifyWithPrecondition("missing", Update{"$inc": map[string]interface{}{"n": 1}}, Precondition{}); stored != nil || err != nil {
+		t.Fatalf("document absent: %v (%v), attendu nil", stored, err)
+	}
+}
@@ -1,11 +1,13 @@
 package database
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,20 +16,23 @@ type Document map[string]interface{}
 
 // Use existing types from transaction.go
 
-// Index représente un index sur un champ
-type Index struct {
-	field  string
-	values map[interface{}][]string // valeur -> liste d'IDs
-	unique bool                     // indique si l'index est unique
-	mu     sync.RWMutex
-}
-
 // Collection représente une collection de documents
 type Collection struct {
 	name    string
 	path    string
 	indexes map[string]*Index
-	mu      sync.RWMutex
+	storage Storage
+	options CollectionOptions
+	ids     *idGenerator
+	db      *Database
+	// versions garde les images remplacées encore lisibles par un
+	// instantané (voir mvcc.go), sous versionsMu
+	versions   map[string][]docVersion
+	versionsMu sync.Mutex
+	// commitTS est l'horodatage de la validation en cours, qui détient c.mu
+	commitTS     uint64
+	commitRecord bool
+	mu           sync.RWMutex
 }
 
 // Database représente la base de données
@@ -36,7 +41,14 @@ type Database struct {
 	collections  map[string]*Collection
 	transactions map[string]*Transaction
 	txManager    *TransactionManager
+	catalog      map[string]*CollectionInfo
+	catalogMu    sync.Mutex
 	mu           sync.RWMutex
+
+	// durability (une Durability) est lue par les écritures qui détiennent
+	// le verrou d'une collection : hors de db.mu, que DropCollection et
+	// RenameCollection prennent avant celui de la collection
+	durability atomic.Int32
 }
 
 // NewDatabase crée une nouvelle instance de base de données
@@ -57,38 +69,191 @@ func NewDatabase(path string) (*Database, error) {
 		return nil, fmt.Errorf("erreur initialisation gestionnaire transactions: %v", err)
 	}
 
-	return &Database{
+	db := &Database{
 		path:         path,
 		collections:  make(map[string]*Collection),
 		transactions: make(map[string]*Transaction),
 		txManager:    txManager,
-	}, nil
+		catalog:      make(map[string]*CollectionInfo),
+	}
+	db.durability.Store(int32(DurabilityWrite))
+
+	// Rouvrir les collections enregistrées dans le catalogue
+	if err := db.loadCatalog(); err != nil {
+		return nil, fmt.Errorf("erreur chargement catalogue: %v", err)
+	}
+	if err := db.openCatalogCollections(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Récupérer les transactions interrompues au démarrage
+	if err := txManager.recoverTransactions(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("erreur récupération transactions: %v", err)
+	}
+
+	return db, nil
 }
 
-// CreateCollection crée une nouvelle collection
-func (db *Database) CreateCollection(name string) (*Collection, error) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+// recoveryCollection retourne la collection visée par une entrée du WAL.
+// Une collection absente du catalogue (répertoire antérieur au catalogue)
+// est ouverte directement, une seule fois par collection (opened).
+func (db *Database) recoveryCollection(name string, opened map[string]*Collection) (*Collection, error) {
+	if collection, err := db.GetCollection(name); err == nil {
+		return collection, nil
+	}
+	if collection, exists := opened[name]; exists {
+		return collection, nil
+	}
 
-	if _, exists := db.collections[name]; exists {
-		return nil, fmt.Errorf("collection %s existe déjà", name)
+	collection, err := db.openCollection(name, CollectionOptions{})
+	if err != nil {
+		return nil, err
 	}
+	opened[name] = collection
+	return collection, nil
+}
 
+// openCollection ouvre le répertoire et le moteur de stockage d'une collection
+func (db *Database) openCollection(name string, options CollectionOptions) (*Collection, error) {
 	path := filepath.Join(db.path, name)
 	if err := os.MkdirAll(path, 0755); err != nil {
 		return nil, fmt.Errorf("erreur création répertoire collection: %v", err)
 	}
 
+	storage, err := openStorage(path, options.Storage)
+	if err != nil {
+		return nil, fmt.Errorf("erreur ouverture stockage collection: %v", err)
+	}
+	if options.Storage == "" {
+		options.Storage, _, _ = detectStorageKind(path)
+	}
+	ids, err := newIDGenerator(options.IDGenerator)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+	options.IDGenerator = ids.kind
+
 	collection := &Collection{
 		name:    name,
 		path:    path,
 		indexes: make(map[string]*Index),
+		storage: storage,
+		options: options,
+		ids:     ids,
+		db:      db,
+	}
+
+	// Recharger les index persistés, reconstruits s'ils sont obsolètes
+	if err := collection.loadIndexes(); err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("erreur chargement index collection: %v", err)
+	}
+
+	return collection, nil
+}
+
+// Close persiste les index puis ferme les moteurs de stockage de toutes les collections
+func (db *Database) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var firstErr error
+	for _, collection := range db.collections {
+		if err := collection.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// close persiste les index de la collection et ferme son moteur de stockage
+func (c *Collection) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.saveIndexes(); err != nil {
+		c.storage.Close()
+		return fmt.Errorf("erreur sauvegarde index collection %s: %v", c.name, err)
+	}
+	return c.storage.Close()
+}
+
+// SetDurability choisit quand les écritures de documents sont forcées sur disque
+func (db *Database) SetDurability(level Durability) {
+	db.durability.Store(int32(level))
+}
+
+// Durability retourne le niveau de durabilité courant
+func (db *Database) Durability() Durability {
+	return Durability(db.durability.Load())
+}
+
+// CreateCollection crée une nouvelle collection avec le stockage par défaut
+func (db *Database) CreateCollection(name string) (*Collection, error) {
+	return db.CreateCollectionWithOptions(name, CollectionOptions{})
+}
+
+// CreateCollectionWithOptions crée une nouvelle collection et l'enregistre
+// dans le catalogue. Une collection déjà au catalogue est une erreur ; un
+// répertoire existant hors catalogue est repris avec ses données. Sans
+// moteur de stockage précisé, celui des données existantes est repris,
+// sinon StorageFiles.
+func (db *Database) CreateCollectionWithOptions(name string, options CollectionOptions) (*Collection, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, exists := db.collections[name]; exists {
+		return nil, fmt.Errorf("collection %s existe déjà", name)
+	}
+	if !validCollectionName(name) {
+		return nil, fmt.Errorf("nom de collection invalide: %q", name)
+	}
+
+	collection, err := db.openCollection(name, options)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.registerCollection(collection); err != nil {
+		collection.storage.Close()
+		return nil, fmt.Errorf("erreur mise à jour catalogue: %v", err)
 	}
 
 	db.collections[name] = collection
 	return collection, nil
 }
 
+// GetOrCreateCollection retourne la collection si elle existe déjà (par
+// exemple rechargée depuis le catalogue), sinon la crée
+func (db *Database) GetOrCreateCollection(name string, options CollectionOptions) (*Collection, error) {
+	if collection, err := db.GetCollection(name); err == nil {
+		if options.Storage != "" && options.Storage != collection.options.Storage {
+			return nil, fmt.Errorf("la collection %s utilise déjà le stockage %s", name, collection.options.Storage)
+		}
+		if options.IDGenerator != "" && options.IDGenerator != collection.options.IDGenerator {
+			return nil, fmt.Errorf("la collection %s utilise déjà le générateur d'ID %s", name, collection.options.IDGenerator)
+		}
+		return collection, nil
+	}
+
+	collection, err := db.CreateCollectionWithOptions(name, options)
+	if err != nil {
+		// Créée entre-temps par un autre appelant
+		if existing, getErr := db.GetCollection(name); getErr == nil {
+			return existing, nil
+		}
+		return nil, err
+	}
+	return collection, nil
+}
+
+// Options retourne les options de la collection
+func (c *Collection) Options() CollectionOptions {
+	return c.options
+}
+
 // GetCollection returns a collection by name
 func (db *Database) GetCollection(name string) (*Collection, error) {
 	db.mu.RLock()
@@ -111,97 +276,121 @@ func (db *Database) GetCollections() map[string]*Collection {
 	return collections
 }
 
-// CreateIndex crée un index sur un champ
+// CreateIndex crée un index hash sur un champ et le persiste. Redéclarer un
+// index identique, par exemple rechargé depuis le disque, est sans effet.
 func (c *Collection) CreateIndex(field string, unique bool) error {
+	return c.CreateIndexWithOptions(field, IndexOptions{Unique: unique})
+}
+
+// CreateIndexWithOptions crée un index en choisissant sa structure
+// (IndexHash par défaut, ou IndexOrdered pour les recherches par intervalle)
+func (c *Collection) CreateIndexWithOptions(field string, options IndexOptions) error {
+	return c.CreateCompoundIndex([]IndexField{{Path: field}}, options)
+}
+
+// createIndex construit et persiste un index puis l'enregistre au catalogue
+func (c *Collection) createIndex(index *Index) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if _, exists := c.indexes[field]; exists {
-		return fmt.Errorf("index %s existe déjà", field)
-	}
-
-	index := &Index{
-		field:  field,
-		values: make(map[interface{}][]string),
-		unique: unique,
+	name := index.name
+	if existing, exists := c.indexes[name]; exists {
+		if existing.Definition().equal(index.Definition()) {
+			return nil
+		}
+		return fmt.Errorf("index %s existe déjà", name)
 	}
 
-	// Construire l'index à partir des documents existants
-	files, err := os.ReadDir(c.path)
+	// Construire l'index à partir des documents existants, qui doivent
+	// respecter son unicité
+	err := c.scan(func(docID string, doc Document) error {
+		if err := index.checkUnique(docID, doc); err != nil {
+			return fmt.Errorf("index %s impossible: %v", name, err)
+		}
+		index.addDocument(docID, doc)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	for _, file := range files {
-		if filepath.Ext(file.Name()) == ".json" {
-			docID := file.Name()[:len(file.Name())-5] // Remove .json extension
-			path := filepath.Join(c.path, file.Name())
-			data, err := os.ReadFile(path)
-			if err != nil {
-				continue
-			}
-
-			var doc Document
-			if err := json.Unmarshal(data, &doc); err != nil {
-				continue
-			}
+	c.indexes[name] = index
 
-			if value, exists := doc[field]; exists {
-				index.values[value] = append(index.values[value], docID)
-			}
-		}
+	fingerprint, err := c.storage.Fingerprint()
+	if err != nil {
+		return err
+	}
+	if err := c.saveIndex(index, fingerprint); err != nil {
+		return fmt.Errorf("erreur sauvegarde index %s: %v", name, err)
+	}
+	if err := c.db.setCatalogIndexes(c.name, c.indexDefinitions()); err != nil {
+		return fmt.Errorf("erreur mise à jour catalogue: %v", err)
 	}
-
-	c.indexes[field] = index
 	return nil
 }
 
-// Insert inserts a document into a collection
+// Insert inserts a document into a collection. The document keeps its _id
+// when it has one (ErrDuplicateID if taken), otherwise the collection's ID
+// generator picks one; doc itself is left unchanged. The document is locked
+// exclusively, so inserts and updates of other documents proceed
+// concurrently.
 func (c *Collection) Insert(doc Document) (string, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	docID := generateID()
-
-	// Unique index check
-	for _, index := range c.indexes {
-		if index.unique {
-			if value, exists := doc[index.field]; exists {
-				if ids, ok := index.values[value]; ok && len(ids) > 0 {
-					return "", fmt.Errorf("violation de contrainte unique sur %s: %v", index.field, value)
-				}
-			}
-		}
-	}
+	owner := c.db.locks().newOwner("insertion dans " + c.currentName())
+	defer c.db.locks().release(owner)
 
-	path := filepath.Join(c.path, docID+".json")
-	data, err := json.Marshal(doc)
+	docID, err := c.reserveDocumentID(doc, func(docID string) error {
+		return c.lockDocument(owner, docID, LockExclusive)
+	})
 	if err != nil {
 		return "", err
 	}
 
-	if err := os.WriteFile(path, data, 0644); err != nil {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.documentExists(docID) {
+		return "", fmt.Errorf("%w: %s", ErrDuplicateID, docID)
+	}
+	if err := c.storeDocument(docID, nil, withDocumentID(docID, doc)); err != nil {
 		return "", err
 	}
+	return docID, nil
+}
 
-	// Update indexes
-	for _, index := range c.indexes {
-		if value, exists := doc[index.field]; exists {
-			index.values[value] = append(index.values[value], docID)
-		}
+// insertDocument inserts doc as docID, chosen by insertID.choose and
+// locked by the caller, which holds c.mu for writing. It returns the stored
+// document, a copy of doc carrying its _id.
+func (c *Collection) insertDocument(docID string, doc Document) (Document, error) {
+	if c.documentExists(docID) {
+		return nil, fmt.Errorf("%w: %s", ErrDuplicateID, docID)
 	}
-
-	return docID, nil
+	doc = withDocumentID(docID, doc)
+	if err := c.storeDocument(docID, nil, doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
 }
 
 // InsertWithTransaction logs an insert operation during a transaction (deferred writing)
 func (db *Database) InsertWithTransaction(tx *Transaction, collectionName string, doc Document) (string, error) {
-	_, err := db.GetCollection(collectionName)
+	collection, err := db.GetCollection(collectionName)
 	if err != nil {
 		return "", fmt.Errorf("collection %s not found", collectionName)
 	}
 
-	docID := generateID()
+	// The document stays locked until the transaction ends; its ID is
+	// checked again at commit, when the document is written
+	docID, err := collection.reserveDocumentID(doc, func(docID string) error {
+		return db.lockForTransaction(tx, collection, docID, LockExclusive)
+	})
+	if err != nil {
+		return "", err
+	}
+	collection.mu.RLock()
+	exists := collection.documentExists(docID)
+	collection.mu.RUnlock()
+	if exists {
+		return "", fmt.Errorf("%w: %s", ErrDuplicateID, docID)
+	}
 
 	entry := LogEntry{
 		TransactionID: tx.ID,
@@ -209,29 +398,27 @@ func (db *Database) InsertWithTransaction(tx *Transaction, collectionName string
 		Operation:     OpInsert,
 		Collection:    collectionName,
 		DocumentID:    docID,
-		Data:          doc,
+		Data:          withDocumentID(docID, doc),
 	}
 
-	tx.AddLogEntry(entry)
+	if err := tx.AddLogEntry(entry); err != nil {
+		return "", err
+	}
 	return docID, nil
 }
 
 // UpdateWithTransaction logs an update operation during a transaction (deferred writing)
 func (db *Database) UpdateWithTransaction(tx *Transaction, collectionName string, docID string, doc Document) error {
-	collection, err := db.GetCollection(collectionName)
-	if err != nil {
-		return fmt.Errorf("collection %s not found", collectionName)
+	if err := db.lockDocumentForWrite(tx, collectionName, docID); err != nil {
+		return err
 	}
-
-	// Read existing document to get old data
-	path := filepath.Join(collection.path, docID+".json")
-	data, err := os.ReadFile(path)
+	// Read the document as tx sees it to get old data: undoing this entry
+	// restores the transaction's own earlier write, if any
+	oldDoc, err := db.GetDocumentWithTransaction(tx, collectionName, docID)
 	if err != nil {
 		return err
 	}
-
-	var oldDoc Document
-	if err := json.Unmarshal(data, &oldDoc); err != nil {
+	if err := checkDocumentID(docID, doc); err != nil {
 		return err
 	}
 
@@ -241,30 +428,47 @@ func (db *Database) UpdateWithTransaction(tx *Transaction, collectionName string
 		Operation:     OpUpdate,
 		Collection:    collectionName,
 		DocumentID:    docID,
-		Data:          doc,
+		Data:          withDocumentID(docID, doc),
 		OldData:       oldDoc,
 	}
 
-	tx.AddLogEntry(entry)
-	return nil
+	return tx.AddLogEntry(entry)
 }
 
-// DeleteWithTransaction logs a delete operation during a transaction (deferred writing)
-func (db *Database) DeleteWithTransaction(tx *Transaction, collectionName string, docID string) error {
-	collection, err := db.GetCollection(collectionName)
-	if err != nil {
-		return fmt.Errorf("collection %s not found", collectionName)
+// ModifyWithTransaction logs update operators for docID during a
+// transaction (deferred writing). Unlike UpdateWithTransaction, the
+// operators are resolved into a full image at commit time.
+func (db *Database) ModifyWithTransaction(tx *Transaction, collectionName string, docID string, update Update) error {
+	if _, err := compileUpdate(update); err != nil {
+		return err
 	}
-
-	// Read existing document to get old data
-	path := filepath.Join(collection.path, docID+".json")
-	data, err := os.ReadFile(path)
-	if err != nil {
+	if err := db.lockDocumentForWrite(tx, collectionName, docID); err != nil {
 		return err
 	}
+	if _, err := db.GetDocumentWithTransaction(tx, collectionName, docID); err != nil {
+		return err
+	}
+
+	entry := LogEntry{
+		TransactionID: tx.ID,
+		Timestamp:     time.Now().UnixNano(),
+		Operation:     OpModify,
+		Collection:    collectionName,
+		DocumentID:    docID,
+		Update:        update,
+	}
 
-	var oldDoc Document
-	if err := json.Unmarshal(data, &oldDoc); err != nil {
+	return tx.AddLogEntry(entry)
+}
+
+// DeleteWithTransaction logs a delete operation during a transaction (deferred writing)
+func (db *Database) DeleteWithTransaction(tx *Transaction, collectionName string, docID string) error {
+	if err := db.lockDocumentForWrite(tx, collectionName, docID); err != nil {
+		return err
+	}
+	// Read the document as tx sees it to get old data
+	oldDoc, err := db.GetDocumentWithTransaction(tx, collectionName, docID)
+	if err != nil {
 		return err
 	}
 
@@ -277,15 +481,33 @@ func (db *Database) DeleteWithTransaction(tx *Transaction, collectionName string
 		OldData:       oldDoc,
 	}
 
-	tx.AddLogEntry(entry)
-	return nil
+	return tx.AddLogEntry(entry)
 }
 
-// StartTransaction starts a new transaction
+// lockDocumentForWrite checks docID and locks it exclusively until tx
+// ends, before tx logs a write to it
+func (db *Database) lockDocumentForWrite(tx *Transaction, collectionName string, docID string) error {
+	if err := validateDocumentID(docID); err != nil {
+		return err
+	}
+	collection, err := db.GetCollection(collectionName)
+	if err != nil {
+		return fmt.Errorf("collection %s not found", collectionName)
+	}
+	return db.lockForTransaction(tx, collection, docID, LockExclusive)
+}
+
+// StartTransaction starts a new transaction with snapshot isolation
 func (db *Database) StartTransaction() *Transaction {
 	return db.txManager.BeginTransaction()
 }
 
+// BeginTransactionWithOptions starts a new transaction with the given
+// isolation level
+func (db *Database) BeginTransactionWithOptions(opts TransactionOptions) (*Transaction, error) {
+	return db.txManager.BeginTransactionWithOptions(opts)
+}
+
 // BeginTransaction is an alias for StartTransaction
 func (db *Database) BeginTransaction() *Transaction {
 	return db.StartTransaction()
@@ -296,323 +518,542 @@ func (db *Database) GetTransaction(id string) (*Transaction, bool) {
 	return db.txManager.GetTransaction(id)
 }
 
-// Commit commits a transaction by applying all WAL entries
+// Commit commits a transaction by applying all WAL entries. An error
+// wrapping ErrNotDurable means the transaction did commit, but its
+// documents could not be synced to disk.
 func (db *Database) Commit(tx *Transaction) error {
-	if err := db.ApplyTransactionLog(tx); err != nil {
-		return err
-	}
-
+	defer db.collectVersions()
 	return db.txManager.Commit(db, tx)
 }
 
 // Rollback rolls back a transaction by removing WAL files (no data files to delete since we use deferred writing)
 func (db *Database) Rollback(tx *Transaction) error {
+	defer db.collectVersions()
 	return db.txManager.Rollback(tx)
 }
 
 // ApplyLogEntry applies a single WAL log entry to the database
 func (db *Database) ApplyLogEntry(entry LogEntry) error {
+	if err := validateDocumentID(entry.DocumentID); err != nil {
+		return err
+	}
 	collection, err := db.GetCollection(entry.Collection)
 	if err != nil {
 		return fmt.Errorf("collection %s not found", entry.Collection)
 	}
 
-	switch entry.Operation {
-	case OpInsert:
-		// Unique index check
-		for _, index := range collection.indexes {
-			if index.unique {
-				if value, exists := entry.Data[index.field]; exists {
-					index.mu.RLock()
-					if ids, ok := index.values[value]; ok && len(ids) > 0 {
-						index.mu.RUnlock()
-						return fmt.Errorf("valeur '%v' du champ '%s' déjà utilisée (index unique)", value, index.field)
-					}
-					index.mu.RUnlock()
-				}
-			}
+	return collection.applyLogEntry(entry)
+}
+
+// ApplyTransactionLog applies all WAL log entries for a transaction (in
+// order) and commits it, exactly like Commit: the COMMIT marker is written
+// and the WAL removed, otherwise recovery would undo the applied entries
+func (db *Database) ApplyTransactionLog(tx *Transaction) error {
+	return db.Commit(tx)
+}
+
+// applyLogEntriesLocked validates every WAL entry, then applies them in
+// order; the caller holds the lock of every collection they touch. MODIFY
+// entries are resolved into full-image UPDATE entries, rewritten in the WAL
+// before their document is written so recovery can redo or undo them like
+// any other update. The APPLY marker written before the first write tells
+// recovery the entries may have been applied. If an entry fails to apply,
+// the ones already applied are reverted using OldData.
+func (db *Database) applyLogEntriesLocked(entries []LogEntry, collections map[string]*Collection) error {
+	if err := validateLogEntries(entries, collections); err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		if err := db.txManager.writeMarker(entries[0].TransactionID, OpApply); err != nil {
+			return fmt.Errorf("erreur écriture marqueur d'application: %v", err)
+		}
+	}
+
+	sync := db.Durability() == DurabilityWrite
+	for i, entry := range entries {
+		collection := collections[entry.Collection]
+
+		var err error
+		switch entry.Operation {
+		case OpModify:
+			entries[i], err = collection.applyModifyLocked(entry, func(resolved LogEntry) error {
+				return rewriteWALEntry(db.txManager.walPath, resolved)
+			}, sync)
+		default:
+			err = collection.applyLogEntryLocked(entry)
 		}
-		// Write the document to disk
-		path := filepath.Join(collection.path, entry.DocumentID+".json")
-		data, err := json.Marshal(entry.Data)
 		if err != nil {
+			// The failed entry may have been partly applied: undo it too
+			undoLogEntriesLocked(entries[:i+1], collections)
 			return err
 		}
-		if err := os.WriteFile(path, data, 0644); err != nil {
+	}
+	return nil
+}
+
+// validateLogEntries checks, before anything is written, that every entry
+// applies: document IDs are valid, inserted documents do not exist yet, updated, modified and
+// deleted ones do, update operators apply, and no unique index is violated
+// once the earlier entries are applied
+func validateLogEntries(entries []LogEntry, collections map[string]*Collection) error {
+	batches := make(map[string]*indexBatch)
+	pending := make(map[string]map[string]Document)
+	for _, entry := range entries {
+		if err := validateDocumentID(entry.DocumentID); err != nil {
 			return err
 		}
-		// Update indexes
-		for _, index := range collection.indexes {
-			if value, exists := entry.Data[index.field]; exists {
-				index.mu.Lock()
-				index.values[value] = append(index.values[value], entry.DocumentID)
-				index.mu.Unlock()
+		c := collections[entry.Collection]
+		if batches[c.name] == nil {
+			batches[c.name] = newIndexBatch()
+			pending[c.name] = make(map[string]Document)
+		}
+		batch, written := batches[c.name], pending[c.name]
+
+		current, seen := written[entry.DocumentID]
+		if !seen {
+			current = c.readCurrent(entry.DocumentID)
+		}
+		if entry.Operation == OpInsert {
+			if current != nil {
+				return fmt.Errorf("%w: %s", ErrDuplicateID, entry.DocumentID)
 			}
+		} else if current == nil {
+			return &os.PathError{Op: strings.ToLower(string(entry.Operation)), Path: entry.DocumentID, Err: os.ErrNotExist}
 		}
-	case OpUpdate:
-		// Unique index check
-		for field, index := range collection.indexes {
-			if index.unique {
-				if value, exists := entry.Data[field]; exists {
-					index.mu.RLock()
-					if ids, ok := index.values[value]; ok {
-						for _, id := range ids {
-							if id != entry.DocumentID {
-								index.mu.RUnlock()
-								return fmt.Errorf("valeur '%v' du champ '%s' déjà utilisée (index unique)", value, field)
-							}
-						}
-					}
-					index.mu.RUnlock()
-				}
+
+		var doc Document
+		switch entry.Operation {
+		case OpInsert, OpUpdate:
+			doc = withDocumentID(entry.DocumentID, entry.Data)
+		case OpModify:
+			update, err := compileUpdate(entry.Update)
+			if err != nil {
+				return err
+			}
+			if doc, err = update.apply(current); err != nil {
+				return err
 			}
 		}
-		// Update the document on disk
-		path := filepath.Join(collection.path, entry.DocumentID+".json")
-		data, err := json.Marshal(entry.Data)
-		if err != nil {
+		if err := batch.checkUnique(c.indexes, entry.DocumentID, doc); err != nil {
 			return err
 		}
-		if err := os.WriteFile(path, data, 0644); err != nil {
-			return err
+		batch.record(c.indexes, entry.DocumentID, current, doc)
+		written[entry.DocumentID] = doc
+	}
+	return nil
+}
+
+// undoLogEntriesLocked reverts applied WAL entries in reverse order, after
+// a failed commit; the caller holds the lock of every collection they touch
+func undoLogEntriesLocked(entries []LogEntry, collections map[string]*Collection) {
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		collection := collections[entry.Collection]
+		if err := collection.undoLogEntryLocked(entry, collection.syncWrites()); err != nil {
+			fmt.Printf("Avertissement: annulation de l'écriture de %s impossible: %v\n", entry.DocumentID, err)
 		}
-		// Update indexes
-		for field, index := range collection.indexes {
-			if value, exists := entry.Data[field]; exists {
-				index.mu.Lock()
-				if oldValue, oldExists := entry.OldData[field]; oldExists {
-					if ids, exists := index.values[oldValue]; exists {
-						for i, docID := range ids {
-							if docID == entry.DocumentID {
-								index.values[oldValue] = append(ids[:i], ids[i+1:]...)
-								break
-							}
-						}
-					}
-				}
-				index.values[value] = append(index.values[value], entry.DocumentID)
-				index.mu.Unlock()
-			}
+	}
+}
+
+// logCollections returns the names of the collections touched by entries
+func logCollections(entries []LogEntry) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		if !seen[entry.Collection] {
+			seen[entry.Collection] = true
+			names = append(names, entry.Collection)
 		}
-	case OpDelete:
-		// Remove the document from disk
-		path := filepath.Join(collection.path, entry.DocumentID+".json")
-		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
-			return err
+	}
+	return names
+}
+
+// syncLogEntries forces the documents touched by entries to disk, once per
+// file and once per collection directory (per-commit durability)
+func (db *Database) syncLogEntries(entries []LogEntry) error {
+	touched := make(map[string][]string)
+	var order []string
+	for _, entry := range entries {
+		if _, seen := touched[entry.Collection]; !seen {
+			order = append(order, entry.Collection)
 		}
-		// Update indexes
-		for _, index := range collection.indexes {
-			if value, exists := entry.OldData[index.field]; exists {
-				index.mu.Lock()
-				if ids, exists := index.values[value]; exists {
-					for i, docID := range ids {
-						if docID == entry.DocumentID {
-							index.values[value] = append(ids[:i], ids[i+1:]...)
-							break
-						}
-					}
-				}
-				index.mu.Unlock()
-			}
+		touched[entry.Collection] = append(touched[entry.Collection], entry.DocumentID)
+	}
+
+	for _, name := range order {
+		collection, err := db.GetCollection(name)
+		if err != nil {
+			return fmt.Errorf("collection %s not found", name)
+		}
+		if err := collection.syncDocuments(touched[name]); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-// ApplyTransactionLog applies all WAL log entries for a transaction (in order)
-func (db *Database) ApplyTransactionLog(tx *Transaction) error {
-	tx.mu.Lock()
-	defer tx.mu.Unlock()
-	for _, entry := range tx.Log {
-		if err := db.ApplyLogEntry(entry); err != nil {
+// applyLogEntry applies a WAL entry to the collection. Entries carry full
+// document images, so replaying an entry that was already applied is safe.
+func (c *Collection) applyLogEntry(entry LogEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.applyLogEntryLocked(entry)
+}
+
+// applyLogEntryLocked applies a WAL entry; the caller holds c.mu
+func (c *Collection) applyLogEntryLocked(entry LogEntry) error {
+	// With per-commit durability the commit syncs every touched file once
+	sync := c.db.Durability() == DurabilityWrite
+
+	switch entry.Operation {
+	case OpModify:
+		// Replayed without a WAL to rewrite: the operators apply again
+		_, err := c.applyModifyLocked(entry, nil, sync)
+		return err
+	case OpInsert, OpUpdate:
+		if err := c.checkUnique(entry.DocumentID, entry.Data); err != nil {
+			return err
+		}
+
+		// Read the current state so a replayed entry does not leave stale index values
+		oldDoc, _ := c.readDocument(entry.DocumentID)
+
+		if err := c.writeDocument(entry.DocumentID, entry.Data, sync); err != nil {
+			return err
+		}
+
+		c.removeFromIndexes(entry.DocumentID, oldDoc)
+		c.addToIndexes(entry.DocumentID, entry.Data)
+	case OpDelete:
+		oldDoc, err := c.readDocument(entry.DocumentID)
+		if err != nil {
+			oldDoc = entry.OldData
+		}
+		if err := c.deleteDocument(entry.DocumentID, sync); err != nil {
 			return err
 		}
+		c.removeFromIndexes(entry.DocumentID, oldDoc)
 	}
 	return nil
 }
 
-// GetDocument retrieves a document by ID
-func (c *Collection) GetDocument(docID string) (Document, error) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-
-	path := filepath.Join(c.path, docID+".json")
-	data, err := os.ReadFile(path)
+// applyModifyLocked resolves and applies a MODIFY entry; the caller holds c.mu
+func (c *Collection) applyModifyLocked(entry LogEntry, persist func(LogEntry) error, sync bool) (LogEntry, error) {
+	update, err := compileUpdate(entry.Update)
 	if err != nil {
-		return nil, err
+		return entry, err
+	}
+	current, err := c.readDocument(entry.DocumentID)
+	if err != nil {
+		return entry, err
+	}
+	updated, err := update.apply(current)
+	if err != nil {
+		return entry, err
 	}
 
-	var doc Document
-	if err := json.Unmarshal(data, &doc); err != nil {
-		return nil, err
+	resolved := entry
+	resolved.Operation = OpUpdate
+	resolved.Data = updated
+	resolved.OldData = current
+	resolved.Update = nil
+	if persist != nil {
+		if err := persist(resolved); err != nil {
+			return entry, fmt.Errorf("erreur réécriture WAL: %v", err)
+		}
 	}
 
-	return doc, nil
+	if err := c.replaceDocument(entry.DocumentID, current, updated, c.affectedIndexes(update.paths), sync); err != nil {
+		return entry, err
+	}
+	return resolved, nil
 }
 
-// GetAllDocuments retrieves all documents in a collection
-func (c *Collection) GetAllDocuments() ([]Document, error) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-
-	files, err := os.ReadDir(c.path)
-	if err != nil {
-		return nil, err
-	}
+// undoLogEntry reverts a WAL entry of a transaction that never committed,
+// using OldData. Recovery only calls it for transactions whose APPLY marker
+// was written, on documents no later commit wrote: their exclusive locks
+// kept every other writer away, so OldData is the state to restore.
+func (c *Collection) undoLogEntry(entry LogEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	var documents []Document
-	for _, file := range files {
-		if filepath.Ext(file.Name()) == ".json" {
-			path := filepath.Join(c.path, file.Name())
-			data, err := os.ReadFile(path)
-			if err != nil {
-				continue
-			}
+	// Recovery runs before anything else touches the data: always sync
+	return c.undoLogEntryLocked(entry, true)
+}
 
-			var doc Document
-			if err := json.Unmarshal(data, &doc); err != nil {
-				continue
-			}
+// undoLogEntryLocked reverts a WAL entry, whether it was applied or not;
+// the caller holds c.mu
+func (c *Collection) undoLogEntryLocked(entry LogEntry, sync bool) error {
+	current, err := c.readDocument(entry.DocumentID)
+	exists := err == nil
 
-			documents = append(documents, doc)
+	switch entry.Operation {
+	case OpInsert:
+		if !exists {
+			return nil
+		}
+		if err := c.deleteDocument(entry.DocumentID, sync); err != nil {
+			return err
+		}
+		c.removeFromIndexes(entry.DocumentID, current)
+	case OpUpdate, OpDelete:
+		// Nothing to restore without the previous image
+		if entry.OldData == nil {
+			return nil
+		}
+		if err := c.writeDocument(entry.DocumentID, entry.OldData, sync); err != nil {
+			return err
 		}
+		c.removeFromIndexes(entry.DocumentID, current)
+		c.addToIndexes(entry.DocumentID, entry.OldData)
 	}
-
-	return documents, nil
+	return nil
 }
 
-// FindByID retrieves a document by ID
-func (c *Collection) FindByID(docID string) (Document, error) {
-	return c.GetDocument(docID)
+// syncWrites reports whether a non-transactional write must be fsynced:
+// under per-commit durability, such a write (or bulk batch) is its own commit
+func (c *Collection) syncWrites() bool {
+	return c.db.Durability() != DurabilityNone
 }
 
-// Update updates a document by ID
-func (c *Collection) Update(docID string, doc Document) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// writeDocument writes a document through the storage engine; the caller holds c.mu
+func (c *Collection) writeDocument(docID string, doc map[string]interface{}, sync bool) error {
+	return c.versioned(docID, func() error {
+		return c.storage.Put(docID, doc, sync)
+	})
+}
 
-	path := filepath.Join(c.path, docID+".json")
+// deleteDocument removes a document through the storage engine; the caller holds c.mu
+func (c *Collection) deleteDocument(docID string, sync bool) error {
+	return c.versioned(docID, func() error {
+		return c.storage.Delete(docID, sync)
+	})
+}
 
-	// Read existing document to get old data for index updates
-	var oldDoc Document
-	if data, err := os.ReadFile(path); err == nil {
-		json.Unmarshal(data, &oldDoc)
+// storeDocument replaces oldDoc (nil when absent) with doc (nil to delete)
+// and maintains every index. New index values are claimed before the write
+// and old ones dropped after it, so writers holding c.mu for reading cannot
+// take the same unique value. The caller holds c.mu for writing, or for
+// reading along with the document's exclusive lock.
+func (c *Collection) storeDocument(docID string, oldDoc, doc Document) error {
+	var claimed []*Index
+	for _, index := range c.indexes {
+		if err := index.claim(docID, oldDoc, doc); err != nil {
+			for _, done := range claimed {
+				done.settle(docID, doc, oldDoc)
+			}
+			return err
+		}
+		claimed = append(claimed, index)
 	}
 
-	data, err := json.Marshal(doc)
-	if err != nil {
-		return err
+	var err error
+	if doc == nil {
+		err = c.deleteDocument(docID, c.syncWrites())
+	} else {
+		err = c.writeDocument(docID, doc, c.syncWrites())
 	}
+	for _, index := range claimed {
+		if err != nil {
+			index.settle(docID, doc, oldDoc)
+		} else {
+			index.settle(docID, oldDoc, doc)
+		}
+	}
+	return err
+}
 
-	if err := os.WriteFile(path, data, 0644); err != nil {
-		return err
+// syncDocuments forces the given documents to disk
+func (c *Collection) syncDocuments(docIDs []string) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.storage.Sync(docIDs)
+}
+
+// readDocument reads a document through the storage engine, with its _id;
+// the caller holds c.mu
+func (c *Collection) readDocument(docID string) (Document, error) {
+	doc, err := c.storage.Get(docID)
+	if err != nil {
+		return nil, err
 	}
+	return withDocumentID(docID, doc), nil
+}
 
-	// Update indexes
-	for field, index := range c.indexes {
-		if value, exists := doc[field]; exists {
-			index.mu.Lock()
-			// Remove from old value
-			if oldValue, oldExists := oldDoc[field]; oldExists {
-				if ids, exists := index.values[oldValue]; exists {
-					for i, id := range ids {
-						if id == docID {
-							index.values[oldValue] = append(ids[:i], ids[i+1:]...)
-							break
-						}
-					}
-				}
-			}
-			// Add to new value
-			index.values[value] = append(index.values[value], docID)
-			index.mu.Unlock()
+// checkUnique verifies that doc does not violate a unique index, ignoring docID itself
+func (c *Collection) checkUnique(docID string, doc map[string]interface{}) error {
+	for _, index := range c.indexes {
+		if err := index.checkUnique(docID, doc); err != nil {
+			return err
 		}
 	}
-
 	return nil
 }
 
-// Delete deletes a document by ID
-func (c *Collection) Delete(docID string) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	path := filepath.Join(c.path, docID+".json")
+// checkUnique reports doc's values already used by another document in a unique index
+func (index *Index) checkUnique(docID string, doc map[string]interface{}) error {
+	value, taken := index.conflict(docID, doc)
+	if !taken {
+		return nil
+	}
+	return index.conflictError(value)
+}
 
-	// Read existing document to get old data for index updates
-	var oldDoc Document
-	if data, err := os.ReadFile(path); err == nil {
-		json.Unmarshal(data, &oldDoc)
+// conflictError describes a value already used in a unique index
+func (index *Index) conflictError(value interface{}) error {
+	if index.compound() {
+		return fmt.Errorf("valeurs %v des champs %s déjà utilisées (index unique %s)", value, index.fieldPaths(), index.name)
 	}
+	return fmt.Errorf("valeur '%v' du champ '%s' déjà utilisée (index unique)", value, index.fields[0].Path)
+}
 
-	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
-		return err
+// addToIndexes adds docID to every index covering a field of doc
+func (c *Collection) addToIndexes(docID string, doc map[string]interface{}) {
+	for _, index := range c.indexes {
+		index.add(docID, doc)
 	}
+}
 
-	// Update indexes
+// removeFromIndexes removes docID from the index entries of doc's fields
+func (c *Collection) removeFromIndexes(docID string, doc map[string]interface{}) {
 	for _, index := range c.indexes {
-		if value, exists := oldDoc[index.field]; exists {
-			index.mu.Lock()
-			if ids, exists := index.values[value]; exists {
-				for i, id := range ids {
-					if id == docID {
-						index.values[value] = append(ids[:i], ids[i+1:]...)
-						break
-					}
-				}
-			}
-			index.mu.Unlock()
-		}
+		index.remove(docID, doc)
 	}
+}
 
-	return nil
+// sameDocument compares two documents decoded from JSON
+func sameDocument(a, b map[string]interface{}) bool {
+	return reflect.DeepEqual(map[string]interface{}(a), map[string]interface{}(b))
 }
 
-// FindByField finds documents by field value
-func (c *Collection) FindByField(field string, value interface{}) ([]Document, error) {
+// GetDocument retrieves a document by ID
+func (c *Collection) GetDocument(docID string) (Document, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	// Check if there's an index on this field
-	if index, exists := c.indexes[field]; exists {
-		index.mu.RLock()
-		if docIDs, exists := index.values[value]; exists {
-			var documents []Document
-			for _, docID := range docIDs {
-				if doc, err := c.GetDocument(docID); err == nil {
-					documents = append(documents, doc)
-				}
-			}
-			index.mu.RUnlock()
-			return documents, nil
-		}
-		index.mu.RUnlock()
-	}
+	return c.readDocument(docID)
+}
+
+// GetAllDocuments retrieves all documents in a collection
+func (c *Collection) GetAllDocuments() ([]Document, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 
-	// Fallback to scanning all documents
 	var documents []Document
-	files, err := os.ReadDir(c.path)
+	err := c.scan(func(docID string, doc Document) error {
+		documents = append(documents, doc)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	for _, file := range files {
-		if filepath.Ext(file.Name()) == ".json" {
-			path := filepath.Join(c.path, file.Name())
-			data, err := os.ReadFile(path)
-			if err != nil {
-				continue
-			}
+	return documents, nil
+}
 
-			var doc Document
-			if err := json.Unmarshal(data, &doc); err != nil {
-				continue
-			}
+// FindByID retrieves a document by ID
+func (c *Collection) FindByID(docID string) (Document, error) {
+	return c.GetDocument(docID)
+}
+
+// Update updates a document by ID (last writer wins, see UpdateIfRevision)
+func (c *Collection) Update(docID string, doc Document) error {
+	_, err := c.UpdateWithPrecondition(docID, doc, Precondition{})
+	return err
+}
+
+// Delete deletes a document by ID (see DeleteIfRevision)
+func (c *Collection) Delete(docID string) error {
+	return c.DeleteWithPrecondition(docID, Precondition{})
+}
+
+// FindByField finds documents by field value, through a simple index on
+// the field or a compound index starting with it when there is one
+func (c *Collection) FindByField(field string, value interface{}) ([]Document, error) {
+	return c.FindByFields(map[string]interface{}{field: value})
+}
+
+// FindRange finds documents whose field lies in r, in field order when an
+// ordered index covers the field. Bounds only match values of their own
+// type, so a numeric range never returns strings.
+func (c *Collection) FindRange(field string, r Range) ([]Document, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if index := c.fieldIndex(field, true); index != nil {
+		var docIDs []string
+		index.scanRange(r, func(key interface{}, ids []string) bool {
+			docIDs = append(docIDs, ids...)
+			return true
+		})
+		return c.readDocuments(docIDs)
+	}
 
-			if docValue, exists := doc[field]; exists && docValue == value {
-				documents = append(documents, doc)
+	return c.scanDocuments(func(doc Document) bool {
+		return matchPath(doc, field, r.contains)
+	}, 0)
+}
+
+// FindByPrefix finds documents whose string field starts with prefix
+func (c *Collection) FindByPrefix(field string, prefix string) ([]Document, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if index := c.fieldIndex(field, true); index != nil {
+		var docIDs []string
+		index.scanPrefix(prefix, func(key interface{}, ids []string) bool {
+			docIDs = append(docIDs, ids...)
+			return true
+		})
+		return c.readDocuments(docIDs)
+	}
+
+	return c.scanDocuments(func(doc Document) bool {
+		return matchPath(doc, field, func(value interface{}) bool {
+			str, ok := value.(string)
+			return ok && strings.HasPrefix(str, prefix)
+		})
+	}, 0)
+}
+
+// readDocuments reads the given documents once each, skipping missing ones
+// (a multikey index can list a document under several values); an
+// unreadable document is an error. The caller holds c.mu.
+func (c *Collection) readDocuments(docIDs []string) ([]Document, error) {
+	var documents []Document
+	seen := make(map[string]bool, len(docIDs))
+	for _, docID := range docIDs {
+		if seen[docID] {
+			continue
+		}
+		seen[docID] = true
+		doc, err := c.readDocument(docID)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("document %s illisible: %w", docID, err)
+		}
+		documents = append(documents, doc)
+	}
+	return documents, nil
+}
+
+// scanDocuments returns the documents matching match, stopping after limit
+// matches when limit is positive; the caller holds c.mu
+func (c *Collection) scanDocuments(match func(doc Document) bool, limit int) ([]Document, error) {
+	var documents []Document
+	err := c.scan(func(docID string, doc Document) error {
+		if match(doc) {
+			documents = append(documents, doc)
+			if limit > 0 && len(documents) == limit {
+				return errStopScan
 			}
 		}
+		return nil
+	})
+	if err != nil && err != errStopScan {
+		return nil, err
 	}
 
 	return documents, nil
@@ -643,8 +1084,3 @@ func (c *Collection) DeleteWithTransaction(tx *Transaction, docID string) error
 	// We need access to the database instance, so this method should be called on the database
 	return fmt.Errorf("use Database.DeleteWithTransaction instead")
 }
-
-// generateID generates a unique document ID
-func generateID() string {
-	return fmt.Sprintf("%d", time.Now().UnixNano())
-}
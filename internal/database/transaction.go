@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,6 +28,17 @@ const (
 	OpInsert OperationType = "INSERT"
 	OpUpdate OperationType = "UPDATE"
 	OpDelete OperationType = "DELETE"
+	// OpModify applique des opérateurs de mise à jour (Update) au document
+	// tel qu'il est à la validation ; l'entrée est alors réécrite dans le
+	// WAL en UPDATE avec les images complètes, avant toute écriture
+	OpModify OperationType = "MODIFY"
+	// OpApply est le marqueur écrit dans le WAL une fois les entrées d'une
+	// transaction vérifiées, avant la première écriture : sans lui, rien
+	// n'a été appliqué
+	OpApply OperationType = "APPLY"
+	// OpCommit est l'enregistrement marqueur écrit dans le WAL une fois
+	// toutes les entrées d'une transaction appliquées
+	OpCommit OperationType = "COMMIT"
 )
 
 // LogEntry représente une entrée dans le WAL
@@ -37,6 +50,10 @@ type LogEntry struct {
 	DocumentID    string                 `json:"document_id,omitempty"`
 	Data          map[string]interface{} `json:"data,omitempty"`
 	OldData       map[string]interface{} `json:"old_data,omitempty"`
+	Update        map[string]interface{} `json:"update,omitempty"`
+	// Seq ordonne les entrées du WAL de toute la base : les marqueurs
+	// APPLY et COMMIT donnent l'ordre d'application et de validation
+	Seq uint64 `json:"seq,omitempty"`
 }
 
 // Transaction représente une transaction
@@ -45,15 +62,32 @@ type Transaction struct {
 	State     TransactionState `json:"state"`
 	StartTime int64            `json:"start_time"`
 	Log       []LogEntry       `json:"log"`
+	Isolation IsolationLevel   `json:"isolation"`
 	walPath   string           `json:"-"` // Chemin vers le répertoire WAL
-	mu        sync.RWMutex
+	// snapshot est l'horodatage de validation dont la transaction lit l'état
+	snapshot uint64
+	// reads est l'ensemble de lecture d'une transaction sérialisable, par
+	// collection
+	reads map[string]*readSet
+	// locks détient les verrous de la transaction jusqu'à sa fin
+	locks *lockOwner
+	// seq est le compteur des entrées du WAL, partagé par le gestionnaire
+	seq *atomic.Uint64
+	// walErr signale une entrée du WAL qui ne correspond à aucune entrée de
+	// Log : la récupération la rejouerait, la transaction ne peut être validée
+	walErr error
+	mu     sync.RWMutex
 }
 
 // TransactionManager gère les transactions
 type TransactionManager struct {
 	transactions map[string]*Transaction
 	walPath      string
-	mu           sync.RWMutex
+	clock        *commitClock
+	locks        *lockManager
+	// seq numérote les entrées du WAL (LogEntry.Seq)
+	seq atomic.Uint64
+	mu  sync.RWMutex
 }
 
 // NewTransactionManager crée un nouveau gestionnaire de transactions
@@ -65,31 +99,51 @@ func NewTransactionManager(walPath string) (*TransactionManager, error) {
 	tm := &TransactionManager{
 		transactions: make(map[string]*Transaction),
 		walPath:      walPath,
-	}
-
-	// Récupérer les transactions non terminées au démarrage
-	if err := tm.recoverTransactions(); err != nil {
-		return nil, fmt.Errorf("erreur récupération transactions: %v", err)
+		clock:        newCommitClock(),
+		locks:        newLockManager(),
 	}
 
 	return tm, nil
 }
 
-// BeginTransaction commence une nouvelle transaction
+// BeginTransaction commence une nouvelle transaction, en isolation par
+// instantané
 func (tm *TransactionManager) BeginTransaction() *Transaction {
-	tm.mu.Lock()
-	defer tm.mu.Unlock()
+	tx, _ := tm.BeginTransactionWithOptions(TransactionOptions{})
+	return tx
+}
+
+// BeginTransactionWithOptions commence une nouvelle transaction : ses
+// lectures voient l'état validé à cet instant
+func (tm *TransactionManager) BeginTransactionWithOptions(opts TransactionOptions) (*Transaction, error) {
+	isolation := opts.Isolation
+	switch isolation {
+	case "":
+		isolation = IsolationSnapshot
+	case IsolationSnapshot, IsolationSerializable:
+	default:
+		return nil, fmt.Errorf("niveau d'isolation %q inconnu (snapshot ou serializable)", isolation)
+	}
 
 	tx := &Transaction{
 		ID:        generateTransactionID(),
 		State:     TransactionActive,
 		StartTime: time.Now().UnixNano(),
 		Log:       make([]LogEntry, 0),
+		Isolation: isolation,
 		walPath:   tm.walPath,
+		snapshot:  tm.clock.snapshot(),
+		seq:       &tm.seq,
+	}
+	tx.locks = tm.locks.newOwner("transaction " + tx.ID)
+	if isolation == IsolationSerializable {
+		tx.reads = make(map[string]*readSet)
 	}
 
+	tm.mu.Lock()
 	tm.transactions[tx.ID] = tx
-	return tx
+	tm.mu.Unlock()
+	return tx, nil
 }
 
 // Commit valide une transaction
@@ -100,26 +154,65 @@ func (tm *TransactionManager) Commit(db *Database, tx *Transaction) error {
 	if tx.State != TransactionActive {
 		return fmt.Errorf("transaction %s n'est pas active", tx.ID)
 	}
+	if tx.walErr != nil {
+		tx.State = TransactionAborted
+		tm.end(tx)
+		return fmt.Errorf("transaction %s annulée: %v", tx.ID, tx.walErr)
+	}
 
-	// Appliquer le log de la transaction (déferred writing)
-	if err := db.ApplyTransactionLog(tx); err != nil {
-		return fmt.Errorf("erreur application log transaction: %v", err)
+	// Appliquer le log de la transaction (déferred writing) d'un bloc :
+	// les lectures concurrentes voient toute la transaction ou rien. La
+	// transaction vérifie d'abord, sous les mêmes verrous, qu'aucune
+	// validation n'a écrit ses documents depuis son début et, si elle est
+	// sérialisable, n'a touché ce qu'elle a lu ; puis chaque entrée est
+	// vérifiée avant la première écriture. En cas d'échec, les écritures
+	// déjà faites sont annulées et la transaction aussi.
+	names := logCollections(tx.Log)
+	for name := range tx.reads {
+		names = append(names, name)
 	}
+	err := db.applyAtomically(names, func(collections map[string]*Collection) error {
+		if err := tx.validateWrites(collections); err != nil {
+			return err
+		}
+		if err := tx.validateReads(collections); err != nil {
+			return err
+		}
+		if err := db.applyLogEntriesLocked(tx.Log, collections); err != nil {
+			return err
+		}
 
-	// Marquer la transaction comme validée
+		// Écrire le marqueur de validation : sans lui, la récupération
+		// considère la transaction comme non validée et l'annule
+		if err := tm.writeMarker(tx.ID, OpCommit); err != nil {
+			undoLogEntriesLocked(tx.Log, collections)
+			return fmt.Errorf("erreur écriture marqueur de validation: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		tx.State = TransactionAborted
+		tm.end(tx)
+		return fmt.Errorf("transaction %s annulée: %w", tx.ID, err)
+	}
+
+	// Le marqueur de validation est sur disque : la transaction est
+	// validée, quoi qu'il arrive à la synchronisation de ses documents
 	tx.State = TransactionCommitted
 
-	// Nettoyer les fichiers WAL de cette transaction
-	if err := tm.cleanupTransactionWAL(tx.ID); err != nil {
-		fmt.Printf("Avertissement: erreur nettoyage WAL pour transaction %s: %v\n", tx.ID, err)
+	// En durabilité par commit, forcer les documents écrits avant de
+	// tronquer le log qui permettrait de les rejouer. Le log n'est pas
+	// gardé en cas d'échec : rejoué après une validation ultérieure des
+	// mêmes documents, il l'écraserait.
+	var syncErr error
+	if db.Durability() == DurabilityCommit {
+		if err := db.syncLogEntries(tx.Log); err != nil {
+			syncErr = fmt.Errorf("transaction %s: %w: %v", tx.ID, ErrNotDurable, err)
+		}
 	}
+	tm.end(tx)
 
-	// Nettoyer la transaction
-	tm.mu.Lock()
-	delete(tm.transactions, tx.ID)
-	tm.mu.Unlock()
-
-	return nil
+	return syncErr
 }
 
 // Rollback annule une transaction
@@ -133,96 +226,240 @@ func (tm *TransactionManager) Rollback(tx *Transaction) error {
 
 	// Marquer la transaction comme annulée
 	tx.State = TransactionAborted
+	tm.end(tx)
 
+	return nil
+}
+
+// end libère une transaction terminée : fichiers WAL, instantané, verrous
+// et entrée du gestionnaire ; l'appelant détient tx.mu
+func (tm *TransactionManager) end(tx *Transaction) {
 	// Nettoyer les fichiers WAL de cette transaction
 	if err := tm.cleanupTransactionWAL(tx.ID); err != nil {
 		fmt.Printf("Avertissement: erreur nettoyage WAL pour transaction %s: %v\n", tx.ID, err)
 	}
 
+	// Les versions gardées pour son instantané peuvent être oubliées, et
+	// les verrous détenus jusqu'ici libérés
+	tm.clock.release(tx.snapshot)
+	tm.locks.release(tx.locks)
+
 	// Nettoyer la transaction
 	tm.mu.Lock()
 	delete(tm.transactions, tx.ID)
 	tm.mu.Unlock()
-
-	return nil
 }
 
-// AddLogEntry ajoute une entrée de log à une transaction
-func (tx *Transaction) AddLogEntry(entry LogEntry) {
+// AddLogEntry ajoute une entrée de log à une transaction, après l'avoir
+// écrite dans le WAL : la récupération ne peut annuler une écriture dont
+// l'entrée n'y est pas. En cas d'erreur, l'entrée n'est pas ajoutée ; si
+// un fichier partiel n'a pu être retiré du WAL, la transaction ne pourra
+// plus être validée.
+func (tx *Transaction) AddLogEntry(entry LogEntry) error {
 	tx.mu.Lock()
 	defer tx.mu.Unlock()
 
+	if tx.State != TransactionActive {
+		return fmt.Errorf("transaction %s n'est pas active", tx.ID)
+	}
+
 	entry.TransactionID = tx.ID
 	entry.Timestamp = time.Now().UnixNano()
-	tx.Log = append(tx.Log, entry)
+	entry.Seq = tx.seq.Add(1)
 
-	// Écrire immédiatement dans le WAL pour la durabilité
+	// Écrire dans le WAL avant de garder l'entrée, pour la durabilité
 	if err := tx.writeLogEntryToWAL(entry); err != nil {
-		fmt.Printf("Erreur écriture WAL pour transaction %s: %v\n", tx.ID, err)
+		path := filepath.Join(tx.walPath, walFileName(entry))
+		if removeErr := os.Remove(path); removeErr != nil && !os.IsNotExist(removeErr) {
+			tx.walErr = fmt.Errorf("entrée %s restée dans le WAL: %v", walFileName(entry), removeErr)
+		}
+		return fmt.Errorf("erreur écriture WAL pour transaction %s: %v", tx.ID, err)
 	}
+	tx.Log = append(tx.Log, entry)
+	return nil
 }
 
 // writeLogEntry écrit une entrée dans le WAL
 func (tm *TransactionManager) writeLogEntry(entry LogEntry) error {
-	filename := fmt.Sprintf("%s_%s.log", entry.TransactionID, fmt.Sprintf("%d", entry.Timestamp))
-	path := filepath.Join(tm.walPath, filename)
+	return writeWALEntry(tm.walPath, entry)
+}
+
+// writeMarker écrit dans le WAL le marqueur operation (OpApply ou
+// OpCommit) de la transaction transactionID
+func (tm *TransactionManager) writeMarker(transactionID string, operation OperationType) error {
+	return tm.writeLogEntry(LogEntry{
+		TransactionID: transactionID,
+		Timestamp:     time.Now().UnixNano(),
+		Seq:           tm.seq.Add(1),
+		Operation:     operation,
+	})
+}
+
+// writeLogEntryToWAL écrit une entrée dans le WAL (méthode de Transaction)
+func (tx *Transaction) writeLogEntryToWAL(entry LogEntry) error {
+	return writeWALEntry(tx.walPath, entry)
+}
+
+// writeWALEntry sérialise une entrée dans son propre fichier du WAL et la
+// force sur disque : la récupération doit pouvoir compter sur OldData avant
+// que la moindre écriture de données ne soit faite
+func writeWALEntry(walPath string, entry LogEntry) error {
+	path := filepath.Join(walPath, walFileName(entry))
 
 	data, err := json.Marshal(entry)
 	if err != nil {
 		return fmt.Errorf("erreur sérialisation log: %v", err)
 	}
 
-	return os.WriteFile(path, data, 0644)
+	// Chaque entrée a son propre numéro : un fichier existant ne doit
+	// jamais être écrasé
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return syncDir(walPath)
 }
 
-// writeLogEntryToWAL écrit une entrée dans le WAL (méthode de Transaction)
-func (tx *Transaction) writeLogEntryToWAL(entry LogEntry) error {
-	filename := fmt.Sprintf("%s_%s.log", entry.TransactionID, fmt.Sprintf("%d", entry.Timestamp))
-	path := filepath.Join(tx.walPath, filename)
+// walFileName retourne le nom du fichier d'une entrée du WAL, unique par
+// son numéro (deux entrées peuvent avoir le même horodatage)
+func walFileName(entry LogEntry) string {
+	return fmt.Sprintf("%s_%d.log", entry.TransactionID, entry.Seq)
+}
 
+// rewriteWALEntry remplace une entrée du WAL de façon atomique : la
+// récupération lit l'ancienne entrée ou la nouvelle, jamais un mélange
+func rewriteWALEntry(walPath string, entry LogEntry) error {
 	data, err := json.Marshal(entry)
 	if err != nil {
 		return fmt.Errorf("erreur sérialisation log: %v", err)
 	}
-
-	return os.WriteFile(path, data, 0644)
+	return writeFileAtomic(filepath.Join(walPath, walFileName(entry)), data, true)
 }
 
-// recoverTransactions récupère les transactions non terminées
-func (tm *TransactionManager) recoverTransactions() error {
+// recoverTransactions rejoue le WAL laissé par un arrêt brutal.
+// Les transactions portant un marqueur de validation sont rejouées (redo)
+// dans l'ordre de leurs marqueurs ; les autres, si leur marqueur
+// d'application montre qu'elles ont commencé à écrire, voient leurs
+// écritures partielles annulées grâce à OldData (undo), sauf sur les
+// documents qu'une transaction validée après elles a écrits. Le log n'est
+// supprimé qu'une fois toutes les transactions traitées.
+func (tm *TransactionManager) recoverTransactions(db *Database) error {
 	files, err := os.ReadDir(tm.walPath)
 	if err != nil {
 		return err
 	}
 
-	// Grouper les fichiers par transaction ID
+	// Grouper les entrées par transaction ID
+	transactionEntries := make(map[string][]LogEntry)
 	transactionFiles := make(map[string][]string)
 	for _, file := range files {
 		if filepath.Ext(file.Name()) != ".log" {
 			continue
 		}
 
-		// Extraire l'ID de transaction du nom de fichier
-		// Format: tx_ID_timestamp.log
-		parts := strings.Split(file.Name(), "_")
-		if len(parts) >= 3 {
-			transactionID := parts[0] + "_" + parts[1]
-			transactionFiles[transactionID] = append(transactionFiles[transactionID], file.Name())
+		data, err := os.ReadFile(filepath.Join(tm.walPath, file.Name()))
+		if err != nil {
+			return fmt.Errorf("erreur lecture log %s: %v", file.Name(), err)
+		}
+
+		// Une entrée tronquée ne peut provenir que d'une écriture
+		// interrompue : on l'ignore, la transaction reste non validée
+		var entry LogEntry
+		if err := json.Unmarshal(data, &entry); err != nil || entry.TransactionID == "" {
+			fmt.Printf("Récupération: entrée WAL illisible ignorée %s\n", file.Name())
+			if idx := strings.LastIndex(file.Name(), "_"); idx > 0 {
+				transactionID := file.Name()[:idx]
+				transactionFiles[transactionID] = append(transactionFiles[transactionID], file.Name())
+			}
+			continue
+		}
+
+		transactionEntries[entry.TransactionID] = append(transactionEntries[entry.TransactionID], entry)
+		transactionFiles[entry.TransactionID] = append(transactionFiles[entry.TransactionID], file.Name())
+
+		// Les nouvelles entrées sont numérotées après celles du WAL
+		if entry.Seq > tm.seq.Load() {
+			tm.seq.Store(entry.Seq)
 		}
 	}
 
-	// Pour chaque transaction, analyser les logs et décider de l'action
-	for transactionID, fileList := range transactionFiles {
-		fmt.Printf("Récupération: transaction %s avec %d fichiers WAL\n", transactionID, len(fileList))
+	var committed, applied []*recoveredTransaction
+	for transactionID, entries := range transactionEntries {
+		recovered := newRecoveredTransaction(transactionID, entries)
+		switch {
+		case recovered.commit != nil:
+			committed = append(committed, recovered)
+		case recovered.apply != nil:
+			applied = append(applied, recovered)
+		default:
+			fmt.Printf("Récupération: transaction %s jamais appliquée, %d opérations ignorées\n", transactionID, len(recovered.operations))
+		}
+	}
+	sort.Slice(committed, func(i, j int) bool {
+		return walBefore(*committed[i].commit, *committed[j].commit)
+	})
+
+	// Collections ouvertes pour la seule récupération, fermées à la fin
+	opened := make(map[string]*Collection)
+	defer func() {
+		for _, collection := range opened {
+			collection.storage.Close()
+		}
+	}()
+
+	// Rejouer les transactions validées dans l'ordre de validation, en
+	// notant pour chaque document le numéro de la dernière qui l'a écrit
+	lastCommit := make(map[string]uint64)
+	for _, recovered := range committed {
+		fmt.Printf("Récupération: transaction %s validée, rejeu de %d opérations\n", recovered.id, len(recovered.operations))
+		for _, entry := range recovered.operations {
+			collection, err := db.recoveryCollection(entry.Collection, opened)
+			if err != nil {
+				return err
+			}
+			if err := collection.applyLogEntry(entry); err != nil {
+				return fmt.Errorf("erreur rejeu transaction %s: %v", recovered.id, err)
+			}
+			lastCommit[entry.Collection+"/"+entry.DocumentID] = recovered.commit.Seq
+		}
+	}
+
+	for _, recovered := range applied {
+		fmt.Printf("Récupération: transaction %s non validée, annulation de %d opérations\n", recovered.id, len(recovered.operations))
+		for i := len(recovered.operations) - 1; i >= 0; i-- {
+			entry := recovered.operations[i]
+			// Une transaction validée après le début de celle-ci a écrit
+			// le document : son écriture est la plus récente
+			if lastCommit[entry.Collection+"/"+entry.DocumentID] > recovered.apply.Seq {
+				continue
+			}
+			collection, err := db.recoveryCollection(entry.Collection, opened)
+			if err != nil {
+				return err
+			}
+			if err := collection.undoLogEntry(entry); err != nil {
+				return fmt.Errorf("erreur annulation transaction %s: %v", recovered.id, err)
+			}
+		}
+	}
 
-		// Pour l'instant, on supprime les anciens logs
-		// Dans une implémentation complète, on analyserait les logs pour récupérer l'état
+	// Tronquer le log seulement une fois les transactions traitées
+	for _, fileList := range transactionFiles {
 		for _, fileName := range fileList {
 			filePath := filepath.Join(tm.walPath, fileName)
 			if err := os.Remove(filePath); err != nil {
 				fmt.Printf("Erreur suppression log %s: %v\n", fileName, err)
-			} else {
-				fmt.Printf("Supprimé: %s\n", fileName)
 			}
 		}
 	}
@@ -230,6 +467,46 @@ func (tm *TransactionManager) recoverTransactions() error {
 	return nil
 }
 
+// recoveredTransaction regroupe les entrées du WAL d'une transaction lues
+// à la récupération
+type recoveredTransaction struct {
+	id         string
+	operations []LogEntry
+	// apply et commit sont ses marqueurs, nil s'ils n'ont pas été écrits
+	apply  *LogEntry
+	commit *LogEntry
+}
+
+// newRecoveredTransaction trie les entrées de la transaction transactionID
+// et sépare ses marqueurs de ses opérations
+func newRecoveredTransaction(transactionID string, entries []LogEntry) *recoveredTransaction {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return walBefore(entries[i], entries[j])
+	})
+
+	recovered := &recoveredTransaction{id: transactionID}
+	for i := range entries {
+		switch entries[i].Operation {
+		case OpApply:
+			recovered.apply = &entries[i]
+		case OpCommit:
+			recovered.commit = &entries[i]
+		default:
+			recovered.operations = append(recovered.operations, entries[i])
+		}
+	}
+	return recovered
+}
+
+// walBefore indique si l'entrée a précède b dans le WAL : par numéro, ou
+// par horodatage pour les entrées écrites avant LogEntry.Seq
+func walBefore(a, b LogEntry) bool {
+	if a.Seq != b.Seq {
+		return a.Seq < b.Seq
+	}
+	return a.Timestamp < b.Timestamp
+}
+
 // generateTransactionID génère un ID unique pour une transaction
 func generateTransactionID() string {
 	return fmt.Sprintf("tx_%x", time.Now().UnixNano())
@@ -244,6 +521,46 @@ func (tm *TransactionManager) GetTransaction(id string) (*Transaction, bool) {
 	return tx, exists
 }
 
+// usingCollection retourne une transaction active dont le log ou
+// l'ensemble de lecture vise la collection name
+func (tm *TransactionManager) usingCollection(name string) (string, bool) {
+	tm.mu.RLock()
+	active := make([]*Transaction, 0, len(tm.transactions))
+	for _, tx := range tm.transactions {
+		active = append(active, tx)
+	}
+	tm.mu.RUnlock()
+
+	// tx.mu est pris hors de tm.mu, que la fin d'une transaction prend
+	// sous tx.mu
+	for _, tx := range active {
+		if tx.uses(name) {
+			return tx.ID, true
+		}
+	}
+	return "", false
+}
+
+// uses indique si la transaction, encore active, a écrit ou lu dans la
+// collection name
+func (tx *Transaction) uses(name string) bool {
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+
+	if tx.State != TransactionActive {
+		return false
+	}
+	if _, read := tx.reads[name]; read {
+		return true
+	}
+	for _, entry := range tx.Log {
+		if entry.Collection == name {
+			return true
+		}
+	}
+	return false
+}
+
 // cleanupTransactionWAL nettoie les fichiers WAL d'une transaction spécifique
 func (tm *TransactionManager) cleanupTransactionWAL(transactionID string) error {
 	files, err := os.ReadDir(tm.walPath)
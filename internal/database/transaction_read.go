@@ -0,0 +1,199 @@
+package database
+
+import (
+	"fmt"
+	"os"
+)
+
+// GetDocumentWithTransaction lit le document docID tel que tx le voit :
+// les écritures de tx non encore validées recouvrent l'état validé à son
+// début (son instantané)
+func (db *Database) GetDocumentWithTransaction(tx *Transaction, collectionName string, docID string) (Document, error) {
+	collection, err := db.GetCollection(collectionName)
+	if err != nil {
+		return nil, fmt.Errorf("collection %s not found", collectionName)
+	}
+	pending, err := tx.pendingDocuments(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	if doc, written := pending[docID]; written {
+		if doc == nil {
+			return nil, &os.PathError{Op: "get", Path: docID, Err: os.ErrNotExist}
+		}
+		return doc, nil
+	}
+	if tx.Isolation == IsolationSerializable {
+		// Le verrou partagé, gardé jusqu'à la fin, est converti en verrou
+		// exclusif si tx écrit ensuite le document
+		if err := db.lockForTransaction(tx, collection, docID, LockShared); err != nil {
+			return nil, err
+		}
+	}
+	tx.recordRead(collectionName, docID, nil)
+	return collection.getDocumentAt(docID, tx.snapshot)
+}
+
+// FindByFieldWithTransaction retourne les documents dont field vaut value,
+// tels que tx les voit
+func (db *Database) FindByFieldWithTransaction(tx *Transaction, collectionName string, field string, value interface{}) ([]Document, error) {
+	return db.FindWithTransaction(tx, collectionName, Filter{field: value}, FindOptions{})
+}
+
+// FindWithTransaction retourne les documents vérifiant filter tels que tx
+// les voit : documents de son instantané, sauf ceux que tx a modifiés ou
+// supprimés, et documents écrits par tx, le tout trié, paginé et projeté
+// selon opts. La pagination par curseur n'est pas disponible dans une
+// transaction.
+func (db *Database) FindWithTransaction(tx *Transaction, collectionName string, filter Filter, opts FindOptions) ([]Document, error) {
+	collection, err := db.GetCollection(collectionName)
+	if err != nil {
+		return nil, fmt.Errorf("collection %s not found", collectionName)
+	}
+	if opts.After != "" {
+		return nil, fmt.Errorf("%w: curseur non disponible dans une transaction", ErrInvalidFilter)
+	}
+	match, err := compileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	pending, err := tx.pendingDocuments(collection)
+	if err != nil {
+		return nil, err
+	}
+	tx.recordRead(collectionName, "", match)
+
+	committed, err := collection.queryAt(filter, match, opts, tx.snapshot, pending)
+	if err != nil {
+		return nil, err
+	}
+	sorter := &documentSorter{fields: opts.Sort}
+	for _, entry := range committed {
+		sorter.add(entry)
+	}
+	for docID, doc := range pending {
+		if doc != nil && match(doc) {
+			sorter.add(&sortedDocument{id: docID, doc: copyDocument(doc)})
+		}
+	}
+
+	entries := sorter.sorted()
+	if opts.Skip >= len(entries) {
+		return []Document{}, nil
+	}
+	entries = entries[opts.Skip:]
+	if opts.Limit > 0 && opts.Limit < len(entries) {
+		entries = entries[:opts.Limit]
+	}
+	documents := make([]Document, len(entries))
+	for i, entry := range entries {
+		documents[i] = project(entry.doc, opts.Projection)
+	}
+	return documents, nil
+}
+
+// queryAt retourne les documents de l'instantané snapshot vérifiant le
+// filtre, hors documents écrits par la transaction (pending), assez pour
+// remplir la page de opts une fois ceux-ci ajoutés. Les documents écrits
+// depuis l'instantané sont remplacés par leurs versions, relevées après la
+// recherche : une écriture concurrente à la recherche y figure.
+func (c *Collection) queryAt(filter Filter, match matcher, opts FindOptions, snapshot uint64, pending map[string]Document) ([]*sortedDocument, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	// Chaque document écrit par tx ou depuis l'instantané peut écarter un
+	// document de la fenêtre : elle est élargie d'autant, et la recherche
+	// recommencée si d'autres écritures ont eu lieu entretemps
+	slack := len(pending) + len(c.overlayAt(snapshot))
+	for {
+		window := FindOptions{Sort: opts.Sort}
+		if opts.Limit > 0 {
+			window.Limit = opts.Skip + opts.Limit + slack
+		}
+		planner, err := c.planQuery(filter, window)
+		if err != nil {
+			return nil, err
+		}
+		var found []*sortedDocument
+		err = c.execute(planner, match, window, nil, &Explanation{}, func(entry *sortedDocument) bool {
+			found = append(found, &sortedDocument{id: entry.id, doc: entry.doc})
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		overlay := c.overlayAt(snapshot)
+		if opts.Limit > 0 && len(pending)+len(overlay) > slack {
+			slack = len(pending) + len(overlay)
+			continue
+		}
+
+		var entries []*sortedDocument
+		for _, entry := range found {
+			_, written := pending[entry.id]
+			if _, changed := overlay[entry.id]; !written && !changed {
+				entries = append(entries, entry)
+			}
+		}
+		for docID, doc := range overlay {
+			if _, written := pending[docID]; written || doc == nil || !match(doc) {
+				continue
+			}
+			entries = append(entries, &sortedDocument{id: docID, doc: copyDocument(doc)})
+		}
+		return entries, nil
+	}
+}
+
+// pendingDocuments rejoue les entrées de tx portant sur la collection et
+// retourne le dernier état de chaque document écrit, nil s'il est supprimé.
+// Les opérateurs d'une entrée MODIFY s'appliquent au document tel que tx le
+// voit.
+func (tx *Transaction) pendingDocuments(c *Collection) (map[string]Document, error) {
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+
+	if tx.State != TransactionActive {
+		return nil, fmt.Errorf("transaction %s n'est pas active", tx.ID)
+	}
+
+	name := c.currentName()
+	pending := make(map[string]Document)
+	for _, entry := range tx.Log {
+		if entry.Collection != name {
+			continue
+		}
+		switch entry.Operation {
+		case OpInsert, OpUpdate:
+			pending[entry.DocumentID] = copyDocument(withDocumentID(entry.DocumentID, entry.Data))
+		case OpDelete:
+			pending[entry.DocumentID] = nil
+		case OpModify:
+			update, err := compileUpdate(entry.Update)
+			if err != nil {
+				return nil, err
+			}
+			current, written := pending[entry.DocumentID]
+			if !written {
+				if current, err = c.getDocumentAt(entry.DocumentID, tx.snapshot); err != nil {
+					// La validation échouera : le document reste tel quel
+					continue
+				}
+			}
+			if current == nil {
+				continue
+			}
+			updated, err := update.apply(current)
+			if err != nil {
+				return nil, err
+			}
+			pending[entry.DocumentID] = updated
+		}
+	}
+	return pending, nil
+}
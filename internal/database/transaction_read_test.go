@@ -0,0 +1,92 @@
+package database
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// TestReadYourOwnWrites vérifie qu'une transaction lit ses propres
+// écritures, invisibles hors d'elle jusqu'à la validation
+func TestReadYourOwnWrites(t *testing.T) {
+	db := openTestDatabase(t)
+	c := createTestCollection(t, db, "accounts")
+	mustInsert(t, c, Document{"_id": "a", "owner": "ann", "balance": 10})
+	mustInsert(t, c, Document{"_id": "b", "owner": "bob", "balance": 20})
+	mustInsert(t, c, Document{"_id": "c", "owner": "cid", "balance": 30})
+
+	tx := db.BeginTransaction()
+	if _, err := db.InsertWithTransaction(tx, "accounts", Document{"_id": "d", "owner": "dan", "balance": 40}); err != nil {
+		t.Fatalf("InsertWithTransaction: %v", err)
+	}
+	if err := db.UpdateWithTransaction(tx, "accounts", "a", Document{"owner": "ann", "balance": 15}); err != nil {
+		t.Fatalf("UpdateWithTransaction: %v", err)
+	}
+	if err := db.ModifyWithTransaction(tx, "accounts", "a", Update{"$inc": map[string]interface{}{"balance": 1}}); err != nil {
+		t.Fatalf("ModifyWithTransaction: %v", err)
+	}
+	if err := db.DeleteWithTransaction(tx, "accounts", "b"); err != nil {
+		t.Fatalf("DeleteWithTransaction: %v", err)
+	}
+
+	doc, err := db.GetDocumentWithTransaction(tx, "accounts", "a")
+	if err != nil || doc["balance"] != float64(16) {
+		t.Fatalf("a dans la transaction = %v (%v), attendu le solde 16", doc, err)
+	}
+	if _, err := db.GetDocumentWithTransaction(tx, "accounts", "b"); !os.IsNotExist(err) {
+		t.Fatalf("b dans la transaction: %v, attendu supprimé", err)
+	}
+	docs, err := db.FindWithTransaction(tx, "accounts", Filter{"balance": map[string]interface{}{"$gt": 12}}, FindOptions{Sort: []SortField{{Path: "balance"}}})
+	if err != nil {
+		t.Fatalf("FindWithTransaction: %v", err)
+	}
+	if got := documentIDs(docs); !reflect.DeepEqual(got, []string{"a", "c", "d"}) {
+		t.Fatalf("FindWithTransaction = %v, attendu [a c d]", got)
+	}
+
+	// Hors de la transaction, rien n'a changé
+	all, err := c.GetAllDocuments()
+	if err != nil {
+		t.Fatalf("GetAllDocuments: %v", err)
+	}
+	ids := documentIDs(all)
+	sort.Strings(ids)
+	if !reflect.DeepEqual(ids, []string{"a", "b", "c"}) || mustGet(t, c, "a")["balance"] != float64(10) {
+		t.Fatalf("hors transaction: %v, attendu l'état validé", all)
+	}
+
+	if err := db.Commit(tx); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if doc := mustGet(t, c, "a"); doc["balance"] != float64(16) {
+		t.Fatalf("a = %v après validation, attendu le solde 16", doc)
+	}
+	if _, err := c.FindByID("b"); !os.IsNotExist(err) {
+		t.Fatalf("b après validation: %v, attendu supprimé", err)
+	}
+	mustGet(t, c, "d")
+}
+
+// TestRollbackDiscardsWrites vérifie qu'une transaction annulée n'écrit
+// rien et libère ses documents
+func TestRollbackDiscardsWrites(t *testing.T) {
+	db := openTestDatabase(t)
+	c := createTestCollection(t, db, "accounts")
+	mustInsert(t, c, Document{"_id": "a", "balance": 10})
+
+	tx := db.BeginTransaction()
+	if err := db.UpdateWithTransaction(tx, "accounts", "a", Document{"balance": 0}); err != nil {
+		t.Fatalf("UpdateWithTransaction: %v", err)
+	}
+	if err := db.Rollback(tx); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+
+	if doc := mustGet(t, c, "a"); doc["balance"] != float64(10) {
+		t.Fatalf("a = %v après annulation", doc)
+	}
+	if err := c.Update("a", Document{"balance": 11}); err != nil {
+		t.Fatalf("Update après annulation: %v", err)
+	}
+}
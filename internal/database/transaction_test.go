@@ -0,0 +1,197 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// crashedDatabase prépare une base dont la collection items contient docs,
+// indexés par ID, puis écrit entries dans son WAL comme l'aurait laissé un
+// arrêt brutal ; retourne la collection rouverte, après récupération
+func crashedDatabase(t *testing.T, docs map[string]Document, entries ...LogEntry) *Collection {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := NewDatabase(dir)
+	if err != nil {
+		t.Fatalf("NewDatabase: %v", err)
+	}
+	c := createTestCollection(t, db, "items")
+	for docID, doc := range docs {
+		if err := c.applyLogEntry(LogEntry{Operation: OpInsert, DocumentID: docID, Data: doc}); err != nil {
+			t.Fatalf("applyLogEntry(%s): %v", docID, err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	walPath := filepath.Join(dir, "wal")
+	for i, entry := range entries {
+		if entry.Operation != OpApply && entry.Operation != OpCommit {
+			entry.Collection = "items"
+		}
+		if entry.Timestamp == 0 {
+			entry.Timestamp = int64(i + 1)
+		}
+		if err := writeWALEntry(walPath, entry); err != nil {
+			t.Fatalf("writeWALEntry: %v", err)
+		}
+	}
+
+	db, err = NewDatabase(dir)
+	if err != nil {
+		t.Fatalf("NewDatabase après arrêt: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if files, _ := os.ReadDir(walPath); len(files) != 0 {
+		t.Fatalf("%d fichiers restent dans le WAL après récupération", len(files))
+	}
+	collection, err := db.GetCollection("items")
+	if err != nil {
+		t.Fatalf("GetCollection: %v", err)
+	}
+	return collection
+}
+
+// TestRecoveryReplaysInCommitOrder vérifie que les transactions validées
+// sont rejouées dans l'ordre de leurs marqueurs COMMIT, quel que soit
+// l'ordre de leurs horodatages ou de leurs ID
+func TestRecoveryReplaysInCommitOrder(t *testing.T) {
+	c := crashedDatabase(t, map[string]Document{"a": {"n": 0}},
+		LogEntry{TransactionID: "tx_1", Timestamp: 30, Seq: 3, Operation: OpUpdate, DocumentID: "a", Data: Document{"n": 2}, OldData: Document{"n": 1}},
+		LogEntry{TransactionID: "tx_1", Timestamp: 40, Seq: 4, Operation: OpCommit},
+		LogEntry{TransactionID: "tx_2", Timestamp: 50, Seq: 1, Operation: OpUpdate, DocumentID: "a", Data: Document{"n": 1}, OldData: Document{"n": 0}},
+		LogEntry{TransactionID: "tx_2", Timestamp: 60, Seq: 2, Operation: OpCommit},
+	)
+
+	if doc := mustGet(t, c, "a"); doc["n"] != float64(2) {
+		t.Fatalf("a = %v, attendu l'écriture de la dernière transaction validée", doc)
+	}
+}
+
+// TestRecoveryIgnoresUnappliedTransaction vérifie qu'une transaction
+// interrompue avant son marqueur APPLY n'est pas annulée, même si le
+// document porte depuis une valeur identique à la sienne
+func TestRecoveryIgnoresUnappliedTransaction(t *testing.T) {
+	c := crashedDatabase(t, map[string]Document{"a": {"n": 1}},
+		LogEntry{TransactionID: "tx_1", Seq: 1, Operation: OpUpdate, DocumentID: "a", Data: Document{"n": 1}, OldData: Document{"n": 0}},
+		LogEntry{TransactionID: "tx_1", Seq: 2, Operation: OpInsert, DocumentID: "b", Data: Document{"n": 1}},
+	)
+
+	if doc := mustGet(t, c, "a"); doc["n"] != float64(1) {
+		t.Fatalf("a = %v, l'écriture validée depuis a été annulée", doc)
+	}
+}
+
+// TestRecoveryUndoesAppliedTransaction vérifie qu'une transaction
+// interrompue après son marqueur APPLY voit ses écritures annulées, sauf
+// sur un document qu'une transaction validée après elle a écrit
+func TestRecoveryUndoesAppliedTransaction(t *testing.T) {
+	c := crashedDatabase(t, map[string]Document{"a": {"n": 1}, "b": {"n": 1}, "c": {"n": 1}},
+		LogEntry{TransactionID: "tx_1", Seq: 1, Operation: OpUpdate, DocumentID: "a", Data: Document{"n": 1}, OldData: Document{"n": 0}},
+		LogEntry{TransactionID: "tx_1", Seq: 2, Operation: OpInsert, DocumentID: "b", Data: Document{"n": 1}},
+		LogEntry{TransactionID: "tx_1", Seq: 3, Operation: OpUpdate, DocumentID: "c", Data: Document{"n": 1}, OldData: Document{"n": 0}},
+		LogEntry{TransactionID: "tx_1", Seq: 4, Operation: OpApply},
+		LogEntry{TransactionID: "tx_2", Seq: 5, Operation: OpUpdate, DocumentID: "c", Data: Document{"n": 2}, OldData: Document{"n": 1}},
+		LogEntry{TransactionID: "tx_2", Seq: 6, Operation: OpCommit},
+	)
+
+	if doc := mustGet(t, c, "a"); doc["n"] != float64(0) {
+		t.Fatalf("a = %v, attendu l'image OldData", doc)
+	}
+	if _, err := c.FindByID("b"); !os.IsNotExist(err) {
+		t.Fatalf("FindByID(b) = %v, attendu l'insertion annulée", err)
+	}
+	if doc := mustGet(t, c, "c"); doc["n"] != float64(2) {
+		t.Fatalf("c = %v, attendu l'écriture validée après la transaction annulée", doc)
+	}
+}
+
+// TestCommitWritesMarkersInOrder vérifie que les entrées et les marqueurs
+// d'une transaction sont numérotés dans l'ordre où ils sont écrits
+func TestCommitWritesMarkersInOrder(t *testing.T) {
+	db := openTestDatabase(t)
+	createTestCollection(t, db, "items")
+	tx := db.BeginTransaction()
+	tx.AddLogEntry(LogEntry{Operation: OpInsert, Collection: "items", DocumentID: "a", Data: Document{"n": 1}})
+	entry := tx.Log[0]
+
+	if err := db.Commit(tx); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if next := db.txManager.seq.Load(); entry.Seq == 0 || next != entry.Seq+2 {
+		t.Fatalf("entrée n°%d, compteur à %d : attendu les marqueurs APPLY et COMMIT après l'entrée", entry.Seq, next)
+	}
+}
+
+// TestApplyTransactionLogSurvivesReopen vérifie qu'ApplyTransactionLog
+// valide la transaction : le WAL est vidé et ses écritures restent après
+// réouverture
+func TestApplyTransactionLogSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDatabase(dir)
+	if err != nil {
+		t.Fatalf("NewDatabase: %v", err)
+	}
+	createTestCollection(t, db, "items")
+	tx := db.BeginTransaction()
+	tx.AddLogEntry(LogEntry{Operation: OpInsert, Collection: "items", DocumentID: "a", Data: Document{"n": 1}})
+	if err := db.ApplyTransactionLog(tx); err != nil {
+		t.Fatalf("ApplyTransactionLog: %v", err)
+	}
+	if tx.State != TransactionCommitted {
+		t.Fatalf("état = %v, attendu validée", tx.State)
+	}
+	if files, _ := os.ReadDir(filepath.Join(dir, "wal")); len(files) != 0 {
+		t.Fatalf("%d fichiers restent dans le WAL", len(files))
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	c, err := openTestDatabaseAt(t, dir).GetCollection("items")
+	if err != nil {
+		t.Fatalf("GetCollection: %v", err)
+	}
+	if doc := mustGet(t, c, "a"); doc["n"] != float64(1) {
+		t.Fatalf("a = %v après réouverture", doc)
+	}
+}
+
+// TestFailedWALWriteIsNotLogged vérifie qu'une écriture dont l'entrée n'a
+// pu être écrite dans le WAL échoue sans être gardée pour le commit
+func TestFailedWALWriteIsNotLogged(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDatabaseAt(t, dir)
+	c := createTestCollection(t, db, "items")
+	tx := db.BeginTransaction()
+	if err := os.RemoveAll(filepath.Join(dir, "wal")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.InsertWithTransaction(tx, "items", Document{"n": 1}); err == nil {
+		t.Fatal("InsertWithTransaction a réussi sans WAL")
+	}
+	if len(tx.Log) != 0 {
+		t.Fatalf("%d entrées gardées, attendu aucune", len(tx.Log))
+	}
+	if docs, err := c.GetAllDocuments(); err != nil || len(docs) != 0 {
+		t.Fatalf("GetAllDocuments = %v, %v, attendu aucune écriture", docs, err)
+	}
+}
+
+// TestWALEntriesWithSameTimestamp vérifie que deux entrées de même
+// horodatage ne s'écrasent pas dans le WAL
+func TestWALEntriesWithSameTimestamp(t *testing.T) {
+	dir := t.TempDir()
+	for seq := uint64(1); seq <= 2; seq++ {
+		entry := LogEntry{TransactionID: "tx_1", Timestamp: 42, Seq: seq, Operation: OpInsert}
+		if err := writeWALEntry(dir, entry); err != nil {
+			t.Fatalf("writeWALEntry(%d): %v", seq, err)
+		}
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 2 {
+		t.Fatalf("%d fichiers dans le WAL, attendu 2", len(files))
+	}
+}
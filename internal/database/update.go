@@ -0,0 +1,430 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Update est une mise à jour partielle à la MongoDB, par exemple
+//
+//	{"$set": {"address.city": "Lyon"}, "$inc": {"visits": 1}, "$push": {"tags": "vip"}}
+//
+// Opérateurs : $set, $unset, $inc, $push (avec $each pour plusieurs
+// valeurs), $pull (une valeur ou une condition sur les éléments) et
+// $rename. Les chemins utilisent la notation pointée et ne peuvent être
+// modifiés par deux opérateurs à la fois.
+type Update map[string]interface{}
+
+// ErrInvalidUpdate signale une mise à jour mal formée ou inapplicable
+var ErrInvalidUpdate = errors.New("mise à jour invalide")
+
+// UpdateResult compte les documents vérifiant le filtre et ceux modifiés
+type UpdateResult struct {
+	Matched  int `json:"matched"`
+	Modified int `json:"modified"`
+	// UpsertedID est l'ID du document inséré lorsqu'aucun document ne
+	// vérifiait le filtre d'un upsert
+	UpsertedID string `json:"upserted_id,omitempty"`
+}
+
+// updateOperation est une opération compilée sur un chemin
+type updateOperation struct {
+	operator string
+	path     string
+	value    interface{}
+	each     []interface{} // valeurs de $push
+	pull     valueMatcher  // condition de $pull
+	target   string        // destination de $rename
+}
+
+// documentUpdate est une mise à jour compilée
+type documentUpdate struct {
+	operations []updateOperation
+	// paths sont les chemins touchés, pour la maintenance des index
+	paths []string
+}
+
+// compileUpdate valide une mise à jour et la compile
+func compileUpdate(update map[string]interface{}) (*documentUpdate, error) {
+	if len(update) == 0 {
+		return nil, fmt.Errorf("%w: aucun opérateur", ErrInvalidUpdate)
+	}
+
+	// Ordre stable des opérateurs et des chemins
+	operators := make([]string, 0, len(update))
+	for operator := range update {
+		operators = append(operators, operator)
+	}
+	sort.Strings(operators)
+
+	compiled := &documentUpdate{}
+	for _, operator := range operators {
+		if !strings.HasPrefix(operator, "$") {
+			return nil, fmt.Errorf("%w: %s n'est pas un opérateur (un document de remplacement passe par Update)", ErrInvalidUpdate, operator)
+		}
+		fields, ok := asMap(update[operator])
+		if !ok {
+			return nil, fmt.Errorf("%w: %s attend un objet de champs", ErrInvalidUpdate, operator)
+		}
+		paths := make([]string, 0, len(fields))
+		for path := range fields {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+
+		for _, path := range paths {
+			operation, err := compileUpdateOperation(operator, path, fields[path])
+			if err != nil {
+				return nil, err
+			}
+			compiled.operations = append(compiled.operations, operation)
+			compiled.paths = append(compiled.paths, path)
+			if operation.target != "" {
+				compiled.paths = append(compiled.paths, operation.target)
+			}
+		}
+	}
+
+	for i, path := range compiled.paths {
+		if pathsOverlap(path, IDField) {
+			return nil, fmt.Errorf("%w: le champ _id ne peut être modifié", ErrInvalidUpdate)
+		}
+		for _, other := range compiled.paths[i+1:] {
+			if pathsOverlap(path, other) {
+				return nil, fmt.Errorf("%w: les chemins %s et %s sont modifiés par deux opérations", ErrInvalidUpdate, path, other)
+			}
+		}
+	}
+	return compiled, nil
+}
+
+// compileUpdateOperation compile un opérateur appliqué à un chemin
+func compileUpdateOperation(operator, path string, value interface{}) (updateOperation, error) {
+	if err := validatePath(path); err != nil {
+		return updateOperation{}, fmt.Errorf("%w: %v", ErrInvalidUpdate, err)
+	}
+	operation := updateOperation{operator: operator, path: path, value: value}
+
+	switch operator {
+	case "$set", "$unset":
+	case "$inc":
+		if _, ok := normalizeKey(value).(float64); !ok {
+			return operation, fmt.Errorf("%w: $inc attend un nombre pour %s", ErrInvalidUpdate, path)
+		}
+	case "$push":
+		operation.each = []interface{}{value}
+		if modifiers, ok := asMap(value); ok && isOperatorMap(modifiers) {
+			each, ok := asArray(modifiers["$each"])
+			if !ok || len(modifiers) != 1 {
+				return operation, fmt.Errorf("%w: $push attend une valeur ou {\"$each\": [...]}", ErrInvalidUpdate)
+			}
+			operation.each = each
+		}
+	case "$pull":
+		var err error
+		if operation.pull, err = compilePullCondition(value); err != nil {
+			return operation, err
+		}
+	case "$rename":
+		target, ok := value.(string)
+		if !ok || validatePath(target) != nil {
+			return operation, fmt.Errorf("%w: $rename attend un chemin de destination pour %s", ErrInvalidUpdate, path)
+		}
+		operation.target = target
+	default:
+		return operation, fmt.Errorf("%w: opérateur %s inconnu", ErrInvalidUpdate, operator)
+	}
+	return operation, nil
+}
+
+// compilePullCondition compile la condition de $pull : des opérateurs
+// ({"$gte": 6}), un filtre sur des éléments objets ({"sku": "x"}) ou une
+// valeur retirée par égalité
+func compilePullCondition(value interface{}) (valueMatcher, error) {
+	conditions, ok := asMap(value)
+	if !ok || len(conditions) == 0 {
+		return equalMatcher(value), nil
+	}
+	if valueOperators(conditions) {
+		return compileCondition(conditions)
+	}
+	match, err := compileFilter(conditions)
+	if err != nil {
+		return nil, err
+	}
+	return func(raw []interface{}) bool {
+		element, ok := asMap(raw[0])
+		return ok && match(element)
+	}, nil
+}
+
+// apply retourne le document modifié, sans toucher à doc
+func (u *documentUpdate) apply(doc Document) (Document, error) {
+	updated := copyDocument(doc)
+	for _, operation := range u.operations {
+		if err := operation.apply(updated); err != nil {
+			return nil, err
+		}
+	}
+	return updated, nil
+}
+
+func (operation *updateOperation) apply(doc Document) error {
+	current, exists := getPath(doc, operation.path)
+	switch operation.operator {
+	case "$set":
+		return operation.set(doc, operation.path, copyValue(operation.value))
+	case "$unset":
+		unsetPath(doc, operation.path)
+	case "$inc":
+		increment := normalizeKey(operation.value).(float64)
+		if !exists {
+			return operation.set(doc, operation.path, increment)
+		}
+		number, ok := normalizeKey(current).(float64)
+		if !ok {
+			return fmt.Errorf("%w: $inc sur %s, qui n'est pas un nombre", ErrInvalidUpdate, operation.path)
+		}
+		return operation.set(doc, operation.path, number+increment)
+	case "$push":
+		array, ok := current.([]interface{})
+		if exists && !ok {
+			return fmt.Errorf("%w: $push sur %s, qui n'est pas un tableau", ErrInvalidUpdate, operation.path)
+		}
+		for _, value := range operation.each {
+			array = append(array, copyValue(value))
+		}
+		return operation.set(doc, operation.path, array)
+	case "$pull":
+		if !exists {
+			return nil
+		}
+		array, ok := current.([]interface{})
+		if !ok {
+			return fmt.Errorf("%w: $pull sur %s, qui n'est pas un tableau", ErrInvalidUpdate, operation.path)
+		}
+		kept := make([]interface{}, 0, len(array))
+		for _, element := range array {
+			if !operation.pull([]interface{}{element}) {
+				kept = append(kept, element)
+			}
+		}
+		return operation.set(doc, operation.path, kept)
+	case "$rename":
+		if !exists {
+			return nil
+		}
+		unsetPath(doc, operation.path)
+		return operation.set(doc, operation.target, current)
+	}
+	return nil
+}
+
+// set affecte une valeur, en signalant un chemin inapplicable
+func (operation *updateOperation) set(doc Document, path string, value interface{}) error {
+	if err := setPath(doc, path, value); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidUpdate, operation.operator, err)
+	}
+	return nil
+}
+
+// pathsOverlap indique si deux chemins désignent le même champ ou si l'un
+// contient l'autre ; les positions dans les tableaux sont ignorées
+func pathsOverlap(a, b string) bool {
+	a, b = fieldPath(a), fieldPath(b)
+	return a == b || strings.HasPrefix(a, b+".") || strings.HasPrefix(b, a+".")
+}
+
+// fieldPath retire d'un chemin ses segments numériques (positions)
+func fieldPath(path string) string {
+	segments := splitPath(path)
+	kept := segments[:0:0]
+	for _, segment := range segments {
+		if _, ok := arrayIndex(segment, math.MaxInt); !ok {
+			kept = append(kept, segment)
+		}
+	}
+	return strings.Join(kept, ".")
+}
+
+// affectedIndexes retourne les index portant sur l'un des chemins touchés
+// par une mise à jour ; l'appelant détient c.mu
+func (c *Collection) affectedIndexes(paths []string) []*Index {
+	var affected []*Index
+	for _, index := range c.indexes {
+		for _, field := range index.fields {
+			touched := false
+			for _, path := range paths {
+				if pathsOverlap(field.Path, path) {
+					touched = true
+					break
+				}
+			}
+			if touched {
+				affected = append(affected, index)
+				break
+			}
+		}
+	}
+	return affected
+}
+
+// UpdateOne applique update au premier document vérifiant filter
+func (c *Collection) UpdateOne(filter Filter, update Update) (UpdateResult, error) {
+	return c.updateMatching(filter, update, 1)
+}
+
+// UpdateMany applique update à tous les documents vérifiant filter. Les
+// documents sont modifiés sous le verrou de la collection, avec un seul
+// horodatage de validation : une recherche concurrente, ou une transaction,
+// voit tous les documents avant ou tous après. Si l'un d'eux
+// ne peut être écrit (index unique), les précédents sont restaurés.
+func (c *Collection) UpdateMany(filter Filter, update Update) (UpdateResult, error) {
+	return c.updateMatching(filter, update, 0)
+}
+
+// UpdateByID applique update au document docID
+func (c *Collection) UpdateByID(docID string, update Update) (UpdateResult, error) {
+	return c.UpdateByIDWithPrecondition(docID, update, Precondition{})
+}
+
+// UpdateByIDWithPrecondition applique update au document docID si la
+// précondition sur sa révision est vérifiée
+func (c *Collection) UpdateByIDWithPrecondition(docID string, update Update, pre Precondition) (UpdateResult, error) {
+	result, _, err := c.updateByID(docID, update, pre)
+	return result, err
+}
+
+// ModifyWithPrecondition est UpdateByIDWithPrecondition, mais retourne le
+// document tel qu'il a été écrit (nil si docID n'existe pas)
+func (c *Collection) ModifyWithPrecondition(docID string, update Update, pre Precondition) (Document, error) {
+	_, doc, err := c.updateByID(docID, update, pre)
+	return doc, err
+}
+
+// updateByID applique update au document docID si pre est vérifiée, et
+// retourne le document résultant, lu sous les mêmes verrous que l'écriture
+func (c *Collection) updateByID(docID string, update Update, pre Precondition) (UpdateResult, Document, error) {
+	compiled, err := compileUpdate(update)
+	if err != nil {
+		return UpdateResult{}, nil, err
+	}
+
+	owner, err := c.lockForWrite(docID)
+	if err != nil {
+		return UpdateResult{}, nil, err
+	}
+	defer c.db.locks().release(owner)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	doc := c.readCurrent(docID)
+	if err := pre.check(doc); err != nil {
+		return UpdateResult{}, nil, err
+	}
+	if doc == nil {
+		return UpdateResult{}, nil, nil
+	}
+	result, err := c.applyUpdate(compiled, []*sortedDocument{{id: docID, doc: doc}})
+	if err != nil {
+		return UpdateResult{}, nil, err
+	}
+	return result, c.readCurrent(docID), nil
+}
+
+// updateMatching applique update aux documents vérifiant filter, au plus
+// limit si limit est positif, après les avoir verrouillés
+func (c *Collection) updateMatching(filter Filter, update Update, limit int) (UpdateResult, error) {
+	compiled, err := compileUpdate(update)
+	if err != nil {
+		return UpdateResult{}, err
+	}
+	match, err := compileFilter(filter)
+	if err != nil {
+		return UpdateResult{}, err
+	}
+
+	var entries []*sortedDocument
+	var result UpdateResult
+	err = c.writeLocked("mise à jour de "+c.currentName(), func() ([]string, error) {
+		opts := FindOptions{Limit: limit}
+		planner, err := c.planQuery(filter, opts)
+		if err != nil {
+			return nil, err
+		}
+		entries = entries[:0]
+		var docIDs []string
+		err = c.execute(planner, match, opts, nil, &Explanation{}, func(entry *sortedDocument) bool {
+			entries = append(entries, entry)
+			docIDs = append(docIDs, entry.id)
+			return true
+		})
+		return docIDs, err
+	}, func() (err error) {
+		result, err = c.applyUpdate(compiled, entries)
+		return err
+	})
+	return result, err
+}
+
+// applyUpdate calcule puis écrit les documents modifiés ; seuls les index
+// portant sur les chemins touchés sont vérifiés et mis à jour. L'appelant
+// détient c.mu en écriture.
+func (c *Collection) applyUpdate(update *documentUpdate, entries []*sortedDocument) (UpdateResult, error) {
+	result := UpdateResult{Matched: len(entries)}
+	defer c.db.stampWrites([]*Collection{c})()
+
+	// Tous les documents sont calculés avant la première écriture
+	updated := make([]Document, len(entries))
+	for i, entry := range entries {
+		doc, err := update.apply(entry.doc)
+		if err != nil {
+			return UpdateResult{}, err
+		}
+		updated[i] = doc
+	}
+
+	indexes := c.affectedIndexes(update.paths)
+	var written []int
+	for i, entry := range entries {
+		if sameDocument(entry.doc, updated[i]) {
+			continue
+		}
+		err := c.replaceDocument(entry.id, entry.doc, updated[i], indexes, c.syncWrites())
+		if err != nil {
+			// Restaurer les documents déjà modifiés
+			for j := len(written) - 1; j >= 0; j-- {
+				k := written[j]
+				if restoreErr := c.replaceDocument(entries[k].id, updated[k], entries[k].doc, indexes, c.syncWrites()); restoreErr != nil {
+					fmt.Printf("Avertissement: restauration du document %s impossible: %v\n", entries[k].id, restoreErr)
+				}
+			}
+			return UpdateResult{}, err
+		}
+		written = append(written, i)
+		result.Modified++
+	}
+	return result, nil
+}
+
+// replaceDocument écrit newDoc à la place de oldDoc en ne vérifiant et ne
+// maintenant que les index donnés ; l'appelant détient c.mu en écriture
+func (c *Collection) replaceDocument(docID string, oldDoc, newDoc Document, indexes []*Index, sync bool) error {
+	for _, index := range indexes {
+		if err := index.checkUnique(docID, newDoc); err != nil {
+			return err
+		}
+	}
+	if err := c.writeDocument(docID, newDoc, sync); err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		index.remove(docID, oldDoc)
+		index.add(docID, newDoc)
+	}
+	return nil
+}
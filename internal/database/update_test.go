@@ -0,0 +1,96 @@
+package database
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// decodeUpdate décode une mise à jour JSON comme le ferait l'API
+func decodeUpdate(t *testing.T, data string) Update {
+	t.Helper()
+	return Update(decodeDocument(t, data))
+}
+
+// TestUpdateOperators vérifie chaque opérateur de mise à jour partielle
+func TestUpdateOperators(t *testing.T) {
+	c := createTestCollection(t, openTestDatabase(t), "users")
+	mustInsert(t, c, decodeDocument(t, `{"_id": "a", "name": "ann", "visits": 1, "tags": ["new", "vip", "new"],
+		"scores": [3, 8, 5], "address": {"city": "Paris", "zip": "75001"}}`))
+
+	update := decodeUpdate(t, `{
+		"$set": {"address.city": "Lyon", "profile.lang": "fr"},
+		"$unset": {"address.zip": ""},
+		"$inc": {"visits": 2, "level": 1},
+		"$push": {"tags": {"$each": ["gold", "old"]}},
+		"$pull": {"scores": {"$gte": 5}},
+		"$rename": {"name": "nickname"}}`)
+	result, err := c.UpdateByID("a", update)
+	if err != nil {
+		t.Fatalf("UpdateByID: %v", err)
+	}
+	if result.Matched != 1 || result.Modified != 1 {
+		t.Fatalf("résultat = %+v, attendu 1 vérifié et 1 modifié", result)
+	}
+
+	want := decodeDocument(t, `{"_id": "a", "nickname": "ann", "visits": 3, "level": 1,
+		"tags": ["new", "vip", "new", "gold", "old"], "scores": [3],
+		"address": {"city": "Lyon"}, "profile": {"lang": "fr"}}`)
+	if doc := mustGet(t, c, "a"); !reflect.DeepEqual(doc, want) {
+		t.Fatalf("a = %v, attendu %v", doc, want)
+	}
+}
+
+// TestUpdateManyMaintainsIndexes vérifie les compteurs de UpdateMany et la
+// mise à jour des index sur les chemins modifiés
+func TestUpdateManyMaintainsIndexes(t *testing.T) {
+	c := createTestCollection(t, openTestDatabase(t), "users")
+	if err := c.CreateIndex("address.city", false); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	mustInsert(t, c, decodeDocument(t, `{"_id": "a", "address": {"city": "Paris"}}`))
+	mustInsert(t, c, decodeDocument(t, `{"_id": "b", "address": {"city": "Lyon"}}`))
+	mustInsert(t, c, decodeDocument(t, `{"_id": "c", "address": {"city": "Paris"}}`))
+
+	result, err := c.UpdateMany(Filter{"address.city": "Paris"}, decodeUpdate(t, `{"$set": {"address.city": "Lyon"}}`))
+	if err != nil {
+		t.Fatalf("UpdateMany: %v", err)
+	}
+	if result.Matched != 2 || result.Modified != 2 {
+		t.Fatalf("résultat = %+v, attendu 2 vérifiés et 2 modifiés", result)
+	}
+	if docs, _ := c.FindByField("address.city", "Paris"); len(docs) != 0 {
+		t.Fatalf("index: %d documents encore à Paris", len(docs))
+	}
+	if docs, _ := c.FindByField("address.city", "Lyon"); len(docs) != 3 {
+		t.Fatalf("index: %d documents à Lyon, attendu 3", len(docs))
+	}
+
+	// Une mise à jour sans effet vérifie le document sans le modifier
+	result, err = c.UpdateOne(Filter{IDField: "b"}, decodeUpdate(t, `{"$set": {"address.city": "Lyon"}}`))
+	if err != nil || result.Matched != 1 || result.Modified != 0 {
+		t.Fatalf("UpdateOne = %+v (%v), attendu 1 vérifié et 0 modifié", result, err)
+	}
+}
+
+// TestInvalidUpdate vérifie qu'une mise à jour mal formée ou inapplicable
+// est refusée avec ErrInvalidUpdate sans toucher au document
+func TestInvalidUpdate(t *testing.T) {
+	c := createTestCollection(t, openTestDatabase(t), "users")
+	mustInsert(t, c, decodeDocument(t, `{"_id": "a", "name": "ann", "visits": 1}`))
+	for _, update := range []string{
+		`{}`,
+		`{"$explode": {"name": 1}}`,
+		`{"$inc": {"name": 1}}`,
+		`{"$set": {"visits": 2}, "$inc": {"visits": 1}}`,
+		`{"$push": {"name": "x"}}`,
+		`{"$set": {"_id": "b"}}`,
+	} {
+		if _, err := c.UpdateByID("a", decodeUpdate(t, update)); !errors.Is(err, ErrInvalidUpdate) {
+			t.Errorf("UpdateByID(%s) = %v, attendu ErrInvalidUpdate", update, err)
+		}
+	}
+	if doc := mustGet(t, c, "a"); doc["visits"] != float64(1) || doc["name"] != "ann" {
+		t.Fatalf("a = %v après des mises à jour refusées", doc)
+	}
+}